@@ -0,0 +1,399 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	bolt "github.com/etcd-io/bbolt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the tar backup keeps the database as BACKUP_DB_NAME and task files under BACKUP_FILES_DIR
+const (
+	BACKUP_DB_NAME     = "upload.db"
+	BACKUP_FILES_DIR   = "files/"
+	BACKUP_NAME_PREFIX = "upload-"
+	BACKUP_NAME_FORMAT = "20060102-150405.000000"
+)
+
+// backupStorage returns the layer of the storage able to make snapshots or nil,
+// only the bolt engine makes them
+func backupStorage(db IStorage) IBackupStorage {
+	s := findStorage(db, func(s IStorage) bool {
+		_, ok := s.(IBackupStorage)
+		return ok
+	})
+	if s == nil {
+		return nil
+	}
+	return s.(IBackupStorage)
+}
+
+// backupWrite writes the database snapshot, withFiles - a tar of the snapshot and files of its Tasks
+func backupWrite(w io.Writer, s IBackupStorage, withFiles bool) error {
+	if !withFiles {
+		return s.Snapshot(func(size int64, tasks []*TTask, data io.WriterTo) error {
+			_, err := data.WriteTo(w)
+			return err
+		})
+	}
+	tw := tar.NewWriter(w)
+	// files stay in the layout of the snapshot until they are written
+	layoutPause.Lock()
+	defer layoutPause.Unlock()
+	var snapshot []*TTask
+	err := s.Snapshot(func(size int64, tasks []*TTask, data io.WriterTo) error {
+		snapshot = tasks
+		err := tw.WriteHeader(&tar.Header{Name: BACKUP_DB_NAME, Mode: 0600, Size: size, ModTime: time.Now(), Typeflag: tar.TypeReg})
+		if err != nil {
+			return err
+		}
+		_, err = data.WriteTo(tw)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// files don't need the read transaction, uploaded files never change
+	for _, task := range snapshot {
+		err = backupTaskFiles(tw, task)
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// backupTaskFiles adds files of the Task, files removed meanwhile are skipped
+func backupTaskFiles(tw *tar.Writer, task *TTask) error {
+	blobs := taskBlobs()
+	files, err := taskFiles(blobs, task)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		key := taskBlobPrefix(task) + file.Name
+		f, err := blobs.Get(key)
+		if err != nil {
+			if errors.Is(err, ErrBlobNotFound) {
+				continue
+			}
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:     BACKUP_FILES_DIR + key,
+			Mode:     0644,
+			Size:     file.Size,
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+		})
+		if err == nil {
+			_, err = io.CopyN(tw, f, file.Size)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupValidate checks the database file of the snapshot, returns the number of Tasks
+func backupValidate(dbfilename string) (int, error) {
+	db, err := bolt.Open(dbfilename, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+	if err != nil {
+		return 0, fmt.Errorf("Invalid database: %s", err)
+	}
+	defer db.Close()
+	version, _, err := boltPendingMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	err = db.View(func(tx *bolt.Tx) error {
+		// read all errors, the checker stops when the channel is drained
+		var corrupted error
+		for err := range tx.Check() {
+			if corrupted == nil {
+				corrupted = fmt.Errorf("Database is corrupted: %s", err)
+			}
+		}
+		if corrupted != nil {
+			return corrupted
+		}
+		b := tx.Bucket([]byte("TASKS"))
+		if b == nil {
+			if version > 0 {
+				return fmt.Errorf("No tasks in database")
+			}
+			return nil
+		}
+		err := b.ForEach(func(k, v []byte) error {
+			_, err := boltGetTask(tx, k)
+			n++
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		// the queue keeps payloads before the migration 3
+		if version < 3 || tx.Bucket([]byte("QUEUE")) == nil {
+			return nil
+		}
+		return tx.Bucket([]byte("QUEUE")).ForEach(func(k, v []byte) error {
+			if b.Get(v) == nil {
+				return fmt.Errorf("Queue points to missing task: %s", v)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// backupRestore validates the snapshot, a database file or a tar with files,
+// and puts it in place of the database file, the previous one is kept as <db>.before-restore,
+// files of the tar are staged and stored after the database is replaced,
+// the service must be stopped, returns the number of Tasks and files
+func backupRestore(r io.ReadSeeker, dbfilename string) (tasks int, files int, err error) {
+	if _, err := os.Stat(dbfilename); err == nil {
+		db, err := bolt.Open(dbfilename, 0600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			return 0, 0, fmt.Errorf("Database is in use: %s", err)
+		}
+		db.Close()
+	}
+	var src io.Reader = r
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	isTar := err == nil && hdr.Name == BACKUP_DB_NAME
+	if isTar {
+		src = tr
+	} else if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	tmpName := dbfilename + ".restore"
+	defer os.Remove(tmpName)
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = io.Copy(f, src)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	tasks, err = backupValidate(tmpName)
+	if err != nil {
+		return 0, 0, err
+	}
+	// the files store is not changed until the whole tar is read
+	stage, err := ioutil.TempDir("", "upload-restore-")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.RemoveAll(stage)
+	var keys []string
+	for isTar {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		key, err := backupStageFile(stage, tr, hdr)
+		if err != nil {
+			return 0, 0, err
+		}
+		keys = append(keys, key)
+	}
+	previous := dbfilename + ".before-restore"
+	_, err = os.Stat(dbfilename)
+	hadPrevious := err == nil
+	if hadPrevious {
+		err = os.Rename(dbfilename, previous)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	err = os.Rename(tmpName, dbfilename)
+	if err == nil {
+		err = backupStoreFiles(stage, keys)
+	}
+	if err != nil {
+		// put the previous database back
+		if hadPrevious {
+			os.Rename(previous, dbfilename)
+		} else {
+			os.Remove(dbfilename)
+		}
+		return 0, 0, err
+	}
+	return tasks, len(keys), nil
+}
+
+// backupStageFile writes the task file from the tar to the staging directory, returns its blob key
+func backupStageFile(stage string, r io.Reader, hdr *tar.Header) (string, error) {
+	name := filepath.ToSlash(filepath.Clean(hdr.Name))
+	if hdr.Typeflag != tar.TypeReg || !strings.HasPrefix(name, BACKUP_FILES_DIR) || strings.Contains(name, "..") {
+		return "", fmt.Errorf("Invalid backup entry: %s", hdr.Name)
+	}
+	key := strings.TrimPrefix(name, BACKUP_FILES_DIR)
+	path := filepath.Join(stage, filepath.FromSlash(key))
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return key, err
+}
+
+// backupStoreFiles moves the staged files to the files store,
+// on error the files stored by it are removed
+func backupStoreFiles(stage string, keys []string) error {
+	blobs := taskBlobs()
+	var added []string
+	for _, key := range keys {
+		_, err := blobs.Stat(key)
+		exists := err == nil
+		f, err := os.Open(filepath.Join(stage, filepath.FromSlash(key)))
+		if err == nil {
+			_, err = blobs.Put(key, f)
+			f.Close()
+		}
+		if err != nil {
+			for _, key := range added {
+				blobs.Delete(key)
+			}
+			return err
+		}
+		if !exists {
+			added = append(added, key)
+		}
+	}
+	return nil
+}
+
+// backupToDir writes the database snapshot to the directory and keeps the last keep backups
+func backupToDir(db IStorage, dir string, keep int) (string, error) {
+	s := backupStorage(db)
+	if s == nil {
+		return "", fmt.Errorf("Backups are supported by the bolt storage engine only")
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	name := dir + "/" + BACKUP_NAME_PREFIX + time.Now().UTC().Format(BACKUP_NAME_FORMAT) + ".db"
+	tmpName := dir + "/.backup.tmp"
+	defer os.Remove(tmpName)
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	err = backupWrite(f, s, false)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(tmpName, name)
+	if err != nil {
+		return "", err
+	}
+	return name, backupRotate(dir, keep)
+}
+
+// backupRotate removes the oldest backups in the directory except the last keep ones
+func backupRotate(dir string, keep int) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), BACKUP_NAME_PREFIX) && strings.HasSuffix(info.Name(), ".db") {
+			names = append(names, info.Name())
+		}
+	}
+	// names sort by time
+	sort.Strings(names)
+	for len(names) > keep {
+		err = os.Remove(dir + "/" + names[0])
+		if err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// backupLoop writes backups to the directory every interval seconds
+func backupLoop(db IStorage, dir string, interval int64, keep int) {
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+		name, err := backupToDir(db, dir, keep)
+		if err != nil {
+			Error.Printf("Backup failed: %s\n", err)
+			continue
+		}
+		Info.Printf("Backup written: %s\n", name)
+	}
+}
+
+// stream the database snapshot, with files=1 a tar of the snapshot and task files
+func backupHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
+	s := backupStorage(db)
+	if s == nil {
+		sendJSONErrorDetails(w, E_NOT_IMPLEMENTED, "Backups are supported by the bolt storage engine only", http.StatusNotImplemented)
+		Warning.Printf("[%s]: Storage engine can't make backups\n", r.RemoteAddr)
+		return
+	}
+	withFiles := r.URL.Query().Get("files") == "1"
+	name := BACKUP_NAME_PREFIX + time.Now().UTC().Format("20060102-150405")
+	if withFiles {
+		name += ".tar"
+		w.Header().Set("Content-Type", "application/x-tar")
+	} else {
+		name += ".db"
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	// start a normal output
+	w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0, must-revalidate")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"\"")
+	w.WriteHeader(http.StatusOK)
+	err := backupWrite(w, s, withFiles)
+	if err != nil {
+		// the status is sent already, the client gets a broken stream
+		Error.Printf("[%s]: Backup failed: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// write a success message to the log
+	Info.Printf("[%s]: Backup %s sent\n", r.RemoteAddr, name)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func Test_Backup(t *testing.T) {
+	fmt.Println("Test_Backup")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	Conf.MaxFiles = 2
+	Conf.MinFiles = 2
+	Conf.MaxFileSize = 1024 * 100
+	Conf.DataDir = t.TempDir()
+	dir := t.TempDir()
+	db, err := BoltNewStorage(dir + "/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	token := NewId(16)
+	r := setRouting(token, wrapStorage(db, 16, nil))
+	b := new(bytes.Buffer)
+	file1 := NewId(128)
+	body, ct := MakeTestUploadBody(t, "file1.bin", file1, "file2.bin", NewId(64))
+	resp := MakeTestUploadRequest(r, "POST", "", ct, body)
+	if resp.StatusCode != 201 {
+		t.Errorf("Status expected 201 but was: %d", resp.StatusCode)
+	}
+	task := &TTaskAnswer{}
+	task.fromJReader(resp.Body)
+	resp = MakeTestRequest(r, "GET", "/api-01/backup", "", b)
+	if resp.StatusCode != 401 {
+		t.Errorf("Status expected 401 but was: %d", resp.StatusCode)
+	}
+	resp = MakeTestRequest(r, "GET", "/api-01/backup?files=1", token, b)
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	snapshot, _ := ioutil.ReadAll(resp.Body)
+	// restore to the other place
+	data := Conf.DataDir
+	Conf.DataDir = dir + "/data"
+	tasks, files, err := backupRestore(bytes.NewReader(snapshot), dir+"/restored.db")
+	Conf.DataDir = data
+	if err != nil || tasks != 1 || files != 3 {
+		t.Fatalf("1 task and 3 files with the manifest expected, but was: %d %d %v", tasks, files, err)
+	}
+	content, err := readBlob(CompressNewBlobStore(CASNewBlobStore(LocalNewBlobStore(dir+"/data")), ""), taskBlobPrefix(&TTask{Id: task.TaskId})+"file1.bin")
+	if err != nil || content != file1 {
+		t.Errorf("Restored file expected: %s", err)
+	}
+	restored, err := BoltNewStorage(dir + "/restored.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, err := restored.Claim(0)
+	restored.Close()
+	if err != nil || queued.Id != task.TaskId {
+		t.Errorf("Task %s expected in queue, but was: %v %v", task.TaskId, queued, err)
+	}
+	// an invalid snapshot keeps the database
+	_, _, err = backupRestore(bytes.NewReader(snapshot[:len(snapshot)/2]), dir+"/restored.db")
+	if err == nil {
+		t.Errorf("Error expected for the broken snapshot")
+	}
+	_, _, err = backupRestore(bytes.NewReader([]byte(NewId(4096))), dir+"/restored.db")
+	if err == nil {
+		t.Errorf("Error expected for the broken snapshot")
+	}
+	if _, err := backupValidate(dir + "/restored.db"); err != nil {
+		t.Errorf("Database expected to be kept: %s", err)
+	}
+	// a bad entry after the files keeps the database and the files store
+	Conf.DataDir = dir + "/partial"
+	_, _, err = backupRestore(bytes.NewReader(appendTarEntry(t, snapshot, "notes.txt")), dir+"/partial.db")
+	Conf.DataDir = data
+	if err == nil {
+		t.Errorf("Error expected for the invalid entry")
+	}
+	if _, err := os.Stat(dir + "/partial.db"); !os.IsNotExist(err) {
+		t.Errorf("No database expected: %v", err)
+	}
+	if _, err := os.Stat(dir + "/partial"); !os.IsNotExist(err) {
+		t.Errorf("No files expected: %v", err)
+	}
+	// the database in use can't be replaced
+	_, _, err = backupRestore(bytes.NewReader(snapshot), dir+"/test.db")
+	if err == nil {
+		t.Errorf("Error expected for the database in use")
+	}
+	// scheduled backups are rotated
+	for i := 0; i < 3; i++ {
+		_, err = backupToDir(wrapStorage(db, 16, nil), dir+"/scheduled", 2)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	infos, _ := ioutil.ReadDir(dir + "/scheduled")
+	if len(infos) != 2 {
+		t.Errorf("2 backups expected, but was: %d", len(infos))
+	}
+	if _, err := backupToDir(MemoryNewStorage(), dir+"/scheduled", 2); err == nil {
+		t.Errorf("Error expected for the memory storage")
+	}
+	resp = MakeTestRequest(setRouting(token, MemoryNewStorage()), "GET", "/api-01/backup", token, b)
+	e := &TJSONError{}
+	if resp.StatusCode != 501 || json.NewDecoder(resp.Body).Decode(e) != nil || e.Msg != E_NOT_IMPLEMENTED || e.Details == "" {
+		t.Errorf("Not implemented with details expected, but was: %d %v", resp.StatusCode, e)
+	}
+}
+
+// appendTarEntry returns the tar with one more entry
+func appendTarEntry(t *testing.T, data []byte, name string) []byte {
+	tr := tar.NewReader(bytes.NewReader(data))
+	out := new(bytes.Buffer)
+	tw := tar.NewWriter(out)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		content, _ := ioutil.ReadAll(tr)
+		tw.WriteHeader(hdr)
+		tw.Write(content)
+	}
+	err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw.Write([]byte("x"))
+	tw.Close()
+	return out.Bytes()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// TBatchPair is the result of the upload of one pair of the batch
+type TBatchPair struct {
+	Files   []string `json:"files"`          // decoded names in the order of parts
+	TaskId  string   `json:"task,omitempty"` // of the created Task
+	Error   string   `json:"error,omitempty"`
+	Details string   `json:"details,omitempty"`
+}
+
+type TBatchAnswer struct {
+	Pairs []TBatchPair `json:"pairs"` // in the order of the first parts of pairs
+}
+
+// Write TBatchAnswer object to io.Writer as JSON
+func (c *TBatchAnswer) toJWriter(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "    ")
+	return e.Encode(c)
+}
+
+// Fill TBatchAnswer object from io.Reader as JSON
+func (c *TBatchAnswer) fromJReader(r io.Reader) error {
+	return json.NewDecoder(r).Decode(c)
+}
+
+// pairFiles groups files of the batch into data files with their signatures, roles are told
+// by the content or the name like the upload does; files without the pair, or with several
+// ones, are left alone to be rejected by the upload checks
+func pairFiles(files []TUploadFile) [][]TUploadFile {
+	names := make([]string, len(files))
+	roles := make([]string, len(files))
+	for i, f := range files {
+		names[i] = normalizeFileName(f.Name, nameRules())
+		roles[i] = fileRole(names[i], detectFileType(f.Content))
+	}
+	paired := make(map[int]int) // both ways
+	for i := range files {
+		if roles[i] != ROLE_SIGNATURE {
+			continue
+		}
+		// notice.pdf.sig is the signature of notice.pdf rather than of notice.docx
+		var exact, stem []int
+		for j := range files {
+			if roles[j] != ROLE_DATA || !signs(names[i], names[j]) {
+				continue
+			}
+			if strings.EqualFold(signedName(names[i]), names[j]) {
+				exact = append(exact, j)
+			} else {
+				stem = append(stem, j)
+			}
+		}
+		candidates := exact
+		if len(candidates) == 0 {
+			candidates = stem
+		}
+		if len(candidates) != 1 {
+			continue
+		}
+		if _, ok := paired[candidates[0]]; ok {
+			continue
+		}
+		paired[i] = candidates[0]
+		paired[candidates[0]] = i
+	}
+	groups := [][]TUploadFile{}
+	for i, f := range files {
+		j, ok := paired[i]
+		if !ok {
+			groups = append(groups, []TUploadFile{f})
+		} else if j > i {
+			groups = append(groups, []TUploadFile{f, files[j]})
+		}
+	}
+	return groups
+}
+
+// batchUploadHandler creates a Task of every pair of the batch, pairs are uploaded
+// and rejected independently with the limits of the upload
+func batchUploadHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
+	if Conf.MaxBatchFiles < 1 {
+		sendJSONErrorMessage(w, E_NOT_IMPLEMENTED, http.StatusNotImplemented)
+		Warning.Printf("[%s]: Batch uploads are disabled\n", r.RemoteAddr)
+		return
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// files are paired after all of them are read, they are kept in memory
+	files, err := readUploadFiles(r, reader, Conf.MaxBatchFiles+1)
+	if err != nil {
+		sendJSONErrorMessage(w, E_INVALID_REQUEST, http.StatusBadRequest)
+		Error.Printf("[%s]: Can't read the request: %s\n", r.RemoteAddr, err)
+		return
+	}
+	if len(files) > Conf.MaxBatchFiles {
+		sendJSONErrorDetails(w, E_INVALID_REQUEST, fmt.Sprintf("too many files, at most %d in the batch", Conf.MaxBatchFiles), http.StatusBadRequest)
+		Error.Printf("[%s]: Too many files in the batch\n", r.RemoteAddr)
+		return
+	}
+	answer := &TBatchAnswer{Pairs: []TBatchPair{}}
+	uploaded := 0
+	for _, group := range pairFiles(files) {
+		pair := TBatchPair{}
+		for _, f := range group {
+			pair.Files = append(pair.Files, f.Name)
+		}
+		task, uerr := uploadTask(r, db, group)
+		if uerr != nil {
+			pair.Error = uerr.Msg
+			pair.Details = uerr.Details
+		} else {
+			pair.TaskId = task.Id
+			uploaded++
+		}
+		answer.Pairs = append(answer.Pairs, pair)
+	}
+	HelperSetStandartHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	err = answer.toJWriter(w)
+	if err != nil {
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	Info.Printf("[%s]: Batch uploaded: %d of %d pairs\n", r.RemoteAddr, uploaded, len(answer.Pairs))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_BatchPairs(t *testing.T) {
+	fmt.Println("Test_BatchPairs")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	sig := testCMS(t, nil)
+	list := []string{
+		"b.pdf", testPDF(),
+		"a.sig", sig, // the signature of a.pdf by the name
+		"a.pdf", testPDF(),
+		"x.docx", testDOCX(t),
+		"b.pdf.sig", sig,
+		"c.pdf", sig, // the signature by the content, but not named after a data file
+		"d.pdf", testPDF(),
+		"d.pdf.p7s", "unknown",
+		"e.sig", sig, // the signature of e.pdf or e.docx
+		"e.pdf", testPDF(),
+		"e.docx", testDOCX(t),
+	}
+	files := []TUploadFile{}
+	for i := 0; i+1 < len(list); i += 2 {
+		files = append(files, TUploadFile{Name: list[i], Content: []byte(list[i+1])})
+	}
+	groups := []string{}
+	for _, group := range pairFiles(files) {
+		names := []string{}
+		for _, f := range group {
+			names = append(names, f.Name)
+		}
+		groups = append(groups, strings.Join(names, "+"))
+	}
+	expected := "b.pdf+b.pdf.sig a.sig+a.pdf x.docx c.pdf d.pdf+d.pdf.p7s e.sig e.pdf e.docx"
+	if strings.Join(groups, " ") != expected {
+		t.Errorf("%s expected, but was: %s", expected, strings.Join(groups, " "))
+	}
+}
+
+func Test_UploadBatch(t *testing.T) {
+	fmt.Println("Test_UploadBatch")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	Conf.MaxFiles = 2
+	Conf.MinFiles = 2
+	Conf.MaxFileSize = 1024 * 100
+	Conf.DataDir = t.TempDir()
+	Conf.AllowedTypes, _ = parseFileTypes(defaultFileTypes)
+	Conf.PairCheck = true
+	defer func() {
+		Conf.AllowedTypes = nil
+		Conf.PairCheck = false
+		Conf.MaxBatchFiles = 0
+	}()
+	db := MemoryNewStorage()
+	r := setRouting(NewId(16), db)
+	batch := func(status int, files ...string) *TBatchAnswer {
+		body, ct := MakeTestUploadBody(t, files...)
+		req := httptest.NewRequest("POST", "/api-01/upload/batch", body)
+		req.Header.Set("Content-Type", ct)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		resp := w.Result()
+		if resp.StatusCode != status {
+			t.Fatalf("Status expected %d but was: %d", status, resp.StatusCode)
+		}
+		answer := &TBatchAnswer{}
+		if status == 200 && answer.fromJReader(resp.Body) != nil {
+			t.Fatalf("Answer expected")
+		}
+		return answer
+	}
+	sig := testCMS(t, nil)
+	batch(501, "a.pdf", testPDF(), "a.pdf.sig", sig)
+	Conf.MaxBatchFiles = 10
+	answer := batch(200,
+		"a.pdf", testPDF(),
+		"b.pdf.sig", sig,
+		"a.pdf.sig", sig,
+		"b.pdf", testPDF(),
+		"c.pdf", "%PDF-1.4\n",
+		"c.pdf.sig", sig,
+		"d.docx", testDOCX(t),
+		"e.pdf", testPDF()+strings.Repeat(" ", int(Conf.MaxFileSize)),
+		"e.pdf.sig", sig,
+	)
+	// pairs succeed or fail independently, with their own limits
+	expected := []struct {
+		files, code string
+	}{
+		{"a.pdf a.pdf.sig", ""},
+		{"b.pdf.sig b.pdf", ""},
+		{"c.pdf c.pdf.sig", E_MALFORMED_FILE},
+		{"d.docx", E_INVALID_REQUEST},
+		{"e.pdf e.pdf.sig", E_FILE_TOO_BIG},
+	}
+	if len(answer.Pairs) != len(expected) {
+		t.Fatalf("%d pairs expected, but was: %v", len(expected), answer.Pairs)
+	}
+	for n, e := range expected {
+		pair := answer.Pairs[n]
+		if strings.Join(pair.Files, " ") != e.files || pair.Error != e.code || (pair.TaskId == "") != (e.code != "") {
+			t.Errorf("%s %s expected, but was: %v", e.files, e.code, pair)
+		}
+	}
+	for _, pair := range answer.Pairs[:2] {
+		task, _ := db.GetTask(pair.TaskId)
+		if m, err := readManifest(taskBlobs(), task); err != nil || len(m.Files) != 2 || m.Files[0].Name != pair.Files[0] {
+			t.Errorf("Manifest of the pair expected, but was: %v %v", m, err)
+		}
+	}
+	if tasks, _ := db.ListTasks("received", math.MaxInt64); len(tasks) != 2 {
+		t.Errorf("2 tasks expected, but was: %d", len(tasks))
+	}
+	body, ct := MakeTestUploadBody(t, strings.Split(strings.Repeat("a.pdf,x,", 11), ",")...)
+	req := httptest.NewRequest("POST", "/api-01/upload/batch", body)
+	req.Header.Set("Content-Type", ct)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	e := &TJSONError{}
+	if w.Code != 400 || json.NewDecoder(w.Body).Decode(e) != nil || e.Msg != E_INVALID_REQUEST {
+		t.Errorf("Too many files expected, but was: %d %v", w.Code, e)
+	}
+}
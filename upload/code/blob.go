@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LOCAL_BLOB_TMP is the directory of files being written, skipped by List
+const LOCAL_BLOB_TMP = ".blobtmp"
+
+var ErrBlobNotFound = errors.New("Blob not found")
+
+// IBlobStore keeps files by slash separated keys
+type IBlobStore interface {
+	// Put replaces the blob, returns its size
+	Put(key string, r io.Reader) (int64, error)
+	// Get opens the blob, ErrBlobNotFound if missing
+	Get(key string) (io.ReadCloser, error)
+	// Stat returns the blob info, ErrBlobNotFound if missing
+	Stat(key string) (*TBlobInfo, error)
+	// List returns blobs with keys starting with the prefix ordered by key
+	List(prefix string) ([]TBlobInfo, error)
+	// Delete removes the blob, a missing blob is not an error
+	Delete(key string) error
+}
+
+type TBlobInfo struct {
+	Key     string `json:"key"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	SHA256  string `json:"sha256,omitempty"` // known by content addressed stores
+}
+
+// TLocalBlobStore keeps blobs as files under the directory
+type TLocalBlobStore struct {
+	dir string
+}
+
+var s3Blobs *TS3BlobStore // S3 store of files if configured
+
+// fileBlobs is the raw store of files, S3 or the data directory
+func fileBlobs() IBlobStore {
+	if s3Blobs != nil {
+		return s3Blobs
+	}
+	return LocalNewBlobStore(Conf.DataDir)
+}
+
+// taskBlobs is the store of Task files addressed by content in the file store,
+// compressed and encrypted by the Task if configured
+func taskBlobs() IBlobStore {
+	return CompressNewBlobStore(encryptBlobs(CASNewBlobStore(fileBlobs()), "tasks/"), Conf.Compression)
+}
+
+// quarantineBlobs is the store of the quarantine, S3 or the quarantine directory,
+// encrypted by the entry if configured
+func quarantineBlobs() IBlobStore {
+	if s3Blobs != nil {
+		return encryptBlobs(s3Blobs.Sub("quarantine/"), "quarantine/")
+	}
+	return encryptBlobs(LocalNewBlobStore(Conf.QuarantineDir), "quarantine/")
+}
+
+// validBlobKey checks the key has no empty, relative or hidden temporary parts
+func validBlobKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." || part == LOCAL_BLOB_TMP {
+			return false
+		}
+	}
+	return true
+}
+
+func LocalNewBlobStore(dir string) *TLocalBlobStore {
+	return &TLocalBlobStore{dir: dir}
+}
+
+func (s *TLocalBlobStore) path(key string) (string, error) {
+	if !validBlobKey(key) {
+		return "", fmt.Errorf("Invalid blob key: %s", key)
+	}
+	return s.dir + "/" + key, nil
+}
+
+// Put writes the temporary file and renames it, readers never see a part
+func (s *TLocalBlobStore) Put(key string, r io.Reader) (int64, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	err = os.MkdirAll(s.dir+"/"+LOCAL_BLOB_TMP, 0755)
+	if err != nil {
+		return 0, err
+	}
+	f, err := ioutil.TempFile(s.dir+"/"+LOCAL_BLOB_TMP, "blob-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *TLocalBlobStore) Get(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrBlobNotFound, key)
+	}
+	return f, err
+}
+
+func (s *TLocalBlobStore) Stat(key string) (*TBlobInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) || err == nil && !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: %s", ErrBlobNotFound, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &TBlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime().Unix()}, nil
+}
+
+// List walks the deepest directory of the prefix
+func (s *TLocalBlobStore) List(prefix string) ([]TBlobInfo, error) {
+	blobs := []TBlobInfo{}
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i]
+		if !validBlobKey(dir) {
+			return nil, fmt.Errorf("Invalid blob prefix: %s", prefix)
+		}
+	}
+	root := s.dir + "/" + dir
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() && info.Name() == LOCAL_BLOB_TMP {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		key := filepath.ToSlash(strings.TrimPrefix(path, s.dir+"/"))
+		if strings.HasPrefix(key, prefix) {
+			blobs = append(blobs, TBlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime().Unix()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Key < blobs[j].Key })
+	return blobs, nil
+}
+
+// Delete removes the file and its empty parent directories
+func (s *TLocalBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for dir := filepath.Dir(path); dir != s.dir && strings.HasPrefix(dir, s.dir+"/"); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// blobMove moves the blob between stores, local files are renamed if possible
+func blobMove(src IBlobStore, srcKey string, dst IBlobStore, dstKey string) error {
+	ls, ok1 := src.(*TLocalBlobStore)
+	ld, ok2 := dst.(*TLocalBlobStore)
+	if ok1 && ok2 {
+		from, err := ls.path(srcKey)
+		if err != nil {
+			return err
+		}
+		to, err := ld.path(dstKey)
+		if err != nil {
+			return err
+		}
+		if os.MkdirAll(filepath.Dir(to), 0755) == nil && os.Rename(from, to) == nil {
+			return ls.Delete(srcKey)
+		}
+	}
+	r, err := src.Get(srcKey)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Put(dstKey, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	return src.Delete(srcKey)
+}
+
+// blobDeletePrefix removes all blobs with the prefix
+func blobDeletePrefix(bs IBlobStore, prefix string) error {
+	blobs, err := bs.List(prefix)
+	if err != nil {
+		return err
+	}
+	for _, b := range blobs {
+		err = bs.Delete(b.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,171 +1,556 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	bolt "github.com/etcd-io/bbolt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
 	"time"
 )
 
+// BOLT_BATCH_DELAY is how long a write waits for others to share the commit
+const BOLT_BATCH_DELAY = 2 * time.Millisecond
+
+// purgeChunk is how many Tasks a purge reads in one write transaction
+var purgeChunk = 1000
+
 type TBoltStorage struct {
-	db *bolt.DB
+	db      *bolt.DB
+	noBatch bool         // every write pays for its own commit
+	mu      sync.RWMutex // exclusive while the database file is swapped
+	wmu     sync.RWMutex // exclusive while writes are paused
+	dmu     sync.Mutex
+	dirty   map[string]bool // task ids written during compaction, nil - not tracked
+	remove  string          // the temporary database file removed on Close
 }
 
 func BoltNewStorage(dbfilename string) (*TBoltStorage, error) {
-	db, err := bolt.Open(dbfilename, 0600, nil)
+	return BoltOpenStorage(dbfilename, false)
+}
+
+// BoltOpenStorage opens the database and applies pending migrations,
+// the database file is copied before migrations if backup is set
+func BoltOpenStorage(dbfilename string, backup bool) (*TBoltStorage, error) {
+	db, err := bolt.Open(dbfilename, 0600, &bolt.Options{Timeout: 5 * time.Second})
 	if err != nil {
 		return nil, err
 	}
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("TASKS"))
-		if err != nil {
-			return err
+	_, err = boltMigrate(db, dbfilename, backup, false)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	db.MaxBatchDelay = BOLT_BATCH_DELAY
+	return &TBoltStorage{db: db}, nil
+}
+
+// BoltOpenSource opens the database to read from, the file is not changed: it is opened
+// read-only and pending migrations are applied to the temporary copy removed on Close
+func BoltOpenSource(dbfilename string) (*TBoltStorage, error) {
+	db, err := bolt.Open(dbfilename, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	_, pending, err := boltPendingMigrations(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if len(pending) == 0 {
+		return &TBoltStorage{db: db}, nil
+	}
+	f, err := ioutil.TempFile("", "upload-*.db")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	f.Close()
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(f.Name(), 0600)
+	})
+	db.Close()
+	var s *TBoltStorage
+	if err == nil {
+		s, err = BoltOpenStorage(f.Name(), false)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	s.remove = f.Name()
+	Info.Printf("Database %s is migrated in the temporary copy\n", dbfilename)
+	return s, nil
+}
+
+// view runs fn in the read transaction
+func (s *TBoltStorage) view(fn func(tx *bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.View(fn)
+}
+
+// write runs fn in the shared write transaction, concurrent writes are
+// committed together by db.Batch, fn may be called more than once;
+// fn returns expected errors before it changes anything, they don't abort the others
+func (s *TBoltStorage) write(fn func(tx *bolt.Tx) error) error {
+	s.wmu.RLock()
+	defer s.wmu.RUnlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.noBatch {
+		return s.db.Update(fn)
+	}
+	var expected error
+	err := s.db.Batch(func(tx *bolt.Tx) error {
+		expected = nil
+		err := fn(tx)
+		if boltExpectedError(err) {
+			expected = err
+			return nil
 		}
-		_, err = tx.CreateBucketIfNotExists([]byte("QUEUE"))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return expected
+}
+
+// boltExpectedError tells errors of requests from failures, a failure rolls back
+// the shared transaction and bolt runs its writes again
+func boltExpectedError(err error) bool {
+	return errors.Is(err, ErrTaskNotFound) || errors.Is(err, ErrTaskExists) ||
+		errors.Is(err, ErrTaskConflict) || errors.Is(err, ErrQueueIsEmpty)
+}
+
+// touch marks the Task written for the running compaction
+func (s *TBoltStorage) touch(taskId string) {
+	s.dmu.Lock()
+	defer s.dmu.Unlock()
+	if s.dirty != nil {
+		s.dirty[taskId] = true
+	}
+}
+
+// statusIndexKey makes key of the status index: status, 0, issued time, task id
+func statusIndexKey(status string, issuedAt int64, taskId string) []byte {
+	key := make([]byte, 0, len(status)+1+8+len(taskId))
+	key = append(key, status...)
+	key = append(key, 0)
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(issuedAt))
+	key = append(key, buf...)
+	return append(key, taskId...)
+}
+
+// boltIndexAdd adds the Task to indexes
+func boltIndexAdd(tx *bolt.Tx, task *TTask) error {
+	err := tx.Bucket([]byte("STATUS_IDX")).Put(statusIndexKey(task.Status, task.IssuedAt, task.Id), []byte{})
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	return nil
+}
+
+// boltIndexDelete removes the Task from indexes
+func boltIndexDelete(tx *bolt.Tx, task *TTask) error {
+	err := tx.Bucket([]byte("STATUS_IDX")).Delete(statusIndexKey(task.Status, task.IssuedAt, task.Id))
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	return nil
+}
+
+// boltIndexScan calls fn for task ids with the status issued before the unix time
+func boltIndexScan(tx *bolt.Tx, status string, before int64, fn func(taskId []byte) error) error {
+	prefix := append([]byte(status), 0)
+	end := statusIndexKey(status, before, "")
+	c := tx.Bucket([]byte("STATUS_IDX")).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+		err := fn(k[len(prefix)+8:])
 		if err != nil {
 			return err
 		}
-		_, err = tx.CreateBucketIfNotExists([]byte("TQREL"))
+	}
+	return nil
+}
+
+// boltGetTask reads the Task in the transaction
+func boltGetTask(tx *bolt.Tx, taskId []byte) (*TTask, error) {
+	v := tx.Bucket([]byte("TASKS")).Get(taskId)
+	if v == nil {
+		return nil, fmt.Errorf("%w: %s", ErrTaskNotFound, taskId)
+	}
+	task := &TTask{}
+	err := task.fromJBytes(v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: Invalid task format: %s", ErrStorage, err)
+	}
+	return task, nil
+}
+
+// boltPutTask saves the Task in the transaction
+func boltPutTask(tx *bolt.Tx, task *TTask) error {
+	payload, err := task.toJBytes()
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	err = tx.Bucket([]byte("TASKS")).Put([]byte(task.Id), payload)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	return nil
+}
+
+// boltQueuePush appends the Task to the queue
+func boltQueuePush(tx *bolt.Tx, taskId string) error {
+	bq := tx.Bucket([]byte("QUEUE"))
+	btq := tx.Bucket([]byte("TQREL"))
+	qid, _ := bq.NextSequence()
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(qid))
+	err := bq.Put(buf, []byte(taskId))
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	err = btq.Put([]byte(taskId), buf)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	return nil
+}
+
+// boltQueueRemove removes the Task from the queue if it is there
+func boltQueueRemove(tx *bolt.Tx, taskId string) error {
+	bq := tx.Bucket([]byte("QUEUE"))
+	btq := tx.Bucket([]byte("TQREL"))
+	buf := btq.Get([]byte(taskId))
+	if buf == nil {
+		return nil
+	}
+	err := bq.Delete(buf)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	err = btq.Delete([]byte(taskId))
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	return nil
+}
+
+// put Task in queue
+func (s *TBoltStorage) Enqueue(task *TTask) error {
+	return s.write(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("TASKS")).Get([]byte(task.Id)) != nil {
+			return fmt.Errorf("%w: %s", ErrTaskExists, task.Id)
+		}
+		s.touch(task.Id)
+		task.Rev = 1
+		err := boltPutTask(tx, task)
 		if err != nil {
 			return err
 		}
-		return nil
+		if task.Status == "received" {
+			err = boltQueuePush(tx, task.Id)
+			if err != nil {
+				return err
+			}
+		}
+		return boltIndexAdd(tx, task)
 	})
-	return &TBoltStorage{db}, err
 }
 
-// put Task in queue
-func (s *TBoltStorage) TaskQueue(taskId string, taskPayload []byte) (err *TErrorStorage) {
-	_err := s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("TASKS"))
-		bq := tx.Bucket([]byte("QUEUE"))
-		btq := tx.Bucket([]byte("TQREL"))
-		v := b.Get([]byte(taskId))
-		if v != nil {
-			return &TErrorStorage{"Task not found", E_STORAGE_TASK_EXISTS}
+// change Task, the queue follows the status
+func (s *TBoltStorage) UpdateTask(taskId string, fn func(task *TTask) error) (task *TTask, err error) {
+	err = s.write(func(tx *bolt.Tx) error {
+		old, err := boltGetTask(tx, []byte(taskId))
+		if err != nil {
+			return err
 		}
-		qid, _ := bq.NextSequence()
-		buf := make([]byte, 8)
-		binary.BigEndian.PutUint64(buf, uint64(qid))
-		err := bq.Put(buf, taskPayload)
+		task, err = boltGetTask(tx, []byte(taskId))
 		if err != nil {
-			return &TErrorStorage{fmt.Sprintf("Database error: %s", err), E_STORAGE_DATABASE_ERROR}
+			return err
 		}
-		err = b.Put([]byte(taskId), taskPayload)
+		err = fn(task)
 		if err != nil {
-			return &TErrorStorage{fmt.Sprintf("Database error: %s", err), E_STORAGE_DATABASE_ERROR}
+			return err
+		}
+		if task.Id != old.Id {
+			return fmt.Errorf("%w: Task id can't be changed: %s", ErrTaskConflict, taskId)
+		}
+		task.Rev = old.Rev + 1
+		if task.Status != "received" {
+			task.Claimed = 0
 		}
-		err = btq.Put([]byte(taskId), buf)
+		s.touch(taskId)
+		err = boltIndexDelete(tx, old)
 		if err != nil {
-			return &TErrorStorage{fmt.Sprintf("Database error: %s", err), E_STORAGE_DATABASE_ERROR}
+			return err
 		}
-		return nil
+		err = boltPutTask(tx, task)
+		if err != nil {
+			return err
+		}
+		if old.Status != "received" && task.Status == "received" {
+			err = boltQueuePush(tx, taskId)
+		} else if old.Status == "received" && task.Status != "received" {
+			err = boltQueueRemove(tx, taskId)
+		}
+		if err != nil {
+			return err
+		}
+		return boltIndexAdd(tx, task)
+	})
+	if err != nil {
+		task = nil
+	}
+	return
+}
+
+func (s *TBoltStorage) GetTask(taskId string) (task *TTask, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		task, err = boltGetTask(tx, []byte(taskId))
+		return err
 	})
-	err, _ = _err.(*TErrorStorage)
 	return
 }
 
-// complete Task
-func (s *TBoltStorage) TaskComplete(taskId string, oldTaskPayload, newTaskPayload []byte) (err *TErrorStorage) {
-	_err := s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("TASKS"))
-		bq := tx.Bucket([]byte("QUEUE"))
-		btq := tx.Bucket([]byte("TQREL"))
-		v := b.Get([]byte(taskId))
-		if v == nil {
-			return &TErrorStorage{"Task not found", E_STORAGE_TASK_NOT_FOUND}
+func (s *TBoltStorage) Claim(lease int64) (task *TTask, err error) {
+	if lease <= 0 {
+		err = s.view(func(tx *bolt.Tx) error {
+			c := tx.Bucket([]byte("QUEUE")).Cursor()
+			_, taskId := c.First()
+			if taskId == nil {
+				return ErrQueueIsEmpty
+			}
+			task, err = boltGetTask(tx, taskId)
+			if err != nil {
+				return fmt.Errorf("%w: Queue points to missing task: %s", ErrStorage, err)
+			}
+			return nil
+		})
+		return
+	}
+	now := time.Now().Unix()
+	err = s.write(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("QUEUE")).Cursor()
+		for _, taskId := c.First(); taskId != nil; _, taskId = c.Next() {
+			task, err = boltGetTask(tx, taskId)
+			if err != nil {
+				return fmt.Errorf("%w: Queue points to missing task: %s", ErrStorage, err)
+			}
+			if task.Claimed > now-lease {
+				continue
+			}
+			// the status and the issued time are the same, indexes are kept
+			task.Claimed = now
+			task.Rev++
+			s.touch(task.Id)
+			return boltPutTask(tx, task)
 		}
-		if string(v) != string(oldTaskPayload) {
-			return &TErrorStorage{"Task conflict", E_STORAGE_TASK_CONFLICT}
+		return ErrQueueIsEmpty
+	})
+	if err != nil {
+		task = nil
+	}
+	return
+}
+
+// remove Tasks with status issued before the unix time, return their ids,
+// Tasks are removed by chunks of purgeChunk to let other writes go between them
+func (s *TBoltStorage) PurgeTasks(status string, before int64) (taskIds []string, err error) {
+	prefix := append([]byte(status), 0)
+	end := statusIndexKey(status, before, "")
+	for from := prefix; from != nil; {
+		var chunk []string
+		var next []byte
+		err = s.write(func(tx *bolt.Tx) error {
+			var tasks []*TTask
+			chunk, next = nil, nil
+			// the cursor is invalid after deletes, collect tasks first
+			c := tx.Bucket([]byte("STATUS_IDX")).Cursor()
+			for k, _ := c.Seek(from); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+				if len(tasks) == purgeChunk {
+					next = append([]byte{}, k...)
+					break
+				}
+				task, err := boltGetTask(tx, k[len(prefix)+8:])
+				if err != nil {
+					return fmt.Errorf("%w: Index points to missing task: %s", ErrStorage, err)
+				}
+				tasks = append(tasks, task)
+			}
+			for _, task := range tasks {
+				// tasks under legal hold are kept forever
+				if task.Hold != nil {
+					continue
+				}
+				s.touch(task.Id)
+				err := boltQueueRemove(tx, task.Id)
+				if err != nil {
+					return err
+				}
+				err = boltIndexDelete(tx, task)
+				if err != nil {
+					return err
+				}
+				err = tx.Bucket([]byte("TASKS")).Delete([]byte(task.Id))
+				if err != nil {
+					return fmt.Errorf("%w: %s", ErrStorage, err)
+				}
+				chunk = append(chunk, task.Id)
+			}
+			return nil
+		})
+		if err != nil {
+			// chunks before are committed
+			return
 		}
-		buf := btq.Get([]byte(taskId))
-		if buf != nil {
-			err := bq.Delete(buf)
+		taskIds = append(taskIds, chunk...)
+		from = next
+	}
+	return
+}
+
+// list Tasks with status issued before the unix time
+func (s *TBoltStorage) ListTasks(status string, before int64) (tasks []*TTask, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		return boltIndexScan(tx, status, before, func(taskId []byte) error {
+			task, err := boltGetTask(tx, taskId)
 			if err != nil {
-				return &TErrorStorage{fmt.Sprintf("Database error: %s", err), E_STORAGE_DATABASE_ERROR}
+				return fmt.Errorf("%w: Index points to missing task: %s", ErrStorage, err)
 			}
-			err = btq.Delete([]byte(taskId))
+			tasks = append(tasks, task)
+			return nil
+		})
+	})
+	return
+}
+
+// save the Task as is, the queue follows the status
+func (s *TBoltStorage) PutTask(task *TTask) error {
+	return s.write(func(tx *bolt.Tx) error {
+		s.touch(task.Id)
+		queued := false
+		old, err := boltGetTask(tx, []byte(task.Id))
+		if err == nil {
+			queued = old.Status == "received"
+			err = boltIndexDelete(tx, old)
 			if err != nil {
-				return &TErrorStorage{fmt.Sprintf("Database error: %s", err), E_STORAGE_DATABASE_ERROR}
+				return err
 			}
+		} else if !errors.Is(err, ErrTaskNotFound) {
+			return err
 		}
-		err := b.Delete([]byte(taskId))
+		err = boltPutTask(tx, task)
 		if err != nil {
-			return &TErrorStorage{fmt.Sprintf("Database error: %s", err), E_STORAGE_DATABASE_ERROR}
+			return err
+		}
+		if !queued && task.Status == "received" {
+			err = boltQueuePush(tx, task.Id)
+		} else if queued && task.Status != "received" {
+			err = boltQueueRemove(tx, task.Id)
 		}
-		err = b.Put([]byte(taskId), newTaskPayload)
 		if err != nil {
-			return &TErrorStorage{fmt.Sprintf("Database error: %s", err), E_STORAGE_DATABASE_ERROR}
+			return err
 		}
-		return nil
+		return boltIndexAdd(tx, task)
 	})
-	err, _ = _err.(*TErrorStorage)
-	return
 }
 
-func (s *TBoltStorage) TaskGet(taskId string) (taskPayload []byte, err *TErrorStorage) {
-	_err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("TASKS"))
-		taskPayload = b.Get([]byte(taskId))
-		if taskPayload == nil {
-			return &TErrorStorage{"Task not found", E_STORAGE_TASK_NOT_FOUND}
+// remove the Task
+func (s *TBoltStorage) DeleteTask(taskId string) error {
+	return s.write(func(tx *bolt.Tx) error {
+		task, err := boltGetTask(tx, []byte(taskId))
+		if err != nil {
+			return err
+		}
+		s.touch(taskId)
+		err = boltQueueRemove(tx, taskId)
+		if err != nil {
+			return err
+		}
+		err = boltIndexDelete(tx, task)
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte("TASKS")).Delete([]byte(taskId))
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrStorage, err)
 		}
 		return nil
 	})
-	err, _ = _err.(*TErrorStorage)
-	return
 }
 
-func (s *TBoltStorage) QueueGet() (taskPayload []byte, err *TErrorStorage) {
-	_err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("QUEUE"))
-		c := b.Cursor()
-		_, taskPayload = c.First()
-		if taskPayload == nil {
-			return &TErrorStorage{"Queue is empty", E_STORAGE_QUEUE_IS_EMPTY}
+// exportTasks returns all Tasks and task ids of the queue in order
+func (s *TBoltStorage) exportTasks() (tasks []*TTask, queue []string, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		err := tx.Bucket([]byte("TASKS")).ForEach(func(k, v []byte) error {
+			task, err := boltGetTask(tx, k)
+			if err != nil {
+				return err
+			}
+			tasks = append(tasks, task)
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		return nil
+		return tx.Bucket([]byte("QUEUE")).ForEach(func(k, v []byte) error {
+			queue = append(queue, string(v))
+			return nil
+		})
 	})
-	err, _ = _err.(*TErrorStorage)
 	return
 }
 
-func (s *TBoltStorage) TaskPurge(status string, duration int64) (err *TErrorStorage) {
-	task := &TTask{}
-	t := time.Now().Unix()
-	_err := s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("TASKS"))
-		bq := tx.Bucket([]byte("QUEUE"))
-		btq := tx.Bucket([]byte("TQREL"))
-		c := b.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			err := task.fromJBytes(v)
-			if err != nil {
-				return &TErrorStorage{fmt.Sprintf("Invalid task format: %s", err), E_STORAGE_DATABASE_ERROR}
-			}
-			if task.Status == status {
-				if task.IssuedAt+duration < t {
-					buf := btq.Get([]byte(task.Id))
-					if buf != nil {
-						err = bq.Delete(buf)
-						if err != nil {
-							return &TErrorStorage{fmt.Sprintf("Database error: %s", err), E_STORAGE_DATABASE_ERROR}
-						}
-						err = btq.Delete([]byte(task.Id))
-						if err != nil {
-							return &TErrorStorage{fmt.Sprintf("Database error: %s", err), E_STORAGE_DATABASE_ERROR}
-						}
-					}
-					b.Delete(k)
-				}
-			}
+// snapshot is the read transaction, bolt writes it as a database file
+func (s *TBoltStorage) Snapshot(fn func(size int64, tasks []*TTask, data io.WriterTo) error) error {
+	return s.view(func(tx *bolt.Tx) error {
+		var tasks []*TTask
+		err := tx.Bucket([]byte("TASKS")).ForEach(func(k, v []byte) error {
+			task, err := boltGetTask(tx, k)
+			tasks = append(tasks, task)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return fn(tx.Size(), tasks, tx)
+	})
+}
+
+func (s *TBoltStorage) GetMeta(key string) (value string, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte("META")); b != nil {
+			value = string(b.Get([]byte(key)))
 		}
 		return nil
 	})
-	err, _ = _err.(*TErrorStorage)
 	return
 }
 
+func (s *TBoltStorage) SetMeta(key, value string) error {
+	return s.write(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("META"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), []byte(value))
+	})
+}
+
 func (s *TBoltStorage) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.db.Close()
+	if s.remove != "" {
+		os.Remove(s.remove)
+	}
 }
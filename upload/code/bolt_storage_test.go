@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	bolt "github.com/etcd-io/bbolt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_BoltStatusIndex(t *testing.T) {
+	fmt.Println("Test_BoltStatusIndex")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	// a database without indexes
+	db, err := bolt.Open(dir+"/test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	tasks := []TTask{
+		{Id: NewId(TASK_ID_LEN), Status: "verified", IssuedAt: now - 100},
+		{Id: NewId(TASK_ID_LEN), Status: "verified", IssuedAt: now - 10},
+		{Id: NewId(TASK_ID_LEN), Status: "failed", IssuedAt: now - 100},
+		{Id: NewId(TASK_ID_LEN), Status: "verified", IssuedAt: now - 200, Hold: &TTaskHold{Reason: "case", Actor: "legal"}},
+		{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: now - 5},
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("TASKS"))
+		if err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			payload, err := task.toJBytes()
+			if err != nil {
+				return err
+			}
+			err = b.Put([]byte(task.Id), payload)
+			if err != nil {
+				return err
+			}
+		}
+		// fields unknown to the current model are kept by migrations
+		err = b.Put([]byte(tasks[2].Id), []byte(`{"id":"`+tasks[2].Id+`","status":"failed","iat":`+fmt.Sprint(now-100)+`,"extra":{"a":1}}`))
+		if err != nil {
+			return err
+		}
+		// the old queue keeps payloads
+		bq, err := tx.CreateBucket([]byte("QUEUE"))
+		if err != nil {
+			return err
+		}
+		btq, err := tx.CreateBucket([]byte("TQREL"))
+		if err != nil {
+			return err
+		}
+		payload, _ := tasks[4].toJBytes()
+		buf := []byte{0, 0, 0, 0, 0, 0, 0, 1}
+		err = bq.Put(buf, payload)
+		if err != nil {
+			return err
+		}
+		return btq.Put([]byte(tasks[4].Id), buf)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	s, err := BoltNewStorage(dir + "/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	list, err := s.ListTasks("verified", now-50)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(list) != 2 {
+		t.Errorf("2 tasks expected, but was: %d", len(list))
+	}
+	taskIds, err := s.PurgeTasks("verified", now-50)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(taskIds) != 1 || taskIds[0] != tasks[0].Id {
+		t.Errorf("Task %s expected to be purged, but was: %v", tasks[0].Id, taskIds)
+	}
+	list, _ = s.ListTasks("verified", now+1)
+	if len(list) != 2 {
+		t.Errorf("2 tasks expected, but was: %d", len(list))
+	}
+	list, _ = s.ListTasks("failed", now+1)
+	if len(list) != 1 {
+		t.Errorf("1 task expected, but was: %d", len(list))
+	}
+	task, err := s.Claim(0)
+	if err != nil || task.Id != tasks[4].Id || task.Rev != 1 {
+		t.Errorf("Task %s revision 1 expected in queue, but was: %v %v", tasks[4].Id, task, err)
+	}
+	err = s.view(func(tx *bolt.Tx) error {
+		payload := string(tx.Bucket([]byte("TASKS")).Get([]byte(tasks[2].Id)))
+		if !strings.Contains(payload, `"extra":{"a":1}`) || !strings.Contains(payload, `"rev":1`) {
+			return fmt.Errorf("Unknown field and revision 1 expected, but was: %s", payload)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_BoltStorage(t *testing.T) {
+	fmt.Println("Test_BoltStorage")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	s, err := BoltNewStorage(dir + "/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Claim(0); !errors.Is(err, ErrQueueIsEmpty) {
+		t.Errorf("ErrQueueIsEmpty expected, but was: %v", err)
+	}
+	if _, err := s.GetTask("none"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("ErrTaskNotFound expected, but was: %v", err)
+	}
+	task := &TTask{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: time.Now().Unix()}
+	err = s.Enqueue(task)
+	if err != nil || task.Rev != 1 {
+		t.Fatalf("Revision 1 expected, but was: %d %v", task.Rev, err)
+	}
+	if err := s.Enqueue(&TTask{Id: task.Id, Status: "received"}); !errors.Is(err, ErrTaskExists) {
+		t.Errorf("ErrTaskExists expected, but was: %v", err)
+	}
+	_, err = s.UpdateTask(task.Id, func(task *TTask) error {
+		task.Id = "other"
+		return nil
+	})
+	if !errors.Is(err, ErrTaskConflict) {
+		t.Errorf("ErrTaskConflict expected, but was: %v", err)
+	}
+	updated, err := s.UpdateTask(task.Id, func(task *TTask) error {
+		task.Status = "verified"
+		return nil
+	})
+	if err != nil || updated.Rev != 2 || updated.Status != "verified" {
+		t.Errorf("Revision 2 expected, but was: %v %v", updated, err)
+	}
+	if _, err := s.Claim(0); !errors.Is(err, ErrQueueIsEmpty) {
+		t.Errorf("ErrQueueIsEmpty expected, but was: %v", err)
+	}
+	stored, err := s.GetTask(task.Id)
+	if err != nil || stored.Rev != 2 {
+		t.Errorf("Revision 2 expected, but was: %v %v", stored, err)
+	}
+}
+
+func Test_BoltBatchErrors(t *testing.T) {
+	fmt.Println("Test_BoltBatchErrors")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	s, err := BoltNewStorage(t.TempDir() + "/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	task := &TTask{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: time.Now().Unix()}
+	s.Enqueue(task)
+	// requests failing with expected errors share the commit, others are not run again
+	var wg sync.WaitGroup
+	var calls int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			taskId := task.Id
+			if i%2 == 0 {
+				taskId = "none"
+			}
+			_, err := s.UpdateTask(taskId, func(task *TTask) error {
+				atomic.AddInt32(&calls, 1)
+				if i%4 == 1 {
+					return ErrTaskConflict
+				}
+				task.HoldHistory = append(task.HoldHistory, TTaskHoldRecord{Action: "hold"})
+				return nil
+			})
+			if i%2 == 0 && !errors.Is(err, ErrTaskNotFound) || i%4 == 1 && !errors.Is(err, ErrTaskConflict) || i%4 == 3 && err != nil {
+				t.Errorf("Unexpected error of %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if calls != 25 {
+		t.Errorf("25 calls expected, but was: %d", calls)
+	}
+	stored, err := s.GetTask(task.Id)
+	if err != nil || stored.Rev != 13 || len(stored.HoldHistory) != 12 {
+		t.Errorf("Revision 13 expected, but was: %v %v", stored, err)
+	}
+}
+
+// benchmarkBolt runs parallel writes with and without shared commits,
+// go test -run NONE -bench Bolt
+func benchmarkBolt(b *testing.B, fn func(s *TBoltStorage, taskId string) error) {
+	logInit(ioutil.Discard, ioutil.Discard, ioutil.Discard, os.Stderr)
+	for _, noBatch := range []bool{true, false} {
+		name := "batch"
+		if noBatch {
+			name = "update"
+		}
+		b.Run(name, func(b *testing.B) {
+			s, err := BoltNewStorage(b.TempDir() + "/bench.db")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.Close()
+			s.noBatch = noBatch
+			b.SetParallelism(256)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					err := fn(s, NewId(TASK_ID_LEN))
+					if err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// upload burst
+func Benchmark_BoltEnqueue(b *testing.B) {
+	benchmarkBolt(b, func(s *TBoltStorage, taskId string) error {
+		return s.Enqueue(&TTask{Id: taskId, Status: "received", IssuedAt: time.Now().Unix()})
+	})
+}
+
+// upload and verification of every task
+func Benchmark_BoltEnqueueComplete(b *testing.B) {
+	benchmarkBolt(b, func(s *TBoltStorage, taskId string) error {
+		err := s.Enqueue(&TTask{Id: taskId, Status: "received", IssuedAt: time.Now().Unix()})
+		if err != nil {
+			return err
+		}
+		_, err = s.UpdateTask(taskId, func(task *TTask) error {
+			task.Status = "verified"
+			return nil
+		})
+		return err
+	})
+}
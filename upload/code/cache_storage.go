@@ -0,0 +1,139 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// TCacheStorage is a read-through LRU cache of GetTask, writes invalidate it
+type TCacheStorage struct {
+	IStorage
+	mu     sync.Mutex
+	size   int
+	lru    *list.List               // of *TCacheItem, the most recent first
+	items  map[string]*list.Element // by task id
+	gen    uint64                   // changes on every invalidation
+	hits   int64
+	misses int64
+}
+
+type TCacheItem struct {
+	id      string
+	payload []byte
+}
+
+type TCacheStats struct {
+	Size   int   `json:"size"`
+	Len    int   `json:"len"`
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+// CacheNewStorage wraps the storage with the cache of size tasks
+func CacheNewStorage(s IStorage, size int) *TCacheStorage {
+	return &TCacheStorage{IStorage: s, size: size, lru: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *TCacheStorage) Unwrap() IStorage {
+	return c.IStorage
+}
+
+// invalidate drops the cached Tasks
+func (c *TCacheStorage) invalidate(taskIds ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, taskId := range taskIds {
+		if e, ok := c.items[taskId]; ok {
+			c.lru.Remove(e)
+			delete(c.items, taskId)
+		}
+	}
+}
+
+// the cache keeps JSON, callers get their own copies
+func (c *TCacheStorage) GetTask(taskId string) (*TTask, error) {
+	c.mu.Lock()
+	if e, ok := c.items[taskId]; ok {
+		c.lru.MoveToFront(e)
+		c.hits++
+		payload := e.Value.(*TCacheItem).payload
+		c.mu.Unlock()
+		task := &TTask{}
+		err := task.fromJBytes(payload)
+		if err != nil {
+			return nil, fmt.Errorf("%w: Invalid task format: %s", ErrStorage, err)
+		}
+		return task, nil
+	}
+	c.misses++
+	gen := c.gen
+	c.mu.Unlock()
+	task, err := c.IStorage.GetTask(taskId)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := task.toJBytes()
+	if err != nil {
+		return task, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// a write in the meantime makes the read stale
+	if gen != c.gen {
+		return task, nil
+	}
+	if e, ok := c.items[taskId]; ok {
+		c.lru.MoveToFront(e)
+		e.Value.(*TCacheItem).payload = payload
+		return task, nil
+	}
+	c.items[taskId] = c.lru.PushFront(&TCacheItem{taskId, payload})
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.items, e.Value.(*TCacheItem).id)
+	}
+	return task, nil
+}
+
+func (c *TCacheStorage) Enqueue(task *TTask) error {
+	defer c.invalidate(task.Id)
+	return c.IStorage.Enqueue(task)
+}
+
+func (c *TCacheStorage) Claim(lease int64) (*TTask, error) {
+	task, err := c.IStorage.Claim(lease)
+	if err == nil && lease > 0 {
+		c.invalidate(task.Id)
+	}
+	return task, err
+}
+
+func (c *TCacheStorage) UpdateTask(taskId string, fn func(task *TTask) error) (*TTask, error) {
+	defer c.invalidate(taskId)
+	return c.IStorage.UpdateTask(taskId, fn)
+}
+
+func (c *TCacheStorage) PurgeTasks(status string, before int64) ([]string, error) {
+	taskIds, err := c.IStorage.PurgeTasks(status, before)
+	c.invalidate(taskIds...)
+	return taskIds, err
+}
+
+func (c *TCacheStorage) PutTask(task *TTask) error {
+	defer c.invalidate(task.Id)
+	return c.IStorage.PutTask(task)
+}
+
+func (c *TCacheStorage) DeleteTask(taskId string) error {
+	defer c.invalidate(taskId)
+	return c.IStorage.DeleteTask(taskId)
+}
+
+func (c *TCacheStorage) Stats() TCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return TCacheStats{Size: c.size, Len: c.lru.Len(), Hits: c.hits, Misses: c.misses}
+}
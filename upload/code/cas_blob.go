@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	CAS_TASKS_PREFIX  = "tasks/"  // Task file references by the Task file key
+	CAS_BLOBS_PREFIX  = "sha256/" // contents by the hash
+	CAS_LAYOUT_MARKER = ".cas"    // written when legacy Task directories are converted
+)
+
+// TCASRef is the Task file, it refers to the content by the hash
+type TCASRef struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// TCASBlob is the content record, the content is removed with the last reference
+type TCASBlob struct {
+	Refs int   `json:"refs"`
+	Size int64 `json:"size"`
+}
+
+// TCASBlobStore keeps Task files as references to contents stored once by their SHA-256,
+// the same document uploaded many times takes the space once
+type TCASBlobStore struct {
+	raw IBlobStore
+}
+
+// casLocks serialize reference counting by the first byte of the hash
+var casLocks [256]sync.Mutex
+
+func CASNewBlobStore(raw IBlobStore) *TCASBlobStore {
+	return &TCASBlobStore{raw: raw}
+}
+
+// casBlobKey is the key of the content, sha256/ab/cd/abcd...
+func casBlobKey(hash string) string {
+	return CAS_BLOBS_PREFIX + hash[0:2] + "/" + hash[2:4] + "/" + hash
+}
+
+func casLock(hash string) *sync.Mutex {
+	b, _ := strconv.ParseUint(hash[0:2], 16, 8)
+	return &casLocks[b]
+}
+
+// getJSON reads the JSON record from the raw store
+func (s *TCASBlobStore) getJSON(key string, v interface{}) error {
+	r, err := s.raw.Get(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(v)
+}
+
+// putJSON writes the JSON record to the raw store
+func (s *TCASBlobStore) putJSON(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.raw.Put(key, bytes.NewReader(data))
+	return err
+}
+
+func (s *TCASBlobStore) ref(key string) (*TCASRef, error) {
+	if !validBlobKey(key) {
+		return nil, fmt.Errorf("Invalid blob key: %s", key)
+	}
+	ref := &TCASRef{}
+	err := s.getJSON(CAS_TASKS_PREFIX+key, ref)
+	if err != nil {
+		return nil, err
+	}
+	if len(ref.SHA256) != sha256.Size*2 {
+		return nil, fmt.Errorf("Invalid blob reference: %s", key)
+	}
+	return ref, nil
+}
+
+// Put stores the content if it is new and counts the reference before it is written,
+// so a failure leaves an unused content at worst and never a reference to nothing
+func (s *TCASBlobStore) Put(key string, r io.Reader) (int64, error) {
+	if !validBlobKey(key) {
+		return 0, fmt.Errorf("Invalid blob key: %s", key)
+	}
+	f, err := ioutil.TempFile("", "cas-blob-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return 0, err
+	}
+	ref := &TCASRef{SHA256: hex.EncodeToString(h.Sum(nil)), Size: n}
+	err = s.addRef(ref, f)
+	if err != nil {
+		return 0, err
+	}
+	old, err := s.ref(key)
+	if err != nil && !errors.Is(err, ErrBlobNotFound) {
+		return 0, err
+	}
+	err = s.putJSON(CAS_TASKS_PREFIX+key, ref)
+	if err != nil {
+		return 0, err
+	}
+	if old != nil {
+		// the same content is counted twice above
+		err = s.dropRef(old.SHA256)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// addRef increments the reference count, the content is written by the first reference
+func (s *TCASBlobStore) addRef(ref *TCASRef, content io.ReadSeeker) error {
+	lock := casLock(ref.SHA256)
+	lock.Lock()
+	defer lock.Unlock()
+	key := casBlobKey(ref.SHA256)
+	blob := &TCASBlob{Size: ref.Size}
+	err := s.getJSON(key+".json", blob)
+	if err != nil && !errors.Is(err, ErrBlobNotFound) {
+		return err
+	}
+	if _, serr := s.raw.Stat(key); blob.Refs == 0 || errors.Is(serr, ErrBlobNotFound) {
+		_, err = content.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = s.raw.Put(key, content)
+		if err != nil {
+			return err
+		}
+	}
+	blob.Refs++
+	return s.putJSON(key+".json", blob)
+}
+
+// dropRef decrements the reference count, the content is removed with the last reference,
+// a content without the record is left as is
+func (s *TCASBlobStore) dropRef(hash string) error {
+	lock := casLock(hash)
+	lock.Lock()
+	defer lock.Unlock()
+	key := casBlobKey(hash)
+	blob := &TCASBlob{}
+	err := s.getJSON(key+".json", blob)
+	if errors.Is(err, ErrBlobNotFound) {
+		Warning.Printf("Blob %s has no reference count\n", hash)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	blob.Refs--
+	if blob.Refs > 0 {
+		return s.putJSON(key+".json", blob)
+	}
+	err = s.raw.Delete(key)
+	if err != nil {
+		return err
+	}
+	return s.raw.Delete(key + ".json")
+}
+
+func (s *TCASBlobStore) Get(key string) (io.ReadCloser, error) {
+	ref, err := s.ref(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.raw.Get(casBlobKey(ref.SHA256))
+}
+
+func (s *TCASBlobStore) Stat(key string) (*TBlobInfo, error) {
+	ref, err := s.ref(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.raw.Stat(CAS_TASKS_PREFIX + key)
+	if err != nil {
+		return nil, err
+	}
+	return &TBlobInfo{Key: key, Size: ref.Size, ModTime: info.ModTime, SHA256: ref.SHA256}, nil
+}
+
+// List reads references with keys starting with the prefix
+func (s *TCASBlobStore) List(prefix string) ([]TBlobInfo, error) {
+	list, err := s.raw.List(CAS_TASKS_PREFIX + prefix)
+	if err != nil {
+		return nil, err
+	}
+	blobs := []TBlobInfo{}
+	for _, b := range list {
+		key := strings.TrimPrefix(b.Key, CAS_TASKS_PREFIX)
+		ref, err := s.ref(key)
+		if errors.Is(err, ErrBlobNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, TBlobInfo{Key: key, Size: ref.Size, ModTime: b.ModTime, SHA256: ref.SHA256})
+	}
+	return blobs, nil
+}
+
+// Delete removes the reference and then the content if it was the last one
+func (s *TCASBlobStore) Delete(key string) error {
+	ref, err := s.ref(key)
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = s.raw.Delete(CAS_TASKS_PREFIX + key)
+	if err != nil {
+		return err
+	}
+	return s.dropRef(ref.SHA256)
+}
+
+// Refs returns the reference count of the content, 0 if it is not stored
+func (s *TCASBlobStore) Refs(hash string) (int, error) {
+	blob := &TCASBlob{}
+	err := s.getJSON(casBlobKey(hash)+".json", blob)
+	if errors.Is(err, ErrBlobNotFound) {
+		return 0, nil
+	}
+	return blob.Refs, err
+}
+
+// casLegacyKey checks the key is the Task file of the layout before content addressing, x/y/xy.../name
+func casLegacyKey(key string) bool {
+	parts := strings.Split(key, "/")
+	return len(parts) == 4 && len(parts[2]) >= 2 && parts[0] == parts[2][0:1] && parts[1] == parts[2][1:2] &&
+		safeTaskId(parts[2]) && safeFileName(parts[3])
+}
+
+// casMigrate converts Task directories of the previous layout into references,
+// returns the number of converted files, the store is marked and not scanned again
+func casMigrate(raw IBlobStore, dryRun bool) (int, error) {
+	_, err := raw.Stat(CAS_LAYOUT_MARKER)
+	if err == nil {
+		return 0, nil
+	}
+	if !errors.Is(err, ErrBlobNotFound) {
+		return 0, err
+	}
+	list, err := raw.List("")
+	if err != nil {
+		return 0, err
+	}
+	cas := CASNewBlobStore(raw)
+	converted := 0
+	for _, b := range list {
+		if !casLegacyKey(b.Key) {
+			continue
+		}
+		converted++
+		if dryRun {
+			continue
+		}
+		r, err := raw.Get(b.Key)
+		if err != nil {
+			return converted, err
+		}
+		_, err = cas.Put(b.Key, r)
+		r.Close()
+		if err != nil {
+			return converted, err
+		}
+		// a repeated run after a failure puts the same reference again
+		err = raw.Delete(b.Key)
+		if err != nil {
+			return converted, err
+		}
+	}
+	if dryRun {
+		return converted, nil
+	}
+	_, err = raw.Put(CAS_LAYOUT_MARKER, strings.NewReader("sha256\n"))
+	return converted, err
+}
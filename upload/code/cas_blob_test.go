@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_BlobStoreCAS(t *testing.T) {
+	fmt.Println("Test_BlobStoreCAS")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	testBlobStoreConformance(t, CASNewBlobStore(LocalNewBlobStore(dir+"/blobs")))
+	fake := newFakeS3()
+	defer fake.Close()
+	bs, err := S3ParseURL(fake.URL + "/bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStoreConformance(t, CASNewBlobStore(bs))
+}
+
+func Test_BlobStoreCASRefs(t *testing.T) {
+	fmt.Println("Test_BlobStoreCASRefs")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	raw := LocalNewBlobStore(dir + "/blobs")
+	bs := CASNewBlobStore(raw)
+	doc := NewId(256)
+	digest := sha256.Sum256([]byte(doc))
+	hash := hex.EncodeToString(digest[:])
+	// the same document in three tasks is stored once
+	for _, key := range []string{"a/b/ab1/doc.xml", "a/b/ab2/doc.xml", "c/d/cd1/copy.xml"} {
+		_, err := bs.Put(key, strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if refs, err := bs.Refs(hash); err != nil || refs != 3 {
+		t.Errorf("3 references expected, but was: %d %v", refs, err)
+	}
+	contents, _ := raw.List(CAS_BLOBS_PREFIX)
+	if len(contents) != 2 || contents[0].Key != casBlobKey(hash) || contents[0].Size != 256 {
+		t.Errorf("Single content with the counter expected, but was: %v", contents)
+	}
+	if info, err := bs.Stat("a/b/ab2/doc.xml"); err != nil || info.SHA256 != hash || info.Size != 256 {
+		t.Errorf("Reference by hash expected, but was: %v %v", info, err)
+	}
+	// replacing with the same content keeps the count
+	_, err := bs.Put("a/b/ab1/doc.xml", strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs, _ := bs.Refs(hash); refs != 3 {
+		t.Errorf("3 references expected, but was: %d", refs)
+	}
+	// replacing with other content drops the reference
+	_, err = bs.Put("c/d/cd1/copy.xml", strings.NewReader("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs, _ := bs.Refs(hash); refs != 2 {
+		t.Errorf("2 references expected, but was: %d", refs)
+	}
+	blobDeletePrefix(bs, "a/b/ab1/")
+	if content, err := readBlob(bs, "a/b/ab2/doc.xml"); err != nil || content != doc {
+		t.Errorf("Content used by the other task expected: %v", err)
+	}
+	blobDeletePrefix(bs, "a/b/ab2/")
+	if refs, _ := bs.Refs(hash); refs != 0 {
+		t.Errorf("No references expected, but was: %d", refs)
+	}
+	if _, err := os.Stat(dir + "/blobs/" + casBlobKey(hash)); !os.IsNotExist(err) {
+		t.Errorf("Content removed with the last reference expected")
+	}
+	if list, _ := bs.List(""); len(list) != 1 || list[0].Key != "c/d/cd1/copy.xml" {
+		t.Errorf("1 file expected, but was: %v", list)
+	}
+}
+
+func Test_BlobStoreCASMigrate(t *testing.T) {
+	fmt.Println("Test_BlobStoreCASMigrate")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	raw := LocalNewBlobStore(dir + "/blobs")
+	id1 := NewId(TASK_ID_LEN)
+	id2 := NewId(TASK_ID_LEN)
+	doc := NewId(64)
+	raw.Put(taskBlobPrefix(&TTask{Id: id1})+"doc.xml", strings.NewReader(doc))
+	raw.Put(taskBlobPrefix(&TTask{Id: id1})+"doc.xml.sig", strings.NewReader("sig1"))
+	raw.Put(taskBlobPrefix(&TTask{Id: id2})+"doc.xml", strings.NewReader(doc))
+	raw.Put("quarantine/"+id2+"/other.xml", strings.NewReader("q"))
+	raw.Put("_/"+id2+"/part.xml", strings.NewReader("p"))
+	converted, err := casMigrate(raw, true)
+	if err != nil || converted != 3 {
+		t.Fatalf("3 files to convert expected, but was: %d %v", converted, err)
+	}
+	converted, err = casMigrate(raw, false)
+	if err != nil || converted != 3 {
+		t.Fatalf("3 files converted expected, but was: %d %v", converted, err)
+	}
+	bs := CASNewBlobStore(raw)
+	if content, err := readBlob(bs, taskBlobPrefix(&TTask{Id: id2})+"doc.xml"); err != nil || content != doc {
+		t.Errorf("Converted file expected: %v", err)
+	}
+	if files := testTaskFiles(t, bs, &TTask{Id: id1}); len(files) != 2 || files[0].SHA256 == "" {
+		t.Errorf("2 files expected, but was: %v", files)
+	}
+	if _, err := raw.Stat(taskBlobPrefix(&TTask{Id: id1}) + "doc.xml"); err == nil {
+		t.Errorf("Legacy file removed expected")
+	}
+	if contents, _ := raw.List(CAS_BLOBS_PREFIX); len(contents) != 4 {
+		t.Errorf("2 contents with counters expected, but was: %v", contents)
+	}
+	if _, err := raw.Stat("quarantine/" + id2 + "/other.xml"); err != nil {
+		t.Errorf("Other files kept expected: %v", err)
+	}
+	converted, err = casMigrate(raw, false)
+	if err != nil || converted != 0 {
+		t.Errorf("Converted store expected, but was: %d %v", converted, err)
+	}
+}
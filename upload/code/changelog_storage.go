@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CHANGELOG_SIZE is how many last changes are kept for followers,
+// a follower behind them starts from the snapshot
+const CHANGELOG_SIZE = 10000
+
+// TChange is a storage mutation or a change of the Task files
+type TChange struct {
+	Seq   uint64        `json:"seq"`
+	Op    string        `json:"op"` // "put", "delete" or "files"
+	Id    string        `json:"id"`
+	Task  *TTask        `json:"task,omitempty"`  // the Task after "put"
+	Files []TChangeFile `json:"files,omitempty"` // the Task files after "files"
+}
+
+type TChangeFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// TChangeLogStorage records successful mutations, the epoch changes on every start,
+// a mutation and its record are made under the lock of the Task, so changes of the Task are in the commit order
+type TChangeLogStorage struct {
+	IStorage
+	commit  sync.RWMutex   // held for writing by mutations of any Task
+	tasks   [64]sync.Mutex // held by mutations of the Task
+	mu      sync.Mutex
+	epoch   string
+	seq     uint64
+	changes []*TChange    // the last changes in order
+	notify  chan struct{} // closed on the next change
+}
+
+func ChangeLogNewStorage(s IStorage) *TChangeLogStorage {
+	return &TChangeLogStorage{IStorage: s, epoch: NewId(16), notify: make(chan struct{})}
+}
+
+func (l *TChangeLogStorage) Unwrap() IStorage {
+	return l.IStorage
+}
+
+// lockTask serializes mutations of the Task with their records, returns the unlock
+func (l *TChangeLogStorage) lockTask(taskId string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(taskId))
+	lock := &l.tasks[h.Sum32()%uint32(len(l.tasks))]
+	l.commit.RLock()
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.commit.RUnlock()
+	}
+}
+
+// lockAll serializes mutations of unknown Tasks with their records, returns the unlock
+func (l *TChangeLogStorage) lockAll() func() {
+	l.commit.Lock()
+	return l.commit.Unlock
+}
+
+// record appends the change and wakes up waiting followers
+func (l *TChangeLogStorage) record(c *TChange) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	c.Seq = l.seq
+	l.changes = append(l.changes, c)
+	if len(l.changes) > CHANGELOG_SIZE {
+		l.changes = append([]*TChange{}, l.changes[len(l.changes)-CHANGELOG_SIZE:]...)
+	}
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// recordPut records the copy of the Task, callers keep their own
+func (l *TChangeLogStorage) recordPut(task *TTask) {
+	payload, err := task.toJBytes()
+	if err != nil {
+		return
+	}
+	c := &TChange{Op: "put", Id: task.Id, Task: &TTask{}}
+	if c.Task.fromJBytes(payload) == nil {
+		l.record(c)
+	}
+}
+
+// RecordFiles records the current files of the Task, nothing is recorded if they can't be listed
+func (l *TChangeLogStorage) RecordFiles(task *TTask) {
+	files, err := taskFiles(taskBlobs(), task)
+	if err != nil {
+		Error.Printf("Change log: %s\n", err)
+		return
+	}
+	l.record(&TChange{Op: "files", Id: task.Id, Files: files})
+}
+
+// Position returns the epoch and the last change
+func (l *TChangeLogStorage) Position() (string, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.epoch, l.seq
+}
+
+// Changes returns up to limit changes after since, waiting up to wait for new ones,
+// ok is false if the epoch differs or the changes after since are dropped already
+func (l *TChangeLogStorage) Changes(epoch string, since uint64, limit int, wait time.Duration) (changes []*TChange, ok bool) {
+	l.mu.Lock()
+	if since == l.seq && epoch == l.epoch {
+		notify := l.notify
+		l.mu.Unlock()
+		select {
+		case <-notify:
+		case <-time.After(wait):
+		}
+		l.mu.Lock()
+	}
+	defer l.mu.Unlock()
+	first := l.seq - uint64(len(l.changes)) // the seq before the first kept change
+	if epoch != l.epoch || since < first || since > l.seq {
+		return nil, false
+	}
+	changes = l.changes[since-first:]
+	if len(changes) > limit {
+		changes = changes[:limit]
+	}
+	return changes, true
+}
+
+func (l *TChangeLogStorage) Enqueue(task *TTask) error {
+	defer l.lockTask(task.Id)()
+	err := l.IStorage.Enqueue(task)
+	if err == nil {
+		l.recordPut(task)
+	}
+	return err
+}
+
+// claims are recorded as puts, followers keep the revision
+func (l *TChangeLogStorage) Claim(lease int64) (*TTask, error) {
+	if lease > 0 {
+		defer l.lockAll()()
+	}
+	task, err := l.IStorage.Claim(lease)
+	if err == nil && lease > 0 {
+		l.recordPut(task)
+	}
+	return task, err
+}
+
+func (l *TChangeLogStorage) UpdateTask(taskId string, fn func(task *TTask) error) (*TTask, error) {
+	defer l.lockTask(taskId)()
+	task, err := l.IStorage.UpdateTask(taskId, fn)
+	if err == nil {
+		l.recordPut(task)
+	}
+	return task, err
+}
+
+func (l *TChangeLogStorage) PurgeTasks(status string, before int64) ([]string, error) {
+	defer l.lockAll()()
+	taskIds, err := l.IStorage.PurgeTasks(status, before)
+	for _, taskId := range taskIds {
+		l.record(&TChange{Op: "delete", Id: taskId})
+	}
+	return taskIds, err
+}
+
+func (l *TChangeLogStorage) PutTask(task *TTask) error {
+	defer l.lockTask(task.Id)()
+	err := l.IStorage.PutTask(task)
+	if err == nil {
+		l.recordPut(task)
+	}
+	return err
+}
+
+func (l *TChangeLogStorage) DeleteTask(taskId string) error {
+	defer l.lockTask(taskId)()
+	err := l.IStorage.DeleteTask(taskId)
+	if err == nil {
+		l.record(&TChange{Op: "delete", Id: taskId})
+	}
+	return err
+}
+
+// taskFiles lists files of the Task in the store, a failed listing is an error, not "no files"
+func taskFiles(blobs IBlobStore, task *TTask) ([]TChangeFile, error) {
+	files := []TChangeFile{}
+	prefix := taskBlobPrefix(task)
+	list, err := blobs.List(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("Can't list files of %s: %w", task.Id, err)
+	}
+	for _, b := range list {
+		name := strings.TrimPrefix(b.Key, prefix)
+		if !strings.Contains(name, "/") {
+			files = append(files, TChangeFile{name, b.Size, b.SHA256})
+		}
+	}
+	return files, nil
+}
+
+// changeLogFiles records the changed files of the Task if the storage keeps the change log
+func changeLogFiles(db IStorage, task *TTask) {
+	if l := changeLogStorage(db); l != nil {
+		l.RecordFiles(task)
+	}
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	bolt "github.com/etcd-io/bbolt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// runCommand runs the maintenance subcommand instead of the server, returns exit code
+func runCommand(args []string) int {
+	switch args[0] {
+	case "migrate":
+		return migrateCommand(args[1:])
+	case "convert":
+		return convertCommand(args[1:])
+	case "backup":
+		return backupCommand(args[1:])
+	case "restore":
+		return restoreCommand(args[1:])
+	case "promote":
+		return promoteCommand(args[1:])
+	case "export":
+		return exportCommand(args[1:])
+	case "import":
+		return importCommand(args[1:])
+	case "keygen":
+		return keygenCommand(args[1:])
+	case "rotate-keys":
+		return rotateKeysCommand(args[1:])
+	case "encrypt-files":
+		return encryptFilesCommand(args[1:])
+	case "layout":
+		return layoutCommand(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command: %s\n", args[0])
+	fmt.Fprintf(os.Stderr, "Commands: migrate, convert, backup, restore, promote, export, import, keygen, rotate-keys, encrypt-files, layout\n")
+	return 2
+}
+
+// migrateCommand applies or shows pending database and files migrations
+func migrateCommand(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Show pending migrations only")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	err := migrateDatabase(*dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	converted, err := casMigrate(fileBlobs(), *dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	if *dryRun {
+		fmt.Printf("Task files to convert to content addressed: %d\n", converted)
+	} else {
+		fmt.Printf("Task files converted to content addressed: %d\n", converted)
+	}
+	frame, err := compressFrame(fileBlobs(), taskBlobs().(*TCompressBlobStore), *dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	if *dryRun {
+		fmt.Printf("Task files to give headers: %d, corrupt: %d, not encrypted: %d, unreadable: %d\n", frame.Framed, frame.Corrupt, frame.Plain, frame.Failed)
+	} else {
+		fmt.Printf("Task files given headers: %d, corrupt: %d, not encrypted: %d, failed: %d\n", frame.Framed, frame.Corrupt, frame.Plain, frame.Failed)
+	}
+	if frame.Corrupt > 0 || frame.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// migrateDatabase applies or shows pending migrations of the database by the storage engine,
+// the dry run opens it read-only
+func migrateDatabase(dryRun bool) error {
+	switch Conf.StorageEngine {
+	case "bolt":
+		return migrateBolt(dryRun)
+	case "sqlite":
+		return migrateSqlite(dryRun)
+	case "memory":
+		fmt.Printf("No database to migrate\n")
+		return nil
+	}
+	return fmt.Errorf("Unknown storage engine: %s", Conf.StorageEngine)
+}
+
+func migrateBolt(dryRun bool) error {
+	// bolt creates the missing file even read-only
+	if _, err := os.Stat(Conf.DataBaseFile); dryRun && err != nil {
+		return fmt.Errorf("Can't open database %s: %s", Conf.DataBaseFile, err)
+	}
+	db, err := bolt.Open(Conf.DataBaseFile, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: dryRun})
+	if err != nil {
+		return fmt.Errorf("Can't open database %s: %s", Conf.DataBaseFile, err)
+	}
+	defer db.Close()
+	version, _, err := boltPendingMigrations(db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Schema version: %d, latest: %d\n", version, boltMigrations[len(boltMigrations)-1].Version)
+	pending, err := boltMigrate(db, Conf.DataBaseFile, Conf.MigrateBackup, dryRun)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Printf("No pending migrations\n")
+	}
+	for _, m := range pending {
+		if dryRun {
+			fmt.Printf("Pending: %d %s\n", m.Version, m.Name)
+		} else {
+			fmt.Printf("Applied: %d %s\n", m.Version, m.Name)
+		}
+	}
+	return nil
+}
+
+// migrateSqlite creates missing tables of the latest schema, they are created all at once
+func migrateSqlite(dryRun bool) error {
+	version, err := sqliteSchemaVersion(Conf.DataBaseFile)
+	if err != nil {
+		return fmt.Errorf("Can't open database %s: %s", Conf.DataBaseFile, err)
+	}
+	fmt.Printf("Schema version: %d, latest: %d\n", version, SQLITE_SCHEMA_VERSION)
+	if version > SQLITE_SCHEMA_VERSION {
+		return fmt.Errorf("Database schema version %d is newer than supported %d", version, SQLITE_SCHEMA_VERSION)
+	}
+	if version == SQLITE_SCHEMA_VERSION {
+		fmt.Printf("No pending migrations\n")
+		return nil
+	}
+	if dryRun {
+		fmt.Printf("Pending: %d schema\n", SQLITE_SCHEMA_VERSION)
+		return nil
+	}
+	db, err := SqliteNewStorage(Conf.DataBaseFile)
+	if err != nil {
+		return err
+	}
+	db.Close()
+	fmt.Printf("Applied: %d schema\n", SQLITE_SCHEMA_VERSION)
+	return nil
+}
+
+// convertCommand copies the bolt database to a new SQLite database
+func convertCommand(args []string) int {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	to := fs.String("to", "", "SQLite database file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *to == "" {
+		fmt.Fprintf(os.Stderr, "Destination is required: -to <file>\n")
+		return 2
+	}
+	if _, err := os.Stat(*to); err == nil {
+		fmt.Fprintf(os.Stderr, "Destination exists: %s\n", *to)
+		return 1
+	}
+	tasks, queue, err := boltToSqlite(Conf.DataBaseFile, *to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	fmt.Printf("Converted: %d tasks, %d queued\n", tasks, queue)
+	return 0
+}
+
+// boltToSqlite copies Tasks and the queue, the bolt database is not changed,
+// its pending migrations are applied to a temporary copy
+func boltToSqlite(boltfilename, sqlitefilename string) (int, int, error) {
+	src, err := BoltOpenSource(boltfilename)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Can't open database %s: %s", boltfilename, err)
+	}
+	defer src.Close()
+	tasks, queue, err := src.exportTasks()
+	if err != nil {
+		return 0, 0, err
+	}
+	dst, err := SqliteNewStorage(sqlitefilename)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Can't open database %s: %s", sqlitefilename, err)
+	}
+	defer dst.Close()
+	err = dst.importTasks(tasks, queue)
+	if err != nil {
+		return 0, 0, err
+	}
+	layout, err := src.GetMeta(META_LAYOUT)
+	if err == nil && layout != "" {
+		err = dst.SetMeta(META_LAYOUT, layout)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(tasks), len(queue), nil
+}
+
+// backupCommand writes the snapshot of the stopped service database
+// or downloads it from the running service
+func backupCommand(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	out := fs.String("o", "", "Backup file")
+	withFiles := fs.Bool("files", false, "Tar with task files")
+	url := fs.String("url", "", "API URL of the running service, e.g. http://localhost:14000/api-01")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *out == "" {
+		fmt.Fprintf(os.Stderr, "Destination is required: -o <file>\n")
+		return 2
+	}
+	tmpName := *out + ".tmp"
+	defer os.Remove(tmpName)
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	if *url != "" {
+		err = backupDownload(f, *url, *withFiles)
+	} else {
+		var db *bolt.DB
+		db, err = bolt.Open(Conf.DataBaseFile, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+		if err != nil {
+			err = fmt.Errorf("Can't open database %s (use -url for the running service): %s", Conf.DataBaseFile, err)
+		} else {
+			err = backupWrite(f, &TBoltStorage{db: db}, *withFiles)
+			db.Close()
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, *out)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	fmt.Printf("Backup written: %s\n", *out)
+	return 0
+}
+
+// backupDownload streams the backup from the service API
+func backupDownload(w io.Writer, url string, withFiles bool) error {
+	url += "/backup"
+	if withFiles {
+		url += "?files=1"
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+Conf.AuthToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Backup request failed: %s", resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// restoreCommand validates the backup and puts it in place of the database file
+func restoreCommand(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	in := fs.String("i", "", "Backup file, database or tar with task files")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *in == "" {
+		fmt.Fprintf(os.Stderr, "Source is required: -i <file>\n")
+		return 2
+	}
+	f, err := os.Open(*in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	defer f.Close()
+	tasks, files, err := backupRestore(f, Conf.DataBaseFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Restore failed: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Restored: %d tasks, %d files\n", tasks, files)
+	return 0
+}
+
+// promoteCommand makes the running follower the primary
+func promoteCommand(args []string) int {
+	fs := flag.NewFlagSet("promote", flag.ContinueOnError)
+	url := fs.String("url", "", "API URL of the follower, e.g. http://localhost:14000/api-01")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *url == "" {
+		fmt.Fprintf(os.Stderr, "Follower is required: -url <api url>\n")
+		return 2
+	}
+	req, err := http.NewRequest("POST", *url+"/replication/promote", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+Conf.AuthToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	status := &TReplicationStatus{}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(status) != nil {
+		fmt.Fprintf(os.Stderr, "Promote request failed: %s\n", resp.Status)
+		return 1
+	}
+	fmt.Printf("Role: %s, position: %s:%d\n", status.Role, status.Epoch, status.Seq)
+	return 0
+}
+
+// exportCommand writes tasks with their files to the portable archive
+func exportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := fs.String("o", "", "Export file (tar.gz)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *out == "" {
+		fmt.Fprintf(os.Stderr, "Destination is required: -o <file>\n")
+		return 2
+	}
+	db, err := OpenSourceStorage(Conf.StorageEngine, Conf.DataBaseFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't open database %s (stop the service first): %s\n", Conf.DataBaseFile, err)
+		return 1
+	}
+	defer db.Close()
+	tmpName := *out + ".tmp"
+	defer os.Remove(tmpName)
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	tasks, files, err := exportWrite(f, db)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, *out)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Export failed: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Exported: %d tasks, %d files\n", tasks, files)
+	return 0
+}
+
+// importCommand recreates tasks from the archive in the configured storage,
+// exits with 1 if some tasks were not imported
+func importCommand(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	in := fs.String("i", "", "Export file (tar.gz)")
+	overwrite := fs.Bool("overwrite", false, "Replace existing tasks with the same id")
+	dryRun := fs.Bool("dry-run", false, "Show conflicts only")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *in == "" {
+		fmt.Fprintf(os.Stderr, "Source is required: -i <file>\n")
+		return 2
+	}
+	f, err := os.Open(*in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	defer f.Close()
+	// the dry run only reads the database
+	open := func() (IStorage, error) {
+		return OpenStorage(Conf.StorageEngine, Conf.DataBaseFile, Conf.MigrateBackup)
+	}
+	if *dryRun {
+		open = func() (IStorage, error) {
+			return OpenSourceStorage(Conf.StorageEngine, Conf.DataBaseFile)
+		}
+	}
+	db, err := open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't open database %s (stop the service first): %s\n", Conf.DataBaseFile, err)
+		return 1
+	}
+	defer db.Close()
+	report, err := importRead(f, db, *overwrite, *dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Import failed: %s\n", err)
+		return 1
+	}
+	for _, taskId := range report.Conflicts {
+		fmt.Printf("Conflict: %s exists\n", taskId)
+	}
+	for _, e := range report.Errors {
+		fmt.Printf("Error: %s\n", e)
+	}
+	if *dryRun {
+		fmt.Printf("Would import: %d tasks, %d conflicts\n", len(report.Tasks), len(report.Conflicts))
+		return 0
+	}
+	fmt.Printf("Imported: %d tasks, %d files, %d conflicts, %d errors\n",
+		len(report.Tasks), report.Files, len(report.Conflicts), len(report.Errors))
+	if len(report.Errors) > 0 || len(report.Conflicts) > 0 && !*overwrite {
+		return 1
+	}
+	return 0
+}
+
+// keygenCommand prints a new master key line to append to the key file
+func keygenCommand(args []string) int {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	line, err := masterKeyLine()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	fmt.Println(line)
+	return 0
+}
+
+// rotateKeysCommand wraps data keys with the last master key of the key file,
+// it may run with the service running, the service reads the changed key file
+func rotateKeysCommand(args []string) int {
+	fs := flag.NewFlagSet("rotate-keys", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Count data keys to rotate only")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if masterKeys == nil {
+		fmt.Fprintf(os.Stderr, "Master key file is required: -E <file>\n")
+		return 2
+	}
+	rotated, total, err := cryptRotate(fileBlobs(), masterKeys, *dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Rotation failed after %d of %d data keys: %s\n", rotated, total, err)
+		return 1
+	}
+	if *dryRun {
+		fmt.Printf("Would rotate: %d of %d data keys\n", rotated, total)
+		return 0
+	}
+	fmt.Printf("Rotated: %d of %d data keys\n", rotated, total)
+	return 0
+}
+
+// encryptFilesCommand encrypts files stored before encryption was turned on, up to -limit
+// tasks and quarantine entries per run, the service must be stopped, they can't be read until then
+func encryptFilesCommand(args []string) int {
+	fs := flag.NewFlagSet("encrypt-files", flag.ContinueOnError)
+	limit := fs.Int("limit", 1000, "Most tasks and quarantine entries to encrypt in this run")
+	dryRun := fs.Bool("dry-run", false, "Count plaintext files only")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if masterKeys == nil {
+		fmt.Fprintf(os.Stderr, "Master key file is required: -E <file>\n")
+		return 2
+	}
+	stores := map[string]*TCryptBlobStore{"tasks": CryptNewBlobStore(CASNewBlobStore(fileBlobs()), fileBlobs(), masterKeys, "tasks/")}
+	if Conf.QuarantineDir != "" {
+		stores["quarantine"] = quarantineBlobs().(*TCryptBlobStore)
+	}
+	code := 0
+	for _, ns := range []string{"tasks", "quarantine"} {
+		s, ok := stores[ns]
+		if !ok {
+			continue
+		}
+		owners, blobs, left, err := cryptEncryptPlain(s, *limit, *dryRun)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Encryption of %s failed after %d files: %s\n", ns, blobs, err)
+			code = 1
+			continue
+		}
+		if *dryRun {
+			fmt.Printf("Would encrypt %s: %d, files: %d, left: %d\n", ns, owners, blobs, left)
+			continue
+		}
+		fmt.Printf("Encrypted %s: %d, files: %d, left: %d\n", ns, owners, blobs, left)
+		if ns != "tasks" || blobs == 0 {
+			continue
+		}
+		// files stored before headers were added get them once they are encrypted
+		frame, err := compressFrameAll(CompressNewBlobStore(s, Conf.Compression), false, false)
+		if err == nil && frame.Failed > 0 {
+			err = fmt.Errorf("%d files are unreadable", frame.Failed)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Headers of encrypted task files failed: %s\n", err)
+			code = 1
+			continue
+		}
+		if frame.Framed > 0 {
+			fmt.Printf("Encrypted task files given headers: %d\n", frame.Framed)
+		}
+	}
+	return code
+}
+
+// layoutCommand changes the layout of new Tasks and moves files of existing ones,
+// in the running service with -url or in the stopped one, a stopped run continues with the next one
+func layoutCommand(args []string) int {
+	fs := flag.NewFlagSet("layout", flag.ContinueOnError)
+	to := fs.String("to", "", "Layout: id, hash, date (empty - the current one)")
+	dryRun := fs.Bool("dry-run", false, "Show tasks to move only")
+	url := fs.String("url", "", "API URL of the running service, e.g. http://localhost:14000/api-01")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *url != "" {
+		return layoutRequest(*url, *to, *dryRun)
+	}
+	// the dry run only reads the database
+	open := func() (IStorage, error) {
+		return OpenStorage(Conf.StorageEngine, Conf.DataBaseFile, Conf.MigrateBackup)
+	}
+	if *dryRun {
+		open = func() (IStorage, error) {
+			return OpenSourceStorage(Conf.StorageEngine, Conf.DataBaseFile)
+		}
+	}
+	db, err := open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't open database %s (use -url for the running service): %s\n", Conf.DataBaseFile, err)
+		return 1
+	}
+	defer db.Close()
+	layout := *to
+	if layout == "" {
+		layout, err = currentLayout(db)
+	} else if _, ok := taskLayouts[layout]; !ok {
+		err = fmt.Errorf("Unknown layout: %s (id, hash, date)", layout)
+	} else if !*dryRun {
+		err = setCurrentLayout(db, layout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	report := layoutMigrate(db, layout, *dryRun)
+	for _, e := range report.Errors {
+		fmt.Fprintf(os.Stderr, "%s\n", e)
+	}
+	if *dryRun {
+		fmt.Printf("To move to %s: %d tasks, %d files\n", layout, report.Tasks, report.Files)
+	} else {
+		fmt.Printf("Moved to %s: %d tasks, %d files\n", layout, report.Tasks, report.Files)
+	}
+	if len(report.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// layoutRequest changes the layout of the running service or shows the migration status
+func layoutRequest(url, to string, dryRun bool) int {
+	method := "GET"
+	var body io.Reader
+	if to != "" && !dryRun {
+		method = "POST"
+		b, _ := json.Marshal(&TLayoutRequest{Layout: to})
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url+"/layout", body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+Conf.AuthToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	status := &TLayoutStatus{}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(status) != nil {
+		fmt.Fprintf(os.Stderr, "Layout request failed: %s\n", resp.Status)
+		return 1
+	}
+	fmt.Printf("Layout: %s, running: %v\n", status.Layout, status.Running)
+	names := make([]string, 0, len(status.Tasks))
+	for name := range status.Tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("Tasks in %s: %d\n", name, status.Tasks[name])
+	}
+	if status.Last != nil {
+		fmt.Printf("Last run: %d tasks, %d files moved to %s, %d errors\n",
+			status.Last.Tasks, status.Last.Files, status.Last.Layout, len(status.Last.Errors))
+	}
+	return 0
+}
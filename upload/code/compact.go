@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	bolt "github.com/etcd-io/bbolt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// COMPACT_MIN_FREE is the least free space worth the scheduled compaction
+const COMPACT_MIN_FREE = 1024 * 1024
+
+// COMPACT_TX_SIZE limits the size of a copy transaction
+const COMPACT_TX_SIZE = 64 * 1024 * 1024
+
+// TCompactReport is the result of the database compaction
+type TCompactReport struct {
+	Started    int64  `json:"started"`
+	Finished   int64  `json:"finished"`
+	SizeBefore int64  `json:"size_before"`
+	SizeAfter  int64  `json:"size_after"`
+	Synced     int    `json:"synced"`   // tasks written during the copy
+	PauseUs    int64  `json:"pause_us"` // how long writes waited
+	Error      string `json:"error,omitempty"`
+}
+
+type TCompactStatus struct {
+	Size      int64           `json:"size"`
+	Free      int64           `json:"free"`
+	FreeRatio float64         `json:"free_ratio"`
+	Last      *TCompactReport `json:"last,omitempty"`
+}
+
+var (
+	compactMutex      sync.Mutex
+	compactLastReport *TCompactReport
+)
+
+// Save TCompactStatus object to io.Writer as JSON
+func (c *TCompactStatus) toJWriter(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "    ")
+	return e.Encode(c)
+}
+
+// compactStorage returns the layer of the storage able to compact or nil
+func compactStorage(db IStorage) ICompactStorage {
+	s := findStorage(db, func(s IStorage) bool {
+		_, ok := s.(ICompactStorage)
+		return ok
+	})
+	if s == nil {
+		return nil
+	}
+	return s.(ICompactStorage)
+}
+
+// file size and bytes in free pages
+func (s *TBoltStorage) Usage() (size int64, free int64, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	// stats are updated when a transaction ends
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	info, err := os.Stat(s.db.Path())
+	if err != nil {
+		return
+	}
+	return info.Size(), int64(s.db.Stats().FreeAlloc), nil
+}
+
+// Compact copies live data into a fresh file and swaps it in,
+// reads go on during the copy, writes wait only for tasks written meanwhile to be copied
+func (s *TBoltStorage) Compact() (*TCompactReport, error) {
+	report := &TCompactReport{Started: time.Now().Unix()}
+	s.mu.RLock()
+	path := s.db.Path()
+	s.mu.RUnlock()
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	report.SizeBefore = info.Size()
+	tmpName := path + ".compact"
+	os.Remove(tmpName)
+	defer os.Remove(tmpName)
+	dst, err := bolt.Open(tmpName, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer dst.Close()
+	// track writes from the copy snapshot on, no write is in flight
+	s.wmu.Lock()
+	s.dmu.Lock()
+	s.dirty = make(map[string]bool)
+	s.dmu.Unlock()
+	s.wmu.Unlock()
+	defer func() {
+		s.dmu.Lock()
+		s.dirty = nil
+		s.dmu.Unlock()
+	}()
+	s.mu.RLock()
+	err = bolt.Compact(dst, s.db, COMPACT_TX_SIZE)
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("Copy failed: %s", err)
+	}
+	// pause writes, copy tasks written meanwhile and swap files
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	paused := time.Now()
+	s.dmu.Lock()
+	dirty := s.dirty
+	s.dirty = nil
+	s.dmu.Unlock()
+	s.mu.RLock()
+	err = s.db.View(func(src *bolt.Tx) error {
+		return dst.Update(func(tx *bolt.Tx) error {
+			for taskId := range dirty {
+				err := boltSyncTask(src, tx, taskId)
+				if err != nil {
+					return err
+				}
+			}
+			err := boltSyncMeta(src, tx)
+			if err != nil {
+				return err
+			}
+			return tx.Bucket([]byte("QUEUE")).SetSequence(src.Bucket([]byte("QUEUE")).Sequence())
+		})
+	})
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("Sync failed: %s", err)
+	}
+	report.Synced = len(dirty)
+	err = dst.Close()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.db.Close()
+	rerr := os.Rename(tmpName, path)
+	// the old file is opened again if the rename failed
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Can't open database after compaction: %s", err)
+	}
+	db.MaxBatchDelay = BOLT_BATCH_DELAY
+	s.db = db
+	if rerr != nil {
+		return nil, rerr
+	}
+	report.PauseUs = time.Since(paused).Microseconds()
+	if info, err := os.Stat(path); err == nil {
+		report.SizeAfter = info.Size()
+	}
+	report.Finished = time.Now().Unix()
+	return report, nil
+}
+
+// boltSyncMeta copies settings changed during the copy
+func boltSyncMeta(src, dst *bolt.Tx) error {
+	b := src.Bucket([]byte("META"))
+	if b == nil {
+		return nil
+	}
+	meta, err := dst.CreateBucketIfNotExists([]byte("META"))
+	if err != nil {
+		return err
+	}
+	return b.ForEach(func(k, v []byte) error {
+		return meta.Put(k, v)
+	})
+}
+
+// boltSyncTask replaces the Task with its queue and index entries in dst by the one from src
+func boltSyncTask(src, dst *bolt.Tx, taskId string) error {
+	if old, err := boltGetTask(dst, []byte(taskId)); err == nil {
+		err = boltIndexDelete(dst, old)
+		if err != nil {
+			return err
+		}
+		err = boltQueueRemove(dst, taskId)
+		if err != nil {
+			return err
+		}
+		err = dst.Bucket([]byte("TASKS")).Delete([]byte(taskId))
+		if err != nil {
+			return err
+		}
+	}
+	task, err := boltGetTask(src, []byte(taskId))
+	if err != nil {
+		// purged meanwhile
+		return nil
+	}
+	err = boltPutTask(dst, task)
+	if err != nil {
+		return err
+	}
+	err = boltIndexAdd(dst, task)
+	if err != nil {
+		return err
+	}
+	seq := src.Bucket([]byte("TQREL")).Get([]byte(taskId))
+	if seq == nil {
+		return nil
+	}
+	err = dst.Bucket([]byte("QUEUE")).Put(seq, []byte(taskId))
+	if err != nil {
+		return err
+	}
+	return dst.Bucket([]byte("TQREL")).Put([]byte(taskId), seq)
+}
+
+// compactRun compacts the database once and keeps the report
+func compactRun(c ICompactStorage) *TCompactReport {
+	compactMutex.Lock()
+	defer compactMutex.Unlock()
+	report, err := c.Compact()
+	if err != nil {
+		report = &TCompactReport{Started: time.Now().Unix(), Finished: time.Now().Unix(), Error: err.Error()}
+		Error.Printf("Compaction failed: %s\n", err)
+	} else {
+		Info.Printf("Compaction: %d -> %d bytes, %d tasks synced, writes paused %d us\n",
+			report.SizeBefore, report.SizeAfter, report.Synced, report.PauseUs)
+	}
+	compactLastReport = report
+	return report
+}
+
+// compactLoop checks free space every interval seconds and compacts above the threshold
+func compactLoop(db IStorage, threshold float64, interval int64) {
+	c := compactStorage(db)
+	if c == nil {
+		Warning.Printf("Storage engine can't compact, scheduled compaction is disabled\n")
+		return
+	}
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+		size, free, err := c.Usage()
+		if err != nil {
+			Error.Printf("Compaction check failed: %s\n", err)
+			continue
+		}
+		if free >= COMPACT_MIN_FREE && float64(free) >= threshold*float64(size) {
+			compactRun(c)
+		}
+	}
+}
+
+// show the database usage (GET) or compact it now (POST)
+func compactHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
+	c := compactStorage(db)
+	if c == nil {
+		sendJSONErrorMessage(w, E_NOT_IMPLEMENTED, http.StatusNotImplemented)
+		Warning.Printf("[%s]: Storage engine can't compact\n", r.RemoteAddr)
+		return
+	}
+	if r.Method == "POST" {
+		compactRun(c)
+	}
+	status := &TCompactStatus{}
+	size, free, err := c.Usage()
+	if err != nil {
+		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+		Error.Printf("[%s]: Database error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	status.Size, status.Free = size, free
+	if size > 0 {
+		status.FreeRatio = float64(free) / float64(size)
+	}
+	compactMutex.Lock()
+	status.Last = compactLastReport
+	compactMutex.Unlock()
+	// start a normal output
+	HelperSetStandartHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	err = status.toJWriter(w)
+	if err != nil {
+		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// write a success message to the log
+	Info.Printf("[%s]: Compaction status printed (%s)\n", r.RemoteAddr, r.Method)
+}
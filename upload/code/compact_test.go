@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	bolt "github.com/etcd-io/bbolt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_Compact(t *testing.T) {
+	fmt.Println("Test_Compact")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	s, err := BoltNewStorage(dir + "/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	now := time.Now().Unix()
+	s.noBatch = true
+	for i := 0; i < 5000; i++ {
+		status := "verified"
+		if i%100 == 0 {
+			status = "received"
+		}
+		err = s.Enqueue(&TTask{Id: NewId(TASK_ID_LEN), Status: status, IssuedAt: now - 100, HoldHistory: []TTaskHoldRecord{{Reason: NewId(200)}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.PurgeTasks("verified", now)
+	size, free, err := s.Usage()
+	if err != nil || free == 0 {
+		t.Fatalf("Free pages expected: %d %d %v", size, free, err)
+	}
+	first, _ := s.Claim(0)
+	s.noBatch = false
+	// writes go on during the compaction
+	var written []*TTask
+	var wmu sync.Mutex
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				task := &TTask{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: now}
+				if err := s.Enqueue(task); err != nil {
+					t.Errorf("Unexpected error: %s", err)
+					return
+				}
+				task, err := s.UpdateTask(task.Id, func(task *TTask) error {
+					task.Status = "verified"
+					return nil
+				})
+				if err != nil {
+					t.Errorf("Unexpected error: %s", err)
+					return
+				}
+				wmu.Lock()
+				written = append(written, task)
+				wmu.Unlock()
+			}
+		}()
+	}
+	token := NewId(16)
+	r := setRouting(token, wrapStorage(s, 16, nil))
+	resp := MakeTestRequest(r, "POST", "/api-01/compact", token, new(bytes.Buffer))
+	close(stop)
+	wg.Wait()
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	compactMutex.Lock()
+	report := compactLastReport
+	compactMutex.Unlock()
+	if report == nil || report.Error != "" || report.SizeAfter >= report.SizeBefore {
+		t.Fatalf("Smaller database expected: %v", report)
+	}
+	for _, task := range written {
+		stored, err := s.GetTask(task.Id)
+		if err != nil || stored.Rev != 2 || stored.Status != "verified" {
+			t.Errorf("Task %s revision 2 expected, but was: %v %v", task.Id, stored, err)
+		}
+	}
+	list, _ := s.ListTasks("verified", now+1)
+	if len(list) != len(written) {
+		t.Errorf("%d verified tasks expected, but was: %d", len(written), len(list))
+	}
+	list, _ = s.ListTasks("received", now+1)
+	if len(list) != 50 {
+		t.Errorf("50 received tasks expected, but was: %d", len(list))
+	}
+	task, err := s.Claim(0)
+	if err != nil || task.Id != first.Id {
+		t.Errorf("Task %s expected in queue, but was: %v %v", first.Id, task, err)
+	}
+	// the queue goes on after the copied sequence
+	task = &TTask{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: now}
+	if err := s.Enqueue(task); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, err := s.PurgeTasks("received", now-1); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	claimed, err := s.Claim(0)
+	if err != nil || claimed.Id != task.Id {
+		t.Errorf("Task %s expected in queue, but was: %v %v", task.Id, claimed, err)
+	}
+	resp = MakeTestRequest(r, "GET", "/api-01/compact", token, new(bytes.Buffer))
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+}
+
+func Test_CompactSync(t *testing.T) {
+	fmt.Println("Test_CompactSync")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	s, err := BoltNewStorage(dir + "/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	now := time.Now().Unix()
+	tasks := []*TTask{
+		{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: now - 30},
+		{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: now - 20},
+		{Id: NewId(TASK_ID_LEN), Status: "verified", IssuedAt: now - 10},
+	}
+	for _, task := range tasks {
+		s.Enqueue(task)
+	}
+	db, err := bolt.Open(dir+"/test2.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bolt.Compact(db, s.db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// changes after the copy
+	s.UpdateTask(tasks[0].Id, func(task *TTask) error {
+		task.Status = "failed"
+		return nil
+	})
+	s.PurgeTasks("verified", now)
+	added := &TTask{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: now - 5}
+	s.Enqueue(added)
+	err = s.db.View(func(src *bolt.Tx) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			for _, taskId := range []string{tasks[0].Id, tasks[2].Id, added.Id} {
+				err := boltSyncTask(src, tx, taskId)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &TBoltStorage{db: db}
+	defer d.Close()
+	if task, err := d.GetTask(tasks[0].Id); err != nil || task.Status != "failed" || task.Rev != 2 {
+		t.Errorf("Updated task expected, but was: %v %v", task, err)
+	}
+	if list, _ := d.ListTasks("received", now); len(list) != 2 || list[0].Id != tasks[1].Id || list[1].Id != added.Id {
+		t.Errorf("Tasks %s %s expected, but was: %v", tasks[1].Id, added.Id, list)
+	}
+	if list, _ := d.ListTasks("verified", now); len(list) != 0 {
+		t.Errorf("No verified tasks expected, but was: %v", list)
+	}
+	if task, err := d.Claim(0); err != nil || task.Id != tasks[1].Id {
+		t.Errorf("Task %s expected in queue, but was: %v %v", tasks[1].Id, task, err)
+	}
+	d.UpdateTask(tasks[1].Id, func(task *TTask) error {
+		task.Status = "verified"
+		return nil
+	})
+	if task, err := d.Claim(0); err != nil || task.Id != added.Id {
+		t.Errorf("Task %s expected in queue, but was: %v %v", added.Id, task, err)
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"hash"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	COMPRESS_MAGIC         = "UCMP\x01" // the header of every blob
+	COMPRESS_HEADER_SIZE   = 5 + 1 + 8 + sha256.Size
+	COMPRESS_STORED        = 0 // the body is kept as is
+	COMPRESS_GZIP          = 1
+	COMPRESS_ZSTD          = 2
+	COMPRESS_FORMAT_MARKER = ".framed" // written when blobs stored without headers get them
+)
+
+// compressAlgorithms are values of -Z by the header algorithm byte
+var compressAlgorithms = map[string]byte{"gzip": COMPRESS_GZIP, "zstd": COMPRESS_ZSTD}
+
+// TCompressBlobStore compresses blobs on write if the algorithm is set and decompresses on read,
+// every blob has the header of the algorithm, the original size and SHA-256,
+// blobs compressing badly are kept as is with the stored algorithm
+type TCompressBlobStore struct {
+	inner     IBlobStore
+	algorithm string
+}
+
+// TCompressReport is the result of the background compression run
+type TCompressReport struct {
+	StartedAt  int64    `json:"started"`
+	FinishedAt int64    `json:"finished"`
+	Files      int      `json:"files"`       // compressed
+	SizeBefore int64    `json:"size_before"` // of compressed files
+	SizeAfter  int64    `json:"size_after"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// TFrameReport is the result of giving headers to blobs stored without them
+type TFrameReport struct {
+	Framed  int // given headers, to give for the dry run
+	Corrupt int // with headers, but not reading back to their size and digest, kept as is
+	Plain   int // plaintext with encryption on, framed by encrypt-files
+	Failed  int // unreadable, the store is not marked
+}
+
+// ErrBlobNoHeader means the blob starts with no known header, it is stored before headers were added
+var ErrBlobNoHeader = errors.New("No blob header")
+
+// compressLocks serialize writes of the same key, so a background run never puts back a removed file
+var compressLocks [64]sync.Mutex
+
+func CompressNewBlobStore(inner IBlobStore, algorithm string) *TCompressBlobStore {
+	return &TCompressBlobStore{inner: inner, algorithm: algorithm}
+}
+
+// parseCompression checks the -Z value
+func parseCompression(algorithm string) error {
+	if _, ok := compressAlgorithms[algorithm]; !ok && algorithm != "" {
+		return fmt.Errorf("Unknown compression: %s (gzip, zstd)", algorithm)
+	}
+	return nil
+}
+
+func compressLock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &compressLocks[h.Sum32()%uint32(len(compressLocks))]
+}
+
+// compressWriter returns the writer of the algorithm, the output is the same for the same input,
+// so identical documents are still shared by the content addressed store when encryption is off
+// (with -E every Task encrypts its copy with its own key)
+func compressWriter(w io.Writer, algorithm byte) (io.WriteCloser, error) {
+	switch algorithm {
+	case COMPRESS_GZIP:
+		return gzip.NewWriter(w), nil
+	case COMPRESS_ZSTD:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("Unknown compression algorithm: %d", algorithm)
+}
+
+func compressReader(r io.Reader, algorithm byte) (io.Reader, func(), error) {
+	switch algorithm {
+	case COMPRESS_GZIP:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gr, func() { gr.Close() }, nil
+	case COMPRESS_ZSTD:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	}
+	return nil, nil, fmt.Errorf("Unknown compression algorithm: %d", algorithm)
+}
+
+// TCompressHeader is the decoded header of the compressed blob
+type TCompressHeader struct {
+	Algorithm byte
+	Size      int64
+	SHA256    string
+}
+
+// readCompressHeader reads the header of the blob
+func readCompressHeader(br *bufio.Reader) (*TCompressHeader, error) {
+	header, err := br.Peek(COMPRESS_HEADER_SIZE)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if len(header) < COMPRESS_HEADER_SIZE || !bytes.HasPrefix(header, []byte(COMPRESS_MAGIC)) || header[5] > COMPRESS_ZSTD {
+		return nil, ErrBlobNoHeader
+	}
+	h := &TCompressHeader{
+		Algorithm: header[5],
+		Size:      int64(binary.BigEndian.Uint64(header[6:14])),
+		SHA256:    hex.EncodeToString(header[14:]),
+	}
+	_, err = br.Discard(COMPRESS_HEADER_SIZE)
+	return h, err
+}
+
+// spool copies the blob to the temporary file, returns its size and digest
+func spool(r io.Reader, prefix string) (*os.File, int64, []byte, error) {
+	f, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	os.Remove(f.Name())
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, 0, nil, err
+	}
+	return f, n, h.Sum(nil), nil
+}
+
+// compressHeader returns the header of the blob
+func compressHeader(algorithm byte, size int64, digest []byte) []byte {
+	header := make([]byte, COMPRESS_HEADER_SIZE)
+	copy(header, COMPRESS_MAGIC)
+	header[5] = algorithm
+	binary.BigEndian.PutUint64(header[6:14], uint64(size))
+	copy(header[14:], digest)
+	return header
+}
+
+// compressed returns the header and the compressed original or nil if it does not get smaller
+func compressed(original *os.File, size int64, digest []byte, algorithm byte) (io.ReadCloser, error) {
+	f, err := ioutil.TempFile("", "compress-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	_, err = f.Write(compressHeader(algorithm, size, digest))
+	var cw io.WriteCloser
+	if err == nil {
+		cw, err = compressWriter(f, algorithm)
+	}
+	if err == nil {
+		_, err = io.Copy(cw, original)
+		if cerr := cw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	var csize int64
+	if err == nil {
+		csize, err = f.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil || csize >= size {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Put compresses the blob if it gets smaller
+func (s *TCompressBlobStore) Put(key string, r io.Reader) (int64, error) {
+	original, size, digest, err := spool(r, "original-")
+	if err != nil {
+		return 0, err
+	}
+	defer original.Close()
+	return size, s.put(key, original, size, digest)
+}
+
+// put writes the spooled original compressed or as is
+func (s *TCompressBlobStore) put(key string, original *os.File, size int64, digest []byte) error {
+	var body io.Reader = io.MultiReader(bytes.NewReader(compressHeader(COMPRESS_STORED, size, digest)), original)
+	var cf io.ReadCloser
+	var err error
+	if algorithm, ok := compressAlgorithms[s.algorithm]; ok {
+		cf, err = compressed(original, size, digest, algorithm)
+		if err != nil {
+			return err
+		}
+	}
+	if cf != nil {
+		defer cf.Close()
+		body = cf
+	} else {
+		_, err = original.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+	lock := compressLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	_, err = s.inner.Put(key, body)
+	return err
+}
+
+// Get decompresses the blob and checks the digest at the end
+func (s *TCompressBlobStore) Get(key string) (io.ReadCloser, error) {
+	f, err := s.inner.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	h, err := readCompressHeader(br)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Invalid blob %s: %s", key, err)
+	}
+	var dr io.Reader = br
+	closeFn := func() {}
+	if h.Algorithm != COMPRESS_STORED {
+		dr, closeFn, err = compressReader(br, h.Algorithm)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return &TDigestReader{r: dr, h: sha256.New(), header: h, key: key, close: func() error {
+		closeFn()
+		return f.Close()
+	}}, nil
+}
+
+// header reads the header of the stored blob
+func (s *TCompressBlobStore) header(key string) (*TCompressHeader, error) {
+	f, err := s.inner.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h, err := readCompressHeader(bufio.NewReaderSize(f, COMPRESS_HEADER_SIZE))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid blob %s: %w", key, err)
+	}
+	return h, nil
+}
+
+// originalInfo shows the original size and digest of blobs
+func (s *TCompressBlobStore) originalInfo(info TBlobInfo) (TBlobInfo, error) {
+	h, err := s.header(info.Key)
+	if err != nil {
+		return info, err
+	}
+	info.Size = h.Size
+	info.SHA256 = h.SHA256
+	return info, nil
+}
+
+func (s *TCompressBlobStore) Stat(key string) (*TBlobInfo, error) {
+	info, err := s.inner.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	original, err := s.originalInfo(*info)
+	if err != nil {
+		return nil, err
+	}
+	return &original, nil
+}
+
+func (s *TCompressBlobStore) List(prefix string) ([]TBlobInfo, error) {
+	list, err := s.inner.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	blobs := []TBlobInfo{}
+	for _, b := range list {
+		original, err := s.originalInfo(b)
+		if errors.Is(err, ErrBlobNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, original)
+	}
+	return blobs, nil
+}
+
+func (s *TCompressBlobStore) Delete(key string) error {
+	lock := compressLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	return s.inner.Delete(key)
+}
+
+// Compress rewrites the blob kept as is compressed, returns the stored sizes before and after,
+// after is 0 if the blob is already compressed, was removed or compresses badly
+func (s *TCompressBlobStore) Compress(key string) (before int64, after int64, err error) {
+	algorithm, ok := compressAlgorithms[s.algorithm]
+	if !ok {
+		return 0, 0, fmt.Errorf("Compression is off")
+	}
+	lock := compressLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	info, err := s.inner.Stat(key)
+	if errors.Is(err, ErrBlobNotFound) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	f, err := s.inner.Get(key)
+	if err != nil {
+		return 0, 0, err
+	}
+	br := bufio.NewReader(f)
+	h, err := readCompressHeader(br)
+	if err != nil || h.Algorithm != COMPRESS_STORED {
+		f.Close()
+		return info.Size, 0, err
+	}
+	original, size, digest, err := spool(br, "original-")
+	f.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+	if size != h.Size || hex.EncodeToString(digest) != h.SHA256 {
+		return 0, 0, fmt.Errorf("Blob %s is damaged: size or digest mismatch", key)
+	}
+	defer original.Close()
+	cf, err := compressed(original, size, digest, algorithm)
+	if err != nil || cf == nil {
+		return info.Size, 0, err
+	}
+	defer cf.Close()
+	after, err = s.inner.Put(key, cf)
+	if err != nil {
+		return 0, 0, err
+	}
+	return info.Size, after, nil
+}
+
+// TDigestReader checks the original digest at the end of the decompressed blob
+type TDigestReader struct {
+	r      io.Reader
+	h      hash.Hash
+	n      int64
+	header *TCompressHeader
+	key    string
+	close  func() error
+}
+
+func (d *TDigestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.h.Write(p[:n])
+	d.n += int64(n)
+	if err == io.EOF && (d.n != d.header.Size || hex.EncodeToString(d.h.Sum(nil)) != d.header.SHA256) {
+		return n, fmt.Errorf("Blob %s is damaged: size or digest mismatch", d.key)
+	}
+	return n, err
+}
+
+func (d *TDigestReader) Close() error {
+	return d.close()
+}
+
+// compressRun compresses files of all Tasks stored as is
+func compressRun(db IStorage) *TCompressReport {
+	report := &TCompressReport{StartedAt: time.Now().Unix()}
+	blobs, ok := taskBlobs().(*TCompressBlobStore)
+	if !ok || blobs.algorithm == "" {
+		report.FinishedAt = time.Now().Unix()
+		return report
+	}
+	for _, status := range taskStatuses {
+		tasks, err := db.ListTasks(status, math.MaxInt64)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		for _, task := range tasks {
+			files, err := taskFiles(blobs.inner, task)
+			if err != nil {
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+			for _, f := range files {
+				before, after, err := blobs.Compress(taskBlobPrefix(task) + f.Name)
+				if err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("Can't compress %s/%s: %s", task.Id, f.Name, err))
+					continue
+				}
+				if after == 0 {
+					continue
+				}
+				report.Files++
+				report.SizeBefore += before
+				report.SizeAfter += after
+			}
+		}
+	}
+	report.FinishedAt = time.Now().Unix()
+	return report
+}
+
+// compressExisting compresses files stored before compression was turned on,
+// new files are compressed on write, so one run after the start is enough
+func compressExisting(db IStorage) {
+	report := compressRun(db)
+	for _, e := range report.Errors {
+		Error.Printf("Compression: %s\n", e)
+	}
+	if report.Files > 0 {
+		Info.Printf("Compression: %d files, %d -> %d bytes\n", report.Files, report.SizeBefore, report.SizeAfter)
+	}
+}
+
+// compressFrame adds the header of the stored algorithm to blobs stored without headers,
+// blobs with headers are checked by their size and digest and only reported if they do not read back,
+// the store is marked when no blob failed to read, so the check runs once
+func compressFrame(marker IBlobStore, s *TCompressBlobStore, dryRun bool) (*TFrameReport, error) {
+	_, err := marker.Stat(COMPRESS_FORMAT_MARKER)
+	if err == nil {
+		return &TFrameReport{}, nil
+	}
+	if !errors.Is(err, ErrBlobNotFound) {
+		return nil, err
+	}
+	report, err := compressFrameAll(s, dryRun, true)
+	if err != nil || dryRun || report.Failed > 0 {
+		return report, err
+	}
+	_, err = marker.Put(COMPRESS_FORMAT_MARKER, bytes.NewReader([]byte("1\n")))
+	return report, err
+}
+
+// compressFrameAll adds the header to every blob starting with no known header, plaintext blobs
+// under encryption are skipped until encrypt-files encrypts and frames them
+func compressFrameAll(s *TCompressBlobStore, dryRun bool, verify bool) (*TFrameReport, error) {
+	list, err := s.inner.List("")
+	if err != nil {
+		return nil, err
+	}
+	report := &TFrameReport{}
+	for _, b := range list {
+		lock := compressLock(b.Key)
+		lock.Lock()
+		_, err := s.header(b.Key)
+		switch {
+		case err == nil:
+			if verify {
+				if err = s.verify(b.Key); err != nil && !errors.Is(err, ErrBlobNotFound) {
+					Error.Printf("Blob %s does not read back, kept as is: %s\n", b.Key, err)
+					report.Corrupt++
+				}
+			}
+		case errors.Is(err, ErrBlobNoHeader):
+			err = s.frame(b.Key, dryRun)
+			if err == nil {
+				report.Framed++
+			} else if !errors.Is(err, ErrBlobNotFound) {
+				Error.Printf("Can't add the header to %s: %s\n", b.Key, err)
+				report.Failed++
+			}
+		case errors.Is(err, ErrBlobNotEncrypted):
+			Warning.Printf("Blob %s is not encrypted yet, the header is added by encrypt-files\n", b.Key)
+			report.Plain++
+		case !errors.Is(err, ErrBlobNotFound):
+			Error.Printf("Can't read the header of %s: %s\n", b.Key, err)
+			report.Failed++
+		}
+		lock.Unlock()
+	}
+	return report, nil
+}
+
+// verify reads the blob through the header, so it is checked by its size and digest
+func (s *TCompressBlobStore) verify(key string) error {
+	r, err := s.Get(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// frame rewrites the blob stored without the header with the header of the stored algorithm
+func (s *TCompressBlobStore) frame(key string, dryRun bool) error {
+	f, err := s.inner.Get(key)
+	if err != nil {
+		return err
+	}
+	original, size, digest, err := spool(f, "original-")
+	f.Close()
+	if err != nil || dryRun {
+		if original != nil {
+			original.Close()
+		}
+		return err
+	}
+	defer original.Close()
+	_, err = s.inner.Put(key, io.MultiReader(bytes.NewReader(compressHeader(COMPRESS_STORED, size, digest)), original))
+	return err
+}
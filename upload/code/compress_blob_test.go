@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_BlobStoreCompress(t *testing.T) {
+	fmt.Println("Test_BlobStoreCompress")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	for algorithm := range compressAlgorithms {
+		raw := LocalNewBlobStore(dir + "/" + algorithm)
+		bs := CompressNewBlobStore(CASNewBlobStore(raw), algorithm)
+		testBlobStoreConformance(t, bs)
+		// the original size and digest are shown, the stored blob is smaller
+		text := strings.Repeat("compressible text ", 1000)
+		bs.Put("d/text.txt", strings.NewReader(text))
+		plain := CASNewBlobStore(raw)
+		plain.Put("d/plain.txt", strings.NewReader(text))
+		expected, _ := plain.Stat("d/plain.txt")
+		info, err := bs.Stat("d/text.txt")
+		if err != nil || info.Size != int64(len(text)) || info.SHA256 != expected.SHA256 {
+			t.Errorf("%s: original size and digest expected, but was: %v %v", algorithm, info, err)
+		}
+		if stored, _ := plain.Stat("d/text.txt"); stored.Size >= int64(len(text))/10 {
+			t.Errorf("%s: compressed blob expected, but was: %d bytes", algorithm, stored.Size)
+		}
+		if content, err := readBlob(bs, "d/text.txt"); err != nil || content != text {
+			t.Errorf("%s: decompressed blob expected, but was: %d %v", algorithm, len(content), err)
+		}
+		// the same document is compressed the same way and stored once
+		bs.Put("e/text.txt", strings.NewReader(text))
+		stored, _ := plain.Stat("d/text.txt")
+		if refs, _ := plain.Refs(stored.SHA256); refs != 2 {
+			t.Errorf("%s: 2 references expected, but was: %d", algorithm, refs)
+		}
+		// random data is kept as is after the header
+		b := make([]byte, 1000)
+		rand.Read(b)
+		random := string(b)
+		bs.Put("d/random.bin", strings.NewReader(random))
+		digest := sha256.Sum256(b)
+		if content, _ := readBlob(plain, "d/random.bin"); content != string(compressHeader(COMPRESS_STORED, 1000, digest[:]))+random {
+			t.Errorf("%s: uncompressed blob expected", algorithm)
+		}
+		// blobs stored without headers are not read until they get them
+		if _, err := readBlob(bs, "d/plain.txt"); err == nil {
+			t.Errorf("%s: error expected for the blob without the header", algorithm)
+		}
+		if frame, err := compressFrame(raw, bs, false); err != nil || frame.Framed != 1 || frame.Failed != 0 {
+			t.Errorf("%s: 1 framed blob expected, but was: %v %v", algorithm, frame, err)
+		}
+		if content, err := readBlob(bs, "d/plain.txt"); err != nil || content != text {
+			t.Errorf("%s: plain blob expected, but was: %d %v", algorithm, len(content), err)
+		}
+		// and compressed later
+		before, after, err := bs.Compress("d/plain.txt")
+		if err != nil || before != int64(len(text))+COMPRESS_HEADER_SIZE || after == 0 || after >= before {
+			t.Errorf("%s: compressed blob expected, but was: %d %d %v", algorithm, before, after, err)
+		}
+		if _, after, err = bs.Compress("d/plain.txt"); err != nil || after != 0 {
+			t.Errorf("%s: compressed once expected, but was: %d %v", algorithm, after, err)
+		}
+		if content, err := readBlob(bs, "d/plain.txt"); err != nil || content != text {
+			t.Errorf("%s: decompressed blob expected, but was: %d %v", algorithm, len(content), err)
+		}
+	}
+	// a damaged blob is found by the digest
+	raw := LocalNewBlobStore(dir + "/blobs")
+	bs := CompressNewBlobStore(raw, "gzip")
+	bs.Put("d/text.txt", strings.NewReader(strings.Repeat("text ", 1000)))
+	stored, _ := readBlob(raw, "d/text.txt")
+	damaged := []byte(stored)
+	damaged[COMPRESS_HEADER_SIZE-1] ^= 1
+	raw.Put("d/text.txt", bytes.NewReader(damaged))
+	if _, err := readBlob(bs, "d/text.txt"); err == nil {
+		t.Errorf("Digest mismatch expected")
+	}
+	if parseCompression("lzma") == nil || parseCompression("") != nil {
+		t.Errorf("Only gzip and zstd expected")
+	}
+	// the content is never taken for the header
+	raw = LocalNewBlobStore(dir + "/magic")
+	bs = CompressNewBlobStore(CASNewBlobStore(raw), "")
+	magic := COMPRESS_MAGIC + "\x07" + NewId(64)
+	bs.Put("d/magic.bin", strings.NewReader(magic))
+	if content, err := readBlob(bs, "d/magic.bin"); err != nil || content != magic {
+		t.Errorf("Blob starting with the magic expected, but was: %q %v", content, err)
+	}
+	if info, err := bs.Stat("d/magic.bin"); err != nil || info.Size != int64(len(magic)) {
+		t.Errorf("Original size expected, but was: %v %v", info, err)
+	}
+	// the blob of the previous version is kept if it reads back, the other one gets the header
+	legacy := CompressNewBlobStore(CASNewBlobStore(raw), "gzip")
+	legacy.Put("e/text.txt", strings.NewReader(strings.Repeat("text ", 1000)))
+	CASNewBlobStore(raw).Put("e/magic.bin", strings.NewReader(magic))
+	// the blob with the header not reading back is reported, not wrapped in another header
+	legacy.Put("e/damaged.txt", strings.NewReader(strings.Repeat("damaged ", 1000)))
+	stored, _ = readBlob(CASNewBlobStore(raw), "e/damaged.txt")
+	damaged = []byte(stored)
+	damaged[len(damaged)-10] ^= 1
+	CASNewBlobStore(raw).Put("e/damaged.txt", bytes.NewReader(damaged))
+	if frame, err := compressFrame(raw, bs, false); err != nil || frame.Framed != 1 || frame.Corrupt != 1 || frame.Failed != 0 {
+		t.Errorf("1 framed and 1 corrupt blob expected, but was: %v %v", frame, err)
+	}
+	if content, _ := readBlob(CASNewBlobStore(raw), "e/damaged.txt"); content != string(damaged) {
+		t.Errorf("Damaged blob expected to be kept as is, but was: %d bytes", len(content))
+	}
+	if content, err := readBlob(bs, "e/magic.bin"); err != nil || content != magic {
+		t.Errorf("Blob starting with the magic expected, but was: %q %v", content, err)
+	}
+	if content, err := readBlob(bs, "e/text.txt"); err != nil || content != strings.Repeat("text ", 1000) {
+		t.Errorf("Compressed blob expected, but was: %d %v", len(content), err)
+	}
+	// the marked store is not scanned again
+	CASNewBlobStore(raw).Put("f/late.bin", strings.NewReader("late"))
+	if frame, err := compressFrame(raw, bs, false); err != nil || frame.Framed != 0 {
+		t.Errorf("No framed blobs expected, but was: %v %v", frame, err)
+	}
+}
+
+func Test_CompressFrameEncrypted(t *testing.T) {
+	fmt.Println("Test_CompressFrameEncrypted")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	writeMasterKeys(t, dir+"/test.keys", newMasterKeyLine(t))
+	mk, err := MasterKeysLoad(dir + "/test.keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := LocalNewBlobStore(dir + "/blobs")
+	cs := CryptNewBlobStore(CASNewBlobStore(raw), raw, mk, "tasks/")
+	bs := CompressNewBlobStore(cs, "")
+	bs.Put("d/new.txt", strings.NewReader("new"))
+	CASNewBlobStore(raw).Put("e/old.txt", strings.NewReader("old"))
+	// the plaintext blob does not keep the store from being marked
+	if frame, err := compressFrame(raw, bs, false); err != nil || frame.Plain != 1 || frame.Framed != 0 || frame.Failed != 0 {
+		t.Errorf("1 plaintext blob expected, but was: %v %v", frame, err)
+	}
+	if _, err := raw.Stat(COMPRESS_FORMAT_MARKER); err != nil {
+		t.Errorf("Marker expected, but was: %v", err)
+	}
+	// and gets the header once encrypted
+	if _, _, _, err := cryptEncryptPlain(cs, 10, false); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := compressFrameAll(bs, false, false); err != nil || frame.Framed != 1 || frame.Failed != 0 {
+		t.Errorf("1 framed blob expected, but was: %v %v", frame, err)
+	}
+	for key, expected := range map[string]string{"d/new.txt": "new", "e/old.txt": "old"} {
+		if content, err := readBlob(bs, key); err != nil || content != expected {
+			t.Errorf("%s: blob expected, but was: %q %v", key, content, err)
+		}
+	}
+}
+
+func Test_UploadCompressed(t *testing.T) {
+	fmt.Println("Test_UploadCompressed")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	Conf.MaxFiles = 2
+	Conf.MinFiles = 2
+	Conf.MaxFileSize = 1024 * 100
+	Conf.DataDir = t.TempDir()
+	defer func() { Conf.Compression = "" }()
+	db := MemoryNewStorage()
+	token := NewId(16)
+	r := setRouting(token, db)
+	b := new(bytes.Buffer)
+	file1 := strings.Repeat("file1 ", 1000)
+	upload := func() string {
+		body, ct := MakeTestUploadBody(t, "file1.txt", file1, "file2.bin", NewId(64))
+		resp := MakeTestUploadRequest(r, "POST", "", ct, body)
+		if resp.StatusCode != 201 {
+			t.Fatalf("Status expected 201 but was: %d", resp.StatusCode)
+		}
+		task := &TTaskAnswer{}
+		task.fromJReader(resp.Body)
+		return task.TaskId
+	}
+	stored := func(taskId, name string) int64 {
+		info, err := CASNewBlobStore(fileBlobs()).Stat(taskBlobPrefix(&TTask{Id: taskId}) + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size
+	}
+	// files stored before compression are compressed by the background run
+	old := upload()
+	Conf.Compression = "zstd"
+	taskId := upload()
+	if size := stored(taskId, "file1.txt"); size >= int64(len(file1)) {
+		t.Errorf("Compressed upload expected, but was: %d bytes", size)
+	}
+	if size := stored(old, "file1.txt"); size != int64(len(file1))+COMPRESS_HEADER_SIZE {
+		t.Errorf("Uncompressed file expected, but was: %d bytes", size)
+	}
+	before := stored(old, "file1.txt") + stored(old, MANIFEST_NAME)
+	report := compressRun(db)
+	if report.Files != 2 || report.SizeBefore != before ||
+		report.SizeAfter != stored(old, "file1.txt")+stored(old, MANIFEST_NAME) || len(report.Errors) != 0 {
+		t.Errorf("The file and the manifest compressed expected, but was: %v", report)
+	}
+	if report = compressRun(db); report.Files != 0 {
+		t.Errorf("No files to compress expected, but was: %v", report)
+	}
+	for _, id := range []string{old, taskId} {
+		resp := MakeTestRequest(r, "GET", "/api-01/task/"+id+"/files", token, b)
+		files := &TTaskFiles{}
+		if resp.StatusCode != 200 || files.fromJReader(resp.Body) != nil || len(files.Files) != 2 || files.Files[0].Size != int64(len(file1)) {
+			t.Errorf("Original sizes expected, but was: %d %v", resp.StatusCode, files)
+		}
+		resp = MakeTestRequest(r, "GET", "/api-01/task/"+id+"/files/file1.txt", token, b)
+		content, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != 200 || string(content) != file1 {
+			t.Errorf("Decompressed file expected, but was: %d %d", resp.StatusCode, len(content))
+		}
+	}
+}
@@ -0,0 +1,752 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CRYPT_MAGIC       = "UENC\x01" // the header of encrypted blobs, followed by the nonce
+	CRYPT_CHUNK       = 64 * 1024  // plaintext bytes sealed together
+	CRYPT_KEYS_PREFIX = "keys/"    // wrapped data keys in the file store
+	CRYPT_KEY_SIZE    = 32         // AES-256
+	CRYPT_NONCE_SIZE  = 12         // GCM standard nonce
+	CRYPT_TAG_SIZE    = 16         // GCM tag
+	CRYPT_HEADER_SIZE = 5 + 12     // magic and nonce
+)
+
+var ErrMasterKeyNotFound = errors.New("Master key not found")
+
+// ErrBlobNotEncrypted means the blob has no encryption header, it is stored before encryption was turned on
+var ErrBlobNotEncrypted = errors.New("Blob is not encrypted")
+
+// TMasterKeys is the master key ring loaded from the file of "<id> <base64 key>" lines,
+// the last key wraps new data keys, the others are kept to unwrap until rotated
+type TMasterKeys struct {
+	sync.Mutex
+	file    string
+	modTime time.Time
+	keys    map[string][]byte
+	current string
+}
+
+// TDataKey is the data key of the Task wrapped with the master key
+type TDataKey struct {
+	MasterKey string `json:"master_key"`
+	Nonce     []byte `json:"nonce"`
+	Wrapped   []byte `json:"wrapped"`
+	Created   int64  `json:"created"`
+	Migrating bool   `json:"migrating,omitempty"` // plaintext blobs of the owner are being encrypted
+}
+
+// TCryptBlobStore encrypts blobs with the data key of their owner, the directory of the key,
+// wrapped data keys are kept in the keys store by the namespace and the owner
+type TCryptBlobStore struct {
+	inner  IBlobStore
+	keys   IBlobStore
+	master *TMasterKeys
+	ns     string
+}
+
+var masterKeys *TMasterKeys // encryption at rest if configured
+
+// cryptLocks serialize data key changes by the owner
+var cryptLocks [64]sync.Mutex
+
+// MasterKeysLoad reads the key file, it is read again when changed
+func MasterKeysLoad(file string) (*TMasterKeys, error) {
+	mk := &TMasterKeys{file: file}
+	err := mk.reload()
+	if err != nil {
+		return nil, err
+	}
+	return mk, nil
+}
+
+// reload reads the file if it was changed since the last read
+func (mk *TMasterKeys) reload() error {
+	info, err := os.Stat(mk.file)
+	if err != nil {
+		return err
+	}
+	if mk.keys != nil && info.ModTime().Equal(mk.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(mk.file)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string][]byte)
+	current := ""
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("Invalid master key file %s: line %d", mk.file, n+1)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != CRYPT_KEY_SIZE {
+			return fmt.Errorf("Invalid master key file %s: line %d: %d bytes base64 key expected", mk.file, n+1, CRYPT_KEY_SIZE)
+		}
+		keys[fields[0]] = key
+		current = fields[0]
+	}
+	if current == "" {
+		return fmt.Errorf("No master keys in %s", mk.file)
+	}
+	mk.keys, mk.current, mk.modTime = keys, current, info.ModTime()
+	return nil
+}
+
+// key returns the master key by id or the current one if the id is empty
+func (mk *TMasterKeys) key(id string) (string, []byte, error) {
+	mk.Lock()
+	defer mk.Unlock()
+	err := mk.reload()
+	if err != nil && mk.keys == nil {
+		return "", nil, err
+	}
+	if err != nil {
+		Error.Printf("Can't reload master keys, the loaded ones are used: %s\n", err)
+	}
+	if id == "" {
+		id = mk.current
+	}
+	key, ok := mk.keys[id]
+	if !ok {
+		return "", nil, fmt.Errorf("%w: %s", ErrMasterKeyNotFound, id)
+	}
+	return id, key, nil
+}
+
+// Current returns the id of the master key for new data keys
+func (mk *TMasterKeys) Current() (string, error) {
+	id, _, err := mk.key("")
+	return id, err
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrap seals the data key with the current master key, the record name is authenticated too
+func (mk *TMasterKeys) wrap(name string, dataKey []byte) (*TDataKey, error) {
+	id, key, err := mk.key("")
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	dk := &TDataKey{MasterKey: id, Nonce: make([]byte, CRYPT_NONCE_SIZE), Created: time.Now().Unix()}
+	_, err = rand.Read(dk.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	dk.Wrapped = gcm.Seal(nil, dk.Nonce, dataKey, []byte(name))
+	return dk, nil
+}
+
+// unwrap opens the data key with its master key
+func (mk *TMasterKeys) unwrap(name string, dk *TDataKey) ([]byte, error) {
+	_, key, err := mk.key(dk.MasterKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(dk.Nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("Invalid data key: %s", name)
+	}
+	dataKey, err := gcm.Open(nil, dk.Nonce, dk.Wrapped, []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("Can't unwrap data key %s: %s", name, err)
+	}
+	return dataKey, nil
+}
+
+// masterKeyLine returns a new random master key as the key file line
+func masterKeyLine() (string, error) {
+	key := make([]byte, CRYPT_KEY_SIZE)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format("20060102") + "-" + NewId(6) + " " + base64.StdEncoding.EncodeToString(key), nil
+}
+
+func CryptNewBlobStore(inner, keys IBlobStore, master *TMasterKeys, ns string) *TCryptBlobStore {
+	return &TCryptBlobStore{inner: inner, keys: keys, master: master, ns: ns}
+}
+
+// encryptBlobs wraps the store if encryption at rest is configured
+func encryptBlobs(inner IBlobStore, ns string) IBlobStore {
+	if masterKeys == nil {
+		return inner
+	}
+	return CryptNewBlobStore(inner, fileBlobs(), masterKeys, ns)
+}
+
+// owner returns the owner prefix of the key and the name of its data key record
+func (s *TCryptBlobStore) owner(key string) (prefix string, name string, err error) {
+	i := strings.LastIndex(key, "/")
+	if !validBlobKey(key) || i < 0 {
+		return "", "", fmt.Errorf("Invalid blob key: %s", key)
+	}
+	prefix = key[:i]
+	return prefix + "/", CRYPT_KEYS_PREFIX + s.ns + prefix + ".json", nil
+}
+
+func cryptLock(name string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return &cryptLocks[h.Sum32()%uint32(len(cryptLocks))]
+}
+
+// readDataKey returns the wrapped data key record, nil if the owner has none
+func (s *TCryptBlobStore) readDataKey(name string) (*TDataKey, error) {
+	r, err := s.keys.Get(name)
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	dk := &TDataKey{}
+	err = json.NewDecoder(r).Decode(dk)
+	r.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid data key %s: %s", name, err)
+	}
+	return dk, nil
+}
+
+// writeDataKey saves the wrapped data key record
+func (s *TCryptBlobStore) writeDataKey(name string, dk *TDataKey) error {
+	data, err := json.Marshal(dk)
+	if err != nil {
+		return err
+	}
+	_, err = s.keys.Put(name, bytes.NewReader(data))
+	return err
+}
+
+// dataKey returns the data key of the owner, a new one is created if create is set,
+// nil if there is no key and the owner has no encrypted blobs
+func (s *TCryptBlobStore) dataKey(name string, create bool) ([]byte, error) {
+	dk, err := s.readDataKey(name)
+	if err != nil {
+		return nil, err
+	}
+	if dk != nil {
+		return s.master.unwrap(name, dk)
+	}
+	if !create {
+		return nil, nil
+	}
+	_, key, err := s.newDataKey(name, false)
+	return key, err
+}
+
+// newDataKey creates the data key of the owner, migrating marks the owner of plaintext blobs
+func (s *TCryptBlobStore) newDataKey(name string, migrating bool) (*TDataKey, []byte, error) {
+	key := make([]byte, CRYPT_KEY_SIZE)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	dk, err := s.master.wrap(name, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	dk.Migrating = migrating
+	err = s.writeDataKey(name, dk)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dk, key, nil
+}
+
+// Put encrypts the blob with the data key of its owner
+func (s *TCryptBlobStore) Put(key string, r io.Reader) (int64, error) {
+	_, name, err := s.owner(key)
+	if err != nil {
+		return 0, err
+	}
+	lock := cryptLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+	dataKey, err := s.dataKey(name, true)
+	if err != nil {
+		return 0, err
+	}
+	er, err := newEncryptReader(r, dataKey)
+	if err != nil {
+		return 0, err
+	}
+	_, err = s.inner.Put(key, er)
+	if err != nil {
+		return 0, err
+	}
+	return er.plain, nil
+}
+
+// Get decrypts the blob, every blob must have the header,
+// blobs stored before encryption was turned on are encrypted by cryptEncryptPlain
+func (s *TCryptBlobStore) Get(key string) (io.ReadCloser, error) {
+	_, name, err := s.owner(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.inner.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReaderSize(f, CRYPT_CHUNK+CRYPT_TAG_SIZE+1)
+	header, _ := br.Peek(CRYPT_HEADER_SIZE)
+	if len(header) < CRYPT_HEADER_SIZE || !bytes.HasPrefix(header, []byte(CRYPT_MAGIC)) {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s", ErrBlobNotEncrypted, key)
+	}
+	dataKey, err := s.dataKey(name, false)
+	if err == nil && dataKey == nil {
+		err = fmt.Errorf("No data key for %s", key)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	dr, err := newDecryptReader(br, dataKey)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &TReadCloser{dr, f}, nil
+}
+
+// plainInfo converts the info of the stored blob, hashes of ciphertexts are not shown
+func (s *TCryptBlobStore) plainInfo(info TBlobInfo, encrypted bool) TBlobInfo {
+	if encrypted {
+		info.Size = cryptPlainSize(info.Size)
+	}
+	info.SHA256 = ""
+	return info
+}
+
+// encrypted checks the owner has the data key, so its blobs are encrypted
+func (s *TCryptBlobStore) encrypted(name string) (bool, error) {
+	_, err := s.keys.Stat(name)
+	if errors.Is(err, ErrBlobNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *TCryptBlobStore) Stat(key string) (*TBlobInfo, error) {
+	_, name, err := s.owner(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.inner.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := s.encrypted(name)
+	if err != nil {
+		return nil, err
+	}
+	plain := s.plainInfo(*info, encrypted)
+	return &plain, nil
+}
+
+func (s *TCryptBlobStore) List(prefix string) ([]TBlobInfo, error) {
+	list, err := s.inner.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[string]bool)
+	for i, b := range list {
+		_, name, err := s.owner(b.Key)
+		if err != nil {
+			continue
+		}
+		encrypted, ok := owners[name]
+		if !ok {
+			encrypted, err = s.encrypted(name)
+			if err != nil {
+				return nil, err
+			}
+			owners[name] = encrypted
+		}
+		list[i] = s.plainInfo(b, encrypted)
+	}
+	return list, nil
+}
+
+// Delete removes the blob and the data key with the last blob of the owner
+func (s *TCryptBlobStore) Delete(key string) error {
+	prefix, name, err := s.owner(key)
+	if err != nil {
+		return err
+	}
+	lock := cryptLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+	err = s.inner.Delete(key)
+	if err != nil {
+		return err
+	}
+	left, err := s.inner.List(prefix)
+	if err != nil {
+		return err
+	}
+	// blobs of subdirectories have their own owners
+	for _, b := range left {
+		if !strings.Contains(strings.TrimPrefix(b.Key, prefix), "/") {
+			return nil
+		}
+	}
+	return s.keys.Delete(name)
+}
+
+// TReadCloser reads the reader and closes the closer
+type TReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// cryptPlainSize returns the plaintext size of the encrypted blob size
+func cryptPlainSize(size int64) int64 {
+	body := size - CRYPT_HEADER_SIZE
+	if body < CRYPT_TAG_SIZE {
+		return 0
+	}
+	sealed := int64(CRYPT_CHUNK + CRYPT_TAG_SIZE)
+	n, rest := body/sealed, body%sealed
+	if rest == 0 {
+		return n * CRYPT_CHUNK
+	}
+	return n*CRYPT_CHUNK + rest - CRYPT_TAG_SIZE
+}
+
+// cryptNonce is the chunk nonce, the counter is added to the last 8 bytes of the blob nonce
+func cryptNonce(base []byte, counter uint64) []byte {
+	nonce := append([]byte{}, base...)
+	binary.BigEndian.PutUint64(nonce[4:], binary.BigEndian.Uint64(nonce[4:])^counter)
+	return nonce
+}
+
+// cryptChunkData authenticates the last chunk flag, so truncated blobs fail
+func cryptChunkData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// TEncryptReader reads the plaintext and returns the header and sealed chunks
+type TEncryptReader struct {
+	src     *bufio.Reader
+	gcm     cipher.AEAD
+	nonce   []byte
+	counter uint64
+	buf     []byte
+	out     []byte
+	done    bool
+	plain   int64
+}
+
+func newEncryptReader(r io.Reader, key []byte) (*TEncryptReader, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	er := &TEncryptReader{
+		src:   bufio.NewReaderSize(r, CRYPT_CHUNK),
+		gcm:   gcm,
+		nonce: make([]byte, CRYPT_NONCE_SIZE),
+		buf:   make([]byte, CRYPT_CHUNK),
+	}
+	_, err = rand.Read(er.nonce)
+	if err != nil {
+		return nil, err
+	}
+	er.out = append([]byte(CRYPT_MAGIC), er.nonce...)
+	return er, nil
+}
+
+func (er *TEncryptReader) Read(p []byte) (int, error) {
+	for len(er.out) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(er.src, er.buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		last := n < CRYPT_CHUNK
+		if !last {
+			_, perr := er.src.Peek(1)
+			if perr != nil && perr != io.EOF {
+				return 0, perr
+			}
+			last = perr == io.EOF
+		}
+		er.out = er.gcm.Seal(er.out[:0], cryptNonce(er.nonce, er.counter), er.buf[:n], cryptChunkData(last))
+		er.counter++
+		er.plain += int64(n)
+		er.done = last
+	}
+	n := copy(p, er.out)
+	er.out = er.out[n:]
+	return n, nil
+}
+
+// TDecryptReader opens sealed chunks
+type TDecryptReader struct {
+	src     *bufio.Reader
+	gcm     cipher.AEAD
+	nonce   []byte
+	counter uint64
+	buf     []byte
+	out     []byte
+	done    bool
+}
+
+func newDecryptReader(src *bufio.Reader, key []byte) (*TDecryptReader, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, CRYPT_HEADER_SIZE)
+	_, err = io.ReadFull(src, header)
+	if err != nil {
+		return nil, err
+	}
+	return &TDecryptReader{
+		src:   src,
+		gcm:   gcm,
+		nonce: header[len(CRYPT_MAGIC):],
+		buf:   make([]byte, CRYPT_CHUNK+CRYPT_TAG_SIZE),
+	}, nil
+}
+
+func (dr *TDecryptReader) Read(p []byte) (int, error) {
+	for len(dr.out) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(dr.src, dr.buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		last := n < len(dr.buf)
+		if !last {
+			_, perr := dr.src.Peek(1)
+			if perr != nil && perr != io.EOF {
+				return 0, perr
+			}
+			last = perr == io.EOF
+		}
+		dr.out, err = dr.gcm.Open(dr.buf[:0], cryptNonce(dr.nonce, dr.counter), dr.buf[:n], cryptChunkData(last))
+		if err != nil {
+			return 0, fmt.Errorf("Can't decrypt blob chunk %d: %s", dr.counter, err)
+		}
+		dr.counter++
+		dr.done = last
+	}
+	n := copy(p, dr.out)
+	dr.out = dr.out[n:]
+	return n, nil
+}
+
+// cryptRotate wraps data keys with the current master key, files are not rewritten,
+// returns the number of rewrapped keys and of all keys
+func cryptRotate(keys IBlobStore, master *TMasterKeys, dryRun bool) (rotated int, total int, err error) {
+	current, err := master.Current()
+	if err != nil {
+		return 0, 0, err
+	}
+	list, err := keys.List(CRYPT_KEYS_PREFIX)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, b := range list {
+		total++
+		lock := cryptLock(b.Key)
+		lock.Lock()
+		changed, err := cryptRewrap(keys, master, b.Key, current, dryRun)
+		lock.Unlock()
+		if err != nil {
+			return rotated, total, err
+		}
+		if changed {
+			rotated++
+		}
+	}
+	return rotated, total, nil
+}
+
+// cryptRewrap wraps the data key with the current master key unless it is already
+func cryptRewrap(keys IBlobStore, master *TMasterKeys, name, current string, dryRun bool) (bool, error) {
+	r, err := keys.Get(name)
+	if errors.Is(err, ErrBlobNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	dk := &TDataKey{}
+	err = json.NewDecoder(r).Decode(dk)
+	r.Close()
+	if err != nil {
+		return false, fmt.Errorf("Invalid data key %s: %s", name, err)
+	}
+	if dk.MasterKey == current {
+		return false, nil
+	}
+	dataKey, err := master.unwrap(name, dk)
+	if err != nil || dryRun {
+		return err == nil, err
+	}
+	wrapped, err := master.wrap(name, dataKey)
+	if err != nil {
+		return false, err
+	}
+	wrapped.Created = dk.Created
+	wrapped.Migrating = dk.Migrating
+	data, err := json.Marshal(wrapped)
+	if err != nil {
+		return false, err
+	}
+	_, err = keys.Put(name, bytes.NewReader(data))
+	return err == nil, err
+}
+
+// cryptEncryptPlain encrypts blobs of up to limit owners without data keys, the blobs stored
+// before encryption was turned on, the owner gets the key marked as migrating until all of its
+// blobs are encrypted, so an interrupted run continues with it, returns the numbers of the
+// encrypted owners and blobs and of the owners left
+func cryptEncryptPlain(s *TCryptBlobStore, limit int, dryRun bool) (owners int, blobs int, left int, err error) {
+	list, err := s.inner.List("")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var names []string
+	keys := make(map[string][]string)
+	for _, b := range list {
+		_, name, err := s.owner(b.Key)
+		if err != nil {
+			continue
+		}
+		if _, ok := keys[name]; !ok {
+			names = append(names, name)
+		}
+		keys[name] = append(keys[name], b.Key)
+	}
+	for _, name := range names {
+		dk, err := s.readDataKey(name)
+		if err != nil {
+			return owners, blobs, left, err
+		}
+		if dk != nil && !dk.Migrating {
+			continue
+		}
+		if owners >= limit {
+			left++
+			continue
+		}
+		if dryRun {
+			owners++
+			blobs += len(keys[name])
+			continue
+		}
+		n, err := s.encryptOwner(name, dk, keys[name])
+		blobs += n
+		if err != nil {
+			return owners, blobs, left, err
+		}
+		owners++
+	}
+	return owners, blobs, left, nil
+}
+
+// encryptOwner encrypts the plaintext blobs of the owner and clears the migrating mark,
+// blobs encrypted by the interrupted run open with the data key and are kept
+func (s *TCryptBlobStore) encryptOwner(name string, dk *TDataKey, keys []string) (int, error) {
+	lock := cryptLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+	var dataKey []byte
+	var err error
+	resumed := dk != nil
+	if dk == nil {
+		dk, dataKey, err = s.newDataKey(name, true)
+	} else {
+		dataKey, err = s.master.unwrap(name, dk)
+	}
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, key := range keys {
+		if resumed && s.opens(key, dataKey) {
+			continue
+		}
+		f, err := s.inner.Get(key)
+		if err != nil {
+			return n, err
+		}
+		er, err := newEncryptReader(f, dataKey)
+		if err == nil {
+			_, err = s.inner.Put(key, er)
+		}
+		f.Close()
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	dk.Migrating = false
+	return n, s.writeDataKey(name, dk)
+}
+
+// opens checks the whole blob is authenticated with the data key
+func (s *TCryptBlobStore) opens(key string, dataKey []byte) bool {
+	f, err := s.inner.Get(key)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	dr, err := newDecryptReader(bufio.NewReaderSize(f, CRYPT_CHUNK+CRYPT_TAG_SIZE+1), dataKey)
+	if err != nil {
+		return false
+	}
+	_, err = io.Copy(ioutil.Discard, dr)
+	return err == nil
+}
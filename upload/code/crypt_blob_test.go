@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeMasterKeys writes the key file with new keys, the time is moved to be seen as changed
+func writeMasterKeys(t *testing.T, file string, lines ...string) {
+	err := ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Now().Add(time.Duration(len(lines)) * time.Second)
+	os.Chtimes(file, at, at)
+}
+
+func newMasterKeyLine(t *testing.T) string {
+	line, err := masterKeyLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+func Test_CryptStream(t *testing.T) {
+	fmt.Println("Test_CryptStream")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	key := []byte(NewId(CRYPT_KEY_SIZE))
+	for _, size := range []int{0, 1, CRYPT_CHUNK - 1, CRYPT_CHUNK, CRYPT_CHUNK + 1, 3 * CRYPT_CHUNK} {
+		plain := []byte(strings.Repeat("x", size))
+		er, err := newEncryptReader(bytes.NewReader(plain), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := ioutil.ReadAll(er)
+		if err != nil || er.plain != int64(size) {
+			t.Fatalf("Encrypted %d bytes expected, but was: %d %v", size, er.plain, err)
+		}
+		if cryptPlainSize(int64(len(sealed))) != int64(size) {
+			t.Errorf("Plaintext size %d expected, but was: %d", size, cryptPlainSize(int64(len(sealed))))
+		}
+		dr, err := newDecryptReader(bufio.NewReader(bytes.NewReader(sealed)), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opened, err := ioutil.ReadAll(dr)
+		if err != nil || !bytes.Equal(opened, plain) {
+			t.Errorf("Decrypted %d bytes expected, but was: %d %v", size, len(opened), err)
+		}
+		if size <= CRYPT_CHUNK {
+			continue
+		}
+		// a lost last chunk and a changed byte are found
+		dr, _ = newDecryptReader(bufio.NewReader(bytes.NewReader(sealed[:CRYPT_HEADER_SIZE+CRYPT_CHUNK+CRYPT_TAG_SIZE])), key)
+		if _, err := ioutil.ReadAll(dr); err == nil {
+			t.Errorf("Truncated blob error expected")
+		}
+		sealed[len(sealed)-1] ^= 1
+		dr, _ = newDecryptReader(bufio.NewReader(bytes.NewReader(sealed)), key)
+		if _, err := ioutil.ReadAll(dr); err == nil {
+			t.Errorf("Changed blob error expected")
+		}
+	}
+}
+
+func Test_BlobStoreCrypt(t *testing.T) {
+	fmt.Println("Test_BlobStoreCrypt")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	writeMasterKeys(t, dir+"/test.keys", newMasterKeyLine(t))
+	mk, err := MasterKeysLoad(dir + "/test.keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := LocalNewBlobStore(dir + "/blobs")
+	bs := CryptNewBlobStore(CASNewBlobStore(raw), raw, mk, "tasks/")
+	testBlobStoreConformance(t, bs)
+	// keys of "a" and "a/b" are removed with their last blobs
+	if list, _ := raw.List(CRYPT_KEYS_PREFIX); len(list) != 3 || list[0].Key != CRYPT_KEYS_PREFIX+"tasks/ab.json" {
+		t.Errorf("Data keys of 3 owners expected, but was: %v", list)
+	}
+	contents, _ := raw.List(CAS_BLOBS_PREFIX)
+	for _, b := range contents {
+		content, _ := readBlob(raw, b.Key)
+		if strings.HasSuffix(b.Key, ".json") || strings.HasPrefix(content, CRYPT_MAGIC) {
+			continue
+		}
+		t.Errorf("Encrypted content expected, but was: %s", content)
+	}
+	// blobs stored before encryption are not read until encrypted, even with the header
+	plain := CASNewBlobStore(raw)
+	plain.Put("d/old.bin", strings.NewReader("old"))
+	magic := CRYPT_MAGIC + NewId(64)
+	plain.Put("d/magic.bin", strings.NewReader(magic))
+	plain.Put("e/old.bin", strings.NewReader("old"))
+	if _, err := readBlob(bs, "d/old.bin"); !errors.Is(err, ErrBlobNotEncrypted) {
+		t.Errorf("Not encrypted error expected, but was: %v", err)
+	}
+	if _, err := readBlob(bs, "d/magic.bin"); err == nil {
+		t.Errorf("Error expected for the plaintext blob")
+	}
+	if info, err := bs.Stat("d/old.bin"); err != nil || info.Size != 3 {
+		t.Errorf("Plaintext size expected, but was: %v %v", info, err)
+	}
+	owners, blobs, left, err := cryptEncryptPlain(bs, 1, true)
+	if err != nil || owners != 1 || blobs != 2 || left != 1 {
+		t.Errorf("1 owner of 2 blobs and 1 left expected, but was: %d %d %d %v", owners, blobs, left, err)
+	}
+	if _, err := readBlob(bs, "d/old.bin"); !errors.Is(err, ErrBlobNotEncrypted) {
+		t.Errorf("Dry run expected to keep the blob, but was: %v", err)
+	}
+	// the interrupted run is continued, the encrypted blob is kept
+	_, dataKey, err := bs.newDataKey(CRYPT_KEYS_PREFIX+"tasks/d.json", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	er, _ := newEncryptReader(strings.NewReader("old"), dataKey)
+	plain.Put("d/old.bin", er)
+	owners, blobs, left, err = cryptEncryptPlain(bs, 1, false)
+	if err != nil || owners != 1 || blobs != 1 || left != 1 {
+		t.Errorf("1 owner of 1 blob and 1 left expected, but was: %d %d %d %v", owners, blobs, left, err)
+	}
+	owners, blobs, left, err = cryptEncryptPlain(bs, 1, false)
+	if err != nil || owners != 1 || blobs != 1 || left != 0 {
+		t.Errorf("1 owner of 1 blob expected, but was: %d %d %d %v", owners, blobs, left, err)
+	}
+	for key, expected := range map[string]string{"d/old.bin": "old", "e/old.bin": "old", "d/magic.bin": magic} {
+		if content, err := readBlob(bs, key); err != nil || content != expected {
+			t.Errorf("%s: decrypted blob expected, but was: %s %v", key, content, err)
+		}
+	}
+	if dk, err := bs.readDataKey(CRYPT_KEYS_PREFIX + "tasks/d.json"); err != nil || dk.Migrating {
+		t.Errorf("Migrated data key expected, but was: %v %v", dk, err)
+	}
+	if owners, _, _, err := cryptEncryptPlain(bs, 10, false); err != nil || owners != 0 {
+		t.Errorf("Nothing to encrypt expected, but was: %d %v", owners, err)
+	}
+}
+
+func Test_UploadEncrypted(t *testing.T) {
+	fmt.Println("Test_UploadEncrypted")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	Conf.MaxFiles = 2
+	Conf.MinFiles = 2
+	Conf.MaxFileSize = 1024 * 100
+	Conf.DataDir = t.TempDir()
+	Conf.QuarantineDir = Conf.DataDir + "/quarantine"
+	defer func() { Conf.QuarantineDir = "" }()
+	key1 := newMasterKeyLine(t)
+	writeMasterKeys(t, dir+"/test.keys", key1)
+	var err error
+	masterKeys, err = MasterKeysLoad(dir + "/test.keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { masterKeys = nil }()
+	db := MemoryNewStorage()
+	token := NewId(16)
+	r := setRouting(token, db)
+	b := new(bytes.Buffer)
+	file1 := NewId(128)
+	body, ct := MakeTestUploadBody(t, "file1.bin", file1, "file2.bin", NewId(64))
+	resp := MakeTestUploadRequest(r, "POST", "", ct, body)
+	if resp.StatusCode != 201 {
+		t.Fatalf("Status expected 201 but was: %d", resp.StatusCode)
+	}
+	task := &TTaskAnswer{}
+	task.fromJReader(resp.Body)
+	contents, _ := fileBlobs().List(CAS_BLOBS_PREFIX)
+	for _, c := range contents {
+		if content, _ := readBlob(fileBlobs(), c.Key); strings.Contains(content, file1) {
+			t.Errorf("No plaintext expected in %s", c.Key)
+		}
+	}
+	resp = MakeTestRequest(r, "GET", "/api-01/task/"+task.TaskId+"/files", token, b)
+	files := &TTaskFiles{}
+	if resp.StatusCode != 200 || files.fromJReader(resp.Body) != nil || len(files.Files) != 2 || files.Files[0].Size != 128 {
+		t.Errorf("2 files expected, but was: %d %v", resp.StatusCode, files)
+	}
+	resp = MakeTestRequest(r, "GET", "/api-01/task/"+task.TaskId+"/files/file1.bin", token, b)
+	content, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(content) != file1 {
+		t.Errorf("Decrypted file expected, but was: %d %s", resp.StatusCode, content)
+	}
+	// the quarantine is encrypted with its own key
+	resp = MakeTestTaskRequest(r, "PATCH", "/"+task.TaskId+"/fail", token, b)
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	if content, _ := ioutil.ReadFile(Conf.QuarantineDir + "/" + task.TaskId + "/file1.bin"); !bytes.HasPrefix(content, []byte(CRYPT_MAGIC)) {
+		t.Errorf("Encrypted quarantine file expected")
+	}
+	if keys, _ := fileBlobs().List(CRYPT_KEYS_PREFIX); len(keys) != 1 || keys[0].Key != CRYPT_KEYS_PREFIX+"quarantine/"+task.TaskId+".json" {
+		t.Errorf("The quarantine key only expected, but was: %v", keys)
+	}
+	// rotation rewraps data keys, the old master key can be removed then
+	key2 := newMasterKeyLine(t)
+	writeMasterKeys(t, dir+"/test.keys", key1, key2)
+	rotated, total, err := cryptRotate(fileBlobs(), masterKeys, false)
+	if err != nil || rotated != 1 || total != 1 {
+		t.Errorf("1 data key rotated expected, but was: %d %d %v", rotated, total, err)
+	}
+	writeMasterKeys(t, dir+"/test.keys", key2, "# "+key1)
+	resp = MakeTestRequest(r, "GET", "/api-01/quarantine/"+task.TaskId+"/files/file1.bin", token, b)
+	content, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(content) != file1 {
+		t.Errorf("Decrypted file expected, but was: %d %s", resp.StatusCode, content)
+	}
+	rotated, _, err = cryptRotate(fileBlobs(), masterKeys, false)
+	if err != nil || rotated != 0 {
+		t.Errorf("No data keys to rotate expected, but was: %d %v", rotated, err)
+	}
+	// without the master key files can't be read
+	writeMasterKeys(t, dir+"/test.keys", newMasterKeyLine(t))
+	resp = MakeTestRequest(r, "GET", "/api-01/quarantine/"+task.TaskId+"/files/file1.bin", token, b)
+	if resp.StatusCode != 500 {
+		t.Errorf("Status expected 500 but was: %d", resp.StatusCode)
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
 	"io"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 	"time"
-        "regexp"
 )
 
 const (
@@ -16,15 +21,42 @@ const (
 )
 
 type TTask struct {
-	Id       string `json:"id"`               // a unique identifier
-	Status   string `json:"status,omitempty"` // upload status "", "received", "verified", "invalid"
-	IssuedAt int64  `json:"iat"`              // issued time
+	Id          string            `json:"id"`                     // a unique identifier
+	Status      string            `json:"status,omitempty"`       // upload status "", "received", "verified", "invalid"
+	IssuedAt    int64             `json:"iat"`                    // issued time
+	Rev         uint64            `json:"rev"`                    // revision, incremented by the storage on every change
+	Hold        *TTaskHold        `json:"hold,omitempty"`         // legal hold, the task is never purged
+	HoldHistory []TTaskHoldRecord `json:"hold_history,omitempty"` // placed and released holds
+	Quarantined int64             `json:"quarantined,omitempty"`  // files were moved to the quarantine at
+	Claimed     int64             `json:"claimed,omitempty"`      // the queue gave it to a worker at
+	Layout      string            `json:"layout,omitempty"`       // layout of the files, "" - id
 }
 
 type TTaskAnswer struct {
 	TaskId string `json:"task"` // a unique identifier
 }
 
+// TUploadFile is the file of the form as it was read
+type TUploadFile struct {
+	Name    string // decoded, the sent one if it can't be
+	Sent    string
+	Part    int
+	Field   string
+	Content []byte // up to the size limit
+	NameErr error  // the name is not decoded
+}
+
+// TUploadError is the API error of the refused upload
+type TUploadError struct {
+	TJSONError
+	Status int
+	Reject string `json:"-"` // the reason to keep the files in the quarantine, "" - they are removed
+}
+
+type TTaskFiles struct {
+	Files []TChangeFile `json:"files"`
+}
+
 type TTaskStatus struct {
 	Status string `json:"status"`
 }
@@ -46,6 +78,11 @@ func (c *TTask) toJWriter(w io.Writer) error {
 	return e.Encode(c)
 }
 
+// Fill TTask object from io.Reader as JSON (only for tests)
+func (c *TTask) fromJReader(r io.Reader) error {
+	return json.NewDecoder(r).Decode(c)
+}
+
 // Write TTaskStatus object to io.Writer as JSON
 func (c *TTaskStatus) toJWriter(w io.Writer) error {
 	e := json.NewEncoder(w)
@@ -60,65 +97,88 @@ func (c *TTaskAnswer) toJWriter(w io.Writer) error {
 	return e.Encode(c)
 }
 
-// Fill TTaskAnswer object from io.Reader as JSON (only fow test
+// Write TTaskFiles object to io.Writer as JSON
+func (c *TTaskFiles) toJWriter(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "    ")
+	return e.Encode(c)
+}
+
+// Fill TTaskAnswer object from io.Reader as JSON (only for tests)
 func (c *TTaskAnswer) fromJReader(r io.Reader) error {
 	return json.NewDecoder(r).Decode(c)
 }
 
+// Fill TTaskFiles object from io.Reader as JSON (only for tests)
+func (c *TTaskFiles) fromJReader(r io.Reader) error {
+	return json.NewDecoder(r).Decode(c)
+}
+
 // complete task
 func taskCompleteHandler(w http.ResponseWriter, r *http.Request, db IStorage, status string) {
 	// implies, that the method and content type checks was completed at the routing stage
-	var task TTask
-	var err error
 	vars := mux.Vars(r)
 	task_id := vars["task"]
-	// get data from the database
-	oldTaskPayload, dberr := db.TaskGet(task_id)
-	if dberr != nil {
-		if dberr.code == E_STORAGE_TASK_NOT_FOUND {
-			sendJSONErrorMessage(w, E_TASK_NOT_FOUND, http.StatusBadRequest)
-			Warning.Printf("[%s]: Task not found: %s\n", r.RemoteAddr, task_id)
-		} else if dberr.code == E_STORAGE_DATABASE_ERROR {
-			sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
-			Error.Printf("[%s]: Database error: %s\n", r.RemoteAddr, dberr)
+	quarantine := false
+	update := db.UpdateTask
+	// the worker completes the Task of the claimed revision only, if it tells one
+	if match := r.Header.Get("If-Match"); match != "" {
+		rev, err := strconv.ParseUint(strings.Trim(match, `"`), 10, 64)
+		if err != nil {
+			sendJSONErrorDetails(w, E_INVALID_REQUEST, "If-Match is not a task revision", http.StatusBadRequest)
+			Error.Printf("[%s]: Invalid revision: %s\n", r.RemoteAddr, match)
+			return
+		}
+		update = func(taskId string, fn func(task *TTask) error) (*TTask, error) {
+			return updateTaskRev(db, taskId, rev, fn)
 		}
-		return
-	}
-	err = task.fromJBytes(oldTaskPayload)
-	if err != nil {
-		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
-		Error.Printf("[%s]: JSON syntax error in database payload: %s\n", r.RemoteAddr, err)
-		return
-	}
-	if task.Status != "received" {
-		sendJSONErrorMessage(w, E_CONFLICT, http.StatusConflict)
-		Warning.Printf("[%s]: Task conflict: %s\n", r.RemoteAddr, task_id)
 	}
-	if status == "ok" {
-		task.Status = "verified"
-	} else if status == "fail" {
-		task.Status = "failed"
+	// files are listed before the update, it may run the function more than once
+	hasFiles := false
+	if status == "fail" && Conf.QuarantineDir != "" {
+		task, err := db.GetTask(task_id)
+		if err != nil {
+			sendStorageError(w, r, task_id, err)
+			return
+		}
+		files, err := taskFiles(taskBlobs(), task)
+		if err != nil {
+			sendStorageError(w, r, task_id, err)
+			return
+		}
+		hasFiles = len(files) > 0
 	}
-	newTaskPayload, err := task.toJBytes()
+	// update the Task in the database
+	task, err := update(task_id, func(task *TTask) error {
+		if task.Status != "received" {
+			return ErrTaskConflict
+		}
+		quarantine = false
+		if status == "ok" {
+			task.Status = "verified"
+		} else if status == "fail" {
+			task.Status = "failed"
+			// keep files of the failed task in the quarantine
+			if hasFiles {
+				quarantine = true
+				task.Quarantined = time.Now().Unix()
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
-		Error.Printf("[%s]: JSON syntax error payload: %s\n", r.RemoteAddr, err)
+		sendStorageError(w, r, task_id, err)
 		return
 	}
-	// update the Task in the database
-	dberr = db.TaskComplete(task_id, oldTaskPayload, newTaskPayload)
-	if dberr != nil {
-		if dberr.code == E_STORAGE_TASK_CONFLICT {
-			sendJSONErrorMessage(w, E_CONFLICT, http.StatusConflict)
-			Warning.Printf("[%s]: Task conflict: %s\n", r.RemoteAddr, task_id)
-		} else if dberr.code == E_STORAGE_TASK_NOT_FOUND {
-			sendJSONErrorMessage(w, E_TASK_NOT_FOUND, http.StatusBadRequest)
-			Warning.Printf("[%s]: Task not found: %s\n", r.RemoteAddr, task_id)
-		} else if dberr.code == E_STORAGE_DATABASE_ERROR {
-			sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
-			Error.Printf("[%s]: Database error: %s\n", r.RemoteAddr, dberr)
+	if quarantine {
+		lock := taskFilesLock(task_id)
+		lock.Lock()
+		err = quarantineFiles(task, true, "verification failed")
+		lock.Unlock()
+		if err != nil {
+			Error.Printf("[%s]: Can't quarantine files: %s: %s\n", r.RemoteAddr, task_id, err)
 		}
-		return
+		changeLogFiles(db, task)
 	}
 	// start a normal output
 	HelperSetStandartHeaders(w)
@@ -137,27 +197,12 @@ func taskCompleteHandler(w http.ResponseWriter, r *http.Request, db IStorage, st
 // taskInfoHandler outputs the Task info
 func taskInfoHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
 	// implies, that the method and content type checks was completed at the routing stage
-	var task TTask
-	var err error
 	vars := mux.Vars(r)
 	task_id := vars["task"]
 	// get data from the database
-	payload, dberr := db.TaskGet(task_id)
-	if dberr != nil {
-		if dberr.code == E_STORAGE_TASK_NOT_FOUND {
-			sendJSONErrorMessage(w, E_TASK_NOT_FOUND, http.StatusBadRequest)
-			Warning.Printf("[%s]: Task not found: %s\n", r.RemoteAddr, task_id)
-		} else if dberr.code == E_STORAGE_DATABASE_ERROR {
-			sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
-			Error.Printf("[%s]: Database error: %s\n", r.RemoteAddr, dberr)
-		}
-		return
-	}
-	// validate a data format
-	err = task.fromJBytes(payload)
+	task, err := db.GetTask(task_id)
 	if err != nil {
-		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
-		Error.Printf("[%s]: JSON syntax error in database payload: %s\n", r.RemoteAddr, err)
+		sendStorageError(w, r, task_id, err)
 		return
 	}
 	status := &TTaskStatus{}
@@ -190,28 +235,108 @@ func taskInfoHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
 	Debug.Printf("[%s]: Task %s info printed\n", r.RemoteAddr, task_id)
 }
 
-// queueFirstHandler outputs the first Task info
-func queueFirstHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
+// taskDetailsHandler outputs the full Task record for admins
+func taskDetailsHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
 	// implies, that the method and content type checks was completed at the routing stage
-	var task TTask
-	var err error
+	vars := mux.Vars(r)
+	task_id := vars["task"]
 	// get data from the database
-	payload, dberr := db.QueueGet()
-	if dberr != nil {
-		if dberr.code == E_STORAGE_QUEUE_IS_EMPTY {
-			sendJSONErrorMessage(w, E_QUEUE_EMPTY, http.StatusNoContent)
-			Debug.Printf("[%s]: Queue is empty\n", r.RemoteAddr)
-		} else if dberr.code == E_STORAGE_DATABASE_ERROR {
-			sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
-			Error.Printf("[%s]: Database error: %s\n", r.RemoteAddr, dberr)
-		}
+	task, err := db.GetTask(task_id)
+	if err != nil {
+		sendStorageError(w, r, task_id, err)
+		return
+	}
+	// start a normal output
+	HelperSetStandartHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	// write a Task info
+	err = task.toJWriter(w)
+	if err != nil {
+		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// write a success message to the debug log
+	Debug.Printf("[%s]: Task %s details printed\n", r.RemoteAddr, task_id)
+}
+
+// taskFilesHandler outputs names and sizes of the uploaded Task files, the manifest is read as a file
+func taskFilesHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
+	// implies, that the method and content type checks was completed at the routing stage
+	vars := mux.Vars(r)
+	task_id := vars["task"]
+	task, err := db.GetTask(task_id)
+	if err != nil {
+		sendStorageError(w, r, task_id, err)
+		return
+	}
+	list, err := taskFiles(taskBlobs(), task)
+	if err != nil {
+		sendStorageError(w, r, task_id, err)
 		return
 	}
-	// validate a data format
-	err = task.fromJBytes(payload)
+	files := &TTaskFiles{Files: uploadedFiles(list)}
+	// start a normal output
+	HelperSetStandartHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	err = files.toJWriter(w)
 	if err != nil {
 		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
-		Error.Printf("[%s]: JSON syntax error in database payload: %s\n", r.RemoteAddr, err)
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// write a success message to the debug log
+	Debug.Printf("[%s]: Task %s files printed\n", r.RemoteAddr, task_id)
+}
+
+// taskFileHandler outputs the Task file for workers and followers
+func taskFileHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
+	// implies, that the method and content type checks was completed at the routing stage
+	vars := mux.Vars(r)
+	task_id := vars["task"]
+	name := vars["name"]
+	task, err := db.GetTask(task_id)
+	if err != nil {
+		sendStorageError(w, r, task_id, err)
+		return
+	}
+	if !safeFileName(name) {
+		sendJSONErrorMessage(w, E_INVALID_REQUEST, http.StatusBadRequest)
+		Warning.Printf("[%s]: Invalid file name: %s/%s\n", r.RemoteAddr, task_id, name)
+		return
+	}
+	f, err := taskBlobs().Get(taskBlobPrefix(task) + name)
+	if errors.Is(err, ErrBlobNotFound) {
+		sendJSONErrorMessage(w, E_FILE_NOT_FOUND, http.StatusNotFound)
+		Warning.Printf("[%s]: File not found: %s/%s\n", r.RemoteAddr, task_id, name)
+		return
+	}
+	if err != nil {
+		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+		Error.Printf("[%s]: Can't read file %s/%s: %s\n", r.RemoteAddr, task_id, name, err)
+		return
+	}
+	defer f.Close()
+	// start a normal output
+	HelperSetStandartHeaders(w)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	_, err = io.Copy(w, f)
+	if err != nil {
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// write a success message to the debug log
+	Debug.Printf("[%s]: Task file sent: %s/%s\n", r.RemoteAddr, task_id, name)
+}
+
+// queueFirstHandler outputs the first Task info
+func queueFirstHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
+	// implies, that the method and content type checks was completed at the routing stage
+	// get data from the database
+	task, err := db.Claim(Conf.ClaimTTL)
+	if err != nil {
+		sendStorageError(w, r, "", err)
 		return
 	}
 	// start a normal output
@@ -230,122 +355,221 @@ func queueFirstHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
 
 // upload files
 func uploadHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
-	var task TTask
-	task.Id = NewId(TASK_ID_LEN)
-	task.IssuedAt = time.Now().Unix()
-	task.Status = "received"
 	reader, err := r.MultipartReader()
 	if err != nil {
 		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
 		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
 		return
 	}
-	// Create unique upload dir with underline and than rename it
-	// Defer cleanup those
-	dataDir := Conf.DataDir + "/" + "_" + "/" + task.Id
-	if _, err := os.Stat(dataDir); !os.IsNotExist(err) {
-		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
-		Error.Printf("[%s]: Temp path exists: %s\n", r.RemoteAddr, task.Id)
+	// one more file is read to reject too many of them
+	files, err := readUploadFiles(r, reader, Conf.MaxFiles+1)
+	if err != nil {
+		sendJSONErrorMessage(w, E_INVALID_REQUEST, http.StatusBadRequest)
+		Error.Printf("[%s]: Can't read the request: %s\n", r.RemoteAddr, err)
 		return
 	}
-	dirCleanup := func() {
-		_ = os.RemoveAll(dataDir)
+	task, uerr := uploadTask(r, db, files)
+	if uerr != nil {
+		sendJSONErrorDetails(w, uerr.Msg, uerr.Details, uerr.Status)
+		return
 	}
-	err = os.MkdirAll(dataDir, 0755)
+	answer := &TTaskAnswer{TaskId: task.Id}
+	// start a normal output
+	HelperSetStandartHeaders(w)
+	w.WriteHeader(http.StatusCreated)
+	// write a Queue info
+	err = answer.toJWriter(w)
 	if err != nil {
 		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
-		Error.Printf("[%s]: Can't create temporary directory: %s\n", r.RemoteAddr, err)
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
 		return
 	}
-	defer dirCleanup()
-        re := regexp.MustCompile(`\s*\(\d+\)\s*\.`)
-	fcounter := int(0) // uploaded file counter
-	for {
+	// write a success message to the log
+	Info.Printf("[%s]: Files uploaded\n", r.RemoteAddr)
+}
+
+// readUploadFiles reads up to max files of the form, each one is read up to the size limit,
+// a file of the limit size is too big
+func readUploadFiles(r *http.Request, reader *multipart.Reader, max int) ([]TUploadFile, error) {
+	files := []TUploadFile{}
+	for npart := 0; len(files) < max; npart++ {
 		part, err := reader.NextPart()
 		if err == io.EOF {
 			break
 		}
-		if part.FileName() != "" {
-			if fcounter >= Conf.MaxFiles {
-				sendJSONErrorMessage(w, E_INVALID_REQUEST, http.StatusBadRequest)
-				Error.Printf("[%s]: Too many files\n", r.RemoteAddr)
-				return
-			}
-                        _filename := re.ReplaceAllString(part.FileName(),".")
-			dst, err := os.Create(dataDir + "/" + _filename)
-			if err != nil {
-				sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
-				Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
-				return
-			}
-			defer dst.Close()
-			n, err := io.Copy(dst, io.LimitReader(part, Conf.MaxFileSize))
-			if err == nil && n == Conf.MaxFileSize {
-				sendJSONErrorMessage(w, E_FILE_TOO_BIG, http.StatusBadRequest)
-				Error.Printf("[%s]: File too large: %s\n", r.RemoteAddr, _filename)
-				return
-			} else if err != nil && err != io.EOF {
-				sendJSONErrorMessage(w, E_INVALID_REQUEST, http.StatusBadRequest)
-				Error.Printf("[%s]: Can't read file %s: %s\n", r.RemoteAddr, _filename, err)
-				return
-			}
-			dst.Close()
-			fcounter++
+		if err != nil {
+			return nil, err
 		}
+		name, sent, isFile, err := partFileName(part.Header.Get("Content-Disposition"))
+		if !isFile || sent == "" {
+			continue
+		}
+		f := TUploadFile{Name: name, Sent: sent, Part: npart, Field: part.FormName(), NameErr: err}
+		if err != nil {
+			Warning.Printf("[%s]: Can't decode file name %s: %s\n", r.RemoteAddr, sent, err)
+			f.Name = sent
+		}
+		f.Content, err = ioutil.ReadAll(io.LimitReader(part, Conf.MaxFileSize))
+		if err != nil {
+			return nil, fmt.Errorf("Can't read file %s: %s", sent, err)
+		}
+		files = append(files, f)
 	}
-	// check min settings
-	if fcounter < Conf.MinFiles {
-		sendJSONErrorMessage(w, E_INVALID_REQUEST, http.StatusBadRequest)
-		Error.Printf("[%s]: Too few files\n", r.RemoteAddr)
-		return
-	}
-	taskPayload, err := task.toJBytes()
+	return files, nil
+}
+
+// uploadTask stores the files under the new Task and enqueues it,
+// files of rejected uploads are kept in the quarantine
+func uploadTask(r *http.Request, db IStorage, files []TUploadFile) (*TTask, *TUploadError) {
+	var task TTask
+	task.Id = NewId(TASK_ID_LEN)
+	task.IssuedAt = time.Now().Unix()
+	task.Status = "received"
+	layout, err := currentLayout(db)
 	if err != nil {
-		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
-		Error.Printf("[%s]: JSON syntax error payload: %s\n", r.RemoteAddr, err)
-		return
+		return nil, uploadStorageError(r, &task, err)
 	}
-	dberr := db.TaskQueue(task.Id, taskPayload)
-	if dberr != nil {
-		if dberr.code == E_STORAGE_TASK_EXISTS {
-			sendJSONErrorMessage(w, E_CONFLICT, http.StatusConflict)
-			Error.Printf("[%s]: Task status conflict\n", r.RemoteAddr)
-			return
-		} else {
-			sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
-			Error.Printf("[%s]: Database error: %s\n", r.RemoteAddr, dberr)
+	task.setLayout(layout)
+	// Files are written under the new Task id, the Task is visible only after Enqueue
+	// Defer cleanup those
+	blobs := taskBlobs()
+	prefix := taskBlobPrefix(&task)
+	uploaded := false
+	reject := "" // rejected uploads are kept in the quarantine
+	filesCleanup := func() {
+		if uploaded {
 			return
 		}
+		if reject != "" {
+			if files, err := taskFiles(blobs, &task); err != nil || len(files) > 0 {
+				err := quarantineFiles(&task, false, reject)
+				if err != nil {
+					Error.Printf("[%s]: Can't quarantine files: %s: %s\n", r.RemoteAddr, task.Id, err)
+				}
+			}
+		}
+		if err := blobDeletePrefix(blobs, prefix); err != nil {
+			Error.Printf("[%s]: Can't remove files: %s: %s\n", r.RemoteAddr, task.Id, err)
+		}
+	}
+	defer filesCleanup()
+	// files are checked before they are written
+	var manifest []TManifestFile
+	var uerr *TUploadError
+	if len(files) > Conf.MaxFiles {
+		files = files[:Conf.MaxFiles]
+		uerr = &TUploadError{TJSONError{E_INVALID_REQUEST, "too many files"}, http.StatusBadRequest, "too many files"}
+	}
+	stored := []string{}
+	taken := map[string]bool{MANIFEST_NAME: true} // stored names
+	for _, f := range files {
+		stored = append(stored, uniqueFileName(normalizeFileName(f.Name, nameRules()), taken))
 	}
-	// Rename dir if can
-	newDir := Conf.DataDir + "/" + string(task.Id[0]) + "/" + string(task.Id[1])
-	if _, err := os.Stat(newDir); os.IsNotExist(err) {
-		err = os.MkdirAll(newDir, 0755)
+	if uerr == nil {
+		manifest, uerr = checkUpload(files, stored)
+	}
+	if uerr != nil {
+		reject = uerr.Reject
+		Error.Printf("[%s]: Rejected upload: %s\n", r.RemoteAddr, reject)
+	}
+	for i, f := range files {
+		// files of the rejected upload are written for the quarantine,
+		// the file read up to the limit is not, its truncated part is not kept
+		if uerr != nil && fileTooBig(f) {
+			continue
+		}
+		_, err := blobs.Put(prefix+stored[i], bytes.NewReader(f.Content))
 		if err != nil {
-			sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
-			Error.Printf("[%s]: Can't create new directory: %s\n", r.RemoteAddr, err)
-			return
+			Error.Printf("[%s]: Can't write file %s: %s\n", r.RemoteAddr, stored[i], err)
+			return nil, &TUploadError{TJSONError{E_SERVER_ERROR, ""}, http.StatusInternalServerError, ""}
 		}
 	}
-	err = os.Rename(dataDir, newDir+"/"+task.Id)
+	if uerr != nil {
+		return nil, uerr
+	}
+	// the manifest is written last and marks the files as complete
+	err = writeManifest(blobs, &task, manifest)
 	if err != nil {
-		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
-		Error.Printf("[%s]: Can't rename directory: %s\n", r.RemoteAddr, err)
-		return
+		Error.Printf("[%s]: Can't write the manifest of %s: %s\n", r.RemoteAddr, task.Id, err)
+		return nil, &TUploadError{TJSONError{E_SERVER_ERROR, ""}, http.StatusInternalServerError, ""}
 	}
-	answer := &TTaskAnswer{TaskId: task.Id}
-	// start a normal output
-	HelperSetStandartHeaders(w)
-	w.WriteHeader(http.StatusCreated)
-	// write a Queue info
-	err = answer.toJWriter(w)
+	err = db.Enqueue(&task)
 	if err != nil {
-		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+		return nil, uploadStorageError(r, &task, err)
+	}
+	uploaded = true
+	changeLogFiles(db, &task)
+	return &task, nil
+}
+
+// fileTooBig checks the file is read up to the size limit, so it is bigger
+func fileTooBig(f TUploadFile) bool {
+	return int64(len(f.Content)) >= Conf.MaxFileSize
+}
+
+// checkUpload runs the checks of the upload on the files under their stored names
+func checkUpload(files []TUploadFile, stored []string) ([]TManifestFile, *TUploadError) {
+	manifest := []TManifestFile{}
+	for i, f := range files {
+		if fileTooBig(f) {
+			reject := "file too big: " + stored[i]
+			return nil, &TUploadError{TJSONError{E_FILE_TOO_BIG, reject}, http.StatusBadRequest, reject}
+		}
+		mf, cerr := checkUploadFile(f.Name, f.Sent, stored[i], f.Part, f.Field, f.Content)
+		if cerr != nil {
+			return nil, &TUploadError{TJSONError{cerr.Code, cerr.Error()}, http.StatusBadRequest, cerr.Code + ": " + cerr.Error()}
+		}
+		manifest = append(manifest, mf)
+	}
+	// check min settings
+	if len(manifest) < Conf.MinFiles {
+		return nil, &TUploadError{TJSONError{E_INVALID_REQUEST, "too few files"}, http.StatusBadRequest, "too few files"}
+	}
+	if Conf.PairCheck {
+		if err := checkPair(manifest); err != nil {
+			return nil, &TUploadError{TJSONError{E_INVALID_PAIR, err.Error()}, http.StatusBadRequest, E_INVALID_PAIR + ": " + err.Error()}
+		}
+	}
+	return manifest, nil
+}
+
+// uploadStorageError maps the storage error of the new Task to the API error
+func uploadStorageError(r *http.Request, task *TTask, err error) *TUploadError {
+	code, status := storageErrorCode(err)
+	Error.Printf("[%s]: Can't create the task %s: %s\n", r.RemoteAddr, task.Id, err)
+	return &TUploadError{TJSONError{code, ""}, status, ""}
+}
+
+// sendStorageError maps the storage error to the API error
+func sendStorageError(w http.ResponseWriter, r *http.Request, task_id string, err error) {
+	code, status := storageErrorCode(err)
+	sendJSONErrorMessage(w, code, status)
+	switch {
+	case code == E_TASK_NOT_FOUND:
+		Warning.Printf("[%s]: Task not found: %s\n", r.RemoteAddr, task_id)
+	case code == E_CONFLICT:
+		Warning.Printf("[%s]: Task conflict: %s\n", r.RemoteAddr, task_id)
+	case code == E_QUEUE_EMPTY:
+		Debug.Printf("[%s]: Queue is empty\n", r.RemoteAddr)
+	case errors.Is(err, ErrStorage):
+		// the details stay in the log, clients get the server error
+		Error.Printf("[%s]: Database error: %s\n", r.RemoteAddr, err)
+	default:
 		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
-		return
 	}
-	// write a success message to the log
-	Info.Printf("[%s]: Files uploaded\n", r.RemoteAddr)
+}
+
+// storageErrorCode returns the API error and the HTTP status of the storage error
+func storageErrorCode(err error) (string, int) {
+	switch {
+	case errors.Is(err, ErrTaskNotFound):
+		return E_TASK_NOT_FOUND, http.StatusBadRequest
+	case errors.Is(err, ErrTaskConflict) || errors.Is(err, ErrTaskExists):
+		return E_CONFLICT, http.StatusConflict
+	case errors.Is(err, ErrQueueIsEmpty):
+		return E_QUEUE_EMPTY, http.StatusNoContent
+	}
+	return E_SERVER_ERROR, http.StatusInternalServerError
 }
 
 // handler for OPTIONS request
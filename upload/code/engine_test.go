@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
@@ -42,19 +44,44 @@ func MakeTestUploadRequest(r *mux.Router, method, x, ct string, b *bytes.Buffer)
 	return w.Result()
 }
 
+func MakeTestRequest(r *mux.Router, method, path, token string, b *bytes.Buffer) *http.Response {
+	req := httptest.NewRequest(method, path, b)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Result()
+}
+
+// testTaskBlobPrefix returns the prefix of files of the stored Task by its layout
+func testTaskBlobPrefix(t *testing.T, db IStorage, taskId string) string {
+	task, err := db.GetTask(taskId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return taskBlobPrefix(task)
+}
+
+// testTaskFiles lists files of the Task, a failed listing fails the test
+func testTaskFiles(t *testing.T, blobs IBlobStore, task *TTask) []TChangeFile {
+	files, err := taskFiles(blobs, task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
 func Test_Upload(t *testing.T) {
 	fmt.Println("Test_Upload")
 	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
 	Conf.MaxFiles = 2
 	Conf.MinFiles = 2
 	Conf.MaxFileSize = 1024 * 100
-	Conf.DataDir = "tmp"
-	db, err := BoltNewStorage("test.db")
-	if err != nil {
-		t.Fatal(err)
-	}
+	Conf.DataDir = t.TempDir()
+	db := MemoryNewStorage()
 	defer db.Close()
-	defer os.Remove("test.db")
 	token := NewId(16)
 	r := setRouting(token, db)
 	b := new(bytes.Buffer)
@@ -97,14 +124,37 @@ func Test_Upload(t *testing.T) {
 		t.Errorf("Status expected 202 but was: %d", resp.StatusCode)
 	}
 	// test get queue
+	Conf.ClaimTTL = 60
+	defer func() { Conf.ClaimTTL = 0 }()
 	resp = MakeTestQueueRequest(r, "GET", "", token, b)
 	if resp.StatusCode != 200 {
 		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
 	}
+	claimed := &TTask{}
+	if err := claimed.fromJReader(resp.Body); err != nil || claimed.Id != task.TaskId || claimed.Rev != 2 {
+		t.Errorf("Claimed task %s expected, but was: %v %v", task.TaskId, claimed, err)
+	}
+	// the claimed task is not given to other workers
+	resp = MakeTestQueueRequest(r, "GET", "", token, b)
+	if resp.StatusCode != 204 {
+		t.Errorf("Status expected 204 but was: %d", resp.StatusCode)
+	}
+	// test ok of the other revision
+	req := httptest.NewRequest("PATCH", "/api-01/task/"+task.TaskId+"/ok", b)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("If-Match", `"1"`)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 409 {
+		t.Errorf("Status expected 409 but was: %d", w.Code)
+	}
 	// test ok
-	resp = MakeTestTaskRequest(r, "PATCH", "/"+task.TaskId+"/ok", token, b)
-	if resp.StatusCode != 200 {
-		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	req.Header.Set("If-Match", fmt.Sprintf(`"%d"`, claimed.Rev))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Errorf("Status expected 200 but was: %d", w.Code)
 	}
 	// test task status
 	resp = MakeTestTaskRequest(r, "GET", "/"+task.TaskId, "", b)
@@ -122,8 +172,6 @@ func Test_Upload(t *testing.T) {
 		t.Errorf("Status expected 409 but was: %d", resp.StatusCode)
 	}
 	// cleanup
-	_ = os.RemoveAll(Conf.DataDir + "/" + "_")
-	_ = os.RemoveAll(Conf.DataDir + "/" + string(task.TaskId[0]))
 }
 
 func Test_Upload_Too_Big(t *testing.T) {
@@ -132,13 +180,9 @@ func Test_Upload_Too_Big(t *testing.T) {
 	Conf.MaxFiles = 2
 	Conf.MinFiles = 2
 	Conf.MaxFileSize = 65
-	Conf.DataDir = "tmp"
-	db, err := BoltNewStorage("test.db")
-	if err != nil {
-		t.Fatal(err)
-	}
+	Conf.DataDir = t.TempDir()
+	db := MemoryNewStorage()
 	defer db.Close()
-	defer os.Remove("test.db")
 	r := setRouting("", db)
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
@@ -168,7 +212,6 @@ func Test_Upload_Too_Big(t *testing.T) {
 	if resp.StatusCode != 400 {
 		t.Errorf("Status expected 400 but was: %d", resp.StatusCode)
 	}
-	_ = os.RemoveAll(Conf.DataDir + "/" + "_")
 }
 
 func Test_Upload_Too_Many_Files(t *testing.T) {
@@ -177,13 +220,9 @@ func Test_Upload_Too_Many_Files(t *testing.T) {
 	Conf.MaxFiles = 2
 	Conf.MinFiles = 2
 	Conf.MaxFileSize = 1024 * 100
-	Conf.DataDir = "tmp"
-	db, err := BoltNewStorage("test.db")
-	if err != nil {
-		t.Fatal(err)
-	}
+	Conf.DataDir = t.TempDir()
+	db := MemoryNewStorage()
 	defer db.Close()
-	defer os.Remove("test.db")
 	r := setRouting("", db)
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
@@ -222,7 +261,6 @@ func Test_Upload_Too_Many_Files(t *testing.T) {
 	if resp.StatusCode != 400 {
 		t.Errorf("Status expected 400 but was: %d", resp.StatusCode)
 	}
-	_ = os.RemoveAll(Conf.DataDir + "/" + "_")
 }
 
 func Test_Upload_Too_Few_Files(t *testing.T) {
@@ -231,13 +269,9 @@ func Test_Upload_Too_Few_Files(t *testing.T) {
 	Conf.MaxFiles = 2
 	Conf.MinFiles = 2
 	Conf.MaxFileSize = 1024 * 100
-	Conf.DataDir = "tmp"
-	db, err := BoltNewStorage("test.db")
-	if err != nil {
-		t.Fatal(err)
-	}
+	Conf.DataDir = t.TempDir()
+	db := MemoryNewStorage()
 	defer db.Close()
-	defer os.Remove("test.db")
 	r := setRouting("", db)
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
@@ -258,22 +292,40 @@ func Test_Upload_Too_Few_Files(t *testing.T) {
 	if resp.StatusCode != 400 {
 		t.Errorf("Status expected 400 but was: %d", resp.StatusCode)
 	}
-	_ = os.RemoveAll(Conf.DataDir + "/" + "_")
 }
 
-func Test_Purge(t *testing.T) {
-	fmt.Println("Test_Purge")
+func Test_Upload_Write_Error(t *testing.T) {
+	fmt.Println("Test_Upload_Write_Error")
 	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
 	Conf.MaxFiles = 2
 	Conf.MinFiles = 2
 	Conf.MaxFileSize = 1024 * 100
-	Conf.DataDir = "tmp"
-	db, err := BoltNewStorage("test.db")
+	// files can't be written under a regular file
+	Conf.DataDir = t.TempDir() + "/file"
+	err := ioutil.WriteFile(Conf.DataDir, []byte{}, 0644)
 	if err != nil {
 		t.Fatal(err)
 	}
+	db := MemoryNewStorage()
+	defer db.Close()
+	r := setRouting("", db)
+	body, ct := MakeTestUploadBody(t, "file1.bin", NewId(128), "file2.bin", NewId(64))
+	resp := MakeTestUploadRequest(r, "POST", "", ct, body)
+	e := &TJSONError{}
+	if resp.StatusCode != 500 || json.NewDecoder(resp.Body).Decode(e) != nil || e.Msg != E_SERVER_ERROR {
+		t.Errorf("Server error expected, but was: %d %v", resp.StatusCode, e)
+	}
+}
+
+func Test_Purge(t *testing.T) {
+	fmt.Println("Test_Purge")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	Conf.MaxFiles = 2
+	Conf.MinFiles = 2
+	Conf.MaxFileSize = 1024 * 100
+	Conf.DataDir = t.TempDir()
+	db := MemoryNewStorage()
 	defer db.Close()
-	defer os.Remove("test.db")
 	token := NewId(16)
 	r := setRouting(token, db)
 	b := new(bytes.Buffer)
@@ -371,9 +423,9 @@ func Test_Purge(t *testing.T) {
 	if resp.StatusCode != 200 {
 		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
 	}
-	dberr := db.TaskPurge("verified", 2)
-	if dberr != nil {
-		t.Errorf("Unexpected error: %s", dberr.msg)
+	_, err = db.PurgeTasks("verified", time.Now().Unix()-2)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
 	}
 	resp = MakeTestQueueRequest(r, "GET", "", token, b)
 	if resp.StatusCode != 200 {
@@ -384,7 +436,4 @@ func Test_Purge(t *testing.T) {
 		t.Errorf("Status expected 400 but was: %d", resp.StatusCode)
 	}
 	// cleanup
-	_ = os.RemoveAll(Conf.DataDir + "/" + "_")
-	_ = os.RemoveAll(Conf.DataDir + "/" + string(task.TaskId[0]))
-	_ = os.RemoveAll(Conf.DataDir + "/" + string(task2.TaskId[0]))
 }
@@ -14,16 +14,29 @@ const (
 	E_QUEUE_EMPTY            = "empty_queue"
 	E_SERVER_ERROR           = "server_error"
 	E_NOT_IMPLEMENTED        = "not_implemented"
+	E_QUARANTINE_NOT_FOUND   = "invalid_quarantine"
+	E_READ_ONLY              = "read_only"
+	E_REPLICATION_RESET      = "replication_reset"
+	E_FILE_NOT_FOUND         = "invalid_file"
+	E_UNSUPPORTED_TYPE       = "unsupported_type"
+	E_MALFORMED_SIGNATURE    = "malformed_signature"
+	E_MALFORMED_FILE         = "malformed_file"
+	E_INVALID_PAIR           = "invalid_pair"
 )
 
 type TJSONError struct {
-	Msg string `json:"error"`
+	Msg     string `json:"error"`
+	Details string `json:"details,omitempty"` // why the request was rejected
 }
 
 func sendJSONErrorMessage(w http.ResponseWriter, msg string, status int) {
+	sendJSONErrorDetails(w, msg, "", status)
+}
+
+func sendJSONErrorDetails(w http.ResponseWriter, msg, details string, status int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	c := &TJSONError{msg}
+	c := &TJSONError{msg, details}
 	e := json.NewEncoder(w)
 	e.SetIndent("", "    ")
 	e.Encode(c)
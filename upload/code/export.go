@@ -0,0 +1,396 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	EXPORT_FORMAT        = "upload-export"
+	EXPORT_VERSION       = 1
+	EXPORT_MANIFEST_NAME = "manifest.jsonl"
+	EXPORT_FILES_DIR     = "files/"
+)
+
+// TExportHeader is the first line of the manifest
+type TExportHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Created int64  `json:"created"`
+	Tasks   int    `json:"tasks"`
+}
+
+// TExportTask is the manifest line, the Task record with digests of its files
+type TExportTask struct {
+	Task  *TTask        `json:"task"`
+	Files []TExportFile `json:"files"`
+}
+
+type TExportFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// TImportReport describes the import, tasks are imported with all their files or not at all
+type TImportReport struct {
+	Tasks     []string `json:"tasks"`     // imported
+	Files     int      `json:"files"`     // imported
+	Conflicts []string `json:"conflicts"` // ids existing in the storage, skipped unless overwritten
+	Errors    []string `json:"errors,omitempty"`
+}
+
+// blobDigest returns the hex SHA-256 of the blob
+func blobDigest(bs IBlobStore, key string) (string, error) {
+	f, err := bs.Get(key)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// exportWrite writes gzipped tar: the manifest first, then files/<task>/<name>,
+// the service must be stopped or files may change between the digest and the copy
+func exportWrite(w io.Writer, db IStorage) (tasks int, files int, err error) {
+	var manifest []*TExportTask
+	blobs := taskBlobs()
+	for _, status := range taskStatuses {
+		list, err := db.ListTasks(status, math.MaxInt64)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, task := range list {
+			line := &TExportTask{Task: task, Files: []TExportFile{}}
+			files, err := taskFiles(blobs, task)
+			if err != nil {
+				return 0, 0, err
+			}
+			for _, f := range files {
+				digest := f.SHA256
+				if digest == "" {
+					digest, err = blobDigest(blobs, taskBlobPrefix(task)+f.Name)
+					if err != nil {
+						return 0, 0, err
+					}
+				}
+				line.Files = append(line.Files, TExportFile{f.Name, f.Size, digest})
+			}
+			manifest = append(manifest, line)
+		}
+	}
+	buf := new(strings.Builder)
+	e := json.NewEncoder(buf)
+	e.Encode(&TExportHeader{EXPORT_FORMAT, EXPORT_VERSION, time.Now().Unix(), len(manifest)})
+	for _, line := range manifest {
+		err = e.Encode(line)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err = tw.WriteHeader(&tar.Header{
+		Name:    EXPORT_MANIFEST_NAME,
+		Mode:    0600,
+		Size:    int64(buf.Len()),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = io.WriteString(tw, buf.String())
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, line := range manifest {
+		for _, f := range line.Files {
+			err = exportFile(tw, blobs, line.Task, f)
+			if err != nil {
+				return 0, 0, err
+			}
+			files++
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(manifest), files, gw.Close()
+}
+
+// exportFile copies the Task file into the tar, the size must not change after the digest
+func exportFile(tw *tar.Writer, blobs IBlobStore, task *TTask, ef TExportFile) error {
+	taskId := task.Id
+	f, err := blobs.Get(taskBlobPrefix(task) + ef.Name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = tw.WriteHeader(&tar.Header{
+		Name:    EXPORT_FILES_DIR + taskId + "/" + ef.Name,
+		Mode:    0644,
+		Size:    ef.Size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	n, err := io.CopyN(tw, f, ef.Size)
+	if err != nil {
+		return fmt.Errorf("Can't export %s/%s (%d of %d bytes): %s", taskId, ef.Name, n, ef.Size, err)
+	}
+	return nil
+}
+
+// importRead recreates Tasks from the export in the storage with files in the blob store,
+// existing Tasks are replaced only if overwrite is set, nothing is written on dryRun
+func importRead(r io.Reader, db IStorage, overwrite, dryRun bool) (*TImportReport, error) {
+	gr, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid export: %s", err)
+	}
+	tr := tar.NewReader(gr)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != EXPORT_MANIFEST_NAME {
+		return nil, fmt.Errorf("Invalid export: %s expected first", EXPORT_MANIFEST_NAME)
+	}
+	manifest, err := importManifest(tr)
+	if err != nil {
+		return nil, err
+	}
+	report := &TImportReport{Tasks: []string{}, Conflicts: []string{}}
+	// tasks to import with the files not received yet
+	pending := make(map[string]map[string]TExportFile)
+	var order []string
+	for _, line := range manifest {
+		taskId := line.Task.Id
+		_, err := db.GetTask(taskId)
+		if err == nil {
+			report.Conflicts = append(report.Conflicts, taskId)
+			if !overwrite {
+				continue
+			}
+		} else if !errors.Is(err, ErrTaskNotFound) {
+			return nil, err
+		}
+		files := make(map[string]TExportFile)
+		for _, f := range line.Files {
+			files[f.Name] = f
+		}
+		pending[taskId] = files
+		order = append(order, taskId)
+	}
+	if dryRun {
+		report.Tasks = order
+		return report, nil
+	}
+	staging, err := ioutil.TempDir("", "import-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+	failed := make(map[string]bool)
+	fail := func(taskId, msg string) {
+		if !failed[taskId] {
+			failed[taskId] = true
+			report.Errors = append(report.Errors, taskId+": "+msg)
+		}
+	}
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid export: %s", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || !strings.HasPrefix(hdr.Name, EXPORT_FILES_DIR) {
+			continue
+		}
+		taskId, name := filepath.Split(strings.TrimPrefix(hdr.Name, EXPORT_FILES_DIR))
+		taskId = strings.TrimSuffix(taskId, "/")
+		files, ok := pending[taskId]
+		if !ok || failed[taskId] {
+			continue
+		}
+		f, ok := files[name]
+		if !ok {
+			fail(taskId, "unexpected file "+name)
+			continue
+		}
+		digest, err := importFile(tr, staging+"/"+taskId, name)
+		if err != nil {
+			return nil, err
+		}
+		if digest != f.SHA256 {
+			fail(taskId, "digest mismatch "+name)
+			continue
+		}
+		delete(files, name)
+	}
+	for _, line := range manifest {
+		taskId := line.Task.Id
+		files, ok := pending[taskId]
+		if !ok || failed[taskId] {
+			continue
+		}
+		if len(files) > 0 {
+			for name := range files {
+				fail(taskId, "missing file "+name)
+				break
+			}
+			continue
+		}
+		err = importTask(db, line, staging+"/"+taskId)
+		if err != nil {
+			fail(taskId, err.Error())
+			continue
+		}
+		report.Tasks = append(report.Tasks, taskId)
+		report.Files += len(line.Files)
+	}
+	return report, nil
+}
+
+// importManifest reads and checks the manifest lines
+func importManifest(r io.Reader) ([]*TExportTask, error) {
+	d := json.NewDecoder(r)
+	header := &TExportHeader{}
+	err := d.Decode(header)
+	if err != nil || header.Format != EXPORT_FORMAT {
+		return nil, fmt.Errorf("Invalid export: unknown manifest format")
+	}
+	if header.Version > EXPORT_VERSION {
+		return nil, fmt.Errorf("Invalid export: manifest version %d is newer than %d", header.Version, EXPORT_VERSION)
+	}
+	var manifest []*TExportTask
+	seen := make(map[string]bool)
+	for {
+		line := &TExportTask{}
+		err = d.Decode(line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid export manifest: %s", err)
+		}
+		if line.Task == nil || !safeTaskId(line.Task.Id) || seen[line.Task.Id] {
+			return nil, fmt.Errorf("Invalid export manifest: line %d", len(manifest)+2)
+		}
+		for _, f := range line.Files {
+			if !safeFileName(f.Name) {
+				return nil, fmt.Errorf("Invalid export manifest: file name %s", f.Name)
+			}
+		}
+		seen[line.Task.Id] = true
+		manifest = append(manifest, line)
+	}
+	if len(manifest) != header.Tasks {
+		return nil, fmt.Errorf("Invalid export manifest: %d tasks expected, but was %d", header.Tasks, len(manifest))
+	}
+	return manifest, nil
+}
+
+// importFile writes the file to the staging directory and returns its digest
+func importFile(r io.Reader, dir, name string) (string, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(dir+"/"+name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// importTask puts the staged files in place and saves the Task as is,
+// files are put in the layout of new Tasks and removed if the Task is not saved,
+// files of the replaced Task are removed after it is replaced
+func importTask(db IStorage, line *TExportTask, staged string) error {
+	blobs := taskBlobs()
+	layout, err := currentLayout(db)
+	if err != nil {
+		return err
+	}
+	line.Task.setLayout(layout)
+	old, err := db.GetTask(line.Task.Id)
+	if errors.Is(err, ErrTaskNotFound) {
+		old, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		// new files don't overwrite the files of the replaced Task, the layout migration moves them later
+		layouts := []string{layout}
+		for name := range taskLayouts {
+			layouts = append(layouts, name)
+		}
+		sort.Strings(layouts[1:])
+		for _, name := range layouts {
+			line.Task.setLayout(name)
+			if taskBlobPrefix(line.Task) != taskBlobPrefix(old) {
+				break
+			}
+		}
+	}
+	prefix := taskBlobPrefix(line.Task)
+	// files left without the Task
+	err = blobDeletePrefix(blobs, prefix)
+	if err != nil {
+		return err
+	}
+	for _, ef := range line.Files {
+		f, err := os.Open(staged + "/" + ef.Name)
+		if err == nil {
+			_, err = blobs.Put(prefix+ef.Name, f)
+			f.Close()
+		}
+		if err != nil {
+			blobDeletePrefix(blobs, prefix)
+			return err
+		}
+	}
+	err = db.PutTask(line.Task)
+	if err != nil {
+		// files don't stay without the Task
+		blobDeletePrefix(blobs, prefix)
+		return err
+	}
+	if old != nil {
+		err = blobDeletePrefix(blobs, taskBlobPrefix(old))
+		if err != nil {
+			Error.Printf("Can't remove files of the replaced task %s: %s\n", old.Id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ExportImport(t *testing.T) {
+	fmt.Println("Test_ExportImport")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	Conf.MaxFiles = 2
+	Conf.MinFiles = 2
+	Conf.MaxFileSize = 1024 * 100
+	Conf.DataDir = t.TempDir()
+	src := MemoryNewStorage()
+	r := setRouting(NewId(16), src)
+	file1 := NewId(128)
+	body, ct := MakeTestUploadBody(t, "file1.bin", file1, "file2.bin", NewId(64))
+	resp := MakeTestUploadRequest(r, "POST", "", ct, body)
+	if resp.StatusCode != 201 {
+		t.Fatalf("Status expected 201 but was: %d", resp.StatusCode)
+	}
+	uploaded := &TTaskAnswer{}
+	uploaded.fromJReader(resp.Body)
+	held := &TTask{Id: NewId(TASK_ID_LEN), Status: "verified", IssuedAt: time.Now().Unix() - 100,
+		Hold: &TTaskHold{Reason: "case 1"}}
+	src.Enqueue(held)
+	exported := new(bytes.Buffer)
+	tasks, files, err := exportWrite(exported, src)
+	if err != nil || tasks != 2 || files != 3 {
+		t.Fatalf("2 tasks and 3 files with the manifest expected, but was: %d %d %v", tasks, files, err)
+	}
+	// import into the other backend and data directory
+	Conf.DataDir = dir + "/import"
+	dst, err := SqliteNewStorage(dir + "/test.sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	report, err := importRead(bytes.NewReader(exported.Bytes()), dst, false, false)
+	if err != nil || len(report.Tasks) != 2 || report.Files != 3 || len(report.Conflicts) != 0 || len(report.Errors) != 0 {
+		t.Fatalf("2 tasks imported expected, but was: %v %v", report, err)
+	}
+	if task, err := dst.GetTask(held.Id); err != nil || task.Hold == nil || task.Status != "verified" || task.Rev != 1 {
+		t.Errorf("Held task expected, but was: %v %v", task, err)
+	}
+	if task, err := dst.Claim(0); err != nil || task.Id != uploaded.TaskId {
+		t.Errorf("Task %s expected in queue, but was: %v %v", uploaded.TaskId, task, err)
+	}
+	content, err := readBlob(taskBlobs(), taskBlobPrefix(&TTask{Id: uploaded.TaskId})+"file1.bin")
+	if err != nil || content != file1 {
+		t.Errorf("Imported file expected: %s", err)
+	}
+	// existing ids are reported
+	report, err = importRead(bytes.NewReader(exported.Bytes()), dst, false, false)
+	if err != nil || len(report.Tasks) != 0 || len(report.Conflicts) != 2 {
+		t.Errorf("2 conflicts expected, but was: %v %v", report, err)
+	}
+	report, err = importRead(bytes.NewReader(exported.Bytes()), dst, true, false)
+	if err != nil || len(report.Tasks) != 2 || len(report.Conflicts) != 2 {
+		t.Errorf("2 tasks overwritten expected, but was: %v %v", report, err)
+	}
+	// new files are written beside the replaced ones, those are removed after the switch
+	content, err = readBlob(taskBlobs(), testTaskBlobPrefix(t, dst, uploaded.TaskId)+"file1.bin")
+	if err != nil || content != file1 {
+		t.Errorf("Overwritten file expected: %s", err)
+	}
+	if files := testTaskFiles(t, taskBlobs(), &TTask{Id: uploaded.TaskId}); len(files) != 0 {
+		t.Errorf("Files of the replaced task removed expected, but was: %v", files)
+	}
+	// the failed overwrite keeps the task with its files
+	failing := FaultNewStorage(dst, []TStorageFault{{"PutTask", 1, 0}})
+	report, err = importRead(bytes.NewReader(exported.Bytes()), failing, true, false)
+	if err != nil || len(report.Tasks) != 0 || len(report.Errors) != 2 {
+		t.Errorf("2 failed tasks expected, but was: %v %v", report, err)
+	}
+	content, err = readBlob(taskBlobs(), testTaskBlobPrefix(t, dst, uploaded.TaskId)+"file1.bin")
+	if err != nil || content != file1 {
+		t.Errorf("File of the kept task expected: %s", err)
+	}
+	// a changed file fails its task only
+	blobDeletePrefix(taskBlobs(), testTaskBlobPrefix(t, dst, uploaded.TaskId))
+	blobDeletePrefix(taskBlobs(), testTaskBlobPrefix(t, dst, held.Id))
+	dst.DeleteTask(uploaded.TaskId)
+	dst.DeleteTask(held.Id)
+	tampered := tamperExport(t, exported.Bytes(), "file1.bin")
+	report, err = importRead(bytes.NewReader(tampered), dst, false, false)
+	if err != nil || len(report.Tasks) != 1 || report.Tasks[0] != held.Id || len(report.Errors) != 1 {
+		t.Errorf("Digest mismatch expected, but was: %v %v", report, err)
+	}
+	if _, err := dst.GetTask(uploaded.TaskId); err == nil {
+		t.Errorf("Task %s not imported expected", uploaded.TaskId)
+	}
+	if len(testTaskFiles(t, taskBlobs(), &TTask{Id: uploaded.TaskId})) != 0 {
+		t.Errorf("No files of %s expected", uploaded.TaskId)
+	}
+	// files of the Task not saved are removed
+	report, err = importRead(bytes.NewReader(exported.Bytes()), failing, true, false)
+	if err != nil || len(report.Tasks) != 0 || len(report.Errors) != 2 {
+		t.Errorf("2 failed tasks expected, but was: %v %v", report, err)
+	}
+	if len(testTaskFiles(t, taskBlobs(), &TTask{Id: uploaded.TaskId})) != 0 {
+		t.Errorf("No files of %s expected", uploaded.TaskId)
+	}
+	_, err = importRead(strings.NewReader("not an export"), dst, false, false)
+	if err == nil {
+		t.Errorf("Invalid export expected")
+	}
+}
+
+// tamperExport changes the first byte of the file in the export
+func tamperExport(t *testing.T, export []byte, name string) []byte {
+	gr, err := gzip.NewReader(bytes.NewReader(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	out := new(bytes.Buffer)
+	gw := gzip.NewWriter(out)
+	tw := tar.NewWriter(gw)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		data, _ := ioutil.ReadAll(tr)
+		if strings.HasSuffix(hdr.Name, "/"+name) {
+			data[0] ^= 1
+		}
+		tw.WriteHeader(hdr)
+		tw.Write(data)
+	}
+	tw.Close()
+	gw.Close()
+	return out.Bytes()
+}
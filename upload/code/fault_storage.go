@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TStorageFault makes the operation fail with the rate (0..1) and sleep before
+type TStorageFault struct {
+	Op      string // operation name or "*" for all
+	Rate    float64
+	Latency time.Duration
+}
+
+// TFaultStorage injects errors and latency, for testing only
+type TFaultStorage struct {
+	IStorage
+	mu     sync.Mutex
+	faults map[string]TStorageFault
+	rnd    *rand.Rand
+}
+
+// parseStorageFaults parses "op:rate:latencyMs,...", op is an IStorage method or "*"
+func parseStorageFaults(s string) ([]TStorageFault, error) {
+	var faults []TStorageFault
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid storage fault: %s", item)
+		}
+		rate, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("Invalid storage fault rate: %s", item)
+		}
+		latency, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil || latency < 0 {
+			return nil, fmt.Errorf("Invalid storage fault latency: %s", item)
+		}
+		faults = append(faults, TStorageFault{parts[0], rate, time.Duration(latency) * time.Millisecond})
+	}
+	return faults, nil
+}
+
+func FaultNewStorage(s IStorage, faults []TStorageFault) *TFaultStorage {
+	f := &TFaultStorage{IStorage: s, rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	f.SetFaults(faults)
+	return f
+}
+
+func (f *TFaultStorage) Unwrap() IStorage {
+	return f.IStorage
+}
+
+// SetFaults replaces the faults
+func (f *TFaultStorage) SetFaults(faults []TStorageFault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = make(map[string]TStorageFault, len(faults))
+	for _, fault := range faults {
+		f.faults[fault.Op] = fault
+	}
+}
+
+// inject sleeps and returns the error if the operation must fail
+func (f *TFaultStorage) inject(op string) error {
+	f.mu.Lock()
+	fault, ok := f.faults[op]
+	if !ok {
+		fault, ok = f.faults["*"]
+	}
+	fail := ok && f.rnd.Float64() < fault.Rate
+	f.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	time.Sleep(fault.Latency)
+	if fail {
+		return fmt.Errorf("%w: Injected fault: %s", ErrStorage, op)
+	}
+	return nil
+}
+
+func (f *TFaultStorage) GetTask(taskId string) (*TTask, error) {
+	if err := f.inject("GetTask"); err != nil {
+		return nil, err
+	}
+	return f.IStorage.GetTask(taskId)
+}
+
+func (f *TFaultStorage) Enqueue(task *TTask) error {
+	if err := f.inject("Enqueue"); err != nil {
+		return err
+	}
+	return f.IStorage.Enqueue(task)
+}
+
+func (f *TFaultStorage) Claim(lease int64) (*TTask, error) {
+	if err := f.inject("Claim"); err != nil {
+		return nil, err
+	}
+	return f.IStorage.Claim(lease)
+}
+
+func (f *TFaultStorage) UpdateTask(taskId string, fn func(task *TTask) error) (*TTask, error) {
+	if err := f.inject("UpdateTask"); err != nil {
+		return nil, err
+	}
+	return f.IStorage.UpdateTask(taskId, fn)
+}
+
+func (f *TFaultStorage) PurgeTasks(status string, before int64) ([]string, error) {
+	if err := f.inject("PurgeTasks"); err != nil {
+		return nil, err
+	}
+	return f.IStorage.PurgeTasks(status, before)
+}
+
+func (f *TFaultStorage) ListTasks(status string, before int64) ([]*TTask, error) {
+	if err := f.inject("ListTasks"); err != nil {
+		return nil, err
+	}
+	return f.IStorage.ListTasks(status, before)
+}
+
+func (f *TFaultStorage) PutTask(task *TTask) error {
+	if err := f.inject("PutTask"); err != nil {
+		return err
+	}
+	return f.IStorage.PutTask(task)
+}
+
+func (f *TFaultStorage) DeleteTask(taskId string) error {
+	if err := f.inject("DeleteTask"); err != nil {
+		return err
+	}
+	return f.IStorage.DeleteTask(taskId)
+}
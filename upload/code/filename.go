@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	NAME_MAX_LEN  = 255    // bytes, the limit of file systems
+	NAME_FALLBACK = "file" // for names with nothing left after normalization
+)
+
+// TNameRule rewrites the file name, replacement is expanded as in regexp.ReplaceAllString
+type TNameRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// defaultNameRules strip copy numbers browsers add to names of saved files: "file (1).pdf"
+var defaultNameRules = []TNameRule{{regexp.MustCompile(`\s*\(\d+\)\s*\.`), "."}}
+
+// one-byte charsets of Russian mail clients, runes of 0x80-0xff bytes
+var cp1251Runes = [128]rune{
+	0x0402, 0x0403, 0x201A, 0x0453, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x20AC, 0x2030, 0x0409, 0x2039, 0x040A, 0x040C, 0x040B, 0x040F,
+	0x0452, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0xFFFD, 0x2122, 0x0459, 0x203A, 0x045A, 0x045C, 0x045B, 0x045F,
+	0x00A0, 0x040E, 0x045E, 0x0408, 0x00A4, 0x0490, 0x00A6, 0x00A7,
+	0x0401, 0x00A9, 0x0404, 0x00AB, 0x00AC, 0x00AD, 0x00AE, 0x0407,
+	0x00B0, 0x00B1, 0x0406, 0x0456, 0x0491, 0x00B5, 0x00B6, 0x00B7,
+	0x0451, 0x2116, 0x0454, 0x00BB, 0x0458, 0x0405, 0x0455, 0x0457,
+	0x0410, 0x0411, 0x0412, 0x0413, 0x0414, 0x0415, 0x0416, 0x0417,
+	0x0418, 0x0419, 0x041A, 0x041B, 0x041C, 0x041D, 0x041E, 0x041F,
+	0x0420, 0x0421, 0x0422, 0x0423, 0x0424, 0x0425, 0x0426, 0x0427,
+	0x0428, 0x0429, 0x042A, 0x042B, 0x042C, 0x042D, 0x042E, 0x042F,
+	0x0430, 0x0431, 0x0432, 0x0433, 0x0434, 0x0435, 0x0436, 0x0437,
+	0x0438, 0x0439, 0x043A, 0x043B, 0x043C, 0x043D, 0x043E, 0x043F,
+	0x0440, 0x0441, 0x0442, 0x0443, 0x0444, 0x0445, 0x0446, 0x0447,
+	0x0448, 0x0449, 0x044A, 0x044B, 0x044C, 0x044D, 0x044E, 0x044F,
+}
+
+var koi8rRunes = [128]rune{
+	0x2500, 0x2502, 0x250C, 0x2510, 0x2514, 0x2518, 0x251C, 0x2524,
+	0x252C, 0x2534, 0x253C, 0x2580, 0x2584, 0x2588, 0x258C, 0x2590,
+	0x2591, 0x2592, 0x2593, 0x2320, 0x25A0, 0x2219, 0x221A, 0x2248,
+	0x2264, 0x2265, 0x00A0, 0x2321, 0x00B0, 0x00B2, 0x00B7, 0x00F7,
+	0x2550, 0x2551, 0x2552, 0x0451, 0x2553, 0x2554, 0x2555, 0x2556,
+	0x2557, 0x2558, 0x2559, 0x255A, 0x255B, 0x255C, 0x255D, 0x255E,
+	0x255F, 0x2560, 0x2561, 0x0401, 0x2562, 0x2563, 0x2564, 0x2565,
+	0x2566, 0x2567, 0x2568, 0x2569, 0x256A, 0x256B, 0x256C, 0x00A9,
+	0x044E, 0x0430, 0x0431, 0x0446, 0x0434, 0x0435, 0x0444, 0x0433,
+	0x0445, 0x0438, 0x0439, 0x043A, 0x043B, 0x043C, 0x043D, 0x043E,
+	0x043F, 0x044F, 0x0440, 0x0441, 0x0442, 0x0443, 0x0436, 0x0432,
+	0x044C, 0x044B, 0x0437, 0x0448, 0x044D, 0x0449, 0x0447, 0x044A,
+	0x042E, 0x0410, 0x0411, 0x0426, 0x0414, 0x0415, 0x0424, 0x0413,
+	0x0425, 0x0418, 0x0419, 0x041A, 0x041B, 0x041C, 0x041D, 0x041E,
+	0x041F, 0x042F, 0x0420, 0x0421, 0x0422, 0x0423, 0x0416, 0x0412,
+	0x042C, 0x042B, 0x0417, 0x0428, 0x042D, 0x0429, 0x0427, 0x042A,
+}
+
+var nameCharsets = map[string]*[128]rune{
+	"windows-1251": &cp1251Runes,
+	"cp1251":       &cp1251Runes,
+	"koi8-r":       &koi8rRunes,
+}
+
+// charsetDecode converts the name in the charset to UTF-8
+func charsetDecode(charset string, b []byte) (string, error) {
+	charset = strings.ToLower(charset)
+	switch charset {
+	case "utf-8", "us-ascii", "":
+		return string(b), nil
+	}
+	runes, ok := nameCharsets[charset]
+	if !ok {
+		return "", fmt.Errorf("Unsupported charset: %s", charset)
+	}
+	s := make([]rune, 0, len(b))
+	for _, c := range b {
+		if c < 0x80 {
+			s = append(s, rune(c))
+		} else {
+			s = append(s, runes[c-0x80])
+		}
+	}
+	return string(s), nil
+}
+
+// charsetReader converts the text of the supported charsets to UTF-8
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	b, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	s, err := charsetDecode(charset, b)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(s), nil
+}
+
+// nameWordDecoder decodes RFC 2047 words of the supported charsets
+var nameWordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// nameRules returns the configured rules, the default ones if they were not read
+func nameRules() []TNameRule {
+	if Conf.NameRules == nil {
+		return defaultNameRules
+	}
+	return Conf.NameRules
+}
+
+// parseNameRules reads "<regexp> => <replacement>" lines of the file, the default rules are used without it
+func parseNameRules(file string) ([]TNameRule, error) {
+	if file == "" {
+		return defaultNameRules, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules := []TNameRule{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern, replacement, ok := strings.Cut(line, "=>")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: <regexp> => <replacement> expected", file, n)
+		}
+		re, err := regexp.Compile(strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, n, err)
+		}
+		rules = append(rules, TNameRule{re, strings.TrimSpace(replacement)})
+	}
+	return rules, scanner.Err()
+}
+
+// dispositionParams splits parameters of the Content-Disposition header, keys are lower case,
+// unlike mime.ParseMediaType it keeps extended values of any charset as they are
+func dispositionParams(header string) map[string]string {
+	params := make(map[string]string)
+	_, rest, _ := strings.Cut(header, ";")
+	for {
+		rest = strings.TrimLeft(rest, " \t;")
+		if rest == "" {
+			return params
+		}
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			return params
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimLeft(value, " \t")
+		if strings.HasPrefix(value, `"`) {
+			b := new(strings.Builder)
+			i := 1
+			for ; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				b.WriteByte(value[i])
+			}
+			params[key] = b.String()
+			_, rest, _ = strings.Cut(value[i:], ";")
+		} else {
+			value, rest, _ = strings.Cut(value, ";")
+			params[key] = strings.TrimSpace(value)
+		}
+	}
+}
+
+// decode2231 decodes charset'language'percent-encoded value
+func decode2231(value string) (string, error) {
+	charset, value, ok := strings.Cut(value, "'")
+	if !ok {
+		return "", fmt.Errorf("Charset expected in %s", value)
+	}
+	_, value, ok = strings.Cut(value, "'")
+	if !ok {
+		return "", fmt.Errorf("Language expected in %s", value)
+	}
+	b, err := url.PathUnescape(value)
+	if err != nil {
+		return "", err
+	}
+	return charsetDecode(charset, []byte(b))
+}
+
+// partFileName returns the decoded file name of the form part and the name as it was sent,
+// RFC 2231 filename* (with continuations) is preferred to RFC 2047 words of filename,
+// ok is false for fields without a file name
+func partFileName(header string) (name, sent string, ok bool, err error) {
+	params := dispositionParams(header)
+	if v, found := params["filename*"]; found {
+		name, err = decode2231(v)
+		return name, v, true, err
+	}
+	// continuations: filename*0*=utf-8''%D0%B0; filename*1="b.pdf"
+	keys := []string{}
+	for key := range params {
+		if strings.HasPrefix(key, "filename*") {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) > 0 {
+		number := func(key string) int {
+			n, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(key, "filename*"), "*"))
+			return n
+		}
+		sort.Slice(keys, func(i, j int) bool { return number(keys[i]) < number(keys[j]) })
+		var value strings.Builder
+		encoded := strings.HasSuffix(keys[0], "*")
+		for _, key := range keys {
+			value.WriteString(params[key])
+		}
+		sent = value.String()
+		if !encoded {
+			return sent, sent, true, nil
+		}
+		name, err = decode2231(sent)
+		return name, sent, true, err
+	}
+	sent, ok = params["filename"]
+	if !ok {
+		return "", "", false, nil
+	}
+	name, err = nameWordDecoder.DecodeHeader(sent)
+	return name, sent, true, err
+}
+
+// normalizeFileName makes the stored name of the sent one: the last path element without
+// control and reserved characters, rewritten by the rules, limited in length
+func normalizeFileName(name string, rules []TNameRule) string {
+	name = strings.ToValidUTF8(name, "_")
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	for _, rule := range rules {
+		name = rule.Pattern.ReplaceAllString(name, rule.Replacement)
+	}
+	// no hidden files and no trailing dots Windows drops
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	name = strings.TrimRight(name, ". ")
+	if len(name) > NAME_MAX_LEN {
+		ext := ""
+		if i := strings.LastIndex(name, "."); i > 0 && len(name)-i <= 16 {
+			ext = name[i:]
+		}
+		base := name[:NAME_MAX_LEN-len(ext)]
+		for !utf8.ValidString(base) {
+			base = base[:len(base)-1]
+		}
+		name = base + ext
+	}
+	if name == "" || !safeFileName(name) {
+		return NAME_FALLBACK
+	}
+	return name
+}
+
+// uniqueFileName adds -2, -3 before the extension of the taken name, the first file keeps it,
+// the base is cut to keep the name within the length limit
+func uniqueFileName(name string, taken map[string]bool) string {
+	unique := name
+	ext := ""
+	base := name
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i:]
+	}
+	for n := 2; taken[strings.ToLower(unique)]; n++ {
+		suffix := fmt.Sprintf("-%d", n)
+		b, e := base, ext
+		if len(b)+len(suffix)+len(e) > NAME_MAX_LEN {
+			// the extension too long to keep is cut with the base
+			if len(suffix)+len(e) >= NAME_MAX_LEN {
+				b, e = name, ""
+			}
+			b = b[:NAME_MAX_LEN-len(suffix)-len(e)]
+			for !utf8.ValidString(b) {
+				b = b[:len(b)-1]
+			}
+		}
+		unique = b + suffix + e
+	}
+	taken[strings.ToLower(unique)] = true
+	return unique
+}
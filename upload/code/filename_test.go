@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func Test_FileNames(t *testing.T) {
+	fmt.Println("Test_FileNames")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	for header, expected := range map[string]string{
+		`form-data; name="file"; filename="notice (1).pdf"`:                                     "notice.pdf",
+		`form-data; name="file"; filename="=?UTF-8?B?0YPQstC10LTQvtC80LvQtdC90LjQtS5wZGY=?="`:   "уведомление.pdf",
+		`form-data; name="file"; filename="=?windows-1251?B?8+Ll5O7s6+Xt6OUucGRm?="`:            "уведомление.pdf",
+		`form-data; name="file"; filename="=?koi8-r?Q?=D5=D7=C5=C4=CF=CD=CC=C5=CE=C9=C5.pdf?="`: "уведомление.pdf",
+		`form-data; name="file"; filename*=windows-1251''%F3%E2%E5%E4%EE%EC%EB%E5%ED%E8%E5.pdf`: "уведомление.pdf",
+		`form-data; name="file"; filename*0*=utf-8''%D1%83; filename*1=".pdf"`:                  "у.pdf",
+		`form-data; name="file"; filename="../../etc/passwd"`:                                   "passwd",
+		`form-data; name="file"; filename="a` + "\x00" + `b<>.pdf"`:                             "a_b__.pdf",
+		`form-data; name="file"; filename=".."`:                                                 NAME_FALLBACK,
+		`form-data; name="file"; filename=".hidden.pdf. "`:                                      "hidden.pdf",
+		`form-data; name="file"; filename="` + strings.Repeat("я", 200) + `.pdf"`:               strings.Repeat("я", 125) + ".pdf",
+	} {
+		name, _, ok, err := partFileName(header)
+		if stored := normalizeFileName(name, defaultNameRules); !ok || err != nil || stored != expected {
+			t.Errorf("%s: %s expected, but was: %s %v", header, expected, stored, err)
+		}
+	}
+	if _, _, ok, _ := partFileName(`form-data; name="comment"`); ok {
+		t.Errorf("Field without file name expected")
+	}
+	if _, sent, _, err := partFileName(`form-data; name="file"; filename="=?iso-2022-jp?B?GyRCJUYlOSVIGyhC?="`); err == nil || sent == "" {
+		t.Errorf("Unsupported charset error expected")
+	}
+	// collisions are resolved in the order of parts
+	taken := map[string]bool{MANIFEST_NAME: true}
+	for _, expected := range []string{"a.pdf", "a-2.pdf", "A-3.PDF", "manifest-2.json"} {
+		name := strings.Replace(expected, "-2", "", 1)
+		name = strings.Replace(name, "-3", "", 1)
+		if unique := uniqueFileName(name, taken); unique != expected {
+			t.Errorf("%s expected, but was: %s", expected, unique)
+		}
+	}
+	// the suffix doesn't make the longest name longer
+	long := normalizeFileName(strings.Repeat("ж", 200)+".pdf", nil)
+	cut := strings.Repeat("ж", (NAME_MAX_LEN-len("-2.pdf"))/2)
+	for _, expected := range []string{long, cut + "-2.pdf", cut + "-3.pdf"} {
+		if unique := uniqueFileName(long, taken); unique != expected || len(unique) > NAME_MAX_LEN || !utf8.ValidString(unique) {
+			t.Errorf("%s expected, but was: %s", expected, unique)
+		}
+	}
+	// configured rules replace the default ones
+	rulesFile := t.TempDir() + "/test.rules"
+	ioutil.WriteFile(rulesFile, []byte("# scanner prefixes\n^scan_ =>\n\\.PDF$ => .pdf\n"), 0644)
+	rules, err := parseNameRules(rulesFile)
+	if err != nil || len(rules) != 2 {
+		t.Fatalf("2 rules expected, but was: %v %v", rules, err)
+	}
+	if stored := normalizeFileName("scan_notice (1).PDF", rules); stored != "notice (1).pdf" {
+		t.Errorf("notice (1).pdf expected, but was: %s", stored)
+	}
+	ioutil.WriteFile(rulesFile, []byte("(unclosed => x\n"), 0644)
+	if _, err := parseNameRules(rulesFile); err == nil {
+		t.Errorf("Invalid rule error expected")
+	}
+}
+
+func Test_UploadFileNames(t *testing.T) {
+	fmt.Println("Test_UploadFileNames")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	Conf.MaxFiles = 2
+	Conf.MinFiles = 2
+	Conf.MaxFileSize = 1024 * 100
+	Conf.DataDir = t.TempDir()
+	db := MemoryNewStorage()
+	r := setRouting(NewId(16), db)
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, disposition := range []string{
+		`form-data; name="file1"; filename*=koi8-r''%D5%D7%C5%C4.pdf`,
+		`form-data; name="file2"; filename="../увед.pdf"`,
+	} {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", disposition)
+		part, _ := writer.CreatePart(h)
+		part.Write([]byte(NewId(64)))
+	}
+	writer.Close()
+	resp := MakeTestUploadRequest(r, "POST", "", writer.FormDataContentType(), body)
+	if resp.StatusCode != 201 {
+		t.Fatalf("Status expected 201 but was: %d", resp.StatusCode)
+	}
+	answer := &TTaskAnswer{}
+	answer.fromJReader(resp.Body)
+	task, _ := db.GetTask(answer.TaskId)
+	m, err := readManifest(taskBlobs(), task)
+	if err != nil || len(m.Files) != 2 {
+		t.Fatalf("Manifest of 2 files expected, but was: %v %v", m, err)
+	}
+	// the original names are kept, the stored ones don't overwrite each other
+	if f := m.Files[0]; f.Name != "увед.pdf" || f.Encoded != "koi8-r''%D5%D7%C5%C4.pdf" || f.Stored != "увед.pdf" {
+		t.Errorf("Decoded name expected, but was: %v", f)
+	}
+	if f := m.Files[1]; f.Name != "../увед.pdf" || f.Encoded != "" || f.Stored != "увед-2.pdf" {
+		t.Errorf("Renamed file without the path expected, but was: %v", f)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+const (
+	TYPE_CMS      = "cms" // DER encoded CMS (PKCS #7) signed data
+	TYPE_PDF      = "pdf"
+	TYPE_DOCX     = "docx" // Office Open XML document
+	TYPE_DOC      = "doc"  // Word 97-2003 compound file
+	TYPE_RTF      = "rtf"
+	TYPE_XML      = "xml"
+	TYPE_ZIP      = "zip" // other zip containers
+	TYPE_UNKNOWN  = "unknown"
+	TYPES_ANY     = "any"
+	ZIP_MAX_RATIO = 100 // unpacked size of zip entries to the file size, bombs are rejected
+	PDF_MAX_START = 8   // bytes some writers put before "%PDF-"
+)
+
+// defaultFileTypes are the types of signed notifications
+const defaultFileTypes = "cms,pdf,docx,doc,rtf,xml"
+
+// 1.2.840.113549.1.7.2, PKCS #7 signed data
+var oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+// DER of the OID with the tag and the length
+var derSignedData = []byte{0x06, 0x09, 0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x07, 0x02}
+
+var cfbMagic = []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}
+
+var pdfHeader = regexp.MustCompile(`^%PDF-\d\.\d`)
+
+// fileValidators check the structure of the detected type
+var fileValidators = map[string]func(b []byte) error{
+	TYPE_CMS:  validateCMS,
+	TYPE_PDF:  validatePDF,
+	TYPE_DOCX: validateDOCX,
+	TYPE_DOC:  validateDOC,
+	TYPE_RTF:  validateRTF,
+	TYPE_XML:  validateXML,
+	TYPE_ZIP: func(b []byte) error {
+		_, err := openZip(b)
+		return err
+	},
+}
+
+// ContentInfo of RFC 5652, raw values keep [0] EXPLICIT tags, their Bytes are the tagged values
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0"`
+}
+
+type cmsEncapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     asn1.RawValue `asn1:"optional,tag:0"` // absent in detached signatures
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsEncapContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue   `asn1:"optional,tag:1"`
+	SignerInfos      []asn1.RawValue `asn1:"set"`
+}
+
+// TFileCheckError is the reason to reject the uploaded file
+type TFileCheckError struct {
+	Code   string // E_UNSUPPORTED_TYPE, E_MALFORMED_SIGNATURE, E_MALFORMED_FILE
+	Name   string
+	Reason string
+}
+
+func (e *TFileCheckError) Error() string {
+	return e.Name + ": " + e.Reason
+}
+
+// parseFileTypes returns the allowed types of "type,..." or nil for "any"
+func parseFileTypes(s string) (map[string]bool, error) {
+	if strings.TrimSpace(s) == TYPES_ANY {
+		return nil, nil
+	}
+	types := make(map[string]bool)
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if _, ok := fileValidators[t]; !ok {
+			return nil, fmt.Errorf("Unknown file type: %s (cms, pdf, docx, doc, rtf, xml, zip, any)", t)
+		}
+		types[t] = true
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("No file types are allowed")
+	}
+	return types, nil
+}
+
+// pdfStart returns the offset of "%PDF-" close to the start or -1
+func pdfStart(b []byte) int {
+	head := b
+	if len(head) > PDF_MAX_START+5 {
+		head = head[:PDF_MAX_START+5]
+	}
+	return bytes.Index(head, []byte("%PDF-"))
+}
+
+// detectFileType tells the type by magic bytes, prefixes are checked before magics found further
+func detectFileType(b []byte) string {
+	head := b
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	der := head
+	if len(der) > 32 {
+		der = der[:32]
+	}
+	switch {
+	case len(b) > 2 && b[0] == 0x30 && bytes.Contains(der, derSignedData):
+		return TYPE_CMS
+	case bytes.HasPrefix(b, []byte("PK\x03\x04")) || bytes.HasPrefix(b, []byte("PK\x05\x06")):
+		if z, err := openZip(b); err == nil && zipHas(z, "[Content_Types].xml") && zipHas(z, "word/document.xml") {
+			return TYPE_DOCX
+		}
+		return TYPE_ZIP
+	case pdfStart(b) >= 0:
+		return TYPE_PDF
+	case bytes.HasPrefix(b, cfbMagic):
+		return TYPE_DOC
+	case bytes.HasPrefix(b, []byte(`{\rtf`)):
+		return TYPE_RTF
+	}
+	text := bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")), " \t\r\n")
+	if bytes.HasPrefix(text, []byte("<?xml")) {
+		return TYPE_XML
+	}
+	return TYPE_UNKNOWN
+}
+
+// checkFile detects the type of the uploaded file and validates its structure,
+// allowed nil accepts files of any type
+func checkFile(name string, b []byte, allowed map[string]bool) (string, *TFileCheckError) {
+	t := detectFileType(b)
+	if t == TYPE_UNKNOWN && signatureName(name) && allowed != nil {
+		return t, &TFileCheckError{E_MALFORMED_SIGNATURE, name, "not a DER encoded CMS signature"}
+	}
+	if allowed != nil && !allowed[t] {
+		return t, &TFileCheckError{E_UNSUPPORTED_TYPE, name, "type " + t + " is not allowed"}
+	}
+	validate, ok := fileValidators[t]
+	if !ok {
+		return t, nil
+	}
+	if err := validate(b); err != nil {
+		if t == TYPE_CMS {
+			return t, &TFileCheckError{E_MALFORMED_SIGNATURE, name, err.Error()}
+		}
+		return t, &TFileCheckError{E_MALFORMED_FILE, name, err.Error()}
+	}
+	return t, nil
+}
+
+// parseCMS returns the signed data of the DER encoded CMS
+func parseCMS(b []byte) (*cmsSignedData, error) {
+	ci := &cmsContentInfo{}
+	rest, err := asn1.Unmarshal(b, ci)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CMS: %s", err)
+	}
+	if len(bytes.TrimRight(rest, "\x00")) > 0 {
+		return nil, fmt.Errorf("Invalid CMS: %d bytes after the signature", len(rest))
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("Invalid CMS: content type %s is not signed data", ci.ContentType)
+	}
+	sd := &cmsSignedData{}
+	rest, err = asn1.Unmarshal(ci.Content.Bytes, sd)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CMS signed data: %s", err)
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("Invalid CMS signed data: %d bytes after it", len(rest))
+	}
+	if len(sd.SignerInfos) == 0 {
+		return nil, fmt.Errorf("Invalid CMS signed data: no signers")
+	}
+	return sd, nil
+}
+
+func validateCMS(b []byte) error {
+	_, err := parseCMS(b)
+	return err
+}
+
+// validatePDF checks the header and the trailer, incremental updates append them to the end
+func validatePDF(b []byte) error {
+	start := pdfStart(b)
+	if start < 0 || !pdfHeader.Match(b[start:]) {
+		return fmt.Errorf("Invalid PDF header")
+	}
+	tail := b[start:]
+	if len(tail) > 2048 {
+		tail = tail[len(tail)-2048:]
+	}
+	eof := bytes.LastIndex(tail, []byte("%%EOF"))
+	if eof < 0 {
+		return fmt.Errorf("PDF trailer not found: no %%%%EOF")
+	}
+	if !bytes.Contains(tail[:eof], []byte("startxref")) {
+		return fmt.Errorf("PDF trailer not found: no startxref")
+	}
+	return nil
+}
+
+func openZip(b []byte) (*zip.Reader, error) {
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid zip: %s", err)
+	}
+	return z, nil
+}
+
+func zipHas(z *zip.Reader, name string) bool {
+	for _, f := range z.File {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateDOCX unpacks all entries of the container to check their checksums
+func validateDOCX(b []byte) error {
+	z, err := openZip(b)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"[Content_Types].xml", "word/document.xml"} {
+		if !zipHas(z, name) {
+			return fmt.Errorf("Invalid DOCX: no %s", name)
+		}
+	}
+	limit := int64(len(b)) * ZIP_MAX_RATIO
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("Invalid DOCX: %s: %s", f.Name, err)
+		}
+		n, err := io.Copy(ioutil.Discard, io.LimitReader(r, limit+1))
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("Invalid DOCX: %s: %s", f.Name, err)
+		}
+		limit -= n
+		if limit < 0 {
+			return fmt.Errorf("Invalid DOCX: unpacked entries are too big")
+		}
+	}
+	return nil
+}
+
+// validateDOC checks the compound file header
+func validateDOC(b []byte) error {
+	if len(b) < 512 {
+		return fmt.Errorf("Invalid DOC: the header is truncated")
+	}
+	if b[28] != 0xfe || b[29] != 0xff {
+		return fmt.Errorf("Invalid DOC: wrong byte order mark")
+	}
+	if shift := int(b[30]) | int(b[31])<<8; shift != 9 && shift != 12 {
+		return fmt.Errorf("Invalid DOC: wrong sector size")
+	}
+	return nil
+}
+
+// validateRTF checks that groups are balanced and the document group is closed at the end
+func validateRTF(b []byte) error {
+	depth := 0
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("Invalid RTF: unbalanced groups")
+			}
+			if depth == 0 && len(bytes.TrimRight(b[i+1:], " \t\r\n\x00")) > 0 {
+				return fmt.Errorf("Invalid RTF: data after the document")
+			}
+		}
+	}
+	if depth != 0 {
+		return fmt.Errorf("Invalid RTF: the document is not closed")
+	}
+	return nil
+}
+
+// validateXML parses the document, windows-1251 and koi8-r declarations are read as well
+func validateXML(b []byte) error {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	d.CharsetReader = charsetReader
+	roots := 0
+	depth := 0
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid XML: %s", err)
+		}
+		switch token.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				roots++
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	if roots != 1 {
+		return fmt.Errorf("Invalid XML: %d root elements", roots)
+	}
+	return nil
+}
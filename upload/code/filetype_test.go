@@ -0,0 +1,179 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testPDF returns the smallest document with the header and the trailer
+func testPDF() string {
+	return "%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\ntrailer\n<< /Root 1 0 R >>\nstartxref\n9\n%%EOF\n"
+}
+
+// testDOCX returns the container with the document, entries are stored to be changed by tests
+func testDOCX(t *testing.T, entries ...string) string {
+	if len(entries) == 0 {
+		entries = []string{"[Content_Types].xml", "word/document.xml"}
+	}
+	b := new(bytes.Buffer)
+	z := zip.NewWriter(b)
+	for _, name := range entries {
+		w, err := z.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(w, `<?xml version="1.0"?><w:document name="%s"/>`, name)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+// testCMS returns the DER encoded signed data of the content, detached without it
+func testCMS(t *testing.T, content []byte) string {
+	signer, _ := asn1.Marshal(struct {
+		Version   int
+		Signature []byte
+	}{1, []byte(NewId(64))})
+	sd := cmsSignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: asn1.ObjectIdentifier{1, 2, 643, 7, 1, 1, 2, 2}}},
+		EncapContentInfo: cmsEncapContentInfo{EContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}},
+		SignerInfos:      []asn1.RawValue{{FullBytes: signer}},
+	}
+	explicit := func(v interface{}) asn1.RawValue {
+		b, err := asn1.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: b}
+	}
+	if content != nil {
+		sd.EncapContentInfo.EContent = explicit(content)
+	}
+	b, err := asn1.Marshal(cmsContentInfo{ContentType: oidSignedData, Content: explicit(sd)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func Test_FileTypes(t *testing.T) {
+	fmt.Println("Test_FileTypes")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	allowed, err := parseFileTypes(defaultFileTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cms := testCMS(t, nil)
+	docx := testDOCX(t)
+	damaged := strings.Replace(docx, `name="word/document.xml"`, `name="word/document.xmL"`, 1)
+	doc := string(cfbMagic) + strings.Repeat("\x00", 20) + "\xfe\xff\x09\x00" + strings.Repeat("\x00", 480)
+	for _, c := range []struct {
+		name, content, fileType, code string
+	}{
+		{"a.pdf.sig", cms, TYPE_CMS, ""},
+		{"a.pdf.sig", testCMS(t, []byte("attached")), TYPE_CMS, ""},
+		{"a.pdf.sig", cms[:len(cms)-5], TYPE_CMS, E_MALFORMED_SIGNATURE},
+		{"a.pdf.sig", "-----BEGIN PKCS7-----", TYPE_UNKNOWN, E_MALFORMED_SIGNATURE},
+		{"a.pdf", testPDF(), TYPE_PDF, ""},
+		{"a.pdf", "%PDF-1.4\n" + NewId(64), TYPE_PDF, E_MALFORMED_FILE},
+		{"a.pdf", "\r\n" + testPDF(), TYPE_PDF, ""},
+		{"a.pdf", NewId(64) + testPDF(), TYPE_UNKNOWN, E_UNSUPPORTED_TYPE},
+		{"a.zip", testDOCX(t, "%PDF-1.4.txt"), TYPE_ZIP, E_UNSUPPORTED_TYPE},
+		{"a.docx", docx, TYPE_DOCX, ""},
+		{"a.docx", damaged, TYPE_DOCX, E_MALFORMED_FILE},
+		{"a.zip", testDOCX(t, "a.txt"), TYPE_ZIP, E_UNSUPPORTED_TYPE},
+		{"a.doc", doc, TYPE_DOC, ""},
+		{"a.doc", doc[:100], TYPE_DOC, E_MALFORMED_FILE},
+		{"a.rtf", `{\rtf1 {\b bold \}} text}`, TYPE_RTF, ""},
+		{"a.rtf", `{\rtf1 {\b bold} text`, TYPE_RTF, E_MALFORMED_FILE},
+		{"a.xml", "\xef\xbb\xbf<?xml version=\"1.0\" encoding=\"windows-1251\"?>\n<a>\xe0</a>\n", TYPE_XML, ""},
+		{"a.xml", `<?xml version="1.0"?><a><b></a>`, TYPE_XML, E_MALFORMED_FILE},
+		{"a.txt", "plain text", TYPE_UNKNOWN, E_UNSUPPORTED_TYPE},
+	} {
+		fileType, cerr := checkFile(c.name, []byte(c.content), allowed)
+		code := ""
+		if cerr != nil {
+			code = cerr.Code
+		}
+		if fileType != c.fileType || code != c.code {
+			t.Errorf("%s %.20q: %s %s expected, but was: %s %v", c.name, c.content, c.fileType, c.code, fileType, cerr)
+		}
+	}
+	// any type is accepted, but known ones are still validated
+	if _, cerr := checkFile("a.sig", []byte("plain text"), nil); cerr != nil {
+		t.Errorf("Any file expected, but was: %v", cerr)
+	}
+	if _, cerr := checkFile("a.pdf", []byte("%PDF-1.4\n"), nil); cerr == nil || cerr.Code != E_MALFORMED_FILE {
+		t.Errorf("Malformed PDF expected, but was: %v", cerr)
+	}
+	if types, err := parseFileTypes("pdf, CMS"); err != nil || len(types) != 2 || !types[TYPE_CMS] {
+		t.Errorf("2 types expected, but was: %v %v", types, err)
+	}
+	if types, err := parseFileTypes(TYPES_ANY); err != nil || types != nil {
+		t.Errorf("Any type expected, but was: %v %v", types, err)
+	}
+	if _, err := parseFileTypes("pdf,exe"); err == nil {
+		t.Errorf("Unknown type error expected")
+	}
+}
+
+func Test_UploadFileTypes(t *testing.T) {
+	fmt.Println("Test_UploadFileTypes")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	Conf.MaxFiles = 2
+	Conf.MinFiles = 2
+	Conf.MaxFileSize = 1024 * 100
+	Conf.DataDir = t.TempDir()
+	Conf.QuarantineDir = Conf.DataDir + "/quarantine"
+	defer func() { Conf.QuarantineDir = "" }()
+	Conf.AllowedTypes, _ = parseFileTypes(defaultFileTypes)
+	defer func() { Conf.AllowedTypes = nil }()
+	db := MemoryNewStorage()
+	r := setRouting(NewId(16), db)
+	body, ct := MakeTestUploadBody(t, "notice.pdf", testPDF(), "notice.pdf.sig", testCMS(t, nil))
+	resp := MakeTestUploadRequest(r, "POST", "", ct, body)
+	if resp.StatusCode != 201 {
+		t.Fatalf("Status expected 201 but was: %d", resp.StatusCode)
+	}
+	answer := &TTaskAnswer{}
+	answer.fromJReader(resp.Body)
+	task, _ := db.GetTask(answer.TaskId)
+	if m, err := readManifest(taskBlobs(), task); err != nil || m.Files[0].Type != TYPE_PDF || m.Files[1].Type != TYPE_CMS {
+		t.Errorf("Detected types expected, but was: %v %v", m, err)
+	}
+	// rejected uploads are explained and kept in the quarantine
+	for _, c := range []struct {
+		files   []string
+		code    string
+		details string
+	}{
+		{[]string{"notice.pdf", testPDF(), "notice.pdf.sig", "garbage"}, E_MALFORMED_SIGNATURE, "notice.pdf.sig: not a DER encoded CMS signature"},
+		{[]string{"notice.exe", "MZ" + NewId(64), "notice.exe.sig", testCMS(t, nil)}, E_UNSUPPORTED_TYPE, "notice.exe: type unknown is not allowed"},
+	} {
+		body, ct = MakeTestUploadBody(t, c.files...)
+		resp = MakeTestUploadRequest(r, "POST", "", ct, body)
+		e := &TJSONError{}
+		if resp.StatusCode != 400 || json.NewDecoder(resp.Body).Decode(e) != nil || e.Msg != c.code || e.Details != c.details {
+			t.Errorf("%s expected, but was: %d %v", c.code, resp.StatusCode, e)
+		}
+	}
+	entries, _ := quarantineList()
+	if len(entries) != 2 {
+		t.Fatalf("2 rejected uploads expected, but was: %v", entries)
+	}
+	for _, q := range entries {
+		if !strings.HasPrefix(q.Reason, E_MALFORMED_SIGNATURE+": ") && !strings.HasPrefix(q.Reason, E_UNSUPPORTED_TYPE+": ") {
+			t.Errorf("Rejected upload expected, but was: %v", q)
+		}
+	}
+}
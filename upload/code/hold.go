@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"time"
+)
+
+// TTaskHold is a legal hold placed on the Task
+type TTaskHold struct {
+	Reason string `json:"reason"` // why the task is kept
+	Actor  string `json:"actor"`  // who placed the hold
+	At     int64  `json:"at"`     // when the hold was placed
+}
+
+// TTaskHoldRecord is an entry of the Task hold history
+type TTaskHoldRecord struct {
+	Action string `json:"action"` // "hold" or "release"
+	Reason string `json:"reason"`
+	Actor  string `json:"actor"`
+	At     int64  `json:"at"`
+}
+
+type TTaskHoldRequest struct {
+	Reason string `json:"reason"`
+	Actor  string `json:"actor"`
+}
+
+// Fill TTaskHoldRequest object from io.Reader as JSON
+func (c *TTaskHoldRequest) fromJReader(r io.Reader) error {
+	return json.NewDecoder(r).Decode(c)
+}
+
+// place or release the legal hold, action is "hold" or "release"
+func taskHoldHandler(w http.ResponseWriter, r *http.Request, db IStorage, action string) {
+	// implies, that the method and content type checks was completed at the routing stage
+	var req TTaskHoldRequest
+	vars := mux.Vars(r)
+	task_id := vars["task"]
+	err := req.fromJReader(r.Body)
+	if err != nil || req.Actor == "" || (action == "hold" && req.Reason == "") {
+		sendJSONErrorMessage(w, E_INVALID_REQUEST, http.StatusBadRequest)
+		Warning.Printf("[%s]: Invalid hold request: %s\n", r.RemoteAddr, task_id)
+		return
+	}
+	// retention removes files under the lock after it checks the hold
+	lock := taskFilesLock(task_id)
+	lock.Lock()
+	defer lock.Unlock()
+	// update the Task in the database
+	task, err := db.UpdateTask(task_id, func(task *TTask) error {
+		if (action == "hold" && task.Hold != nil) || (action == "release" && task.Hold == nil) {
+			return ErrTaskConflict
+		}
+		record := TTaskHoldRecord{Action: action, Reason: req.Reason, Actor: req.Actor, At: time.Now().Unix()}
+		if action == "hold" {
+			task.Hold = &TTaskHold{Reason: record.Reason, Actor: record.Actor, At: record.At}
+		} else {
+			task.Hold = nil
+		}
+		task.HoldHistory = append(task.HoldHistory, record)
+		return nil
+	})
+	if err != nil {
+		sendStorageError(w, r, task_id, err)
+		return
+	}
+	// start a normal output
+	HelperSetStandartHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	// write a Task info
+	err = task.toJWriter(w)
+	if err != nil {
+		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// write a success message to the log
+	Info.Printf("[%s]: Task %s legal hold %s by %s: %s\n", r.RemoteAddr, task_id, action, req.Actor, req.Reason)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_Hold(t *testing.T) {
+	fmt.Println("Test_Hold")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	Conf.MaxFiles = 2
+	Conf.MinFiles = 2
+	Conf.MaxFileSize = 1024 * 100
+	Conf.DataDir = t.TempDir()
+	db, err := BoltNewStorage(dir + "/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	token := NewId(16)
+	r := setRouting(token, db)
+	b := new(bytes.Buffer)
+	body, ct := MakeTestUploadBody(t, "file1.bin", NewId(128), "file2.bin", NewId(64))
+	resp := MakeTestUploadRequest(r, "POST", "", ct, body)
+	if resp.StatusCode != 201 {
+		t.Errorf("Status expected 201 but was: %d", resp.StatusCode)
+	}
+	task := &TTaskAnswer{}
+	err = task.fromJReader(resp.Body)
+	if err != nil {
+		t.Errorf("JSON parser error: %s", err)
+	}
+	resp = MakeTestTaskRequest(r, "PATCH", "/"+task.TaskId+"/ok", token, b)
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	// hold without a reason
+	resp = MakeTestTaskRequest(r, "PUT", "/"+task.TaskId+"/hold", token, bytes.NewBufferString(`{"actor":"lawyer"}`))
+	if resp.StatusCode != 400 {
+		t.Errorf("Status expected 400 but was: %d", resp.StatusCode)
+	}
+	resp = MakeTestTaskRequest(r, "PUT", "/"+task.TaskId+"/hold", "", bytes.NewBufferString(`{"actor":"lawyer","reason":"case 1"}`))
+	if resp.StatusCode != 401 {
+		t.Errorf("Status expected 401 but was: %d", resp.StatusCode)
+	}
+	resp = MakeTestTaskRequest(r, "PUT", "/"+task.TaskId+"/hold", token, bytes.NewBufferString(`{"actor":"lawyer","reason":"case 1"}`))
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	resp = MakeTestTaskRequest(r, "PUT", "/"+task.TaskId+"/hold", token, bytes.NewBufferString(`{"actor":"lawyer","reason":"case 2"}`))
+	if resp.StatusCode != 409 {
+		t.Errorf("Status expected 409 but was: %d", resp.StatusCode)
+	}
+	// held task is not purged
+	time.Sleep(2 * time.Second)
+	reports := retentionRun(db, []TRetentionPolicy{{Status: "verified", TaskTTL: 1, FilesTTL: 1}})
+	if len(reports.Reports[0].TasksPurged) != 0 || len(reports.Reports[0].FilesRemoved) != 0 {
+		t.Errorf("Unexpected report: %v", reports.Reports[0])
+	}
+	if list, err := taskBlobs().List(testTaskBlobPrefix(t, db, task.TaskId)); err != nil || len(list) == 0 {
+		t.Errorf("Task files expected: %v", err)
+	}
+	resp = MakeTestTaskRequest(r, "GET", "/"+task.TaskId+"/details", token, b)
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	details := &TTask{}
+	err = details.fromJReader(resp.Body)
+	if err != nil {
+		t.Errorf("JSON parser error: %s", err)
+	}
+	if details.Hold == nil || details.Hold.Actor != "lawyer" || details.Hold.Reason != "case 1" {
+		t.Errorf("Hold expected in details: %v", details)
+	}
+	// release
+	resp = MakeTestTaskRequest(r, "DELETE", "/"+task.TaskId+"/hold", token, bytes.NewBufferString(`{"actor":"judge","reason":"closed"}`))
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	resp = MakeTestTaskRequest(r, "DELETE", "/"+task.TaskId+"/hold", token, bytes.NewBufferString(`{"actor":"judge"}`))
+	if resp.StatusCode != 409 {
+		t.Errorf("Status expected 409 but was: %d", resp.StatusCode)
+	}
+	resp = MakeTestTaskRequest(r, "GET", "/"+task.TaskId+"/details", token, b)
+	details = &TTask{}
+	err = details.fromJReader(resp.Body)
+	if err != nil {
+		t.Errorf("JSON parser error: %s", err)
+	}
+	if details.Hold != nil || len(details.HoldHistory) != 2 || details.HoldHistory[1].Actor != "judge" {
+		t.Errorf("Released hold expected in details: %v", details)
+	}
+	reports = retentionRun(db, []TRetentionPolicy{{Status: "verified", TaskTTL: 1}})
+	if len(reports.Reports[0].TasksPurged) != 1 || reports.Reports[0].TasksPurged[0] != task.TaskId {
+		t.Errorf("Unexpected report: %v", reports.Reports[0])
+	}
+}
+
+// testListHookStorage calls the hook after Tasks are listed
+type testListHookStorage struct {
+	IStorage
+	hook func()
+}
+
+func (s *testListHookStorage) ListTasks(status string, before int64) ([]*TTask, error) {
+	tasks, err := s.IStorage.ListTasks(status, before)
+	s.hook()
+	return tasks, err
+}
+
+func Test_HoldAfterRetentionList(t *testing.T) {
+	fmt.Println("Test_HoldAfterRetentionList")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	Conf.MaxFiles = 2
+	Conf.MinFiles = 2
+	Conf.MaxFileSize = 1024 * 100
+	Conf.DataDir = t.TempDir()
+	token := NewId(16)
+	db := &testListHookStorage{IStorage: MemoryNewStorage()}
+	r := setRouting(token, db)
+	body, ct := MakeTestUploadBody(t, "file1.bin", NewId(128), "file2.bin", NewId(64))
+	resp := MakeTestUploadRequest(r, "POST", "", ct, body)
+	if resp.StatusCode != 201 {
+		t.Fatalf("Status expected 201 but was: %d", resp.StatusCode)
+	}
+	task := &TTaskAnswer{}
+	task.fromJReader(resp.Body)
+	resp = MakeTestTaskRequest(r, "PATCH", "/"+task.TaskId+"/ok", token, new(bytes.Buffer))
+	if resp.StatusCode != 200 {
+		t.Fatalf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	// the hold is placed after retention listed the Task as not held
+	db.hook = func() {
+		resp := MakeTestTaskRequest(r, "PUT", "/"+task.TaskId+"/hold", token, bytes.NewBufferString(`{"actor":"lawyer","reason":"case 1"}`))
+		if resp.StatusCode != 200 {
+			t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+		}
+		db.hook = func() {}
+	}
+	time.Sleep(2 * time.Second)
+	reports := retentionRun(db, []TRetentionPolicy{{Status: "verified", FilesTTL: 1}})
+	if len(reports.Reports[0].FilesRemoved) != 0 {
+		t.Errorf("Unexpected report: %v", reports.Reports[0])
+	}
+	if files := testTaskFiles(t, taskBlobs(), &TTask{Id: task.TaskId}); len(files) != 3 {
+		t.Errorf("Files of the held Task expected, but was: %v", files)
+	}
+}
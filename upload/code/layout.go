@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	LAYOUT_ID   = "id"     // <id[0]>/<id[1]>/<id>, the layout before it was configurable
+	LAYOUT_HASH = "hash"   // <sha256(id)[0:2]>/<sha256(id)[2:4]>/<id>, 65536 even directories
+	LAYOUT_DATE = "date"   // YYYY/MM/DD/<id> by the issued time in UTC, archived by the day
+	META_LAYOUT = "layout" // the metadata key of the layout of new Tasks
+)
+
+// taskLayouts return the prefix of the Task files keys by the layout name
+var taskLayouts = map[string]func(task *TTask) string{
+	LAYOUT_ID: func(task *TTask) string {
+		return string(task.Id[0]) + "/" + string(task.Id[1]) + "/" + task.Id + "/"
+	},
+	LAYOUT_HASH: func(task *TTask) string {
+		h := sha256.Sum256([]byte(task.Id))
+		x := hex.EncodeToString(h[:2])
+		return x[0:2] + "/" + x[2:4] + "/" + task.Id + "/"
+	},
+	LAYOUT_DATE: func(task *TTask) string {
+		return time.Unix(task.IssuedAt, 0).UTC().Format("2006/01/02") + "/" + task.Id + "/"
+	},
+}
+
+// TLayoutReport is the result of the layout migration
+type TLayoutReport struct {
+	Layout     string   `json:"layout"`
+	DryRun     bool     `json:"dry_run,omitempty"`
+	StartedAt  int64    `json:"started"`
+	FinishedAt int64    `json:"finished"`
+	Tasks      int      `json:"tasks"` // moved, to move for the dry run
+	Files      int      `json:"files"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+type TLayoutStatus struct {
+	Layout  string         `json:"layout"` // of new Tasks
+	Tasks   map[string]int `json:"tasks"`  // by the layout of their files
+	Running bool           `json:"running"`
+	Last    *TLayoutReport `json:"last,omitempty"`
+}
+
+type TLayoutRequest struct {
+	Layout string `json:"layout"`
+}
+
+var (
+	layoutMutex      sync.Mutex
+	layoutRunning    bool
+	layoutRestart    bool // the layout changed during the run
+	layoutLastReport *TLayoutReport
+)
+
+// taskFilesLocks serialize moves and removals of the Task files by the Task id
+var taskFilesLocks [64]sync.Mutex
+
+// layoutPause stops moves while backups write files of the snapshot
+var layoutPause sync.RWMutex
+
+// Save TLayoutStatus object to io.Writer as JSON
+func (c *TLayoutStatus) toJWriter(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "    ")
+	return e.Encode(c)
+}
+
+func taskFilesLock(taskId string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(taskId))
+	return &taskFilesLocks[h.Sum32()%uint32(len(taskFilesLocks))]
+}
+
+// taskLayout returns the layout of the Task files, Tasks stored before layouts have none
+func taskLayout(task *TTask) string {
+	if task.Layout == "" {
+		return LAYOUT_ID
+	}
+	return task.Layout
+}
+
+// setLayout records the layout of the Task files, the default one is not recorded
+func (c *TTask) setLayout(layout string) {
+	if layout == LAYOUT_ID {
+		layout = ""
+	}
+	c.Layout = layout
+}
+
+// taskBlobPrefix is the prefix of the Task files keys, unknown layouts are read as id
+func taskBlobPrefix(task *TTask) string {
+	layout, ok := taskLayouts[taskLayout(task)]
+	if !ok {
+		layout = taskLayouts[LAYOUT_ID]
+	}
+	return layout(task)
+}
+
+// metaStorage returns the layer of the storage keeping settings or nil
+func metaStorage(db IStorage) IMetaStorage {
+	s := findStorage(db, func(s IStorage) bool {
+		_, ok := s.(IMetaStorage)
+		return ok
+	})
+	if s == nil {
+		return nil
+	}
+	return s.(IMetaStorage)
+}
+
+// currentLayout returns the layout of new Tasks from the database
+func currentLayout(db IStorage) (string, error) {
+	m := metaStorage(db)
+	if m == nil {
+		return LAYOUT_ID, nil
+	}
+	layout, err := m.GetMeta(META_LAYOUT)
+	if err != nil || layout == "" {
+		return LAYOUT_ID, err
+	}
+	return layout, nil
+}
+
+// setCurrentLayout saves the layout of new Tasks, existing ones are moved by the migration
+func setCurrentLayout(db IStorage, layout string) error {
+	if _, ok := taskLayouts[layout]; !ok {
+		return fmt.Errorf("Unknown layout: %s (id, hash, date)", layout)
+	}
+	m := metaStorage(db)
+	if m == nil {
+		return fmt.Errorf("Storage engine can't keep the layout")
+	}
+	return m.SetMeta(META_LAYOUT, layout)
+}
+
+// layoutMoveFiles copies the Task files to the prefix of the moved Task and removes old ones
+// if switch succeeds, the caller holds the Task files lock
+func layoutMoveFiles(blobs IBlobStore, task, moved *TTask, switchFn func() error) (int, error) {
+	from, to := taskBlobPrefix(task), taskBlobPrefix(moved)
+	if from == to {
+		return 0, switchFn()
+	}
+	layoutPause.RLock()
+	defer layoutPause.RUnlock()
+	files, err := taskFiles(blobs, task)
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range files {
+		r, err := blobs.Get(from + f.Name)
+		if err != nil {
+			return 0, err
+		}
+		_, err = blobs.Put(to+f.Name, r)
+		r.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = switchFn()
+	if err != nil {
+		if derr := blobDeletePrefix(blobs, to); derr != nil {
+			Error.Printf("Can't remove copied files of %s: %s\n", task.Id, derr)
+		}
+		return 0, err
+	}
+	return len(files), blobDeletePrefix(blobs, from)
+}
+
+// layoutMoveTask moves files of the Task to the layout, the Task points to the new files
+// when all of them are copied, so readers find the files at any moment
+func layoutMoveTask(db IStorage, blobs IBlobStore, task *TTask, layout string) (int, error) {
+	lock := taskFilesLock(task.Id)
+	lock.Lock()
+	defer lock.Unlock()
+	moved := *task
+	moved.setLayout(layout)
+	return layoutMoveFiles(blobs, task, &moved, func() error {
+		_, err := db.UpdateTask(task.Id, func(t *TTask) error {
+			if t.Layout != task.Layout {
+				return ErrTaskConflict
+			}
+			t.Layout = moved.Layout
+			return nil
+		})
+		return err
+	})
+}
+
+// layoutCount returns the number of Tasks by the layout of their files
+func layoutCount(db IStorage) (map[string]int, error) {
+	counts := make(map[string]int)
+	for _, status := range taskStatuses {
+		tasks, err := db.ListTasks(status, math.MaxInt64)
+		if err != nil {
+			return nil, err
+		}
+		for _, task := range tasks {
+			counts[taskLayout(task)]++
+		}
+	}
+	return counts, nil
+}
+
+// layoutMigrate moves files of Tasks in other layouts to the layout one Task at a time,
+// every Task records its layout, so a stopped migration continues with the next run
+func layoutMigrate(db IStorage, layout string, dryRun bool) *TLayoutReport {
+	report := &TLayoutReport{Layout: layout, DryRun: dryRun, StartedAt: time.Now().Unix()}
+	defer func() { report.FinishedAt = time.Now().Unix() }()
+	blobs := taskBlobs()
+	for _, status := range taskStatuses {
+		tasks, err := db.ListTasks(status, math.MaxInt64)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		sort.Slice(tasks, func(i, j int) bool { return tasks[i].Id < tasks[j].Id })
+		for _, task := range tasks {
+			if taskLayout(task) == layout {
+				continue
+			}
+			if dryRun {
+				files, err := taskFiles(blobs, task)
+				if err != nil {
+					report.Errors = append(report.Errors, err.Error())
+					continue
+				}
+				report.Tasks++
+				report.Files += len(files)
+				continue
+			}
+			n, err := layoutMoveTask(db, blobs, task, layout)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("Can't move %s: %s", task.Id, err))
+				continue
+			}
+			report.Tasks++
+			report.Files += n
+		}
+	}
+	return report
+}
+
+// layoutStart runs the migration in the background, the running one starts over
+// when it is done if the layout was changed meanwhile
+func layoutStart(db IStorage) {
+	layoutMutex.Lock()
+	defer layoutMutex.Unlock()
+	if layoutRunning {
+		layoutRestart = true
+		return
+	}
+	layoutRunning = true
+	go func() {
+		for {
+			layout, err := currentLayout(db)
+			report := &TLayoutReport{Layout: layout, StartedAt: time.Now().Unix(), FinishedAt: time.Now().Unix()}
+			if err != nil {
+				report.Errors = append(report.Errors, err.Error())
+			} else {
+				report = layoutMigrate(db, layout, false)
+			}
+			for _, e := range report.Errors {
+				Error.Printf("Layout migration: %s\n", e)
+			}
+			if report.Tasks > 0 {
+				Info.Printf("Layout migration: %d tasks, %d files moved to %s\n", report.Tasks, report.Files, report.Layout)
+			}
+			layoutMutex.Lock()
+			layoutLastReport = report
+			if !layoutRestart {
+				layoutRunning = false
+				layoutMutex.Unlock()
+				return
+			}
+			layoutRestart = false
+			layoutMutex.Unlock()
+		}
+	}()
+}
+
+// layoutHandler outputs the layout status, POST changes the layout of new Tasks
+// and starts moving existing ones
+func layoutHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
+	if r.Method == "POST" {
+		if replicaFollowing() {
+			sendJSONErrorMessage(w, E_CONFLICT, http.StatusConflict)
+			Warning.Printf("[%s]: Layout can't be changed on the follower\n", r.RemoteAddr)
+			return
+		}
+		req := &TLayoutRequest{}
+		err := json.NewDecoder(io.LimitReader(r.Body, 1024)).Decode(req)
+		if err == nil {
+			err = setCurrentLayout(db, req.Layout)
+		}
+		if err != nil {
+			sendJSONErrorMessage(w, E_INVALID_REQUEST, http.StatusBadRequest)
+			Warning.Printf("[%s]: Invalid layout request: %s\n", r.RemoteAddr, err)
+			return
+		}
+		layoutStart(db)
+	}
+	status := &TLayoutStatus{}
+	var err error
+	status.Layout, err = currentLayout(db)
+	if err == nil {
+		status.Tasks, err = layoutCount(db)
+	}
+	if err != nil {
+		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+		Error.Printf("[%s]: Database error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	layoutMutex.Lock()
+	status.Running = layoutRunning
+	status.Last = layoutLastReport
+	layoutMutex.Unlock()
+	// start a normal output
+	HelperSetStandartHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	err = status.toJWriter(w)
+	if err != nil {
+		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// write a success message to the log
+	Info.Printf("[%s]: Layout status printed (%s)\n", r.RemoteAddr, r.Method)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_TaskLayouts(t *testing.T) {
+	fmt.Println("Test_TaskLayouts")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	issued := time.Date(2021, 3, 4, 23, 59, 0, 0, time.UTC).Unix()
+	task := &TTask{Id: "abcdef", IssuedAt: issued}
+	for layout, expected := range map[string]string{
+		"":          "a/b/abcdef/",
+		LAYOUT_ID:   "a/b/abcdef/",
+		LAYOUT_HASH: "be/f5/abcdef/",
+		LAYOUT_DATE: "2021/03/04/abcdef/",
+		"unknown":   "a/b/abcdef/",
+	} {
+		task.Layout = layout
+		if prefix := taskBlobPrefix(task); prefix != expected {
+			t.Errorf("%q: prefix %s expected, but was: %s", layout, expected, prefix)
+		}
+	}
+	task.setLayout(LAYOUT_ID)
+	if task.Layout != "" {
+		t.Errorf("The default layout is not recorded, but was: %s", task.Layout)
+	}
+}
+
+func Test_LayoutMigrate(t *testing.T) {
+	fmt.Println("Test_LayoutMigrate")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	Conf.MaxFiles = 2
+	Conf.MinFiles = 2
+	Conf.MaxFileSize = 1024 * 100
+	Conf.DataDir = t.TempDir()
+	db := wrapStorage(MemoryNewStorage(), 16, nil)
+	token := NewId(16)
+	r := setRouting(token, db)
+	file1 := NewId(128)
+	upload := func() *TTask {
+		body, ct := MakeTestUploadBody(t, "file1.bin", file1, "file2.bin", NewId(64))
+		resp := MakeTestUploadRequest(r, "POST", "", ct, body)
+		if resp.StatusCode != 201 {
+			t.Fatalf("Status expected 201 but was: %d", resp.StatusCode)
+		}
+		answer := &TTaskAnswer{}
+		answer.fromJReader(resp.Body)
+		task, err := db.GetTask(answer.TaskId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return task
+	}
+	stored := func(task *TTask) bool {
+		_, err := CASNewBlobStore(fileBlobs()).Stat(taskBlobPrefix(task) + "file1.bin")
+		return err == nil
+	}
+	waitLayout := func() {
+		waitFor(t, "layout migration", func() bool {
+			layoutMutex.Lock()
+			defer layoutMutex.Unlock()
+			return !layoutRunning
+		})
+	}
+	old := upload()
+	if old.Layout != "" || !stored(old) {
+		t.Fatalf("Task in the default layout expected, but was: %v", old)
+	}
+	resp := MakeTestRequest(r, "POST", "/api-01/layout", token, bytes.NewBufferString(`{"layout":"lzma"}`))
+	if resp.StatusCode != 400 {
+		t.Errorf("Status expected 400 but was: %d", resp.StatusCode)
+	}
+	// the migration moves existing Tasks in the background, new ones are stored in the layout
+	resp = MakeTestRequest(r, "POST", "/api-01/layout", token, bytes.NewBufferString(`{"layout":"date"}`))
+	if resp.StatusCode != 200 {
+		t.Fatalf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	waitLayout()
+	moved, _ := db.GetTask(old.Id)
+	if moved.Layout != LAYOUT_DATE || !stored(moved) || stored(old) {
+		t.Errorf("Task moved to the date layout expected, but was: %v", moved)
+	}
+	if task := upload(); task.Layout != LAYOUT_DATE || !stored(task) {
+		t.Errorf("New task in the date layout expected, but was: %v", task)
+	}
+	resp = MakeTestRequest(r, "GET", "/api-01/task/"+old.Id+"/files/file1.bin", token, new(bytes.Buffer))
+	content, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(content) != file1 {
+		t.Errorf("Moved file expected, but was: %d %s", resp.StatusCode, content)
+	}
+	status := &TLayoutStatus{}
+	resp = MakeTestRequest(r, "GET", "/api-01/layout", token, new(bytes.Buffer))
+	if resp.StatusCode != 200 || json.NewDecoder(resp.Body).Decode(status) != nil || status.Layout != LAYOUT_DATE ||
+		status.Tasks[LAYOUT_DATE] != 2 || status.Last == nil || status.Last.Tasks != 1 || status.Last.Files != 3 {
+		t.Errorf("2 tasks in the date layout expected, but was: %d %v", resp.StatusCode, status)
+	}
+	// the dry run moves nothing, a repeated run has nothing to move
+	report := layoutMigrate(db, LAYOUT_HASH, true)
+	if report.Tasks != 2 || report.Files != 6 || len(report.Errors) != 0 {
+		t.Errorf("2 tasks to move expected, but was: %v", report)
+	}
+	if report = layoutMigrate(db, LAYOUT_HASH, false); report.Tasks != 2 || len(report.Errors) != 0 {
+		t.Errorf("2 tasks moved expected, but was: %v", report)
+	}
+	if report = layoutMigrate(db, LAYOUT_HASH, false); report.Tasks != 0 {
+		t.Errorf("Nothing to move expected, but was: %v", report)
+	}
+	moved, _ = db.GetTask(old.Id)
+	if moved.Layout != LAYOUT_HASH || !stored(moved) {
+		t.Errorf("Task moved to the hash layout expected, but was: %v", moved)
+	}
+	dated := *old
+	dated.Layout = LAYOUT_DATE
+	if list, _ := fileBlobs().List(CAS_TASKS_PREFIX + taskBlobPrefix(&dated)); len(list) != 0 {
+		t.Errorf("No files left in the date layout expected, but was: %v", list)
+	}
+	// the follower moves files when the primary does
+	follower := MemoryNewStorage()
+	fblobs := CASNewBlobStore(LocalNewBlobStore(Conf.DataDir + "/follower"))
+	rp := &TReplica{db: follower, blobs: fblobs}
+	follower.PutTask(old)
+	fblobs.Put(taskBlobPrefix(old)+"file1.bin", strings.NewReader(file1))
+	if err := rp.putTask(moved, false); err != nil {
+		t.Fatal(err)
+	}
+	if files := testTaskFiles(t, fblobs, moved); len(files) != 1 || len(testTaskFiles(t, fblobs, old)) != 0 {
+		t.Errorf("File moved on the follower expected, but was: %v", files)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+)
+
+const (
+	MANIFEST_NAME    = "manifest.json" // written last, the Task files are complete when it exists
+	MANIFEST_VERSION = 1
+	ROLE_DATA        = "data"
+	ROLE_SIGNATURE   = "signature"
+)
+
+// TManifestFile describes an uploaded file in the order of the form parts
+type TManifestFile struct {
+	Name    string `json:"name"`              // the original file name from the form, decoded
+	Encoded string `json:"encoded,omitempty"` // the name as it was sent, if it was encoded
+	Stored  string `json:"stored"`            // the name of the stored file
+	Part    int    `json:"part"`              // the number of the form part, from 0
+	Field   string `json:"field"`             // the form field name
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+	Type    string `json:"type"` // detected by the content: cms, pdf, docx, doc, rtf, xml, zip, unknown
+	Role    string `json:"role"` // data or signature
+}
+
+// TManifest is stored as manifest.json next to the Task files
+type TManifest struct {
+	Version  int             `json:"version"`
+	Task     string          `json:"task"`
+	IssuedAt int64           `json:"iat"`
+	Files    []TManifestFile `json:"files"`
+}
+
+// Write TManifest object to io.Writer as JSON
+func (c *TManifest) toJWriter(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "    ")
+	return e.Encode(c)
+}
+
+// Fill TManifest object from io.Reader as JSON
+func (c *TManifest) fromJReader(r io.Reader) error {
+	return json.NewDecoder(r).Decode(c)
+}
+
+// manifestFile describes the uploaded file for the manifest
+func manifestFile(name, sent, stored string, part int, field, fileType string, content []byte) TManifestFile {
+	if sent == name {
+		sent = ""
+	}
+	digest := sha256.Sum256(content)
+	return TManifestFile{
+		Name:    name,
+		Encoded: sent,
+		Stored:  stored,
+		Part:    part,
+		Field:   field,
+		Size:    int64(len(content)),
+		SHA256:  hex.EncodeToString(digest[:]),
+		Type:    fileType,
+		Role:    fileRole(stored, fileType),
+	}
+}
+
+// writeManifest stores the manifest of the Task, the store replaces the blob at once
+func writeManifest(blobs IBlobStore, task *TTask, files []TManifestFile) error {
+	m := &TManifest{Version: MANIFEST_VERSION, Task: task.Id, IssuedAt: task.IssuedAt, Files: files}
+	b := new(bytes.Buffer)
+	err := m.toJWriter(b)
+	if err != nil {
+		return err
+	}
+	_, err = blobs.Put(taskBlobPrefix(task)+MANIFEST_NAME, b)
+	return err
+}
+
+// readManifest returns the manifest of the Task, ErrBlobNotFound if the Task has none
+func readManifest(blobs IBlobStore, task *TTask) (*TManifest, error) {
+	f, err := blobs.Get(taskBlobPrefix(task) + MANIFEST_NAME)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := &TManifest{}
+	return m, m.fromJReader(f)
+}
+
+// uploadedFiles drops the manifest from the Task files
+func uploadedFiles(files []TChangeFile) []TChangeFile {
+	uploaded := []TChangeFile{}
+	for _, f := range files {
+		if f.Name != MANIFEST_NAME {
+			uploaded = append(uploaded, f)
+		}
+	}
+	return uploaded
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func Test_UploadManifest(t *testing.T) {
+	fmt.Println("Test_UploadManifest")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	Conf.MaxFiles = 2
+	Conf.MinFiles = 2
+	Conf.MaxFileSize = 1024 * 100
+	Conf.DataDir = t.TempDir()
+	db := MemoryNewStorage()
+	token := NewId(16)
+	r := setRouting(token, db)
+	b := new(bytes.Buffer)
+	data := testPDF()
+	body, ct := MakeTestUploadBody(t, "notice (1).pdf", data, "notice.pdf.sig", testCMS(t, nil))
+	resp := MakeTestUploadRequest(r, "POST", "", ct, body)
+	if resp.StatusCode != 201 {
+		t.Fatalf("Status expected 201 but was: %d", resp.StatusCode)
+	}
+	answer := &TTaskAnswer{}
+	answer.fromJReader(resp.Body)
+	task, _ := db.GetTask(answer.TaskId)
+	// the manifest is not listed with the uploaded files, but is read as a file
+	resp = MakeTestRequest(r, "GET", "/api-01/task/"+task.Id+"/files", token, b)
+	files := &TTaskFiles{}
+	if resp.StatusCode != 200 || files.fromJReader(resp.Body) != nil || len(files.Files) != 2 {
+		t.Errorf("2 files expected, but was: %d %v", resp.StatusCode, files)
+	}
+	resp = MakeTestRequest(r, "GET", "/api-01/task/"+task.Id+"/files/"+MANIFEST_NAME, token, b)
+	m := &TManifest{}
+	if resp.StatusCode != 200 || m.fromJReader(resp.Body) != nil || m.Task != task.Id || m.IssuedAt != task.IssuedAt || len(m.Files) != 2 {
+		t.Fatalf("Manifest of 2 files expected, but was: %d %v", resp.StatusCode, m)
+	}
+	digest := sha256.Sum256([]byte(data))
+	expected := TManifestFile{Name: "notice (1).pdf", Stored: "notice.pdf", Part: 0, Field: "file", Size: int64(len(data)),
+		SHA256: hex.EncodeToString(digest[:]), Type: TYPE_PDF, Role: ROLE_DATA}
+	if m.Files[0] != expected {
+		t.Errorf("%v expected, but was: %v", expected, m.Files[0])
+	}
+	if f := m.Files[1]; f.Stored != "notice.pdf.sig" || f.Part != 1 || f.Type != TYPE_CMS || f.Role != ROLE_SIGNATURE {
+		t.Errorf("Signature expected, but was: %v", f)
+	}
+	if stored, err := readManifest(taskBlobs(), task); err != nil || len(stored.Files) != 2 {
+		t.Errorf("Stored manifest expected, but was: %v %v", stored, err)
+	}
+	// the uploaded file doesn't replace the manifest
+	body, ct = MakeTestUploadBody(t, MANIFEST_NAME, "{}", "notice.pdf.sig", NewId(64))
+	resp = MakeTestUploadRequest(r, "POST", "", ct, body)
+	if resp.StatusCode != 201 {
+		t.Fatalf("Status expected 201 but was: %d", resp.StatusCode)
+	}
+	answer.fromJReader(resp.Body)
+	task, _ = db.GetTask(answer.TaskId)
+	if m, err := readManifest(taskBlobs(), task); err != nil || m.Files[0].Name != MANIFEST_NAME || m.Files[0].Stored != "manifest-2.json" {
+		t.Errorf("Renamed file expected, but was: %v %v", m, err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TMemoryStorage keeps Tasks in memory, for tests and ephemeral deployments,
+// tasks are stored as JSON so callers never share them
+type TMemoryStorage struct {
+	mu    sync.Mutex
+	tasks map[string][]byte
+	queue []string
+	meta  map[string]string
+}
+
+func MemoryNewStorage() *TMemoryStorage {
+	return &TMemoryStorage{tasks: make(map[string][]byte), meta: make(map[string]string)}
+}
+
+// get decodes the stored Task, the lock must be held
+func (s *TMemoryStorage) get(taskId string) (*TTask, error) {
+	v, ok := s.tasks[taskId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTaskNotFound, taskId)
+	}
+	task := &TTask{}
+	err := task.fromJBytes(v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: Invalid task format: %s", ErrStorage, err)
+	}
+	return task, nil
+}
+
+// put encodes the Task, the lock must be held
+func (s *TMemoryStorage) put(task *TTask) error {
+	payload, err := task.toJBytes()
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	s.tasks[task.Id] = payload
+	return nil
+}
+
+// queueRemove removes the Task from the queue if it is there, the lock must be held
+func (s *TMemoryStorage) queueRemove(taskId string) {
+	for i, id := range s.queue {
+		if id == taskId {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// scan returns Tasks with status issued before the unix time ordered by issued time, the lock must be held
+func (s *TMemoryStorage) scan(status string, before int64) ([]*TTask, error) {
+	var tasks []*TTask
+	for taskId := range s.tasks {
+		task, err := s.get(taskId)
+		if err != nil {
+			return nil, err
+		}
+		if task.Status == status && task.IssuedAt < before {
+			tasks = append(tasks, task)
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].IssuedAt != tasks[j].IssuedAt {
+			return tasks[i].IssuedAt < tasks[j].IssuedAt
+		}
+		return tasks[i].Id < tasks[j].Id
+	})
+	return tasks, nil
+}
+
+// put Task in queue
+func (s *TMemoryStorage) Enqueue(task *TTask) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tasks[task.Id]; ok {
+		return fmt.Errorf("%w: %s", ErrTaskExists, task.Id)
+	}
+	task.Rev = 1
+	err := s.put(task)
+	if err != nil {
+		return err
+	}
+	if task.Status == "received" {
+		s.queue = append(s.queue, task.Id)
+	}
+	return nil
+}
+
+// change Task, the queue follows the status
+func (s *TMemoryStorage) UpdateTask(taskId string, fn func(task *TTask) error) (*TTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, err := s.get(taskId)
+	if err != nil {
+		return nil, err
+	}
+	task, _ := s.get(taskId)
+	err = fn(task)
+	if err != nil {
+		return nil, err
+	}
+	if task.Id != old.Id {
+		return nil, fmt.Errorf("%w: Task id can't be changed: %s", ErrTaskConflict, taskId)
+	}
+	task.Rev = old.Rev + 1
+	if task.Status != "received" {
+		task.Claimed = 0
+	}
+	err = s.put(task)
+	if err != nil {
+		return nil, err
+	}
+	if old.Status != "received" && task.Status == "received" {
+		s.queue = append(s.queue, taskId)
+	} else if old.Status == "received" && task.Status != "received" {
+		s.queueRemove(taskId)
+	}
+	return task, nil
+}
+
+func (s *TMemoryStorage) GetTask(taskId string) (*TTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(taskId)
+}
+
+func (s *TMemoryStorage) Claim(lease int64) (*TTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().Unix()
+	for _, taskId := range s.queue {
+		task, err := s.get(taskId)
+		if err != nil {
+			return nil, fmt.Errorf("%w: Queue points to missing task: %s", ErrStorage, err)
+		}
+		if lease <= 0 {
+			return task, nil
+		}
+		if task.Claimed > now-lease {
+			continue
+		}
+		task.Claimed = now
+		task.Rev++
+		err = s.put(task)
+		if err != nil {
+			return nil, err
+		}
+		return task, nil
+	}
+	return nil, ErrQueueIsEmpty
+}
+
+// remove Tasks with status issued before the unix time, return their ids
+func (s *TMemoryStorage) PurgeTasks(status string, before int64) (taskIds []string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tasks, err := s.scan(status, before)
+	if err != nil {
+		return nil, err
+	}
+	for _, task := range tasks {
+		// tasks under legal hold are kept forever
+		if task.Hold != nil {
+			continue
+		}
+		s.queueRemove(task.Id)
+		delete(s.tasks, task.Id)
+		taskIds = append(taskIds, task.Id)
+	}
+	return taskIds, nil
+}
+
+// list Tasks with status issued before the unix time
+func (s *TMemoryStorage) ListTasks(status string, before int64) ([]*TTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scan(status, before)
+}
+
+// save the Task as is, the queue follows the status
+func (s *TMemoryStorage) PutTask(task *TTask) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queued := false
+	if old, err := s.get(task.Id); err == nil {
+		queued = old.Status == "received"
+	}
+	err := s.put(task)
+	if err != nil {
+		return err
+	}
+	if !queued && task.Status == "received" {
+		s.queue = append(s.queue, task.Id)
+	} else if queued && task.Status != "received" {
+		s.queueRemove(task.Id)
+	}
+	return nil
+}
+
+// remove the Task
+func (s *TMemoryStorage) DeleteTask(taskId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tasks[taskId]; !ok {
+		return fmt.Errorf("%w: %s", ErrTaskNotFound, taskId)
+	}
+	s.queueRemove(taskId)
+	delete(s.tasks, taskId)
+	return nil
+}
+
+func (s *TMemoryStorage) GetMeta(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.meta[key], nil
+}
+
+func (s *TMemoryStorage) SetMeta(key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.meta[key] = value
+	return nil
+}
+
+func (s *TMemoryStorage) Close() {
+}
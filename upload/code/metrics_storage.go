@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TMetricsStorage records latency and errors of every storage operation
+type TMetricsStorage struct {
+	IStorage
+	mu  sync.Mutex
+	ops map[string]*TStorageOpMetrics
+}
+
+// TStorageOpMetrics are counters of the operation, errors are ErrStorage only,
+// not found, conflicts and the empty queue are answers, not failures
+type TStorageOpMetrics struct {
+	Calls   int64 `json:"calls"`
+	Errors  int64 `json:"errors"`
+	TotalUs int64 `json:"total_us"`
+	MaxUs   int64 `json:"max_us"`
+}
+
+type TStorageMetrics struct {
+	Ops   map[string]TStorageOpMetrics `json:"ops"`
+	Cache *TCacheStats                 `json:"cache,omitempty"`
+}
+
+// Save TStorageMetrics object to io.Writer as JSON
+func (c *TStorageMetrics) toJWriter(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "    ")
+	return e.Encode(c)
+}
+
+func MetricsNewStorage(s IStorage) *TMetricsStorage {
+	return &TMetricsStorage{IStorage: s, ops: make(map[string]*TStorageOpMetrics)}
+}
+
+func (m *TMetricsStorage) Unwrap() IStorage {
+	return m.IStorage
+}
+
+// observe counts the call of op started at the time
+func (m *TMetricsStorage) observe(op string, started time.Time, err error) {
+	us := time.Since(started).Microseconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.ops[op]
+	if !ok {
+		o = &TStorageOpMetrics{}
+		m.ops[op] = o
+	}
+	o.Calls++
+	o.TotalUs += us
+	if us > o.MaxUs {
+		o.MaxUs = us
+	}
+	if errors.Is(err, ErrStorage) {
+		o.Errors++
+	}
+}
+
+func (m *TMetricsStorage) GetTask(taskId string) (*TTask, error) {
+	started := time.Now()
+	task, err := m.IStorage.GetTask(taskId)
+	m.observe("GetTask", started, err)
+	return task, err
+}
+
+func (m *TMetricsStorage) Enqueue(task *TTask) error {
+	started := time.Now()
+	err := m.IStorage.Enqueue(task)
+	m.observe("Enqueue", started, err)
+	return err
+}
+
+func (m *TMetricsStorage) Claim(lease int64) (*TTask, error) {
+	started := time.Now()
+	task, err := m.IStorage.Claim(lease)
+	m.observe("Claim", started, err)
+	return task, err
+}
+
+func (m *TMetricsStorage) UpdateTask(taskId string, fn func(task *TTask) error) (*TTask, error) {
+	started := time.Now()
+	task, err := m.IStorage.UpdateTask(taskId, fn)
+	m.observe("UpdateTask", started, err)
+	return task, err
+}
+
+func (m *TMetricsStorage) PurgeTasks(status string, before int64) ([]string, error) {
+	started := time.Now()
+	taskIds, err := m.IStorage.PurgeTasks(status, before)
+	m.observe("PurgeTasks", started, err)
+	return taskIds, err
+}
+
+func (m *TMetricsStorage) ListTasks(status string, before int64) ([]*TTask, error) {
+	started := time.Now()
+	tasks, err := m.IStorage.ListTasks(status, before)
+	m.observe("ListTasks", started, err)
+	return tasks, err
+}
+
+func (m *TMetricsStorage) PutTask(task *TTask) error {
+	started := time.Now()
+	err := m.IStorage.PutTask(task)
+	m.observe("PutTask", started, err)
+	return err
+}
+
+func (m *TMetricsStorage) DeleteTask(taskId string) error {
+	started := time.Now()
+	err := m.IStorage.DeleteTask(taskId)
+	m.observe("DeleteTask", started, err)
+	return err
+}
+
+// Metrics returns a copy of counters and stats of the cache below if any
+func (m *TMetricsStorage) Metrics() *TStorageMetrics {
+	m.mu.Lock()
+	res := &TStorageMetrics{Ops: make(map[string]TStorageOpMetrics, len(m.ops))}
+	for op, o := range m.ops {
+		res.Ops[op] = *o
+	}
+	m.mu.Unlock()
+	c := findStorage(m.IStorage, func(s IStorage) bool {
+		_, ok := s.(*TCacheStorage)
+		return ok
+	})
+	if c != nil {
+		stats := c.(*TCacheStorage).Stats()
+		res.Cache = &stats
+	}
+	return res
+}
+
+// print storage metrics, the storage must be wrapped by TMetricsStorage
+func storageMetricsHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
+	m, ok := db.(*TMetricsStorage)
+	if !ok {
+		sendJSONErrorMessage(w, E_NOT_IMPLEMENTED, http.StatusNotFound)
+		Warning.Printf("[%s]: Storage metrics are disabled\n", r.RemoteAddr)
+		return
+	}
+	// start a normal output
+	HelperSetStandartHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	err := m.Metrics().toJWriter(w)
+	if err != nil {
+		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// write a success message to the log
+	Debug.Printf("[%s]: Storage metrics printed\n", r.RemoteAddr)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	bolt "github.com/etcd-io/bbolt"
+)
+
+// TBoltMigration changes the database layout from Version-1 to Version
+type TBoltMigration struct {
+	Version int
+	Name    string
+	Up      func(tx *bolt.Tx) error
+}
+
+// boltMigrations is the ordered registry of migrations,
+// append new migrations to the end and never change applied ones,
+// they keep their own copies of key formats and read records as they were then
+var boltMigrations = []TBoltMigration{
+	{1, "create tasks and queue buckets", func(tx *bolt.Tx) error {
+		for _, name := range []string{"TASKS", "QUEUE", "TQREL"} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{2, "build status index", func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("STATUS_IDX")) != nil {
+			err := tx.DeleteBucket([]byte("STATUS_IDX"))
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.CreateBucket([]byte("STATUS_IDX"))
+		if err != nil {
+			return err
+		}
+		bi := tx.Bucket([]byte("STATUS_IDX"))
+		return tx.Bucket([]byte("TASKS")).ForEach(func(k, v []byte) error {
+			var task struct {
+				Id       string `json:"id"`
+				Status   string `json:"status"`
+				IssuedAt int64  `json:"iat"`
+			}
+			err := json.Unmarshal(v, &task)
+			if err != nil {
+				return fmt.Errorf("Invalid task format: %s", err)
+			}
+			// status, 0, issued time (8 bytes big endian), id
+			key := append([]byte(task.Status), 0)
+			buf := make([]byte, 8)
+			binary.BigEndian.PutUint64(buf, uint64(task.IssuedAt))
+			key = append(append(key, buf...), task.Id...)
+			return bi.Put(key, []byte{})
+		})
+	}},
+	{3, "keep task ids in queue instead of payloads", func(tx *bolt.Tx) error {
+		bq := tx.Bucket([]byte("QUEUE"))
+		type kv struct{ k, v []byte }
+		var items []kv
+		err := bq.ForEach(func(k, v []byte) error {
+			var task struct {
+				Id string `json:"id"`
+			}
+			err := json.Unmarshal(v, &task)
+			if err != nil {
+				return err
+			}
+			items = append(items, kv{append([]byte{}, k...), []byte(task.Id)})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			err = bq.Put(item.k, item.v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{4, "set the first revision of tasks stored without revisions", func(tx *bolt.Tx) error {
+		bt := tx.Bucket([]byte("TASKS"))
+		type kv struct{ k, v []byte }
+		var items []kv
+		err := bt.ForEach(func(k, v []byte) error {
+			// other fields are kept as they are
+			var task map[string]json.RawMessage
+			err := json.Unmarshal(v, &task)
+			if err != nil {
+				return fmt.Errorf("Invalid task format: %s", err)
+			}
+			var rev uint64
+			if raw, ok := task["rev"]; ok {
+				err = json.Unmarshal(raw, &rev)
+				if err != nil {
+					return fmt.Errorf("Invalid task revision: %s", err)
+				}
+			}
+			if rev != 0 {
+				return nil
+			}
+			task["rev"] = json.RawMessage("1")
+			payload, err := json.Marshal(task)
+			if err != nil {
+				return err
+			}
+			items = append(items, kv{append([]byte{}, k...), payload})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			err = bt.Put(item.k, item.v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+}
+
+// boltSchemaVersion reads the schema version from the META bucket, 0 for old databases
+func boltSchemaVersion(tx *bolt.Tx) int {
+	b := tx.Bucket([]byte("META"))
+	if b == nil {
+		return 0
+	}
+	v := b.Get([]byte("schema_version"))
+	if len(v) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(v))
+}
+
+func boltSetSchemaVersion(tx *bolt.Tx, version int) error {
+	b, err := tx.CreateBucketIfNotExists([]byte("META"))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(version))
+	return b.Put([]byte("schema_version"), buf)
+}
+
+// boltPendingMigrations returns the current schema version and migrations to apply
+func boltPendingMigrations(db *bolt.DB) (version int, pending []TBoltMigration, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		version = boltSchemaVersion(tx)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	latest := boltMigrations[len(boltMigrations)-1].Version
+	if version > latest {
+		err = fmt.Errorf("Database schema version %d is newer than supported %d", version, latest)
+		return
+	}
+	for _, m := range boltMigrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return
+}
+
+// boltMigrate applies pending migrations in one transaction and returns them,
+// with dryRun nothing is changed
+func boltMigrate(db *bolt.DB, dbfilename string, backup, dryRun bool) ([]TBoltMigration, error) {
+	version, pending, err := boltPendingMigrations(db)
+	if err != nil || len(pending) == 0 || dryRun {
+		return pending, err
+	}
+	if backup {
+		backupName := fmt.Sprintf("%s.v%d.bak", dbfilename, version)
+		err = db.View(func(tx *bolt.Tx) error {
+			return tx.CopyFile(backupName, 0600)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Can't backup database: %s", err)
+		}
+		Info.Printf("Database backup before migration: %s\n", backupName)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, m := range pending {
+			err := m.Up(tx)
+			if err != nil {
+				return fmt.Errorf("Migration %d (%s) failed: %s", m.Version, m.Name, err)
+			}
+			err = boltSetSchemaVersion(tx, m.Version)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range pending {
+		Info.Printf("Database migration %d applied: %s\n", m.Version, m.Name)
+	}
+	return pending, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	bolt "github.com/etcd-io/bbolt"
+	"os"
+	"testing"
+)
+
+func Test_BoltMigrate(t *testing.T) {
+	fmt.Println("Test_BoltMigrate")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	db, err := bolt.Open(dir+"/test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := boltMigrations[len(boltMigrations)-1].Version
+	pending, err := boltMigrate(db, dir+"/test.db", true, true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(pending) != latest {
+		t.Errorf("%d pending migrations expected, but was: %d", latest, len(pending))
+	}
+	if _, err := os.Stat(dir + "/test.db.v0.bak"); !os.IsNotExist(err) {
+		t.Errorf("Dry run must not make a backup")
+	}
+	pending, err = boltMigrate(db, dir+"/test.db", true, false)
+	if err != nil || len(pending) != latest {
+		t.Errorf("%d applied migrations expected, but was: %d %v", latest, len(pending), err)
+	}
+	if _, err := os.Stat(dir + "/test.db.v0.bak"); err != nil {
+		t.Errorf("Backup expected: %s", err)
+	}
+	version, pending, err := boltPendingMigrations(db)
+	if err != nil || version != latest || len(pending) != 0 {
+		t.Errorf("Version %d expected, but was: %d %v %v", latest, version, pending, err)
+	}
+	// newer database is not opened
+	err = db.Update(func(tx *bolt.Tx) error {
+		return boltSetSchemaVersion(tx, latest+1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	_, err = BoltNewStorage(dir + "/test.db")
+	if err == nil {
+		t.Errorf("Error expected for newer schema")
+	}
+}
+
+func Test_MigrateDatabase(t *testing.T) {
+	fmt.Println("Test_MigrateDatabase")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	defer func(engine, file string) { Conf.StorageEngine, Conf.DataBaseFile = engine, file }(Conf.StorageEngine, Conf.DataBaseFile)
+	for _, engine := range []string{"bolt", "sqlite"} {
+		Conf.StorageEngine = engine
+		Conf.DataBaseFile = dir + "/" + engine + ".db"
+		// the dry run doesn't create the database
+		if err := migrateDatabase(true); err == nil {
+			t.Errorf("%s: error expected for a missing database", engine)
+		}
+		if _, err := os.Stat(Conf.DataBaseFile); !os.IsNotExist(err) {
+			t.Errorf("%s: no database file expected: %v", engine, err)
+		}
+		db, err := OpenStorage(engine, Conf.DataBaseFile, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		if err := migrateDatabase(true); err != nil {
+			t.Errorf("%s: unexpected error: %s", engine, err)
+		}
+		if err := migrateDatabase(false); err != nil {
+			t.Errorf("%s: unexpected error: %s", engine, err)
+		}
+	}
+}
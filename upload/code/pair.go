@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// signature file extensions, the rest of the name is the name of the signed file
+var signatureExts = []string{".sig", ".p7s"}
+
+// signatureName tells the signature by the name
+func signatureName(name string) bool {
+	return signedName(name) != name
+}
+
+// signedName returns the name of the file the signature is named after
+func signedName(name string) string {
+	for _, ext := range signatureExts {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return name
+}
+
+// fileRole tells the signature from the data by the content, by the name if the type is unknown
+func fileRole(name, fileType string) string {
+	if fileType == TYPE_CMS || (fileType == TYPE_UNKNOWN && signatureName(name)) {
+		return ROLE_SIGNATURE
+	}
+	return ROLE_DATA
+}
+
+// checkDetached rejects signatures with the content inside, the data file is verified against them
+func checkDetached(content []byte) error {
+	sd, err := parseCMS(content)
+	if err != nil {
+		return nil // not a CMS of a known type, rejected by the type check if it is enabled
+	}
+	if len(sd.EncapContentInfo.EContent.FullBytes) > 0 {
+		return fmt.Errorf("the signature is not detached, it contains the signed data")
+	}
+	return nil
+}
+
+// checkPair checks that the files are one data file and its signature named after it:
+// notice.pdf and notice.pdf.sig or notice.sig
+func checkPair(files []TManifestFile) error {
+	var data, signatures []string
+	for _, f := range files {
+		if f.Role == ROLE_SIGNATURE {
+			signatures = append(signatures, f.Stored)
+		} else {
+			data = append(data, f.Stored)
+		}
+	}
+	if len(signatures) != 1 {
+		return fmt.Errorf("1 signature expected, but was: %d (%s)", len(signatures), strings.Join(signatures, ", "))
+	}
+	if len(data) != 1 {
+		return fmt.Errorf("1 data file expected, but was: %d (%s)", len(data), strings.Join(data, ", "))
+	}
+	if !signs(signatures[0], data[0]) {
+		return fmt.Errorf("%s is not named after %s", signatures[0], data[0])
+	}
+	return nil
+}
+
+// signs tells if the signature is named after the data file with or without its extension
+func signs(signature, data string) bool {
+	if !signatureName(signature) {
+		return false
+	}
+	signed := strings.ToLower(signedName(signature))
+	data = strings.ToLower(data)
+	if signed == data {
+		return true
+	}
+	if i := strings.LastIndex(data, "."); i > 0 {
+		return signed == data[:i]
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"testing"
+)
+
+func Test_Pairs(t *testing.T) {
+	fmt.Println("Test_Pairs")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	for _, c := range []struct {
+		name, fileType, role string
+	}{
+		{"notice.pdf.sig", TYPE_CMS, ROLE_SIGNATURE},
+		{"notice.pdf", TYPE_CMS, ROLE_SIGNATURE},
+		{"notice.P7S", TYPE_UNKNOWN, ROLE_SIGNATURE},
+		{"notice.pdf.sig", TYPE_PDF, ROLE_DATA},
+		{"notice.bin", TYPE_UNKNOWN, ROLE_DATA},
+	} {
+		if role := fileRole(c.name, c.fileType); role != c.role {
+			t.Errorf("%s %s: %s expected, but was: %s", c.name, c.fileType, c.role, role)
+		}
+	}
+	pair := func(files ...string) []TManifestFile {
+		m := []TManifestFile{}
+		for i := 0; i+1 < len(files); i += 2 {
+			m = append(m, TManifestFile{Stored: files[i], Role: files[i+1]})
+		}
+		return m
+	}
+	for files, valid := range map[*[]TManifestFile]bool{
+		&[]TManifestFile{}: false,
+		ptr(pair("notice.pdf", ROLE_DATA, "notice.pdf.sig", ROLE_SIGNATURE)):                           true,
+		ptr(pair("Notice.PDF", ROLE_DATA, "notice.pdf.SIG", ROLE_SIGNATURE)):                           true,
+		ptr(pair("notice.pdf.sig", ROLE_SIGNATURE, "notice.pdf", ROLE_DATA)):                           true,
+		ptr(pair("notice.pdf", ROLE_DATA, "notice.sig", ROLE_SIGNATURE)):                               true,
+		ptr(pair("notice.pdf", ROLE_DATA, "notice.p7s", ROLE_SIGNATURE)):                               true,
+		ptr(pair("notice.pdf", ROLE_DATA, "other.pdf.sig", ROLE_SIGNATURE)):                            false,
+		ptr(pair("notice.pdf", ROLE_DATA, "notice.pdf", ROLE_SIGNATURE)):                               false,
+		ptr(pair("notice.pdf", ROLE_DATA, "notice.docx", ROLE_DATA)):                                   false,
+		ptr(pair("notice.pdf.sig", ROLE_SIGNATURE, "notice.sig", ROLE_SIGNATURE)):                      false,
+		ptr(pair("notice.pdf", ROLE_DATA, "notice.pdf.sig", ROLE_SIGNATURE, "notice.docx", ROLE_DATA)): false,
+	} {
+		if err := checkPair(*files); (err == nil) != valid {
+			t.Errorf("%v: valid %v expected, but was: %v", *files, valid, err)
+		}
+	}
+	if err := checkDetached([]byte(testCMS(t, nil))); err != nil {
+		t.Errorf("Detached signature expected, but was: %s", err)
+	}
+	if err := checkDetached([]byte(testCMS(t, []byte("data")))); err == nil {
+		t.Errorf("Attached signature error expected")
+	}
+}
+
+func ptr(files []TManifestFile) *[]TManifestFile {
+	return &files
+}
+
+func Test_UploadPairs(t *testing.T) {
+	fmt.Println("Test_UploadPairs")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	Conf.MaxFiles = 3
+	Conf.MinFiles = 2
+	Conf.MaxFileSize = 1024 * 100
+	Conf.DataDir = t.TempDir()
+	Conf.AllowedTypes, _ = parseFileTypes(defaultFileTypes)
+	Conf.PairCheck = true
+	defer func() {
+		Conf.AllowedTypes = nil
+		Conf.PairCheck = false
+	}()
+	db := MemoryNewStorage()
+	r := setRouting(NewId(16), db)
+	sig := testCMS(t, nil)
+	body, ct := MakeTestUploadBody(t, "notice.pdf.sig", sig, "notice.pdf", testPDF())
+	resp := MakeTestUploadRequest(r, "POST", "", ct, body)
+	if resp.StatusCode != 201 {
+		t.Fatalf("Status expected 201 but was: %d", resp.StatusCode)
+	}
+	answer := &TTaskAnswer{}
+	answer.fromJReader(resp.Body)
+	task, _ := db.GetTask(answer.TaskId)
+	if m, err := readManifest(taskBlobs(), task); err != nil || m.Files[0].Role != ROLE_SIGNATURE || m.Files[1].Role != ROLE_DATA {
+		t.Errorf("Roles by the content expected, but was: %v %v", m, err)
+	}
+	// wrong submissions are rejected before they get a task
+	for _, c := range []struct {
+		files   []string
+		details string
+	}{
+		{[]string{"notice.pdf", testPDF(), "notice.pdf.sig", testCMS(t, []byte(testPDF()))},
+			"notice.pdf.sig: the signature is not detached, it contains the signed data"},
+		{[]string{"notice.pdf", testPDF(), "notice.docx", testDOCX(t)},
+			"1 signature expected, but was: 0 ()"},
+		{[]string{"notice.pdf", testPDF(), "notice.pdf.sig", sig, "notice.docx", testDOCX(t)},
+			"1 data file expected, but was: 2 (notice.pdf, notice.docx)"},
+		{[]string{"notice.pdf", testPDF(), "other.pdf.sig", sig},
+			"other.pdf.sig is not named after notice.pdf"},
+		{[]string{"notice.pdf", sig, "notice.pdf.sig", testPDF()},
+			"notice.pdf is not named after notice.pdf.sig"},
+	} {
+		body, ct = MakeTestUploadBody(t, c.files...)
+		resp = MakeTestUploadRequest(r, "POST", "", ct, body)
+		e := &TJSONError{}
+		if resp.StatusCode != 400 || json.NewDecoder(resp.Body).Decode(e) != nil || e.Msg != E_INVALID_PAIR || e.Details != c.details {
+			t.Errorf("%s expected, but was: %d %v", c.details, resp.StatusCode, e)
+		}
+	}
+	if tasks, _ := db.ListTasks("received", math.MaxInt64); len(tasks) != 1 {
+		t.Errorf("1 task expected, but was: %d", len(tasks))
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const QUARANTINE_META = ".quarantine.json"
+
+var quarantineIdRe = regexp.MustCompile(`^[a-z2-7]+$`)
+
+// TQuarantine describes files moved to the quarantine
+type TQuarantine struct {
+	Id     string            `json:"id"`              // task id or id of the rejected upload
+	Task   bool              `json:"task"`            // there is a task record with the id
+	Reason string            `json:"reason"`          // why the files were quarantined
+	At     int64             `json:"at"`              // quarantine time
+	Files  []TQuarantineFile `json:"files,omitempty"` // filled on output
+	// files are still being moved or the meta is lost, such an entry is not released
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+type TQuarantineFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+type TQuarantineList struct {
+	Entries []*TQuarantine `json:"quarantine"`
+}
+
+// Write TQuarantine object to io.Writer as JSON
+func (c *TQuarantine) toJWriter(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "    ")
+	return e.Encode(c)
+}
+
+// Write TQuarantineList object to io.Writer as JSON
+func (c *TQuarantineList) toJWriter(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "    ")
+	return e.Encode(c)
+}
+
+// quarantineFiles moves uploaded files of the Task to the quarantine,
+// isTask is set if the Task is in the database
+func quarantineFiles(task *TTask, isTask bool, reason string) error {
+	blobs := taskBlobs()
+	id := task.Id
+	if Conf.QuarantineDir == "" {
+		return blobDeletePrefix(blobs, taskBlobPrefix(task))
+	}
+	qblobs := quarantineBlobs()
+	// an incomplete entry is completed by the next move
+	existing, err := quarantineGet(id)
+	if err == nil && !existing.Incomplete {
+		return fmt.Errorf("Quarantine entry exists: %s", id)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	files, err := taskFiles(blobs, task)
+	if err != nil {
+		return err
+	}
+	// the meta is written first, files moved before a failure are found by it
+	q := &TQuarantine{Id: id, Task: isTask, Reason: reason, At: time.Now().Unix(), Incomplete: true}
+	err = quarantineWriteMeta(qblobs, q)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		err := blobMove(blobs, taskBlobPrefix(task)+f.Name, qblobs, id+"/"+f.Name)
+		if err != nil {
+			return err
+		}
+	}
+	q.Incomplete = false
+	return quarantineWriteMeta(qblobs, q)
+}
+
+// quarantineWriteMeta saves the meta of the entry
+func quarantineWriteMeta(qblobs IBlobStore, q *TQuarantine) error {
+	b, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	_, err = qblobs.Put(q.Id+"/"+QUARANTINE_META, bytes.NewReader(b))
+	return err
+}
+
+// quarantineGet reads the quarantine entry with the list of files
+func quarantineGet(id string) (*TQuarantine, error) {
+	if Conf.QuarantineDir == "" || !quarantineIdRe.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+	qblobs := quarantineBlobs()
+	blobs, err := qblobs.List(id + "/")
+	if err != nil {
+		return nil, err
+	}
+	return quarantineRead(qblobs, id, blobs)
+}
+
+// quarantineRead reads the meta of the entry with blobs listed, files without the meta
+// are the incomplete entry quarantined at the time of the last file
+func quarantineRead(qblobs IBlobStore, id string, blobs []TBlobInfo) (*TQuarantine, error) {
+	q := &TQuarantine{Id: id, Incomplete: true}
+	meta, err := qblobs.Get(id + "/" + QUARANTINE_META)
+	lost := errors.Is(err, ErrBlobNotFound)
+	if err != nil && !lost {
+		return nil, err
+	}
+	if !lost {
+		defer meta.Close()
+		q = &TQuarantine{}
+		err = json.NewDecoder(meta).Decode(q)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, b := range blobs {
+		name := strings.TrimPrefix(b.Key, id+"/")
+		if name != QUARANTINE_META && !strings.Contains(name, "/") {
+			q.Files = append(q.Files, TQuarantineFile{Name: name, Size: b.Size})
+			if lost && b.ModTime > q.At {
+				q.At = b.ModTime
+			}
+		}
+	}
+	if lost && len(q.Files) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return q, nil
+}
+
+// quarantineList reads all quarantine entries ordered by time
+func quarantineList() ([]*TQuarantine, error) {
+	entries := []*TQuarantine{}
+	if Conf.QuarantineDir == "" {
+		return entries, nil
+	}
+	qblobs := quarantineBlobs()
+	blobs, err := qblobs.List("")
+	if err != nil {
+		return nil, err
+	}
+	// blobs are ordered by key, so files of the entry go together
+	for i := 0; i < len(blobs); {
+		id := strings.SplitN(blobs[i].Key, "/", 2)[0]
+		j := i + 1
+		for j < len(blobs) && strings.HasPrefix(blobs[j].Key, id+"/") {
+			j++
+		}
+		q, err := quarantineRead(qblobs, id, blobs[i:j])
+		i = j
+		if err != nil {
+			Warning.Printf("Invalid quarantine entry %s: %s\n", id, err)
+			continue
+		}
+		entries = append(entries, q)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].At < entries[j].At })
+	return entries, nil
+}
+
+// quarantineHeld checks the legal hold of the task in the quarantine
+func quarantineHeld(db IStorage, q *TQuarantine) (bool, error) {
+	// the entry without the meta may be of the task too
+	if !q.Task && !q.Incomplete {
+		return false, nil
+	}
+	task, err := db.GetTask(q.Id)
+	if err != nil {
+		if errors.Is(err, ErrTaskNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return task.Hold != nil, nil
+}
+
+// quarantinePurge removes entries older than ttl seconds
+func quarantinePurge(db IStorage, ttl int64) *TRetentionReport {
+	report := &TRetentionReport{
+		Status:        "quarantine",
+		StartedAt:     time.Now().Unix(),
+		TasksPurged:   []string{},
+		FilesRemoved:  []string{},
+		FilesArchived: []string{},
+	}
+	entries, err := quarantineList()
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	for _, q := range entries {
+		if q.At+ttl >= report.StartedAt {
+			continue
+		}
+		held, err := quarantineHeld(db, q)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("Can't check hold of %s: %s", q.Id, err))
+			continue
+		}
+		if held {
+			continue
+		}
+		err = blobDeletePrefix(quarantineBlobs(), q.Id+"/")
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("Can't remove %s: %s", q.Id, err))
+			continue
+		}
+		report.FilesRemoved = append(report.FilesRemoved, q.Id)
+	}
+	report.FinishedAt = time.Now().Unix()
+	return report
+}
+
+// quarantineUploadFiles reads the files of the entry to check them like the upload,
+// their stored names are kept, the manifest is not checked
+func quarantineUploadFiles(q *TQuarantine) ([]TUploadFile, []string, bool, error) {
+	qblobs := quarantineBlobs()
+	files := []TUploadFile{}
+	stored := []string{}
+	hasManifest := false
+	for _, f := range q.Files {
+		if f.Name == MANIFEST_NAME {
+			hasManifest = true
+			continue
+		}
+		rc, err := qblobs.Get(q.Id + "/" + f.Name)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(rc, Conf.MaxFileSize))
+		rc.Close()
+		if err != nil {
+			return nil, nil, false, err
+		}
+		files = append(files, TUploadFile{Name: f.Name, Sent: f.Name, Part: len(files), Content: content})
+		stored = append(stored, f.Name)
+	}
+	return files, stored, hasManifest, nil
+}
+
+// sendQuarantineError writes an error for the quarantine entry
+func sendQuarantineError(w http.ResponseWriter, r *http.Request, id string, err error) {
+	if os.IsNotExist(err) {
+		sendJSONErrorMessage(w, E_QUARANTINE_NOT_FOUND, http.StatusBadRequest)
+		Warning.Printf("[%s]: Quarantine entry not found: %s\n", r.RemoteAddr, id)
+	} else {
+		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+		Error.Printf("[%s]: Quarantine error: %s: %s\n", r.RemoteAddr, id, err)
+	}
+}
+
+// quarantineListHandler outputs all quarantine entries
+func quarantineListHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := quarantineList()
+	if err != nil {
+		sendQuarantineError(w, r, "", err)
+		return
+	}
+	// start a normal output
+	HelperSetStandartHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	err = (&TQuarantineList{entries}).toJWriter(w)
+	if err != nil {
+		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// write a success message to the debug log
+	Debug.Printf("[%s]: Quarantine list printed\n", r.RemoteAddr)
+}
+
+// quarantineInfoHandler outputs the quarantine entry
+func quarantineInfoHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	q, err := quarantineGet(id)
+	if err != nil {
+		sendQuarantineError(w, r, id, err)
+		return
+	}
+	// start a normal output
+	HelperSetStandartHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	err = q.toJWriter(w)
+	if err != nil {
+		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// write a success message to the debug log
+	Debug.Printf("[%s]: Quarantine entry %s printed\n", r.RemoteAddr, id)
+}
+
+// quarantineFileHandler outputs the quarantined file
+func quarantineFileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	name := vars["name"]
+	q, err := quarantineGet(id)
+	if err != nil {
+		sendQuarantineError(w, r, id, err)
+		return
+	}
+	found := false
+	for _, f := range q.Files {
+		if f.Name == name {
+			found = true
+		}
+	}
+	if !found {
+		sendQuarantineError(w, r, id+"/"+name, os.ErrNotExist)
+		return
+	}
+	f, err := quarantineBlobs().Get(id + "/" + name)
+	if errors.Is(err, ErrBlobNotFound) {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		sendQuarantineError(w, r, id+"/"+name, err)
+		return
+	}
+	defer f.Close()
+	// start a normal output
+	HelperSetStandartHeaders(w)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+strings.Replace(name, "\"", "_", -1)+"\"")
+	w.WriteHeader(http.StatusOK)
+	_, err = io.Copy(w, f)
+	if err != nil {
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// write a success message to the log
+	Info.Printf("[%s]: Quarantined file downloaded: %s/%s\n", r.RemoteAddr, id, name)
+}
+
+// quarantineDestroyHandler removes the quarantine entry with files
+func quarantineDestroyHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	q, err := quarantineGet(id)
+	if err != nil {
+		sendQuarantineError(w, r, id, err)
+		return
+	}
+	held, err := quarantineHeld(db, q)
+	if err != nil {
+		sendQuarantineError(w, r, id, err)
+		return
+	}
+	if held {
+		sendJSONErrorMessage(w, E_CONFLICT, http.StatusConflict)
+		Warning.Printf("[%s]: Quarantined task is under legal hold: %s\n", r.RemoteAddr, id)
+		return
+	}
+	err = blobDeletePrefix(quarantineBlobs(), id+"/")
+	if err != nil {
+		sendQuarantineError(w, r, id, err)
+		return
+	}
+	// start a normal output
+	HelperSetStandartHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	err = q.toJWriter(w)
+	if err != nil {
+		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// write a success message to the log
+	Info.Printf("[%s]: Quarantine entry destroyed: %s\n", r.RemoteAddr, id)
+}
+
+// quarantineReleaseHandler moves files back and puts the task in the queue
+func quarantineReleaseHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	q, err := quarantineGet(id)
+	if err != nil {
+		sendQuarantineError(w, r, id, err)
+		return
+	}
+	if q.Incomplete {
+		sendJSONErrorMessage(w, E_CONFLICT, http.StatusConflict)
+		Warning.Printf("[%s]: Quarantine entry is incomplete: %s\n", r.RemoteAddr, id)
+		return
+	}
+	// files of a rejected upload are put in the layout of new Tasks
+	task, err := db.GetTask(id)
+	if errors.Is(err, ErrTaskNotFound) {
+		task = &TTask{Id: id, Status: "received", IssuedAt: time.Now().Unix()}
+		var layout string
+		layout, err = currentLayout(db)
+		task.setLayout(layout)
+	}
+	if err != nil {
+		sendStorageError(w, r, id, err)
+		return
+	}
+	lock := taskFilesLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+	blobs := taskBlobs()
+	existing, err := taskFiles(blobs, task)
+	if err != nil {
+		sendQuarantineError(w, r, id, err)
+		return
+	}
+	if len(existing) > 0 {
+		sendJSONErrorMessage(w, E_CONFLICT, http.StatusConflict)
+		Warning.Printf("[%s]: Task files exist: %s\n", r.RemoteAddr, id)
+		return
+	}
+	// files are checked again like the upload, a rejected upload stays in the quarantine
+	files, stored, hasManifest, err := quarantineUploadFiles(q)
+	if err != nil {
+		sendQuarantineError(w, r, id, err)
+		return
+	}
+	manifest, uerr := checkUpload(files, stored)
+	if uerr != nil {
+		sendJSONErrorDetails(w, uerr.Msg, uerr.Details, uerr.Status)
+		Warning.Printf("[%s]: Quarantine entry is rejected again: %s: %s\n", r.RemoteAddr, id, uerr.Reject)
+		return
+	}
+	qblobs := quarantineBlobs()
+	for _, f := range q.Files {
+		err = blobMove(qblobs, id+"/"+f.Name, blobs, taskBlobPrefix(task)+f.Name)
+		if err != nil {
+			sendQuarantineError(w, r, id, err)
+			return
+		}
+	}
+	err = qblobs.Delete(id + "/" + QUARANTINE_META)
+	if err != nil {
+		sendQuarantineError(w, r, id, err)
+		return
+	}
+	restore := func() {
+		err := quarantineFiles(task, q.Task, q.Reason)
+		if err != nil {
+			Error.Printf("[%s]: Can't return files to quarantine: %s: %s\n", r.RemoteAddr, id, err)
+		}
+	}
+	// a rejected upload gets the manifest the upload would write, the failed task keeps its own
+	if !hasManifest {
+		err = writeManifest(blobs, task, manifest)
+		if err != nil {
+			restore()
+			sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+			Error.Printf("[%s]: Can't write the manifest of %s: %s\n", r.RemoteAddr, id, err)
+			return
+		}
+	}
+	// a failed task is queued again, a rejected upload becomes a new task
+	released, err := db.UpdateTask(id, func(task *TTask) error {
+		if task.Status == "received" {
+			return ErrTaskConflict
+		}
+		task.Status = "received"
+		task.Quarantined = 0
+		return nil
+	})
+	if errors.Is(err, ErrTaskNotFound) {
+		released = &TTask{Id: id, Status: "received", IssuedAt: task.IssuedAt, Layout: task.Layout}
+		err = db.Enqueue(released)
+	}
+	if err != nil {
+		restore()
+		sendStorageError(w, r, id, err)
+		return
+	}
+	changeLogFiles(db, released)
+	// start a normal output
+	HelperSetStandartHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	err = released.toJWriter(w)
+	if err != nil {
+		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// write a success message to the log
+	Info.Printf("[%s]: Quarantine entry released: %s\n", r.RemoteAddr, id)
+}
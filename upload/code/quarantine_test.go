@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_Quarantine(t *testing.T) {
+	fmt.Println("Test_Quarantine")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	Conf.MaxFiles = 2
+	Conf.MinFiles = 2
+	Conf.MaxFileSize = 1024 * 100
+	Conf.DataDir = t.TempDir()
+	Conf.QuarantineDir = Conf.DataDir + "/quarantine"
+	defer func() { Conf.QuarantineDir = "" }()
+	db, err := BoltNewStorage(dir + "/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	token := NewId(16)
+	r := setRouting(token, db)
+	b := new(bytes.Buffer)
+	file1 := NewId(128)
+	body, ct := MakeTestUploadBody(t, "file1.bin", file1, "file2.bin", NewId(64))
+	resp := MakeTestUploadRequest(r, "POST", "", ct, body)
+	if resp.StatusCode != 201 {
+		t.Errorf("Status expected 201 but was: %d", resp.StatusCode)
+	}
+	task := &TTaskAnswer{}
+	err = task.fromJReader(resp.Body)
+	if err != nil {
+		t.Errorf("JSON parser error: %s", err)
+	}
+	// failed task goes to the quarantine
+	resp = MakeTestTaskRequest(r, "PATCH", "/"+task.TaskId+"/fail", token, b)
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	if list, err := taskBlobs().List(testTaskBlobPrefix(t, db, task.TaskId)); err != nil || len(list) != 0 {
+		t.Errorf("Task files expected to be moved, but was: %d %v", len(list), err)
+	}
+	// rejected upload goes to the quarantine
+	body, ct = MakeTestUploadBody(t, "file3.bin", NewId(32))
+	resp = MakeTestUploadRequest(r, "POST", "", ct, body)
+	if resp.StatusCode != 400 {
+		t.Errorf("Status expected 400 but was: %d", resp.StatusCode)
+	}
+	resp = MakeTestRequest(r, "GET", "/api-01/quarantine", "", b)
+	if resp.StatusCode != 401 {
+		t.Errorf("Status expected 401 but was: %d", resp.StatusCode)
+	}
+	resp = MakeTestRequest(r, "GET", "/api-01/quarantine", token, b)
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	entries, err := quarantineList()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Unexpected quarantine: %v", entries)
+	}
+	rejected := ""
+	for _, q := range entries {
+		if q.Id == task.TaskId {
+			if !q.Task || len(q.Files) != 3 {
+				t.Errorf("Unexpected quarantine entry: %v", q)
+			}
+		} else {
+			if q.Task || q.Reason != "too few files" || len(q.Files) != 1 {
+				t.Errorf("Unexpected quarantine entry: %v", q)
+			}
+			rejected = q.Id
+		}
+	}
+	resp = MakeTestRequest(r, "GET", "/api-01/quarantine/"+task.TaskId, token, b)
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	resp = MakeTestRequest(r, "GET", "/api-01/quarantine/"+task.TaskId+"/files/file1.bin", token, b)
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	content, _ := ioutil.ReadAll(resp.Body)
+	if string(content) != file1 {
+		t.Errorf("Unexpected file content: %s", content)
+	}
+	resp = MakeTestRequest(r, "GET", "/api-01/quarantine/"+task.TaskId+"/files/"+QUARANTINE_META, token, b)
+	if resp.StatusCode != 400 {
+		t.Errorf("Status expected 400 but was: %d", resp.StatusCode)
+	}
+	resp = MakeTestRequest(r, "GET", "/api-01/quarantine/x.y", token, b)
+	if resp.StatusCode != 400 {
+		t.Errorf("Status expected 400 but was: %d", resp.StatusCode)
+	}
+	// release requeues the task
+	resp = MakeTestRequest(r, "POST", "/api-01/quarantine/"+task.TaskId+"/release", token, b)
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	if _, err := taskBlobs().Stat(testTaskBlobPrefix(t, db, task.TaskId) + "file1.bin"); err != nil {
+		t.Errorf("Task files expected: %s", err)
+	}
+	resp = MakeTestTaskRequest(r, "GET", "/"+task.TaskId, "", b)
+	if resp.StatusCode != 202 {
+		t.Errorf("Status expected 202 but was: %d", resp.StatusCode)
+	}
+	queued := &TTask{}
+	resp = MakeTestQueueRequest(r, "GET", "", token, b)
+	err = queued.fromJReader(resp.Body)
+	if err != nil || queued.Id != task.TaskId {
+		t.Errorf("Task %s expected in queue: %v %s", task.TaskId, queued, err)
+	}
+	// destroy the rejected upload
+	resp = MakeTestRequest(r, "DELETE", "/api-01/quarantine/"+rejected, token, b)
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	resp = MakeTestRequest(r, "GET", "/api-01/quarantine/"+rejected, token, b)
+	if resp.StatusCode != 400 {
+		t.Errorf("Status expected 400 but was: %d", resp.StatusCode)
+	}
+	// the truncated part of the too big file is not kept
+	body, ct = MakeTestUploadBody(t, "file4.bin", NewId(32), "file5.bin", NewId(int(Conf.MaxFileSize)))
+	resp = MakeTestUploadRequest(r, "POST", "", ct, body)
+	if resp.StatusCode != 400 {
+		t.Errorf("Status expected 400 but was: %d", resp.StatusCode)
+	}
+	entries, _ = quarantineList()
+	if len(entries) != 1 || entries[0].Reason != "file too big: file5.bin" || len(entries[0].Files) != 1 || entries[0].Files[0].Name != "file4.bin" {
+		t.Fatalf("Entry without the too big file expected, but was: %v", entries)
+	}
+	// files after the too big one are kept too
+	rejected = entries[0].Id
+	body, ct = MakeTestUploadBody(t, "file7.bin", NewId(int(Conf.MaxFileSize)), "file6.bin", NewId(32))
+	resp = MakeTestUploadRequest(r, "POST", "", ct, body)
+	if resp.StatusCode != 400 {
+		t.Errorf("Status expected 400 but was: %d", resp.StatusCode)
+	}
+	entries, _ = quarantineList()
+	if len(entries) != 2 {
+		t.Fatalf("2 entries expected, but was: %v", entries)
+	}
+	for _, q := range entries {
+		if q.Id != rejected && (q.Reason != "file too big: file7.bin" || len(q.Files) != 1 || q.Files[0].Name != "file6.bin") {
+			t.Errorf("Entry without the too big file expected, but was: %v", q)
+		}
+		if q.Id != rejected {
+			resp = MakeTestRequest(r, "DELETE", "/api-01/quarantine/"+q.Id, token, b)
+			if resp.StatusCode != 200 {
+				t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+			}
+		}
+	}
+	// release checks files like the upload
+	resp = MakeTestRequest(r, "POST", "/api-01/quarantine/"+rejected+"/release", token, b)
+	e := &TJSONError{}
+	if resp.StatusCode != 400 || json.NewDecoder(resp.Body).Decode(e) != nil || e.Msg != E_INVALID_REQUEST || e.Details != "too few files" {
+		t.Errorf("Too few files expected, but was: %d %v", resp.StatusCode, e)
+	}
+	if _, err := quarantineGet(rejected); err != nil {
+		t.Errorf("Entry expected in the quarantine: %s", err)
+	}
+	Conf.MinFiles = 1
+	defer func() { Conf.MinFiles = 2 }()
+	resp = MakeTestRequest(r, "POST", "/api-01/quarantine/"+rejected+"/release", token, b)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	released, _ := db.GetTask(rejected)
+	if m, err := readManifest(taskBlobs(), released); err != nil || len(m.Files) != 1 || m.Files[0].Stored != "file4.bin" {
+		t.Errorf("Manifest of the released upload expected, but was: %v %v", m, err)
+	}
+	// files moved without the meta are the incomplete entry, it is purged but not released
+	lost := NewId(TASK_ID_LEN)
+	if _, err := quarantineBlobs().Put(lost+"/file1.bin", bytes.NewBufferString(file1)); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(Conf.QuarantineDir+"/"+lost+"/file1.bin", past, past); err != nil {
+		t.Fatal(err)
+	}
+	q, err := quarantineGet(lost)
+	if err != nil || !q.Incomplete || len(q.Files) != 1 || q.At != past.Unix() {
+		t.Errorf("Incomplete entry expected, but was: %v %v", q, err)
+	}
+	resp = MakeTestRequest(r, "POST", "/api-01/quarantine/"+lost+"/release", token, b)
+	if resp.StatusCode != 409 {
+		t.Errorf("Status expected 409 but was: %d", resp.StatusCode)
+	}
+	report := quarantinePurge(db, 60)
+	if len(report.Errors) != 0 || len(report.FilesRemoved) != 1 || report.FilesRemoved[0] != lost {
+		t.Errorf("Unexpected report: %v", report)
+	}
+	if _, err := quarantineGet(lost); !os.IsNotExist(err) {
+		t.Errorf("Incomplete entry removed expected: %v", err)
+	}
+}
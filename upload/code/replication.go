@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// REPLICATION_LIMIT is the most changes sent in one response
+const REPLICATION_LIMIT = 1000
+
+// REPLICATION_RETRY is the pause after a failed request to the primary
+const REPLICATION_RETRY = 2 * time.Second
+
+// replicationWait is how long the primary holds the changes request without changes
+var replicationWait = 25 * time.Second
+
+// errReplicationReset means the follower must start from the snapshot
+var errReplicationReset = errors.New("Replication reset")
+
+// errReplicationGone means the primary has no such Task or file, a later change removes it
+var errReplicationGone = errors.New("Removed on the primary")
+
+var taskStatuses = []string{"received", "verified", "failed"}
+
+// TChanges is the part of the change stream
+type TChanges struct {
+	Epoch   string     `json:"epoch"`
+	Changes []*TChange `json:"changes"`
+}
+
+// TSnapshotHeader is the first line of the snapshot, the position to follow the changes from
+type TSnapshotHeader struct {
+	Epoch string `json:"epoch"`
+	Seq   uint64 `json:"seq"`
+}
+
+// TSnapshotTask is the line of the snapshot
+type TSnapshotTask struct {
+	Task  *TTask        `json:"task"`
+	Files []TChangeFile `json:"files"`
+}
+
+type TReplicationStatus struct {
+	Role     string `json:"role"` // "primary" or "follower"
+	Primary  string `json:"primary,omitempty"`
+	Epoch    string `json:"epoch"`
+	Seq      uint64 `json:"seq"`
+	SyncedAt int64  `json:"synced_at,omitempty"` // the last contact with the primary
+	Error    string `json:"error,omitempty"`
+}
+
+// TReplica follows the primary and applies its changes to the local storage and files
+type TReplica struct {
+	db       IStorage
+	primary  string     // API URL of the primary
+	blobs    IBlobStore // local files
+	token    string
+	client   *http.Client
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	mu       sync.Mutex
+	epoch    string // the primary position, empty before the snapshot
+	seq      uint64
+	syncedAt int64
+	err      string
+}
+
+var (
+	replicaMutex sync.Mutex
+	replica      *TReplica // nil on the primary
+)
+
+// Save TReplicationStatus object to io.Writer as JSON
+func (c *TReplicationStatus) toJWriter(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "    ")
+	return e.Encode(c)
+}
+
+// Save TChanges object to io.Writer as JSON
+func (c *TChanges) toJWriter(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "    ")
+	return e.Encode(c)
+}
+
+// changeLogStorage returns the change log layer of the storage or nil
+func changeLogStorage(db IStorage) *TChangeLogStorage {
+	s := findStorage(db, func(s IStorage) bool {
+		_, ok := s.(*TChangeLogStorage)
+		return ok
+	})
+	if s == nil {
+		return nil
+	}
+	return s.(*TChangeLogStorage)
+}
+
+// replicaStart makes this instance the read-only follower of the primary
+func replicaStart(db IStorage, blobs IBlobStore, primary, token string) *TReplica {
+	ctx, cancel := context.WithCancel(context.Background())
+	rp := &TReplica{
+		db:      db,
+		primary: primary,
+		blobs:   blobs,
+		token:   token,
+		client:  &http.Client{Timeout: replicationWait + time.Minute},
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	replicaMutex.Lock()
+	replica = rp
+	replicaMutex.Unlock()
+	go rp.run()
+	Info.Printf("Following the primary: %s\n", primary)
+	return rp
+}
+
+// replicaFollowing is true until the follower is promoted
+func replicaFollowing() bool {
+	replicaMutex.Lock()
+	defer replicaMutex.Unlock()
+	return replica != nil
+}
+
+// replicaPromote stops following and makes this instance the primary, returns false if it is already
+func replicaPromote() bool {
+	replicaMutex.Lock()
+	rp := replica
+	replica = nil
+	replicaMutex.Unlock()
+	if rp == nil {
+		return false
+	}
+	rp.stop()
+	Info.Printf("Promoted to the primary, the last change applied: %s:%d\n", rp.epoch, rp.seq)
+	return true
+}
+
+// replicationStatus describes the role of this instance
+func replicationStatus(db IStorage) *TReplicationStatus {
+	replicaMutex.Lock()
+	rp := replica
+	replicaMutex.Unlock()
+	if rp == nil {
+		status := &TReplicationStatus{Role: "primary"}
+		if l := changeLogStorage(db); l != nil {
+			status.Epoch, status.Seq = l.Position()
+		}
+		return status
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return &TReplicationStatus{
+		Role:     "follower",
+		Primary:  rp.primary,
+		Epoch:    rp.epoch,
+		Seq:      rp.seq,
+		SyncedAt: rp.syncedAt,
+		Error:    rp.err,
+	}
+}
+
+// stop cancels requests to the primary and waits for the loop to exit
+func (rp *TReplica) stop() {
+	rp.cancel()
+	<-rp.done
+}
+
+func (rp *TReplica) position() (string, uint64) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.epoch, rp.seq
+}
+
+func (rp *TReplica) setPosition(epoch string, seq uint64) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.epoch, rp.seq = epoch, seq
+	rp.syncedAt = time.Now().Unix()
+	rp.err = ""
+}
+
+func (rp *TReplica) setError(err error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.err = err.Error()
+}
+
+// run pulls changes until stopped
+func (rp *TReplica) run() {
+	defer close(rp.done)
+	for rp.ctx.Err() == nil {
+		err := rp.step()
+		if err == nil || rp.ctx.Err() != nil {
+			continue
+		}
+		rp.setError(err)
+		Error.Printf("Replication failed: %s\n", err)
+		select {
+		case <-rp.ctx.Done():
+		case <-time.After(REPLICATION_RETRY):
+		}
+	}
+}
+
+// step loads the snapshot or applies the next changes
+func (rp *TReplica) step() error {
+	epoch, seq := rp.position()
+	if epoch == "" {
+		return rp.resync()
+	}
+	changes, err := rp.changes(epoch, seq)
+	if errors.Is(err, errReplicationReset) {
+		Warning.Printf("Replication position %s:%d is lost, loading the snapshot\n", epoch, seq)
+		rp.setPosition("", 0)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		if err := rp.apply(c); err != nil {
+			return fmt.Errorf("Can't apply change %d (%s %s): %s", c.Seq, c.Op, c.Id, err)
+		}
+		seq = c.Seq
+	}
+	rp.setPosition(epoch, seq)
+	return nil
+}
+
+// get sends the authenticated request to the primary
+func (rp *TReplica) get(path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(rp.ctx, "GET", rp.primary+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+rp.token)
+	resp, err := rp.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, errReplicationReset
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", errReplicationGone, path)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Request %s failed: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+// changes waits for the changes after seq
+func (rp *TReplica) changes(epoch string, seq uint64) ([]*TChange, error) {
+	resp, err := rp.get("/replication/changes?epoch=" + url.QueryEscape(epoch) + "&since=" + strconv.FormatUint(seq, 10))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	changes := &TChanges{}
+	err = json.NewDecoder(resp.Body).Decode(changes)
+	if err != nil {
+		return nil, err
+	}
+	return changes.Changes, nil
+}
+
+// resync loads all Tasks with their files and removes what the primary has no more
+func (rp *TReplica) resync() error {
+	resp, err := rp.get("/replication/snapshot")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	d := json.NewDecoder(bufio.NewReader(resp.Body))
+	header := &TSnapshotHeader{}
+	err = d.Decode(header)
+	if err != nil {
+		return fmt.Errorf("Invalid snapshot: %s", err)
+	}
+	if header.Epoch == "" {
+		return fmt.Errorf("Invalid snapshot: no epoch")
+	}
+	remote := make(map[string]bool)
+	for {
+		line := &TSnapshotTask{}
+		err = d.Decode(line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil || line.Task == nil {
+			return fmt.Errorf("Invalid snapshot: %v", err)
+		}
+		remote[line.Task.Id] = true
+		err = rp.putTask(line.Task, true)
+		if err == nil {
+			err = rp.syncFiles(line.Task, line.Files)
+		}
+		if err != nil {
+			return fmt.Errorf("Can't apply task %s: %s", line.Task.Id, err)
+		}
+	}
+	removed := 0
+	for _, status := range taskStatuses {
+		tasks, err := rp.db.ListTasks(status, math.MaxInt64)
+		if err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			if remote[task.Id] {
+				continue
+			}
+			if err := rp.deleteTask(task.Id); err != nil {
+				return err
+			}
+			removed++
+		}
+	}
+	rp.setPosition(header.Epoch, header.Seq)
+	Info.Printf("Replication snapshot %s:%d loaded: %d tasks, %d removed\n", header.Epoch, header.Seq, len(remote), removed)
+	return nil
+}
+
+// apply makes the change of the primary locally
+func (rp *TReplica) apply(c *TChange) error {
+	if !safeTaskId(c.Id) {
+		return fmt.Errorf("Invalid task id")
+	}
+	switch c.Op {
+	case "put":
+		if c.Task == nil || c.Task.Id != c.Id {
+			return fmt.Errorf("Invalid task")
+		}
+		return rp.putTask(c.Task, false)
+	case "delete":
+		return rp.deleteTask(c.Id)
+	case "files":
+		task, err := rp.db.GetTask(c.Id)
+		if errors.Is(err, ErrTaskNotFound) {
+			// the Task is removed by a later change
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return rp.syncFiles(task, c.Files)
+	}
+	return fmt.Errorf("Unknown operation")
+}
+
+// putTask saves the Task unless the local one is newer, the snapshot replaces any other revision
+func (rp *TReplica) putTask(task *TTask, snapshot bool) error {
+	if !safeTaskId(task.Id) {
+		return fmt.Errorf("Invalid task id")
+	}
+	local, err := rp.db.GetTask(task.Id)
+	if err == nil && (local.Rev == task.Rev || !snapshot && local.Rev > task.Rev) {
+		return nil
+	}
+	if errors.Is(err, ErrTaskNotFound) {
+		return rp.db.PutTask(task)
+	}
+	if err != nil {
+		return err
+	}
+	// files follow the layout changed on the primary
+	lock := taskFilesLock(task.Id)
+	lock.Lock()
+	defer lock.Unlock()
+	_, err = layoutMoveFiles(rp.blobs, local, task, func() error {
+		return rp.db.PutTask(task)
+	})
+	return err
+}
+
+// deleteTask removes the Task with its files
+func (rp *TReplica) deleteTask(taskId string) error {
+	task, err := rp.db.GetTask(taskId)
+	if errors.Is(err, ErrTaskNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = rp.db.DeleteTask(taskId)
+	if err != nil && !errors.Is(err, ErrTaskNotFound) {
+		return err
+	}
+	lock := taskFilesLock(taskId)
+	lock.Lock()
+	defer lock.Unlock()
+	return blobDeletePrefix(rp.blobs, taskBlobPrefix(task))
+}
+
+// syncFiles makes the Task files the same as on the primary
+func (rp *TReplica) syncFiles(task *TTask, files []TChangeFile) error {
+	taskId := task.Id
+	lock := taskFilesLock(taskId)
+	lock.Lock()
+	defer lock.Unlock()
+	prefix := taskBlobPrefix(task)
+	local := make(map[string]TChangeFile)
+	list, err := taskFiles(rp.blobs, task)
+	if err != nil {
+		return err
+	}
+	for _, f := range list {
+		local[f.Name] = f
+	}
+	for _, f := range files {
+		if !safeFileName(f.Name) {
+			return fmt.Errorf("Invalid file name: %s", f.Name)
+		}
+		l, ok := local[f.Name]
+		delete(local, f.Name)
+		// hashes are compared if the primary addresses files by content too
+		if ok && l.Size == f.Size && (f.SHA256 == "" || l.SHA256 == f.SHA256) {
+			continue
+		}
+		err := rp.download(task, f.Name)
+		if errors.Is(err, errReplicationGone) {
+			// the file or the Task is removed after the change
+			Debug.Printf("Replication skipped the file %s/%s: %s\n", taskId, f.Name, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for name := range local {
+		err := rp.blobs.Delete(prefix + name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// download copies the Task file from the primary
+func (rp *TReplica) download(task *TTask, name string) error {
+	resp, err := rp.get("/replication/files/" + task.Id + "/" + url.PathEscape(name))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = rp.blobs.Put(taskBlobPrefix(task)+name, resp.Body)
+	return err
+}
+
+// safeTaskId checks the Task id from outside is safe for paths
+func safeTaskId(taskId string) bool {
+	return len(taskId) >= 2 && safeFileName(taskId)
+}
+
+// safeFileName checks the file name from outside is safe for paths
+func safeFileName(name string) bool {
+	return validBlobKey(name) && !strings.Contains(name, "/")
+}
+
+// readOnly rejects writes while the instance follows the primary
+func readOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !replicaFollowing() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path := ""
+		if route := mux.CurrentRoute(r); route != nil {
+			path, _ = route.GetPathTemplate()
+		}
+		allowed := (r.Method == "GET" || r.Method == "OPTIONS") && path != "/api-01/queue"
+		if allowed || path == "/api-01/replication/promote" || path == "/api-01/compact" || path == "/api-01/validate" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sendJSONErrorMessage(w, E_READ_ONLY, http.StatusServiceUnavailable)
+		Warning.Printf("[%s]: Read-only follower: %s %s\n", r.RemoteAddr, r.Method, r.RequestURI)
+	})
+}
+
+// output changes after since, waits for them if there are none
+func replicationChangesHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
+	l := changeLogStorage(db)
+	if l == nil {
+		sendJSONErrorMessage(w, E_NOT_IMPLEMENTED, http.StatusNotImplemented)
+		Warning.Printf("[%s]: Change log is disabled\n", r.RemoteAddr)
+		return
+	}
+	epoch := r.URL.Query().Get("epoch")
+	since, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		sendJSONErrorMessage(w, E_INVALID_REQUEST, http.StatusBadRequest)
+		Warning.Printf("[%s]: Invalid change position: %s\n", r.RemoteAddr, r.URL.RawQuery)
+		return
+	}
+	changes, ok := l.Changes(epoch, since, REPLICATION_LIMIT, replicationWait)
+	if !ok {
+		sendJSONErrorMessage(w, E_REPLICATION_RESET, http.StatusGone)
+		Warning.Printf("[%s]: Replication position %s:%d is lost\n", r.RemoteAddr, epoch, since)
+		return
+	}
+	answer := &TChanges{Epoch: epoch, Changes: changes}
+	if answer.Changes == nil {
+		answer.Changes = []*TChange{}
+	}
+	// start a normal output
+	HelperSetStandartHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	err = answer.toJWriter(w)
+	if err != nil {
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// write a success message to the debug log
+	Debug.Printf("[%s]: %d changes sent after %s:%d\n", r.RemoteAddr, len(changes), epoch, since)
+}
+
+// output all Tasks with their files as JSON lines after the change stream position
+func replicationSnapshotHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
+	l := changeLogStorage(db)
+	if l == nil {
+		sendJSONErrorMessage(w, E_NOT_IMPLEMENTED, http.StatusNotImplemented)
+		Warning.Printf("[%s]: Change log is disabled\n", r.RemoteAddr)
+		return
+	}
+	// changes after the position may be in the snapshot already, followers apply them again
+	header := &TSnapshotHeader{}
+	header.Epoch, header.Seq = l.Position()
+	var tasks []*TTask
+	for _, status := range taskStatuses {
+		list, err := db.ListTasks(status, math.MaxInt64)
+		if err != nil {
+			sendStorageError(w, r, "", err)
+			return
+		}
+		tasks = append(tasks, list...)
+	}
+	// files are listed before the output, the follower removes files missing in the snapshot
+	lines := make([]*TSnapshotTask, 0, len(tasks))
+	for _, task := range tasks {
+		files, err := taskFiles(taskBlobs(), task)
+		if err != nil {
+			sendStorageError(w, r, task.Id, err)
+			return
+		}
+		lines = append(lines, &TSnapshotTask{Task: task, Files: files})
+	}
+	// start a normal output
+	HelperSetStandartHeaders(w)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	e := json.NewEncoder(w)
+	err := e.Encode(header)
+	for _, line := range lines {
+		if err != nil {
+			break
+		}
+		err = e.Encode(line)
+	}
+	if err != nil {
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// write a success message to the log
+	Info.Printf("[%s]: Replication snapshot sent: %d tasks\n", r.RemoteAddr, len(tasks))
+}
+
+// output the role and the change stream position (GET) or promote the follower (POST)
+func replicationStatusHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
+	if r.Method == "POST" && replicaPromote() {
+		Info.Printf("[%s]: Follower promoted\n", r.RemoteAddr)
+	}
+	// start a normal output
+	HelperSetStandartHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	err := replicationStatus(db).toJWriter(w)
+	if err != nil {
+		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// write a success message to the debug log
+	Debug.Printf("[%s]: Replication status printed (%s)\n", r.RemoteAddr, r.Method)
+}
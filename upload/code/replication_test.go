@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor polls the condition until it is true or the time is out
+func waitFor(t *testing.T, what string, fn func() bool) {
+	for i := 0; i < 100; i++ {
+		if fn() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for: %s", what)
+}
+
+func Test_Replication(t *testing.T) {
+	fmt.Println("Test_Replication")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	Conf.MaxFiles = 2
+	Conf.MinFiles = 2
+	Conf.MaxFileSize = 1024 * 100
+	Conf.DataDir = t.TempDir()
+	replicationWait = 200 * time.Millisecond
+	token := NewId(16)
+	primary := wrapStorage(MemoryNewStorage(), 16, nil)
+	defer primary.Close()
+	r := setRouting(token, primary)
+	server := httptest.NewServer(r)
+	defer server.Close()
+	file1 := NewId(128)
+	body, ct := MakeTestUploadBody(t, "file1.bin", file1, "file2.bin", NewId(64))
+	resp := MakeTestUploadRequest(r, "POST", "", ct, body)
+	if resp.StatusCode != 201 {
+		t.Fatalf("Status expected 201 but was: %d", resp.StatusCode)
+	}
+	uploaded := &TTaskAnswer{}
+	uploaded.fromJReader(resp.Body)
+	resp = MakeTestRequest(r, "GET", "/api-01/replication/changes?epoch=other&since=0", token, new(bytes.Buffer))
+	if resp.StatusCode != 410 {
+		t.Errorf("Status expected 410 but was: %d", resp.StatusCode)
+	}
+	// the follower has a task the primary has not
+	follower := wrapStorage(MemoryNewStorage(), 0, nil)
+	defer follower.Close()
+	stale := &TTask{Id: NewId(TASK_ID_LEN), Status: "verified", IssuedAt: time.Now().Unix()}
+	follower.Enqueue(stale)
+	fr := setRouting(token, follower)
+	fblobs := CASNewBlobStore(LocalNewBlobStore(dir + "/follower"))
+	rp := replicaStart(follower, fblobs, server.URL+"/api-01", token)
+	defer replicaPromote()
+	waitFor(t, "snapshot", func() bool {
+		epoch, _ := rp.position()
+		return epoch != ""
+	})
+	if _, err := follower.GetTask(stale.Id); err == nil {
+		t.Errorf("Task %s removed expected", stale.Id)
+	}
+	content, err := readBlob(fblobs, taskBlobPrefix(&TTask{Id: uploaded.TaskId})+"file1.bin")
+	if err != nil || content != file1 {
+		t.Errorf("Replicated file expected: %s", err)
+	}
+	resp = MakeTestRequest(fr, "GET", "/api-01/task/"+uploaded.TaskId, "", new(bytes.Buffer))
+	if resp.StatusCode != 202 {
+		t.Errorf("Status expected 202 but was: %d", resp.StatusCode)
+	}
+	// changes after the snapshot
+	_, err = primary.UpdateTask(uploaded.TaskId, func(task *TTask) error {
+		task.Status = "verified"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := &TTask{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: time.Now().Unix()}
+	primary.Enqueue(added)
+	taskBlobs().Put(taskBlobPrefix(added)+"a.bin", strings.NewReader("a"))
+	changeLogFiles(primary, added)
+	taskBlobs().Delete(taskBlobPrefix(&TTask{Id: uploaded.TaskId}) + "file2.bin")
+	changeLogFiles(primary, &TTask{Id: uploaded.TaskId})
+	waitFor(t, "changes", func() bool {
+		task, err := follower.GetTask(added.Id)
+		return err == nil && task.Rev == 1
+	})
+	if task, err := follower.GetTask(uploaded.TaskId); err != nil || task.Status != "verified" || task.Rev != 2 {
+		t.Errorf("Updated task expected, but was: %v %v", task, err)
+	}
+	waitFor(t, "files", func() bool {
+		files := testTaskFiles(t, fblobs, &TTask{Id: uploaded.TaskId})
+		return len(files) == 2 && files[0].Name == "file1.bin" && files[1].Name == MANIFEST_NAME
+	})
+	content, err = readBlob(fblobs, taskBlobPrefix(added)+"a.bin")
+	if err != nil || content != "a" {
+		t.Errorf("Replicated file expected: %s", err)
+	}
+	if task, err := follower.Claim(0); err != nil || task.Id != added.Id {
+		t.Errorf("Task %s expected in queue, but was: %v %v", added.Id, task, err)
+	}
+	primary.DeleteTask(added.Id)
+	waitFor(t, "delete", func() bool {
+		_, err := follower.GetTask(added.Id)
+		return err != nil && len(testTaskFiles(t, fblobs, added)) == 0
+	})
+	// a file removed on the primary after the change is skipped
+	l := changeLogStorage(primary)
+	l.record(&TChange{Op: "files", Id: uploaded.TaskId, Files: []TChangeFile{{Name: "gone.bin", Size: 1}}})
+	_, seq := l.Position()
+	waitFor(t, "skipped file", func() bool {
+		_, applied := rp.position()
+		return applied == seq
+	})
+	if _, err := fblobs.Stat(taskBlobPrefix(&TTask{Id: uploaded.TaskId}) + "gone.bin"); err == nil {
+		t.Errorf("No file expected")
+	}
+	// the follower is read-only
+	resp = MakeTestRequest(fr, "PATCH", "/api-01/task/"+uploaded.TaskId+"/fail", token, new(bytes.Buffer))
+	if resp.StatusCode != 503 {
+		t.Errorf("Status expected 503 but was: %d", resp.StatusCode)
+	}
+	resp = MakeTestRequest(fr, "GET", "/api-01/queue", token, new(bytes.Buffer))
+	if resp.StatusCode != 503 {
+		t.Errorf("Status expected 503 but was: %d", resp.StatusCode)
+	}
+	resp = MakeTestRequest(fr, "GET", "/api-01/replication/status", token, new(bytes.Buffer))
+	status := &TReplicationStatus{}
+	if resp.StatusCode != 200 || json.NewDecoder(resp.Body).Decode(status) != nil || status.Role != "follower" {
+		t.Errorf("Follower status expected, but was: %d %v", resp.StatusCode, status)
+	}
+	// promote
+	resp = MakeTestRequest(fr, "POST", "/api-01/replication/promote", token, new(bytes.Buffer))
+	status = &TReplicationStatus{}
+	if resp.StatusCode != 200 || json.NewDecoder(resp.Body).Decode(status) != nil || status.Role != "primary" {
+		t.Errorf("Primary status expected, but was: %d %v", resp.StatusCode, status)
+	}
+	resp = MakeTestRequest(fr, "PATCH", "/api-01/task/"+uploaded.TaskId+"/fail", token, new(bytes.Buffer))
+	if resp.StatusCode != 409 {
+		t.Errorf("Status expected 409 but was: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TRetentionPolicy defines how long Tasks with the status and their files are kept
+type TRetentionPolicy struct {
+	Status   string // task status: "verified", "failed"
+	TaskTTL  int64  // seconds to keep the task record, 0 - forever
+	FilesTTL int64  // seconds to keep the uploaded files, 0 - forever
+	Archive  bool   // archive files to Conf.ArchiveDir before removal
+}
+
+// TRetentionReport describes what was removed by one retention run
+type TRetentionReport struct {
+	Status        string   `json:"status"`
+	StartedAt     int64    `json:"started"`
+	FinishedAt    int64    `json:"finished"`
+	TasksPurged   []string `json:"tasks_purged"`
+	FilesRemoved  []string `json:"files_removed"`
+	FilesArchived []string `json:"files_archived"`
+	Errors        []string `json:"errors,omitempty"`
+}
+
+type TRetentionReports struct {
+	Reports []*TRetentionReport `json:"reports"`
+}
+
+var (
+	retentionMutex      sync.Mutex
+	retentionLastReport *TRetentionReports
+)
+
+// Write TRetentionReports object to io.Writer as JSON
+func (c *TRetentionReports) toJWriter(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "    ")
+	return e.Encode(c)
+}
+
+// parseRetentionPolicies parses "status:taskTTL:filesTTL[:archive],..." string
+func parseRetentionPolicies(s string) ([]TRetentionPolicy, error) {
+	var policies []TRetentionPolicy
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		f := strings.Split(item, ":")
+		if len(f) < 3 || len(f) > 4 || f[0] == "" {
+			return nil, fmt.Errorf("Invalid retention policy: %s", item)
+		}
+		p := TRetentionPolicy{Status: f[0]}
+		var err error
+		p.TaskTTL, err = strconv.ParseInt(f[1], 10, 64)
+		if err != nil || p.TaskTTL < 0 {
+			return nil, fmt.Errorf("Invalid task TTL in retention policy: %s", item)
+		}
+		p.FilesTTL, err = strconv.ParseInt(f[2], 10, 64)
+		if err != nil || p.FilesTTL < 0 {
+			return nil, fmt.Errorf("Invalid files TTL in retention policy: %s", item)
+		}
+		if len(f) == 4 {
+			if f[3] != "archive" {
+				return nil, fmt.Errorf("Invalid retention policy option: %s", item)
+			}
+			p.Archive = true
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+// checkRetentionArchive rejects policies archiving files without the archive directory
+func checkRetentionArchive(policies []TRetentionPolicy, archiveDir string) error {
+	for _, p := range policies {
+		if p.Archive && archiveDir == "" {
+			return fmt.Errorf("Retention policy %s archives files, but the archive directory is not set", p.Status)
+		}
+	}
+	return nil
+}
+
+// retentionRun applies all policies once and returns reports
+func retentionRun(db IStorage, policies []TRetentionPolicy) *TRetentionReports {
+	retentionMutex.Lock()
+	defer retentionMutex.Unlock()
+	reports := &TRetentionReports{}
+	for _, p := range policies {
+		report := retentionApply(db, p)
+		reports.Reports = append(reports.Reports, report)
+		Info.Printf("Retention %s: %d tasks purged, %d files removed, %d files archived, %d errors\n",
+			report.Status, len(report.TasksPurged), len(report.FilesRemoved), len(report.FilesArchived), len(report.Errors))
+		for _, e := range report.Errors {
+			Error.Printf("Retention %s: %s\n", report.Status, e)
+		}
+	}
+	if Conf.QuarantineDir != "" && Conf.QuarantineTTL > 0 {
+		report := quarantinePurge(db, Conf.QuarantineTTL)
+		reports.Reports = append(reports.Reports, report)
+		Info.Printf("Retention quarantine: %d entries removed, %d errors\n", len(report.FilesRemoved), len(report.Errors))
+		for _, e := range report.Errors {
+			Error.Printf("Retention quarantine: %s\n", e)
+		}
+	}
+	retentionLastReport = reports
+	return reports
+}
+
+// retentionLoop runs retention every interval seconds, followers get purges from the primary
+func retentionLoop(db IStorage, policies []TRetentionPolicy, interval int64) {
+	for {
+		if !replicaFollowing() {
+			retentionRun(db, policies)
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+func retentionApply(db IStorage, p TRetentionPolicy) *TRetentionReport {
+	report := &TRetentionReport{
+		Status:        p.Status,
+		StartedAt:     time.Now().Unix(),
+		TasksPurged:   []string{},
+		FilesRemoved:  []string{},
+		FilesArchived: []string{},
+	}
+	blobs := taskBlobs()
+	// the caller holds the Task files lock, false if files are kept
+	removeFiles := func(task *TTask) bool {
+		taskId := task.Id
+		files, err := taskFiles(blobs, task)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			return false
+		}
+		if len(files) == 0 {
+			return true
+		}
+		if p.Archive {
+			err := archiveTaskFiles(blobs, task, files)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("Can't archive %s: %s", taskId, err))
+				return false
+			}
+			report.FilesArchived = append(report.FilesArchived, taskId)
+		}
+		err = blobDeletePrefix(blobs, taskBlobPrefix(task))
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("Can't remove %s: %s", taskId, err))
+			return false
+		}
+		report.FilesRemoved = append(report.FilesRemoved, taskId)
+		changeLogFiles(db, task)
+		return true
+	}
+	// fn is called for Tasks issued ttl seconds ago under the files lock, holds are placed under it,
+	// so the Task is read again to see a hold or a layout changed after the listing
+	forTasks := func(ttl int64, fn func(task *TTask)) {
+		tasks, err := db.ListTasks(p.Status, report.StartedAt-ttl)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+		for _, listed := range tasks {
+			if listed.Hold != nil {
+				continue
+			}
+			lock := taskFilesLock(listed.Id)
+			lock.Lock()
+			task, err := db.GetTask(listed.Id)
+			if err == nil && task.Hold == nil && task.Status == p.Status {
+				fn(task)
+			} else if err != nil && !errors.Is(err, ErrTaskNotFound) {
+				report.Errors = append(report.Errors, err.Error())
+			}
+			lock.Unlock()
+		}
+	}
+	if p.FilesTTL > 0 {
+		forTasks(p.FilesTTL, func(task *TTask) {
+			removeFiles(task)
+		})
+	}
+	if p.TaskTTL > 0 {
+		// files never outlive the task record, it is kept until they are removed
+		forTasks(p.TaskTTL, func(task *TTask) {
+			if !removeFiles(task) {
+				return
+			}
+			err := db.DeleteTask(task.Id)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("Can't purge %s: %s", task.Id, err))
+				return
+			}
+			report.TasksPurged = append(report.TasksPurged, task.Id)
+		})
+	}
+	report.FinishedAt = time.Now().Unix()
+	return report
+}
+
+// archiveTaskFiles writes the Task files to Conf.ArchiveDir/<task>.tar.gz
+func archiveTaskFiles(blobs IBlobStore, task *TTask, files []TChangeFile) error {
+	taskId := task.Id
+	if Conf.ArchiveDir == "" {
+		return fmt.Errorf("Archive directory is not set")
+	}
+	err := os.MkdirAll(Conf.ArchiveDir, 0755)
+	if err != nil {
+		return err
+	}
+	tmpName := Conf.ArchiveDir + "/." + taskId + ".tar.gz"
+	f, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	for _, file := range files {
+		err = archiveBlob(tw, blobs, task, file)
+		if err != nil {
+			return err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, Conf.ArchiveDir+"/"+taskId+".tar.gz")
+}
+
+// archiveBlob adds the Task file to the archive
+func archiveBlob(tw *tar.Writer, blobs IBlobStore, task *TTask, file TChangeFile) error {
+	src, err := blobs.Get(taskBlobPrefix(task) + file.Name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	err = tw.WriteHeader(&tar.Header{
+		Name:    task.Id + "/" + file.Name,
+		Mode:    0644,
+		Size:    file.Size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, src, file.Size)
+	return err
+}
+
+// retentionHandler outputs the last retention report or runs the retention now
+func retentionHandler(w http.ResponseWriter, r *http.Request, db IStorage) {
+	// implies, that the method and content type checks was completed at the routing stage
+	var reports *TRetentionReports
+	if r.Method == "POST" {
+		reports = retentionRun(db, Conf.Retention)
+	} else {
+		retentionMutex.Lock()
+		reports = retentionLastReport
+		retentionMutex.Unlock()
+		if reports == nil {
+			reports = &TRetentionReports{}
+		}
+	}
+	// start a normal output
+	HelperSetStandartHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	err := reports.toJWriter(w)
+	if err != nil {
+		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// write a success message to the log
+	Info.Printf("[%s]: Retention report printed (%s)\n", r.RemoteAddr, r.Method)
+}
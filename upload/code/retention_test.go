@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// MakeTestUploadBody makes multipart body with files name=content
+func MakeTestUploadBody(t *testing.T, files ...string) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for i := 0; i+1 < len(files); i += 2 {
+		part, err := writer.CreateFormFile("file", files[i])
+		if err != nil {
+			t.Errorf("Can't create %s: %s", files[i], err)
+		}
+		_, err = io.Copy(part, strings.NewReader(files[i+1]))
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	return body, writer.FormDataContentType()
+}
+
+func Test_RetentionPolicies(t *testing.T) {
+	fmt.Println("Test_RetentionPolicies")
+	p, err := parseRetentionPolicies("verified:3600:60:archive, failed:0:10")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(p) != 2 || p[0].Status != "verified" || p[0].TaskTTL != 3600 || p[0].FilesTTL != 60 || !p[0].Archive ||
+		p[1].Status != "failed" || p[1].TaskTTL != 0 || p[1].FilesTTL != 10 || p[1].Archive {
+		t.Errorf("Unexpected policies: %v", p)
+	}
+	for _, s := range []string{"verified", "verified:1", "verified:a:1", "verified:1:-1", "verified:1:1:zip", ":1:1"} {
+		if _, err := parseRetentionPolicies(s); err == nil {
+			t.Errorf("Error expected for %q", s)
+		}
+	}
+	if err := checkRetentionArchive(p, ""); err == nil {
+		t.Errorf("Error expected for archiving without the directory")
+	}
+	if err := checkRetentionArchive(p[1:], ""); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func Test_Retention(t *testing.T) {
+	fmt.Println("Test_Retention")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	Conf.MaxFiles = 2
+	Conf.MinFiles = 2
+	Conf.MaxFileSize = 1024 * 100
+	Conf.DataDir = t.TempDir()
+	Conf.ArchiveDir = Conf.DataDir + "/archive"
+	db, err := BoltNewStorage(dir + "/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	token := NewId(16)
+	r := setRouting(token, db)
+	b := new(bytes.Buffer)
+	body, ct := MakeTestUploadBody(t, "file1.bin", NewId(128), "file2.bin", NewId(64))
+	resp := MakeTestUploadRequest(r, "POST", "", ct, body)
+	if resp.StatusCode != 201 {
+		t.Errorf("Status expected 201 but was: %d", resp.StatusCode)
+	}
+	task := &TTaskAnswer{}
+	err = task.fromJReader(resp.Body)
+	if err != nil {
+		t.Errorf("JSON parser error: %s", err)
+	}
+	resp = MakeTestTaskRequest(r, "PATCH", "/"+task.TaskId+"/ok", token, b)
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	time.Sleep(2 * time.Second)
+	// files are removed, the task is kept
+	reports := retentionRun(db, []TRetentionPolicy{{Status: "verified", TaskTTL: 3600, FilesTTL: 1, Archive: true}})
+	report := reports.Reports[0]
+	if len(report.Errors) != 0 || len(report.TasksPurged) != 0 ||
+		len(report.FilesRemoved) != 1 || len(report.FilesArchived) != 1 || report.FilesRemoved[0] != task.TaskId {
+		t.Errorf("Unexpected report: %v", report)
+	}
+	if list, err := taskBlobs().List(testTaskBlobPrefix(t, db, task.TaskId)); err != nil || len(list) != 0 {
+		t.Errorf("Task files expected to be removed, but was: %d %v", len(list), err)
+	}
+	if _, err := os.Stat(Conf.ArchiveDir + "/" + task.TaskId + ".tar.gz"); err != nil {
+		t.Errorf("Task archive expected: %s", err)
+	}
+	resp = MakeTestTaskRequest(r, "GET", "/"+task.TaskId, "", b)
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	// the task is purged
+	reports = retentionRun(db, []TRetentionPolicy{{Status: "verified", TaskTTL: 1}})
+	report = reports.Reports[0]
+	if len(report.Errors) != 0 || len(report.TasksPurged) != 1 || len(report.FilesRemoved) != 0 {
+		t.Errorf("Unexpected report: %v", report)
+	}
+	resp = MakeTestTaskRequest(r, "GET", "/"+task.TaskId, "", b)
+	if resp.StatusCode != 400 {
+		t.Errorf("Status expected 400 but was: %d", resp.StatusCode)
+	}
+	// the last report is available for admins
+	resp = MakeTestRequest(r, "GET", "/api-01/retention", token, b)
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	resp = MakeTestRequest(r, "POST", "/api-01/retention", "", b)
+	if resp.StatusCode != 401 {
+		t.Errorf("Status expected 401 but was: %d", resp.StatusCode)
+	}
+	// the task is kept with its files until they are archived
+	body, ct = MakeTestUploadBody(t, "file1.bin", NewId(128), "file2.bin", NewId(64))
+	resp = MakeTestUploadRequest(r, "POST", "", ct, body)
+	if resp.StatusCode != 201 {
+		t.Fatalf("Status expected 201 but was: %d", resp.StatusCode)
+	}
+	task = &TTaskAnswer{}
+	task.fromJReader(resp.Body)
+	resp = MakeTestTaskRequest(r, "PATCH", "/"+task.TaskId+"/ok", token, b)
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	time.Sleep(2 * time.Second)
+	archiveDir := Conf.ArchiveDir
+	Conf.ArchiveDir = ""
+	reports = retentionRun(db, []TRetentionPolicy{{Status: "verified", TaskTTL: 1, Archive: true}})
+	Conf.ArchiveDir = archiveDir
+	report = reports.Reports[0]
+	if len(report.Errors) != 1 || len(report.TasksPurged) != 0 || len(report.FilesRemoved) != 0 {
+		t.Errorf("Unexpected report: %v", report)
+	}
+	if files := testTaskFiles(t, taskBlobs(), &TTask{Id: task.TaskId}); len(files) != 3 {
+		t.Errorf("Task files expected, but was: %v", files)
+	}
+	reports = retentionRun(db, []TRetentionPolicy{{Status: "verified", TaskTTL: 1, Archive: true}})
+	report = reports.Reports[0]
+	if len(report.Errors) != 0 || len(report.TasksPurged) != 1 || len(report.FilesArchived) != 1 {
+		t.Errorf("Unexpected report: %v", report)
+	}
+	if _, err := db.GetTask(task.TaskId); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("Task purged expected: %v", err)
+	}
+	if files := testTaskFiles(t, taskBlobs(), &TTask{Id: task.TaskId}); len(files) != 0 {
+		t.Errorf("Task files removed expected, but was: %v", files)
+	}
+}
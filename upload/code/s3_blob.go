@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3_EMPTY_SHA256 is the digest of the empty payload
+const S3_EMPTY_SHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// TS3BlobStore keeps blobs in the S3 compatible bucket with path-style requests signed by AWS SigV4
+type TS3BlobStore struct {
+	endpoint  string // scheme://host[:port]
+	bucket    string
+	prefix    string // added to every key
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// S3ParseURL parses http(s)://[key:secret@]host[:port]/bucket[/prefix][?region=...],
+// keys default to AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+func S3ParseURL(s string) (*TS3BlobStore, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid S3 URL: %s", s)
+	}
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("Invalid S3 URL, no bucket: %s", s)
+	}
+	st := &TS3BlobStore{
+		endpoint:  u.Scheme + "://" + u.Host,
+		bucket:    parts[0],
+		region:    u.Query().Get("region"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}
+	if len(parts) > 1 && parts[1] != "" {
+		st.prefix = parts[1] + "/"
+	}
+	if st.region == "" {
+		st.region = "us-east-1"
+	}
+	if u.User != nil {
+		st.accessKey = u.User.Username()
+		st.secretKey, _ = u.User.Password()
+	}
+	if st.accessKey == "" || st.secretKey == "" {
+		return nil, fmt.Errorf("S3 credentials are not set")
+	}
+	return st, nil
+}
+
+// Sub returns the store of keys under the prefix
+func (s *TS3BlobStore) Sub(prefix string) *TS3BlobStore {
+	sub := *s
+	sub.prefix += prefix
+	return &sub
+}
+
+// s3Escape encodes the string for the canonical request, "/" is kept in paths
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || path && c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3Hmac(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3SigningKey derives the SigV4 key of the day, the region and the service
+func s3SigningKey(secretKey, date, region, service string) []byte {
+	key := s3Hmac([]byte("AWS4"+secretKey), date)
+	key = s3Hmac(key, region)
+	key = s3Hmac(key, service)
+	return s3Hmac(key, "aws4_request")
+}
+
+// s3Signature returns the SigV4 signature of the request and the signed headers,
+// the request must have Host, X-Amz-Date and X-Amz-Content-Sha256 set
+func s3Signature(req *http.Request, region, secretKey string) (signature string, signed string) {
+	amzDate := req.Header.Get("X-Amz-Date")
+	date := amzDate
+	if len(date) > 8 {
+		date = date[:8]
+	}
+	query := req.URL.Query()
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	signed = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, true),
+		strings.Join(params, "&"),
+		"host:" + req.Host + "\n" +
+			"x-amz-content-sha256:" + req.Header.Get("X-Amz-Content-Sha256") + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signed,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	digest := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+	return hex.EncodeToString(s3Hmac(s3SigningKey(secretKey, date, region, "s3"), toSign)), signed
+}
+
+// do sends the signed request for the key, the body must match the digest
+func (s *TS3BlobStore) do(method, key string, query url.Values, body io.Reader, size int64, digest string) (*http.Response, error) {
+	u := s.endpoint + "/" + s.bucket + "/"
+	if key != "" {
+		u += s3Escape(s.prefix+key, true)
+	}
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	now := time.Now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", digest)
+	signature, signed := s3Signature(req, s.region, s.secretKey)
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+now.Format("20060102")+"/"+
+		s.region+"/s3/aws4_request, SignedHeaders="+signed+", Signature="+signature)
+	return s.client.Do(req)
+}
+
+// s3Error reads the error response
+func s3Error(resp *http.Response, key string) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrBlobNotFound, key)
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("S3 %s: %s: %s", key, resp.Status, strings.TrimSpace(string(b)))
+}
+
+// Put spools the blob to the temporary file to know its size and digest
+func (s *TS3BlobStore) Put(key string, r io.Reader) (int64, error) {
+	if !validBlobKey(key) {
+		return 0, fmt.Errorf("Invalid blob key: %s", key)
+	}
+	f, err := ioutil.TempFile("", "s3-blob-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.do("PUT", key, nil, f, n, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, s3Error(resp, key)
+	}
+	resp.Body.Close()
+	return n, nil
+}
+
+func (s *TS3BlobStore) Get(key string) (io.ReadCloser, error) {
+	if !validBlobKey(key) {
+		return nil, fmt.Errorf("Invalid blob key: %s", key)
+	}
+	resp, err := s.do("GET", key, nil, nil, 0, S3_EMPTY_SHA256)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error(resp, key)
+	}
+	return resp.Body, nil
+}
+
+func (s *TS3BlobStore) Stat(key string) (*TBlobInfo, error) {
+	if !validBlobKey(key) {
+		return nil, fmt.Errorf("Invalid blob key: %s", key)
+	}
+	resp, err := s.do("HEAD", key, nil, nil, 0, S3_EMPTY_SHA256)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error(resp, key)
+	}
+	resp.Body.Close()
+	info := &TBlobInfo{Key: key, Size: resp.ContentLength}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t.Unix()
+	}
+	return info, nil
+}
+
+// List pages through ListObjectsV2
+func (s *TS3BlobStore) List(prefix string) ([]TBlobInfo, error) {
+	blobs := []TBlobInfo{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", query, nil, 0, S3_EMPTY_SHA256)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, s3Error(resp, prefix)
+		}
+		result := &s3ListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid S3 list: %s", err)
+		}
+		for _, c := range result.Contents {
+			blobs = append(blobs, TBlobInfo{Key: strings.TrimPrefix(c.Key, s.prefix), Size: c.Size, ModTime: c.LastModified.Unix()})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Key < blobs[j].Key })
+	return blobs, nil
+}
+
+func (s *TS3BlobStore) Delete(key string) error {
+	if !validBlobKey(key) {
+		return fmt.Errorf("Invalid blob key: %s", key)
+	}
+	resp, err := s.do("DELETE", key, nil, nil, 0, S3_EMPTY_SHA256)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp, key)
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -15,12 +15,59 @@ func setRouting(token string, db IStorage) *mux.Router {
 		superTokenAuth(makeHandlerWithStoreAndParam(taskCompleteHandler, db, "ok"), token))
 	r.Path("/api-01/task/{task}/fail").Methods("PATCH").HandlerFunc(
 		superTokenAuth(makeHandlerWithStoreAndParam(taskCompleteHandler, db, "fail"), token))
+	r.Path("/api-01/task/{task}/details").Methods("GET").HandlerFunc(
+		superTokenAuth(makeHandlerWithStore(taskDetailsHandler, db), token))
+	r.Path("/api-01/task/{task}/files").Methods("GET").HandlerFunc(
+		superTokenAuth(makeHandlerWithStore(taskFilesHandler, db), token))
+	r.Path("/api-01/task/{task}/files/{name}").Methods("GET").HandlerFunc(
+		superTokenAuth(makeHandlerWithStore(taskFileHandler, db), token))
+	r.Path("/api-01/task/{task}/hold").Methods("PUT").HandlerFunc(
+		superTokenAuth(makeHandlerWithStoreAndParam(taskHoldHandler, db, "hold"), token))
+	r.Path("/api-01/task/{task}/hold").Methods("DELETE").HandlerFunc(
+		superTokenAuth(makeHandlerWithStoreAndParam(taskHoldHandler, db, "release"), token))
 	r.Path("/api-01/upload").Methods("POST").HandlerFunc(
 		makeHandlerWithStore(uploadHandler, db))
 	r.Path("/api-01/upload").Methods("OPTIONS").HandlerFunc(optionsHandler)
+	r.Path("/api-01/upload/batch").Methods("POST").HandlerFunc(
+		makeHandlerWithStore(batchUploadHandler, db))
+	r.Path("/api-01/upload/batch").Methods("OPTIONS").HandlerFunc(optionsHandler)
+	r.Path("/api-01/validate").Methods("POST").HandlerFunc(validateHandler)
+	r.Path("/api-01/validate").Methods("OPTIONS").HandlerFunc(optionsHandler)
 	r.Path("/api-01/queue").Methods("GET").HandlerFunc(
 		superTokenAuth(makeHandlerWithStore(queueFirstHandler, db), token))
+	r.Path("/api-01/retention").Methods("GET", "POST").HandlerFunc(
+		superTokenAuth(makeHandlerWithStore(retentionHandler, db), token))
+	r.Path("/api-01/backup").Methods("GET").HandlerFunc(
+		superTokenAuth(makeHandlerWithStore(backupHandler, db), token))
+	r.Path("/api-01/compact").Methods("GET", "POST").HandlerFunc(
+		superTokenAuth(makeHandlerWithStore(compactHandler, db), token))
+	r.Path("/api-01/layout").Methods("GET", "POST").HandlerFunc(
+		superTokenAuth(makeHandlerWithStore(layoutHandler, db), token))
+	r.Path("/api-01/storage/metrics").Methods("GET").HandlerFunc(
+		superTokenAuth(makeHandlerWithStore(storageMetricsHandler, db), token))
+	r.Path("/api-01/quarantine").Methods("GET").HandlerFunc(
+		superTokenAuth(quarantineListHandler, token))
+	r.Path("/api-01/quarantine/{id}").Methods("GET").HandlerFunc(
+		superTokenAuth(quarantineInfoHandler, token))
+	r.Path("/api-01/quarantine/{id}").Methods("DELETE").HandlerFunc(
+		superTokenAuth(makeHandlerWithStore(quarantineDestroyHandler, db), token))
+	r.Path("/api-01/quarantine/{id}/files/{name}").Methods("GET").HandlerFunc(
+		superTokenAuth(quarantineFileHandler, token))
+	r.Path("/api-01/quarantine/{id}/release").Methods("POST").HandlerFunc(
+		superTokenAuth(makeHandlerWithStore(quarantineReleaseHandler, db), token))
+	r.Path("/api-01/replication/changes").Methods("GET").HandlerFunc(
+		superTokenAuth(makeHandlerWithStore(replicationChangesHandler, db), token))
+	r.Path("/api-01/replication/snapshot").Methods("GET").HandlerFunc(
+		superTokenAuth(makeHandlerWithStore(replicationSnapshotHandler, db), token))
+	r.Path("/api-01/replication/files/{task}/{name}").Methods("GET").HandlerFunc(
+		superTokenAuth(makeHandlerWithStore(taskFileHandler, db), token))
+	r.Path("/api-01/replication/status").Methods("GET").HandlerFunc(
+		superTokenAuth(makeHandlerWithStore(replicationStatusHandler, db), token))
+	r.Path("/api-01/replication/promote").Methods("POST").HandlerFunc(
+		superTokenAuth(makeHandlerWithStore(replicationStatusHandler, db), token))
 	r.PathPrefix("/").HandlerFunc(invalidRequest)
+	// followers serve reads only
+	r.Use(readOnly)
 	return r
 }
 
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+const (
+	SIGNATURE_VERIFIED    = "verified"    // the data is signed by the key of the certificate inside the signature
+	SIGNATURE_INVALID     = "invalid"     // the digest or the signature doesn't match the data
+	SIGNATURE_UNAVAILABLE = "unavailable" // algorithms are not supported here, GOST signatures are verified by the queue
+)
+
+// 1.2.840.113549.1.9.4, the digest of the signed data in signed attributes
+var oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+
+var digestAlgorithms = map[string]crypto.Hash{
+	"1.3.14.3.2.26":          crypto.SHA1,
+	"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+	"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+	"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+}
+
+var signatureAlgorithms = map[x509.PublicKeyAlgorithm]map[crypto.Hash]x509.SignatureAlgorithm{
+	x509.RSA: {
+		crypto.SHA1:   x509.SHA1WithRSA,
+		crypto.SHA256: x509.SHA256WithRSA,
+		crypto.SHA384: x509.SHA384WithRSA,
+		crypto.SHA512: x509.SHA512WithRSA,
+	},
+	x509.ECDSA: {
+		crypto.SHA1:   x509.ECDSAWithSHA1,
+		crypto.SHA256: x509.ECDSAWithSHA256,
+		crypto.SHA384: x509.ECDSAWithSHA384,
+		crypto.SHA512: x509.ECDSAWithSHA512,
+	},
+}
+
+// SignerInfo of RFC 5652
+type cmsSignerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// TSignatureCheck is the result of the signature verification
+type TSignatureCheck struct {
+	Status  string `json:"status"` // verified, invalid, unavailable
+	Details string `json:"details,omitempty"`
+}
+
+// verifySignature checks every signer of the detached signature against the data,
+// the certificate chain is not checked, it is the work of the queue
+func verifySignature(signature, data []byte) TSignatureCheck {
+	sd, err := parseCMS(signature)
+	if err != nil {
+		return TSignatureCheck{SIGNATURE_UNAVAILABLE, err.Error()}
+	}
+	var certs []*x509.Certificate
+	if len(sd.Certificates.Bytes) > 0 {
+		certs, err = x509.ParseCertificates(sd.Certificates.Bytes)
+		if err != nil {
+			return TSignatureCheck{SIGNATURE_UNAVAILABLE, "Can't parse certificates: " + err.Error()}
+		}
+	}
+	for n, raw := range sd.SignerInfos {
+		if check := verifySigner(raw.FullBytes, certs, data); check.Status != SIGNATURE_VERIFIED {
+			check.Details = fmt.Sprintf("signer %d: %s", n+1, check.Details)
+			return check
+		}
+	}
+	return TSignatureCheck{Status: SIGNATURE_VERIFIED}
+}
+
+func verifySigner(raw []byte, certs []*x509.Certificate, data []byte) TSignatureCheck {
+	si := &cmsSignerInfo{}
+	if _, err := asn1.Unmarshal(raw, si); err != nil {
+		return TSignatureCheck{SIGNATURE_UNAVAILABLE, "Can't parse the signer: " + err.Error()}
+	}
+	hash, ok := digestAlgorithms[si.DigestAlgorithm.Algorithm.String()]
+	if !ok {
+		return TSignatureCheck{SIGNATURE_UNAVAILABLE, "digest algorithm " + si.DigestAlgorithm.Algorithm.String() + " is not supported"}
+	}
+	h := hash.New()
+	h.Write(data)
+	digest := h.Sum(nil)
+	signed := data
+	if len(si.SignedAttrs.FullBytes) > 0 {
+		md, err := messageDigest(si.SignedAttrs.Bytes)
+		if err != nil {
+			return TSignatureCheck{SIGNATURE_INVALID, err.Error()}
+		}
+		if !bytes.Equal(md, digest) {
+			return TSignatureCheck{SIGNATURE_INVALID, "the message digest doesn't match the data"}
+		}
+		// attributes are signed as SET OF, not as the [0] IMPLICIT of the signer
+		signed = append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+	}
+	if len(certs) == 0 {
+		return TSignatureCheck{SIGNATURE_UNAVAILABLE, "no certificates in the signature"}
+	}
+	tried := false
+	for _, cert := range certs {
+		algorithm, ok := signatureAlgorithms[cert.PublicKeyAlgorithm][hash]
+		if !ok {
+			continue
+		}
+		tried = true
+		err := cert.CheckSignature(algorithm, signed, si.Signature)
+		if err == nil {
+			return TSignatureCheck{Status: SIGNATURE_VERIFIED}
+		}
+		var insecure x509.InsecureAlgorithmError
+		if errors.As(err, &insecure) {
+			return TSignatureCheck{SIGNATURE_UNAVAILABLE, err.Error()}
+		}
+	}
+	if !tried {
+		return TSignatureCheck{SIGNATURE_UNAVAILABLE, "key algorithms of the certificates are not supported"}
+	}
+	return TSignatureCheck{SIGNATURE_INVALID, "the signature doesn't match the certificates"}
+}
+
+// messageDigest returns the message digest of signed attributes
+func messageDigest(attrs []byte) ([]byte, error) {
+	for len(attrs) > 0 {
+		attr := cmsAttribute{}
+		rest, err := asn1.Unmarshal(attrs, &attr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid signed attributes: %s", err)
+		}
+		attrs = rest
+		if !attr.Type.Equal(oidMessageDigest) || len(attr.Values) != 1 {
+			continue
+		}
+		var md []byte
+		if _, err := asn1.Unmarshal(attr.Values[0].FullBytes, &md); err != nil {
+			return nil, fmt.Errorf("Invalid message digest: %s", err)
+		}
+		return md, nil
+	}
+	return nil, fmt.Errorf("no message digest in signed attributes")
+}
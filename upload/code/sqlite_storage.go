@@ -0,0 +1,467 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	_ "modernc.org/sqlite"
+	"time"
+)
+
+// SQLITE_SCHEMA_VERSION is kept in PRAGMA user_version
+const SQLITE_SCHEMA_VERSION = 2
+
+// tasks keep the JSON payload, status, iat and rev are copied out for queries,
+// queue keeps task ids in order, a task is there at most once, meta keeps service settings
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS tasks (
+		id      TEXT PRIMARY KEY,
+		status  TEXT NOT NULL,
+		iat     INTEGER NOT NULL,
+		rev     INTEGER NOT NULL,
+		payload BLOB NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS tasks_status_iat ON tasks (status, iat, id)`,
+	`CREATE TABLE IF NOT EXISTS queue (
+		seq     INTEGER PRIMARY KEY AUTOINCREMENT,
+		task_id TEXT NOT NULL UNIQUE REFERENCES tasks (id) ON DELETE CASCADE
+	)`,
+	`CREATE TABLE IF NOT EXISTS meta (
+		key   TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`,
+	fmt.Sprintf(`PRAGMA user_version = %d`, SQLITE_SCHEMA_VERSION),
+}
+
+type TSqliteStorage struct {
+	db *sql.DB
+}
+
+// SqliteNewStorage opens the database file and creates tables,
+// other processes may read the file while the service is running
+func SqliteNewStorage(dbfilename string) (*TSqliteStorage, error) {
+	dsn := "file:" + dbfilename +
+		"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite has a single writer, don't compete for it inside the process
+	db.SetMaxOpenConns(1)
+	var version int
+	err = db.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if err == nil && version > SQLITE_SCHEMA_VERSION {
+		err = fmt.Errorf("Database schema version %d is newer than supported %d", version, SQLITE_SCHEMA_VERSION)
+	}
+	for _, stmt := range sqliteSchema {
+		if err != nil {
+			break
+		}
+		_, err = db.Exec(stmt)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &TSqliteStorage{db}, nil
+}
+
+// SqliteOpenSource opens the database file to read from, it is not changed
+func SqliteOpenSource(dbfilename string) (*TSqliteStorage, error) {
+	db, err := sql.Open("sqlite", "file:"+dbfilename+"?mode=ro&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	var version int
+	err = db.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if err == nil && version != SQLITE_SCHEMA_VERSION {
+		err = fmt.Errorf("Database schema version %d differs from supported %d, open it by the service first", version, SQLITE_SCHEMA_VERSION)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &TSqliteStorage{db}, nil
+}
+
+// sqliteSchemaVersion reads the schema version of the existing database file without changing it
+func sqliteSchemaVersion(dbfilename string) (int, error) {
+	db, err := sql.Open("sqlite", "file:"+dbfilename+"?mode=ro&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var version int
+	err = db.QueryRow(`PRAGMA user_version`).Scan(&version)
+	return version, err
+}
+
+// sqliteTx runs fn in the write transaction
+func (s *TSqliteStorage) sqliteTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	return nil
+}
+
+// sqliteScanTasks decodes payloads of the query rows
+func sqliteScanTasks(rows *sql.Rows) (tasks []*TTask, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		var payload []byte
+		err = rows.Scan(&payload)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrStorage, err)
+		}
+		task := &TTask{}
+		err = task.fromJBytes(payload)
+		if err != nil {
+			return nil, fmt.Errorf("%w: Invalid task format: %s", ErrStorage, err)
+		}
+		tasks = append(tasks, task)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	return tasks, nil
+}
+
+// sqliteGetTask reads the Task in the transaction
+func sqliteGetTask(tx *sql.Tx, taskId string) (*TTask, error) {
+	rows, err := tx.Query(`SELECT payload FROM tasks WHERE id = ?`, taskId)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	tasks, err := sqliteScanTasks(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(tasks) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrTaskNotFound, taskId)
+	}
+	return tasks[0], nil
+}
+
+// sqlitePutTask inserts or replaces the Task in the transaction
+func sqlitePutTask(tx *sql.Tx, task *TTask) error {
+	payload, err := task.toJBytes()
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	_, err = tx.Exec(`INSERT INTO tasks (id, status, iat, rev, payload) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET status = excluded.status, iat = excluded.iat,
+		rev = excluded.rev, payload = excluded.payload`,
+		task.Id, task.Status, task.IssuedAt, task.Rev, payload)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	return nil
+}
+
+// sqliteQueuePush appends the Task to the queue
+func sqliteQueuePush(tx *sql.Tx, taskId string) error {
+	_, err := tx.Exec(`INSERT INTO queue (task_id) VALUES (?)`, taskId)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	return nil
+}
+
+// sqliteQueueRemove removes the Task from the queue if it is there
+func sqliteQueueRemove(tx *sql.Tx, taskId string) error {
+	_, err := tx.Exec(`DELETE FROM queue WHERE task_id = ?`, taskId)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	return nil
+}
+
+// put Task in queue
+func (s *TSqliteStorage) Enqueue(task *TTask) error {
+	return s.sqliteTx(func(tx *sql.Tx) error {
+		var n int
+		err := tx.QueryRow(`SELECT count(*) FROM tasks WHERE id = ?`, task.Id).Scan(&n)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrStorage, err)
+		}
+		if n > 0 {
+			return fmt.Errorf("%w: %s", ErrTaskExists, task.Id)
+		}
+		task.Rev = 1
+		err = sqlitePutTask(tx, task)
+		if err != nil {
+			return err
+		}
+		if task.Status == "received" {
+			return sqliteQueuePush(tx, task.Id)
+		}
+		return nil
+	})
+}
+
+// change Task, the queue follows the status
+func (s *TSqliteStorage) UpdateTask(taskId string, fn func(task *TTask) error) (task *TTask, err error) {
+	err = s.sqliteTx(func(tx *sql.Tx) error {
+		old, err := sqliteGetTask(tx, taskId)
+		if err != nil {
+			return err
+		}
+		task, err = sqliteGetTask(tx, taskId)
+		if err != nil {
+			return err
+		}
+		err = fn(task)
+		if err != nil {
+			return err
+		}
+		if task.Id != old.Id {
+			return fmt.Errorf("%w: Task id can't be changed: %s", ErrTaskConflict, taskId)
+		}
+		task.Rev = old.Rev + 1
+		if task.Status != "received" {
+			task.Claimed = 0
+		}
+		err = sqlitePutTask(tx, task)
+		if err != nil {
+			return err
+		}
+		if old.Status != "received" && task.Status == "received" {
+			return sqliteQueuePush(tx, taskId)
+		} else if old.Status == "received" && task.Status != "received" {
+			return sqliteQueueRemove(tx, taskId)
+		}
+		return nil
+	})
+	if err != nil {
+		task = nil
+	}
+	return
+}
+
+func (s *TSqliteStorage) GetTask(taskId string) (*TTask, error) {
+	rows, err := s.db.Query(`SELECT payload FROM tasks WHERE id = ?`, taskId)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	tasks, err := sqliteScanTasks(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(tasks) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrTaskNotFound, taskId)
+	}
+	return tasks[0], nil
+}
+
+func (s *TSqliteStorage) Claim(lease int64) (task *TTask, err error) {
+	if lease <= 0 {
+		rows, err := s.db.Query(`SELECT t.payload FROM queue q JOIN tasks t ON t.id = q.task_id ORDER BY q.seq LIMIT 1`)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrStorage, err)
+		}
+		tasks, err := sqliteScanTasks(rows)
+		if err != nil {
+			return nil, err
+		}
+		if len(tasks) == 0 {
+			return nil, ErrQueueIsEmpty
+		}
+		return tasks[0], nil
+	}
+	now := time.Now().Unix()
+	err = s.sqliteTx(func(tx *sql.Tx) error {
+		task = nil
+		rows, err := tx.Query(`SELECT t.payload FROM queue q JOIN tasks t ON t.id = q.task_id ORDER BY q.seq`)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrStorage, err)
+		}
+		// rows are read up to the first unclaimed Task, it is saved after they are closed
+		for rows.Next() {
+			var payload []byte
+			err = rows.Scan(&payload)
+			if err != nil {
+				break
+			}
+			queued := &TTask{}
+			err = queued.fromJBytes(payload)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("%w: Invalid task format: %s", ErrStorage, err)
+			}
+			if queued.Claimed <= now-lease {
+				task = queued
+				break
+			}
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrStorage, err)
+		}
+		if task == nil {
+			return ErrQueueIsEmpty
+		}
+		task.Claimed = now
+		task.Rev++
+		return sqlitePutTask(tx, task)
+	})
+	if err != nil {
+		task = nil
+	}
+	return
+}
+
+// remove Tasks with status issued before the unix time, return their ids,
+// Tasks are removed by chunks of purgeChunk to let other writes go between them
+func (s *TSqliteStorage) PurgeTasks(status string, before int64) (taskIds []string, err error) {
+	// chunks go on after the last read task in the index order
+	var iat int64 = -1 << 63
+	id := ""
+	for more := true; more; {
+		var chunk []string
+		err = s.sqliteTx(func(tx *sql.Tx) error {
+			rows, err := tx.Query(`SELECT payload FROM tasks WHERE status = ? AND iat < ?
+				AND (iat > ? OR (iat = ? AND id > ?)) ORDER BY iat, id LIMIT ?`,
+				status, before, iat, iat, id, purgeChunk)
+			if err != nil {
+				return fmt.Errorf("%w: %s", ErrStorage, err)
+			}
+			tasks, err := sqliteScanTasks(rows)
+			if err != nil {
+				return err
+			}
+			more = len(tasks) == purgeChunk
+			if len(tasks) > 0 {
+				iat, id = tasks[len(tasks)-1].IssuedAt, tasks[len(tasks)-1].Id
+			}
+			for _, task := range tasks {
+				// tasks under legal hold are kept forever
+				if task.Hold != nil {
+					continue
+				}
+				// the queue entry goes by the foreign key
+				_, err = tx.Exec(`DELETE FROM tasks WHERE id = ?`, task.Id)
+				if err != nil {
+					return fmt.Errorf("%w: %s", ErrStorage, err)
+				}
+				chunk = append(chunk, task.Id)
+			}
+			return nil
+		})
+		if err != nil {
+			// chunks before are committed
+			return
+		}
+		taskIds = append(taskIds, chunk...)
+	}
+	return
+}
+
+// list Tasks with status issued before the unix time
+func (s *TSqliteStorage) ListTasks(status string, before int64) ([]*TTask, error) {
+	rows, err := s.db.Query(`SELECT payload FROM tasks WHERE status = ? AND iat < ? ORDER BY iat, id`, status, before)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	return sqliteScanTasks(rows)
+}
+
+// save the Task as is, the queue follows the status
+func (s *TSqliteStorage) PutTask(task *TTask) error {
+	return s.sqliteTx(func(tx *sql.Tx) error {
+		err := sqlitePutTask(tx, task)
+		if err != nil {
+			return err
+		}
+		if task.Status != "received" {
+			return sqliteQueueRemove(tx, task.Id)
+		}
+		_, err = tx.Exec(`INSERT INTO queue (task_id) VALUES (?) ON CONFLICT (task_id) DO NOTHING`, task.Id)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrStorage, err)
+		}
+		return nil
+	})
+}
+
+// remove the Task, the queue entry goes by the foreign key
+func (s *TSqliteStorage) DeleteTask(taskId string) error {
+	res, err := s.db.Exec(`DELETE FROM tasks WHERE id = ?`, taskId)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: %s", ErrTaskNotFound, taskId)
+	}
+	return nil
+}
+
+// importTasks copies Tasks with their revisions, queue keeps task ids in order
+func (s *TSqliteStorage) importTasks(tasks []*TTask, queue []string) error {
+	imported := make(map[string]bool, len(tasks))
+	return s.sqliteTx(func(tx *sql.Tx) error {
+		for _, task := range tasks {
+			imported[task.Id] = true
+			var n int
+			err := tx.QueryRow(`SELECT count(*) FROM tasks WHERE id = ?`, task.Id).Scan(&n)
+			if err != nil {
+				return fmt.Errorf("%w: %s", ErrStorage, err)
+			}
+			if n > 0 {
+				return fmt.Errorf("%w: %s", ErrTaskExists, task.Id)
+			}
+			err = sqlitePutTask(tx, task)
+			if err != nil {
+				return err
+			}
+		}
+		for _, taskId := range queue {
+			if !imported[taskId] {
+				return fmt.Errorf("%w: Queue points to missing task: %s", ErrStorage, taskId)
+			}
+			err := sqliteQueuePush(tx, taskId)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *TSqliteStorage) GetMeta(key string) (string, error) {
+	var value string
+	err := s.db.QueryRow(`SELECT value FROM meta WHERE key = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrStorage, err)
+	}
+	return value, nil
+}
+
+func (s *TSqliteStorage) SetMeta(key, value string) error {
+	return s.sqliteTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO meta (key, value) VALUES (?, ?)
+			ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, value)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrStorage, err)
+		}
+		return nil
+	})
+}
+
+func (s *TSqliteStorage) Close() {
+	s.db.Close()
+}
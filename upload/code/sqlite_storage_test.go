@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	bolt "github.com/etcd-io/bbolt"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_SqliteConvert(t *testing.T) {
+	fmt.Println("Test_SqliteConvert")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	src, err := BoltNewStorage(dir + "/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	tasks := []*TTask{
+		{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: now - 10},
+		{Id: NewId(TASK_ID_LEN), Status: "verified", IssuedAt: now - 20, Hold: &TTaskHold{Reason: "case", Actor: "legal"}},
+		{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: now - 30},
+	}
+	for _, task := range tasks {
+		err = src.Enqueue(task)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	src.UpdateTask(tasks[1].Id, func(task *TTask) error {
+		task.Status = "failed"
+		return nil
+	})
+	src.SetMeta(META_LAYOUT, LAYOUT_DATE)
+	// the source of the older schema is converted, but not migrated
+	err = src.db.Update(func(tx *bolt.Tx) error {
+		return boltSetSchemaVersion(tx, 3)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.Close()
+	n, queued, err := boltToSqlite(dir+"/test.db", dir+"/test.sqlite")
+	if err != nil || n != 3 || queued != 2 {
+		t.Fatalf("3 tasks and 2 queued expected, but was: %d %d %v", n, queued, err)
+	}
+	db, err := bolt.Open(dir+"/test.db", 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _, _ := boltPendingMigrations(db); version != 3 {
+		t.Errorf("Source schema version 3 expected, but was: %d", version)
+	}
+	db.Close()
+	if _, err := os.Stat(dir + "/test.db.v3.bak"); !os.IsNotExist(err) {
+		t.Errorf("Source backup is not expected: %v", err)
+	}
+	// the read-only destination is not changed
+	ro, err := SqliteOpenSource(dir + "/test.sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ro.Enqueue(&TTask{Id: NewId(TASK_ID_LEN), Status: "received"}); err == nil {
+		t.Errorf("Error expected for the read-only database")
+	}
+	if task, err := ro.GetTask(tasks[0].Id); err != nil || task.Id != tasks[0].Id {
+		t.Errorf("Task %s expected, but was: %v %v", tasks[0].Id, task, err)
+	}
+	ro.Close()
+	dst, err := SqliteNewStorage(dir + "/test.sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	task, err := dst.Claim(0)
+	if err != nil || task.Id != tasks[0].Id {
+		t.Errorf("Task %s expected in queue, but was: %v %v", tasks[0].Id, task, err)
+	}
+	task, err = dst.GetTask(tasks[1].Id)
+	if err != nil || task.Rev != 2 || task.Status != "failed" || task.Hold == nil {
+		t.Errorf("Converted task expected, but was: %v %v", task, err)
+	}
+	if layout, _ := currentLayout(dst); layout != LAYOUT_DATE {
+		t.Errorf("Layout %s expected, but was: %s", LAYOUT_DATE, layout)
+	}
+	// the destination must be empty
+	if _, _, err := boltToSqlite(dir+"/test.db", dir+"/test.sqlite"); err == nil {
+		t.Errorf("Error expected for existing tasks")
+	}
+}
@@ -1,27 +1,132 @@
 package main
 
-const (
-	E_STORAGE_DATABASE_ERROR = iota
-	E_STORAGE_TASK_EXISTS
-	E_STORAGE_TASK_NOT_FOUND
-	E_STORAGE_TASK_CONFLICT
-	E_STORAGE_QUEUE_IS_EMPTY
+import (
+	"errors"
+	"fmt"
+	"io"
 )
 
-type (
-	TErrorStorage struct {
-		msg  string
-		code int
-	}
+// storage errors, implementations wrap them with details, check with errors.Is
+var (
+	ErrStorage      = errors.New("Database error")
+	ErrTaskExists   = errors.New("Task exists")
+	ErrTaskNotFound = errors.New("Task not found")
+	ErrTaskConflict = errors.New("Task conflict")
+	ErrQueueIsEmpty = errors.New("Queue is empty")
+)
 
+type (
 	IStorage interface {
-		TaskGet(taskId string) (taskPayload []byte, err *TErrorStorage)
-		TaskQueue(taskId string, taskPayload []byte) (err *TErrorStorage)
-		TaskComplete(taskId string, oldTaskPayload, newTaskPayload []byte) (err *TErrorStorage)
-		TaskPurge(status string, duration int64) (err *TErrorStorage)
-		QueueGet() (taskPayload []byte, err *TErrorStorage)
+		// GetTask returns the Task by id
+		GetTask(taskId string) (*TTask, error)
+		// Enqueue saves the new Task with the first revision and puts it in the queue
+		Enqueue(task *TTask) error
+		// Claim returns the first Task in the queue not claimed in the last lease seconds and
+		// claims it with the next revision, it stays in the queue until the status changes,
+		// with lease 0 the first Task is returned as is to every caller
+		Claim(lease int64) (*TTask, error)
+		// UpdateTask changes the Task by fn atomically and saves it with the next revision,
+		// the Task is in the queue while its status is "received", its claim ends with it,
+		// fn may be called more than once and must change nothing but the Task
+		UpdateTask(taskId string, fn func(task *TTask) error) (*TTask, error)
+		// PurgeTasks removes Tasks with the status issued before the unix time except held ones,
+		// it may remove them in several transactions, removed ones are returned with the error
+		PurgeTasks(status string, before int64) (taskIds []string, err error)
+		// ListTasks returns Tasks with the status issued before the unix time
+		ListTasks(status string, before int64) ([]*TTask, error)
+		// PutTask saves the Task as is with its revision, for replication and import,
+		// the queue follows the status
+		PutTask(task *TTask) error
+		// DeleteTask removes the Task even if it is held
+		DeleteTask(taskId string) error
 		Close()
 	}
+	// IStorageWrapper is a decorator around another IStorage
+	IStorageWrapper interface {
+		Unwrap() IStorage
+	}
+	// IBackupStorage can write a consistent snapshot of the database
+	IBackupStorage interface {
+		// Snapshot calls fn with the snapshot, its size and its Tasks,
+		// writes wait until fn returns
+		Snapshot(fn func(size int64, tasks []*TTask, data io.WriterTo) error) error
+	}
+	// ICompactStorage can shrink the database file online
+	ICompactStorage interface {
+		// Usage returns the file size and bytes in free pages
+		Usage() (size int64, free int64, err error)
+		Compact() (*TCompactReport, error)
+	}
+	// IMetaStorage keeps service settings with the Tasks
+	IMetaStorage interface {
+		// GetMeta returns the value of the key, "" if it is not set
+		GetMeta(key string) (string, error)
+		SetMeta(key, value string) error
+	}
 )
 
-func (e *TErrorStorage) Error() string { return e.msg }
+// updateTaskRev is the compare-and-swap UpdateTask, the Task is changed only if it has
+// the revision rev, ErrTaskConflict otherwise
+func updateTaskRev(db IStorage, taskId string, rev uint64, fn func(task *TTask) error) (*TTask, error) {
+	return db.UpdateTask(taskId, func(task *TTask) error {
+		if task.Rev != rev {
+			return fmt.Errorf("%w: Task %s has revision %d, not %d", ErrTaskConflict, taskId, task.Rev, rev)
+		}
+		return fn(task)
+	})
+}
+
+// OpenStorage opens the database file with the engine, "bolt", "sqlite" or "memory",
+// bolt migrations make a backup copy if backup is set, memory ignores the file
+func OpenStorage(engine, dbfilename string, backup bool) (IStorage, error) {
+	switch engine {
+	case "bolt":
+		return BoltOpenStorage(dbfilename, backup)
+	case "sqlite":
+		return SqliteNewStorage(dbfilename)
+	case "memory":
+		return MemoryNewStorage(), nil
+	}
+	return nil, fmt.Errorf("Unknown storage engine: %s", engine)
+}
+
+// OpenSourceStorage opens the database file to read from without changing it,
+// bolt migrations are applied to a temporary copy
+func OpenSourceStorage(engine, dbfilename string) (IStorage, error) {
+	switch engine {
+	case "bolt":
+		return BoltOpenSource(dbfilename)
+	case "sqlite":
+		return SqliteOpenSource(dbfilename)
+	case "memory":
+		return MemoryNewStorage(), nil
+	}
+	return nil, fmt.Errorf("Unknown storage engine: %s", engine)
+}
+
+// wrapStorage adds decorators: metrics around the cache of cacheSize tasks (0 - none)
+// around injected faults (testing only)
+func wrapStorage(s IStorage, cacheSize int, faults []TStorageFault) IStorage {
+	if len(faults) > 0 {
+		s = FaultNewStorage(s, faults)
+	}
+	if cacheSize > 0 {
+		s = CacheNewStorage(s, cacheSize)
+	}
+	return MetricsNewStorage(ChangeLogNewStorage(s))
+}
+
+// findStorage returns the first layer of decorated storage matching the fn or nil
+func findStorage(s IStorage, fn func(s IStorage) bool) IStorage {
+	for s != nil {
+		if fn(s) {
+			return s
+		}
+		w, ok := s.(IStorageWrapper)
+		if !ok {
+			return nil
+		}
+		s = w.Unwrap()
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStorageConformance checks the IStorage contract, every backend must pass it
+func testStorageConformance(t *testing.T, open func() IStorage) {
+	s := open()
+	defer s.Close()
+	now := time.Now().Unix()
+	if _, err := s.Claim(0); !errors.Is(err, ErrQueueIsEmpty) {
+		t.Errorf("ErrQueueIsEmpty expected, but was: %v", err)
+	}
+	if _, err := s.GetTask("none"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("ErrTaskNotFound expected, but was: %v", err)
+	}
+	if _, err := s.UpdateTask("none", func(task *TTask) error { return nil }); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("ErrTaskNotFound expected, but was: %v", err)
+	}
+	tasks := []*TTask{
+		{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: now - 30},
+		{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: now - 20},
+		{Id: NewId(TASK_ID_LEN), Status: "verified", IssuedAt: now - 100},
+		{Id: NewId(TASK_ID_LEN), Status: "verified", IssuedAt: now - 200, Hold: &TTaskHold{Reason: "case", Actor: "legal"}},
+		{Id: NewId(TASK_ID_LEN), Status: "verified", IssuedAt: now - 10},
+	}
+	for _, task := range tasks {
+		err := s.Enqueue(task)
+		if err != nil || task.Rev != 1 {
+			t.Fatalf("Revision 1 expected, but was: %d %v", task.Rev, err)
+		}
+	}
+	if err := s.Enqueue(&TTask{Id: tasks[0].Id, Status: "received"}); !errors.Is(err, ErrTaskExists) {
+		t.Errorf("ErrTaskExists expected, but was: %v", err)
+	}
+	// the queue keeps the order of enqueueing, claim doesn't remove the task
+	for i := 0; i < 2; i++ {
+		task, err := s.Claim(0)
+		if err != nil || task.Id != tasks[0].Id {
+			t.Errorf("Task %s expected in queue, but was: %v %v", tasks[0].Id, task, err)
+		}
+	}
+	// failed fn changes nothing
+	_, err := s.UpdateTask(tasks[0].Id, func(task *TTask) error {
+		task.Status = "verified"
+		return ErrTaskConflict
+	})
+	if !errors.Is(err, ErrTaskConflict) {
+		t.Errorf("ErrTaskConflict expected, but was: %v", err)
+	}
+	_, err = s.UpdateTask(tasks[0].Id, func(task *TTask) error {
+		task.Id = "other"
+		return nil
+	})
+	if !errors.Is(err, ErrTaskConflict) {
+		t.Errorf("ErrTaskConflict expected, but was: %v", err)
+	}
+	stored, err := s.GetTask(tasks[0].Id)
+	if err != nil || stored.Rev != 1 || stored.Status != "received" {
+		t.Errorf("Unchanged task expected, but was: %v %v", stored, err)
+	}
+	// the queue follows the status
+	updated, err := s.UpdateTask(tasks[0].Id, func(task *TTask) error {
+		task.Status = "verified"
+		return nil
+	})
+	if err != nil || updated.Rev != 2 || updated.Status != "verified" {
+		t.Errorf("Revision 2 expected, but was: %v %v", updated, err)
+	}
+	task, err := s.Claim(0)
+	if err != nil || task.Id != tasks[1].Id {
+		t.Errorf("Task %s expected in queue, but was: %v %v", tasks[1].Id, task, err)
+	}
+	_, err = s.UpdateTask(tasks[0].Id, func(task *TTask) error {
+		task.Status = "received"
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	_, err = s.UpdateTask(tasks[1].Id, func(task *TTask) error {
+		task.Status = "failed"
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	task, err = s.Claim(0)
+	if err != nil || task.Id != tasks[0].Id || task.Rev != 3 {
+		t.Errorf("Task %s revision 3 expected in queue, but was: %v %v", tasks[0].Id, task, err)
+	}
+	// list and purge go by the status and the issued time, held tasks are kept
+	list, err := s.ListTasks("verified", now-50)
+	if err != nil || len(list) != 2 || list[0].Id != tasks[3].Id || list[1].Id != tasks[2].Id {
+		t.Errorf("Tasks %s %s expected, but was: %v %v", tasks[3].Id, tasks[2].Id, list, err)
+	}
+	taskIds, err := s.PurgeTasks("verified", now-50)
+	if err != nil || len(taskIds) != 1 || taskIds[0] != tasks[2].Id {
+		t.Errorf("Task %s expected to be purged, but was: %v %v", tasks[2].Id, taskIds, err)
+	}
+	if _, err := s.GetTask(tasks[2].Id); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("ErrTaskNotFound expected, but was: %v", err)
+	}
+	list, _ = s.ListTasks("verified", now+1)
+	if len(list) != 2 {
+		t.Errorf("2 tasks expected, but was: %d", len(list))
+	}
+	taskIds, err = s.PurgeTasks("received", now+1)
+	if err != nil || len(taskIds) != 1 || taskIds[0] != tasks[0].Id {
+		t.Errorf("Task %s expected to be purged, but was: %v %v", tasks[0].Id, taskIds, err)
+	}
+	if _, err := s.Claim(0); !errors.Is(err, ErrQueueIsEmpty) {
+		t.Errorf("ErrQueueIsEmpty expected, but was: %v", err)
+	}
+	taskIds, err = s.PurgeTasks("unknown", now+1)
+	if err != nil || len(taskIds) != 0 {
+		t.Errorf("Nothing expected to be purged, but was: %v %v", taskIds, err)
+	}
+	// large purges go by chunks, held tasks don't stop them
+	purgeChunk = 2
+	defer func() { purgeChunk = 1000 }()
+	for i := 0; i < 5; i++ {
+		task := &TTask{Id: NewId(TASK_ID_LEN), Status: "rejected", IssuedAt: now - 60 + int64(i/2)}
+		if i == 1 {
+			task.Hold = &TTaskHold{Reason: "case", Actor: "legal"}
+		}
+		s.Enqueue(task)
+	}
+	taskIds, err = s.PurgeTasks("rejected", now)
+	if err != nil || len(taskIds) != 4 {
+		t.Errorf("4 tasks expected to be purged, but was: %v %v", taskIds, err)
+	}
+	if list, _ := s.ListTasks("rejected", now); len(list) != 1 || list[0].Hold == nil {
+		t.Errorf("Held task expected, but was: %v", list)
+	}
+	// put keeps the revision, the queue follows the status
+	put := &TTask{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: now - 40, Rev: 7}
+	if err := s.PutTask(put); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := s.PutTask(put); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	task, err = s.Claim(0)
+	if err != nil || task.Id != put.Id || task.Rev != 7 {
+		t.Errorf("Task %s revision 7 expected in queue, but was: %v %v", put.Id, task, err)
+	}
+	put.Status = "verified"
+	put.Rev = 8
+	s.PutTask(put)
+	if _, err := s.Claim(0); !errors.Is(err, ErrQueueIsEmpty) {
+		t.Errorf("ErrQueueIsEmpty expected, but was: %v", err)
+	}
+	if list, _ := s.ListTasks("verified", now-30); len(list) != 2 || list[1].Id != put.Id {
+		t.Errorf("Task %s expected in list, but was: %v", put.Id, list)
+	}
+	// delete removes held tasks too
+	if err := s.DeleteTask(tasks[3].Id); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := s.DeleteTask(tasks[3].Id); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("ErrTaskNotFound expected, but was: %v", err)
+	}
+	if list, _ := s.ListTasks("verified", now-30); len(list) != 1 {
+		t.Errorf("1 task expected, but was: %v", list)
+	}
+	put.Status = "received"
+	put.Rev = 9
+	s.PutTask(put)
+	if err := s.DeleteTask(put.Id); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, err := s.Claim(0); !errors.Is(err, ErrQueueIsEmpty) {
+		t.Errorf("ErrQueueIsEmpty expected, but was: %v", err)
+	}
+	// concurrent updates are serialized, none is lost
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.UpdateTask(tasks[4].Id, func(task *TTask) error {
+				task.HoldHistory = append(task.HoldHistory, TTaskHoldRecord{Action: "hold"})
+				return nil
+			})
+			if err != nil {
+				t.Errorf("Unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	stored, err = s.GetTask(tasks[4].Id)
+	if err != nil || stored.Rev != 21 || len(stored.HoldHistory) != 20 {
+		t.Errorf("Revision 21 expected, but was: %v %v", stored, err)
+	}
+	// returned tasks are copies
+	stored.Status = "changed"
+	stored, _ = s.GetTask(tasks[4].Id)
+	if stored.Status != "verified" {
+		t.Errorf("Stored task expected to be unchanged, but was: %v", stored)
+	}
+	// claims are exclusive for the lease, concurrent workers get different tasks
+	claims := []*TTask{
+		{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: now - 5},
+		{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: now - 4},
+	}
+	for _, task := range claims {
+		s.Enqueue(task)
+	}
+	claimed := make(chan *TTask, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			task, err := s.Claim(60)
+			if err != nil && !errors.Is(err, ErrQueueIsEmpty) {
+				t.Errorf("Unexpected error: %s", err)
+			}
+			claimed <- task
+		}()
+	}
+	wg.Wait()
+	close(claimed)
+	seen := map[string]bool{}
+	for task := range claimed {
+		if task == nil {
+			continue
+		}
+		if seen[task.Id] || task.Rev != 2 || task.Claimed == 0 {
+			t.Errorf("Claimed task of revision 2 expected once, but was: %v", task)
+		}
+		seen[task.Id] = true
+	}
+	if !seen[claims[0].Id] || !seen[claims[1].Id] {
+		t.Errorf("Tasks %s %s expected to be claimed, but was: %v", claims[0].Id, claims[1].Id, seen)
+	}
+	// the claim ends when the task leaves the queue
+	s.UpdateTask(claims[0].Id, func(task *TTask) error {
+		task.Status = "failed"
+		return nil
+	})
+	s.UpdateTask(claims[0].Id, func(task *TTask) error {
+		task.Status = "received"
+		return nil
+	})
+	if task, err := s.Claim(60); err != nil || task.Id != claims[0].Id {
+		t.Errorf("Task %s expected to be claimed again, but was: %v %v", claims[0].Id, task, err)
+	}
+	// compare-and-swap goes by the revision
+	_, err = updateTaskRev(s, claims[1].Id, 1, func(task *TTask) error {
+		task.Status = "verified"
+		return nil
+	})
+	if !errors.Is(err, ErrTaskConflict) {
+		t.Errorf("ErrTaskConflict expected, but was: %v", err)
+	}
+	updated, err = updateTaskRev(s, claims[1].Id, 2, func(task *TTask) error {
+		task.Status = "verified"
+		return nil
+	})
+	if err != nil || updated.Rev != 3 || updated.Claimed != 0 {
+		t.Errorf("Unclaimed revision 3 expected, but was: %v %v", updated, err)
+	}
+	// settings are kept with the Tasks
+	m := metaStorage(s)
+	if m == nil {
+		t.Fatalf("Settings storage expected")
+	}
+	if value, err := m.GetMeta("none"); err != nil || value != "" {
+		t.Errorf("Empty setting expected, but was: %q %v", value, err)
+	}
+	m.SetMeta(META_LAYOUT, LAYOUT_HASH)
+	m.SetMeta(META_LAYOUT, LAYOUT_DATE)
+	if value, err := m.GetMeta(META_LAYOUT); err != nil || value != LAYOUT_DATE {
+		t.Errorf("Setting %q expected, but was: %q %v", LAYOUT_DATE, value, err)
+	}
+}
+
+func Test_StorageConformanceMemory(t *testing.T) {
+	fmt.Println("Test_StorageConformanceMemory")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	testStorageConformance(t, func() IStorage {
+		return MemoryNewStorage()
+	})
+}
+
+func Test_StorageConformanceBolt(t *testing.T) {
+	fmt.Println("Test_StorageConformanceBolt")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	testStorageConformance(t, func() IStorage {
+		s, err := BoltNewStorage(dir + "/test.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func Test_StorageConformanceSqlite(t *testing.T) {
+	fmt.Println("Test_StorageConformanceSqlite")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	dir := t.TempDir()
+	testStorageConformance(t, func() IStorage {
+		s, err := SqliteNewStorage(dir + "/test.sqlite")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
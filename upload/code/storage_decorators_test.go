@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_StorageConformanceDecorators(t *testing.T) {
+	fmt.Println("Test_StorageConformanceDecorators")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	testStorageConformance(t, func() IStorage {
+		return wrapStorage(MemoryNewStorage(), 2, []TStorageFault{{"*", 0, 0}})
+	})
+}
+
+func Test_CacheStorage(t *testing.T) {
+	fmt.Println("Test_CacheStorage")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	c := CacheNewStorage(MemoryNewStorage(), 2)
+	tasks := []*TTask{
+		{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: time.Now().Unix()},
+		{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: time.Now().Unix()},
+		{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: time.Now().Unix()},
+	}
+	for _, task := range tasks {
+		c.Enqueue(task)
+		c.GetTask(task.Id)
+	}
+	c.GetTask(tasks[2].Id)
+	stats := c.Stats()
+	if stats.Len != 2 || stats.Hits != 1 || stats.Misses != 3 {
+		t.Errorf("Unexpected cache stats: %v", stats)
+	}
+	// writes invalidate the cache
+	c.UpdateTask(tasks[2].Id, func(task *TTask) error {
+		task.Status = "verified"
+		return nil
+	})
+	task, err := c.GetTask(tasks[2].Id)
+	if err != nil || task.Status != "verified" || task.Rev != 2 {
+		t.Errorf("Updated task expected, but was: %v %v", task, err)
+	}
+	c.PurgeTasks("verified", time.Now().Unix()+1)
+	if _, err := c.GetTask(tasks[2].Id); err == nil {
+		t.Errorf("Purged task expected to be not found")
+	}
+}
+
+func Test_ChangeLogOrder(t *testing.T) {
+	fmt.Println("Test_ChangeLogOrder")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	l := ChangeLogNewStorage(&testSlowCommitStorage{MemoryNewStorage()})
+	task := &TTask{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: time.Now().Unix()}
+	l.Enqueue(task)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.UpdateTask(task.Id, func(task *TTask) error {
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	epoch, _ := l.Position()
+	changes, ok := l.Changes(epoch, 0, 100, 0)
+	if !ok || len(changes) != 21 {
+		t.Fatalf("21 changes expected, but was: %d %v", len(changes), ok)
+	}
+	// changes of the Task are in the commit order
+	for i, c := range changes {
+		if c.Task.Rev != uint64(i+1) {
+			t.Fatalf("Revision %d expected at %d, but was: %d", i+1, c.Seq, c.Task.Rev)
+		}
+	}
+}
+
+// testSlowCommitStorage returns from updates some time after the commit
+type testSlowCommitStorage struct {
+	IStorage
+}
+
+func (s *testSlowCommitStorage) UpdateTask(taskId string, fn func(task *TTask) error) (*TTask, error) {
+	task, err := s.IStorage.UpdateTask(taskId, fn)
+	time.Sleep(time.Duration(rand.Intn(1000)) * time.Microsecond)
+	return task, err
+}
+
+func Test_FaultStorage(t *testing.T) {
+	fmt.Println("Test_FaultStorage")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	if _, err := parseStorageFaults("GetTask:2:0"); err == nil {
+		t.Errorf("Error expected for invalid rate")
+	}
+	faults, err := parseStorageFaults("GetTask:1:0, *:0:1")
+	if err != nil || len(faults) != 2 || faults[1].Latency != time.Millisecond {
+		t.Fatalf("Unexpected faults: %v %v", faults, err)
+	}
+	db := wrapStorage(MemoryNewStorage(), 16, faults)
+	defer db.Close()
+	task := &TTask{Id: NewId(TASK_ID_LEN), Status: "received", IssuedAt: time.Now().Unix()}
+	err = db.Enqueue(task)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	token := NewId(16)
+	r := setRouting(token, db)
+	b := new(bytes.Buffer)
+	resp := MakeTestTaskRequest(r, "GET", "/"+task.Id, "", b)
+	if resp.StatusCode != 500 {
+		t.Errorf("Status expected 500 but was: %d", resp.StatusCode)
+	}
+	e := &TJSONError{}
+	json.NewDecoder(resp.Body).Decode(e)
+	if e.Msg != E_SERVER_ERROR {
+		t.Errorf("Error %s expected but was: %s", E_SERVER_ERROR, e.Msg)
+	}
+	resp = MakeTestQueueRequest(r, "GET", "", token, b)
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	resp = MakeTestRequest(r, "GET", "/api-01/storage/metrics", token, b)
+	if resp.StatusCode != 200 {
+		t.Errorf("Status expected 200 but was: %d", resp.StatusCode)
+	}
+	m := &TStorageMetrics{}
+	err = json.NewDecoder(resp.Body).Decode(m)
+	if err != nil || m.Ops["GetTask"].Errors != 1 || m.Ops["Claim"].Calls != 1 || m.Ops["Claim"].Errors != 0 || m.Cache == nil {
+		t.Errorf("Unexpected metrics: %v %v", m, err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// TValidateFile is the uploaded file with the reason to reject it
+type TValidateFile struct {
+	TManifestFile
+	Error   string `json:"error,omitempty"`
+	Details string `json:"details,omitempty"`
+	Warning string `json:"warning,omitempty"` // the name is not decoded, the sent one is used
+}
+
+// TValidateReport tells what the upload of the same files would do, nothing is stored
+type TValidateReport struct {
+	Valid     bool             `json:"valid"`
+	Files     []TValidateFile  `json:"files"`
+	Errors    []TJSONError     `json:"errors,omitempty"`    // of the upload as a whole: limits and the pair
+	Signature *TSignatureCheck `json:"signature,omitempty"` // of the valid pair
+}
+
+// Write TValidateReport object to io.Writer as JSON
+func (c *TValidateReport) toJWriter(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "    ")
+	return e.Encode(c)
+}
+
+// Fill TValidateReport object from io.Reader as JSON
+func (c *TValidateReport) fromJReader(r io.Reader) error {
+	return json.NewDecoder(r).Decode(c)
+}
+
+// checkUploadFile runs the checks of one uploaded file and describes it for the manifest
+func checkUploadFile(name, sent, stored string, part int, field string, content []byte) (TManifestFile, *TFileCheckError) {
+	fileType, cerr := checkFile(stored, content, Conf.AllowedTypes)
+	mf := manifestFile(name, sent, stored, part, field, fileType, content)
+	if cerr != nil {
+		return mf, cerr
+	}
+	if Conf.PairCheck && mf.Role == ROLE_SIGNATURE {
+		if err := checkDetached(content); err != nil {
+			return mf, &TFileCheckError{E_INVALID_PAIR, stored, err.Error()}
+		}
+	}
+	return mf, nil
+}
+
+// validateHandler runs the checks of the upload on all files and reports every problem,
+// the signature is verified when the files are a valid pair
+func validateHandler(w http.ResponseWriter, r *http.Request) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		sendJSONErrorMessage(w, E_SERVER_ERROR, http.StatusInternalServerError)
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	// one more file is read to report too many of them, the rest is not read
+	files, err := readUploadFiles(r, reader, Conf.MaxFiles+1)
+	if err != nil {
+		sendJSONErrorMessage(w, E_INVALID_REQUEST, http.StatusBadRequest)
+		Error.Printf("[%s]: Can't read the request: %s\n", r.RemoteAddr, err)
+		return
+	}
+	report := &TValidateReport{Files: []TValidateFile{}}
+	if len(files) > Conf.MaxFiles {
+		report.Errors = append(report.Errors, TJSONError{E_INVALID_REQUEST, fmt.Sprintf("too many files, at most %d are accepted", Conf.MaxFiles)})
+		files = files[:Conf.MaxFiles]
+	}
+	manifest := []TManifestFile{}
+	contents := make(map[string][]byte) // by stored names
+	taken := map[string]bool{MANIFEST_NAME: true}
+	for _, u := range files {
+		f := TValidateFile{}
+		if u.NameErr != nil {
+			f.Warning = "Can't decode file name: " + u.NameErr.Error()
+		}
+		stored := uniqueFileName(normalizeFileName(u.Name, nameRules()), taken)
+		if int64(len(u.Content)) == Conf.MaxFileSize {
+			f.TManifestFile = manifestFile(u.Name, u.Sent, stored, u.Part, u.Field, detectFileType(u.Content), u.Content)
+			f.Size = 0
+			f.SHA256 = ""
+			f.Error = E_FILE_TOO_BIG
+			f.Details = fmt.Sprintf("%s: the file is bigger than %d bytes", stored, Conf.MaxFileSize-1)
+		} else {
+			mf, cerr := checkUploadFile(u.Name, u.Sent, stored, u.Part, u.Field, u.Content)
+			f.TManifestFile = mf
+			if cerr != nil {
+				f.Error = cerr.Code
+				f.Details = cerr.Error()
+			}
+			contents[stored] = u.Content
+		}
+		report.Files = append(report.Files, f)
+		manifest = append(manifest, f.TManifestFile)
+	}
+	if len(report.Files) < Conf.MinFiles {
+		report.Errors = append(report.Errors, TJSONError{E_INVALID_REQUEST, fmt.Sprintf("too few files, at least %d are expected", Conf.MinFiles)})
+	}
+	if err := checkPair(manifest); err == nil {
+		signature, data := manifest[0], manifest[1]
+		if data.Role == ROLE_SIGNATURE {
+			signature, data = data, signature
+		}
+		if contents[signature.Stored] != nil && contents[data.Stored] != nil {
+			check := verifySignature(contents[signature.Stored], contents[data.Stored])
+			report.Signature = &check
+		}
+	} else if Conf.PairCheck {
+		report.Errors = append(report.Errors, TJSONError{E_INVALID_PAIR, err.Error()})
+	}
+	report.Valid = len(report.Errors) == 0 && (report.Signature == nil || report.Signature.Status != SIGNATURE_INVALID)
+	for _, f := range report.Files {
+		if f.Error != "" {
+			report.Valid = false
+		}
+	}
+	HelperSetStandartHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	err = report.toJWriter(w)
+	if err != nil {
+		Error.Printf("[%s]: Unexpected error: %s\n", r.RemoteAddr, err)
+		return
+	}
+	Info.Printf("[%s]: Files validated: %d, valid: %v\n", r.RemoteAddr, len(report.Files), report.Valid)
+}
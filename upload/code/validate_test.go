@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// testSignedCMS returns the detached ECDSA signature of the data with the self-signed certificate
+func testSignedCMS(t *testing.T, data []byte) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "sender"},
+		NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	marshal := func(v interface{}, params string) []byte {
+		b, err := asn1.MarshalWithParams(v, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	digest := sha256.Sum256(data)
+	attrs := marshal([]cmsAttribute{
+		{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}, []asn1.RawValue{{FullBytes: marshal(asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}, "")}}},
+		{oidMessageDigest, []asn1.RawValue{{FullBytes: marshal(digest[:], "")}}},
+	}, "set")
+	signed := sha256.Sum256(attrs)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, signed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := asn1.RawValue{}
+	asn1.Unmarshal(attrs, &set)
+	signer := cmsSignerInfo{
+		Version: 1,
+		SID: asn1.RawValue{FullBytes: marshal(struct {
+			Issuer asn1.RawValue
+			Serial *big.Int
+		}{asn1.RawValue{FullBytes: cert.RawIssuer}, cert.SerialNumber}, "")},
+		DigestAlgorithm:    pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}},
+		SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: set.Bytes},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+		Signature:          signature,
+	}
+	sd := cmsSignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{signer.DigestAlgorithm},
+		EncapContentInfo: cmsEncapContentInfo{EContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der},
+		SignerInfos:      []asn1.RawValue{{FullBytes: marshal(signer, "")}},
+	}
+	content := asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: marshal(sd, "")}
+	return string(marshal(cmsContentInfo{ContentType: oidSignedData, Content: content}, ""))
+}
+
+func Test_Signatures(t *testing.T) {
+	fmt.Println("Test_Signatures")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	data := []byte(testPDF())
+	sig := []byte(testSignedCMS(t, data))
+	if _, cerr := checkFile("a.pdf.sig", sig, nil); cerr != nil {
+		t.Fatalf("Valid CMS expected, but was: %s", cerr)
+	}
+	damaged := append([]byte{}, sig...)
+	damaged[len(damaged)-5] ^= 0xff
+	for _, c := range []struct {
+		sig, data []byte
+		status    string
+	}{
+		{sig, data, SIGNATURE_VERIFIED},
+		{sig, []byte(testPDF() + " "), SIGNATURE_INVALID},
+		{damaged, data, SIGNATURE_INVALID},
+		{[]byte(testCMS(t, nil)), data, SIGNATURE_UNAVAILABLE},
+	} {
+		if check := verifySignature(c.sig, c.data); check.Status != c.status {
+			t.Errorf("%s expected, but was: %v", c.status, check)
+		}
+	}
+}
+
+func Test_UploadValidate(t *testing.T) {
+	fmt.Println("Test_UploadValidate")
+	logInit(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	Conf.MaxFiles = 3
+	Conf.MinFiles = 2
+	Conf.MaxFileSize = 1024 * 100
+	Conf.DataDir = t.TempDir()
+	Conf.AllowedTypes, _ = parseFileTypes(defaultFileTypes)
+	Conf.PairCheck = true
+	defer func() {
+		Conf.AllowedTypes = nil
+		Conf.PairCheck = false
+	}()
+	db := MemoryNewStorage()
+	r := setRouting(NewId(16), db)
+	validate := func(files ...string) *TValidateReport {
+		body, ct := MakeTestUploadBody(t, files...)
+		req := httptest.NewRequest("POST", "/api-01/validate", body)
+		req.Header.Set("Content-Type", ct)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		resp := w.Result()
+		report := &TValidateReport{}
+		if resp.StatusCode != 200 || report.fromJReader(resp.Body) != nil {
+			t.Fatalf("Status expected 200 but was: %d", resp.StatusCode)
+		}
+		return report
+	}
+	report := validate("notice (1).pdf", testPDF(), "notice.pdf.sig", testSignedCMS(t, []byte(testPDF())))
+	if !report.Valid || len(report.Files) != 2 || report.Files[0].Stored != "notice.pdf" || report.Files[1].Role != ROLE_SIGNATURE ||
+		report.Signature == nil || report.Signature.Status != SIGNATURE_VERIFIED {
+		t.Errorf("Valid report expected, but was: %v", report)
+	}
+	report = validate("notice.pdf", testPDF()+" ", "notice.pdf.sig", testSignedCMS(t, []byte(testPDF())))
+	if report.Valid || report.Signature == nil || report.Signature.Status != SIGNATURE_INVALID {
+		t.Errorf("Invalid signature expected, but was: %v", report)
+	}
+	// all problems are reported at once
+	report = validate("notice.pdf", "%PDF-1.4\n", "notice.pdf.sig", "garbage", "notice.exe", "MZ"+NewId(64))
+	if report.Valid || len(report.Files) != 3 || report.Signature != nil || len(report.Errors) != 1 || report.Errors[0].Msg != E_INVALID_PAIR {
+		t.Fatalf("Invalid report expected, but was: %v", report)
+	}
+	for n, code := range []string{E_MALFORMED_FILE, E_MALFORMED_SIGNATURE, E_UNSUPPORTED_TYPE} {
+		if report.Files[n].Error != code || report.Files[n].Details == "" {
+			t.Errorf("%s expected, but was: %v", code, report.Files[n])
+		}
+	}
+	report = validate("a.pdf", testPDF(), "b.pdf", testPDF(), "c.pdf", testPDF(), "d.pdf", testPDF())
+	if report.Valid || len(report.Files) != 3 || len(report.Errors) != 2 || report.Errors[0].Msg != E_INVALID_REQUEST {
+		t.Errorf("Too many files expected, but was: %v", report)
+	}
+	// nothing is stored
+	if tasks, _ := db.ListTasks("received", math.MaxInt64); len(tasks) != 0 {
+		t.Errorf("No tasks expected, but was: %d", len(tasks))
+	}
+	if infos, err := ioutil.ReadDir(Conf.DataDir); err != nil || len(infos) != 0 {
+		t.Errorf("No files expected, but was: %d %v", len(infos), err)
+	}
+}
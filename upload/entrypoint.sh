@@ -40,5 +40,93 @@ if [ ! -z "${DB_FILE}" ]; then
 	args="${args} -b ${DB_FILE}"
 fi
 
+if [ ! -z "${STORAGE_ENGINE}" ]; then
+	args="${args} -e ${STORAGE_ENGINE}"
+fi
+
+if [ ! -z "${CACHE_SIZE}" ]; then
+	args="${args} -C ${CACHE_SIZE}"
+fi
+
+if [ ! -z "${STORAGE_FAULTS}" ]; then
+	args="${args} -F ${STORAGE_FAULTS}"
+fi
+
+if [ ! -z "${RETENTION_POLICY}" ]; then
+	args="${args} -r ${RETENTION_POLICY}"
+fi
+
+if [ ! -z "${RETENTION_PERIOD}" ]; then
+	args="${args} -R ${RETENTION_PERIOD}"
+fi
+
+if [ ! -z "${ARCHIVE_DIRECTORY}" ]; then
+	args="${args} -A ${ARCHIVE_DIRECTORY}"
+fi
+
+if [ ! -z "${QUARANTINE_DIRECTORY}" ]; then
+	args="${args} -q ${QUARANTINE_DIRECTORY}"
+fi
+
+if [ ! -z "${QUARANTINE_TTL}" ]; then
+	args="${args} -Q ${QUARANTINE_TTL}"
+fi
+
+if [ ! -z "${BACKUP_DIRECTORY}" ]; then
+	args="${args} -k ${BACKUP_DIRECTORY}"
+fi
+
+if [ ! -z "${BACKUP_PERIOD}" ]; then
+	args="${args} -K ${BACKUP_PERIOD}"
+fi
+
+if [ ! -z "${BACKUP_KEEP}" ]; then
+	args="${args} -n ${BACKUP_KEEP}"
+fi
+
+if [ ! -z "${COMPACT_RATIO}" ]; then
+	args="${args} -t ${COMPACT_RATIO}"
+fi
+
+if [ ! -z "${COMPACT_PERIOD}" ]; then
+	args="${args} -T ${COMPACT_PERIOD}"
+fi
+
+if [ ! -z "${REPLICATE_FROM}" ]; then
+	args="${args} -f ${REPLICATE_FROM}"
+fi
+
+if [ ! -z "${FILES_S3_URL}" ]; then
+	args="${args} -S ${FILES_S3_URL}"
+fi
+
+if [ ! -z "${MASTER_KEY_FILE}" ]; then
+	args="${args} -E ${MASTER_KEY_FILE}"
+fi
+
+if [ ! -z "${COMPRESSION}" ]; then
+	args="${args} -Z ${COMPRESSION}"
+fi
+
+if [ ! -z "${FILENAME_RULES}" ]; then
+	args="${args} -N ${FILENAME_RULES}"
+fi
+
+if [ ! -z "${FILE_TYPES}" ]; then
+	args="${args} -Y ${FILE_TYPES}"
+fi
+
+if [ ! -z "${PAIR_CHECK}" ]; then
+	args="${args} -P=${PAIR_CHECK}"
+fi
+
+if [ ! -z "${BATCH_MAX_FILES}" ]; then
+	args="${args} -B ${BATCH_MAX_FILES}"
+fi
+
+if [ ! -z "${CLAIM_TTL}" ]; then
+	args="${args} -w ${CLAIM_TTL}"
+fi
+
 /go/bin/app ${args}
 
@@ -6,11 +6,12 @@ import calendar
 import subprocess
 import codecs
 import argparse
-import urllib.request, urllib.error
-import shutil
+import urllib.request, urllib.error, urllib.parse
 import json
 import time
 import logging
+import tempfile
+import shutil
 
 TIMEOUT = 30
 
@@ -46,6 +47,39 @@ def confirm(apiurl, task, token, act):
         code = response.getcode()
         return code
 
+def taskfiles(apiurl, task, token):
+        url = apiurl + "/task/" + task + "/files"
+        request = urllib.request.Request(url)
+        request.add_header('Authorization', "Bearer %s" % token)
+        response = urllib.request.urlopen(request, timeout=TIMEOUT)
+        encoding = response.info().get_content_charset('utf-8')
+        body = response.read()
+        data = json.loads(body.decode(encoding))
+        return [f["name"] for f in data["files"]]
+
+def manifest(apiurl, task, token):
+        url = apiurl + "/task/" + task + "/files/manifest.json"
+        request = urllib.request.Request(url)
+        request.add_header('Authorization', "Bearer %s" % token)
+        try:
+                response = urllib.request.urlopen(request, timeout=TIMEOUT)
+        except urllib.error.HTTPError as e:
+                if e.code == 404:
+                        # tasks uploaded before manifests
+                        return None
+                raise
+        encoding = response.info().get_content_charset('utf-8')
+        body = response.read()
+        return json.loads(body.decode(encoding))
+
+def download(apiurl, task, token, name, path):
+        url = apiurl + "/task/" + task + "/files/" + urllib.parse.quote(name)
+        request = urllib.request.Request(url)
+        request.add_header('Authorization', "Bearer %s" % token)
+        response = urllib.request.urlopen(request, timeout=TIMEOUT)
+        with open(path, "wb") as f:
+                shutil.copyfileobj(response, f)
+
 def getq(apiurl, token):
         url = apiurl + "/queue"
         request = urllib.request.Request(url)
@@ -60,31 +94,47 @@ def getq(apiurl, token):
         else:
                 return code, ""
 
-def cleanup(path):
-        if os.path.exists(path):
-                shutil.rmtree(path)
-
-
 def handle(args, task):
 
         logger.info("Try to verify %s", task)
-        path = os.path.join(args.datadir, task[0], task[1], task)
 
-        if not os.path.exists(path) or not os.path.isdir(path):
-                logger.warning("%s is not exists or not directory!", path)
+        try:
+                names = taskfiles(args.apiurl, task, args.token)
+        except:
+                logger.warning("Can't list files of %s: %s", task, sys.exc_info()[1])
+                names = []
+
+        if len(names) == 0:
+                logger.warning("%s has no files!", task)
                 try:
                         code = confirm(args.apiurl, task, args.token, "fail")
                         logger.info("Confirm fail: %s", code)
-                        if code in (200, 409, 400):
-                                cleanup(path)
                 except:
                         logger.error("Oops: %s", sys.exc_info()[1])
 
                 return
 
+        try:
+                m = manifest(args.apiurl, task, args.token)
+        except:
+                logger.warning("Can't read the manifest of %s: %s", task, sys.exc_info()[1])
+                m = None
+
+        with tempfile.TemporaryDirectory(prefix="verify-", dir=args.datadir) as path:
+                verify_files(args, task, names, path, m)
+
+def manifest_roles(m):
+        data = [f["stored"] for f in m["files"] if f["role"] == "data"]
+        sigs = [f["stored"] for f in m["files"] if f["role"] == "signature"]
+        if len(data) != 1 or len(sigs) != 1:
+                return None, None
+        return data[0], sigs[0]
+
+def verify_files(args, task, names, path, m=None):
+
         files = []
         c = 0
-        for filename in os.listdir(path):
+        for filename in names:
                 if c == 3:
                         break
                 files.append(filename)
@@ -95,13 +145,21 @@ def handle(args, task):
                 try:
                         code = confirm(args.apiurl, task, args.token, "fail")
                         logger.info("Confirm fail: %s", code)
-                        if code in (200, 409, 400):
-                                cleanup(path)
                 except:
                         logger.error("Oops: %s", sys.exc_info()[1])
                 return
 
-        if files[0].endswith(".sig"):
+        if m is not None:
+                datafilename, sigfilename = manifest_roles(m)
+                if datafilename is None:
+                        logger.error("Unknown files in the manifest!")
+                        try:
+                                code = confirm(args.apiurl, task, args.token, "fail")
+                                logger.warning("Confirm fail: %s", code)
+                        except:
+                                logger.error("Oops: %s", sys.exc_info()[1])
+                        return
+        elif files[0].endswith(".sig"):
                 sigfilename = files[0]
                 datafilename = files[1]
         elif files[1].endswith(".sig"):
@@ -112,18 +170,18 @@ def handle(args, task):
                 try:
                         code = confirm(args.apiurl, task, args.token, "fail")
                         logger.warning("Confirm fail: %s", code)
-                        if code in (200, 409, 400):
-                                cleanup(path)
                 except:
                         logger.error("Oops: %s", sys.exc_info()[1])
                 return
 
         logger.info("Data: %s signature: %s", datafilename, sigfilename)
 
-        datafile = os.path.join(path, datafilename)
-        sigfile = os.path.join(path, sigfilename)
+        datafile = os.path.join(path, "data")
+        sigfile = os.path.join(path, "data.sig")
 
         try:
+                download(args.apiurl, task, args.token, datafilename, datafile)
+                download(args.apiurl, task, args.token, sigfilename, sigfile)
                 cms = subprocess.check_output(['openssl', 'pkcs7', '-inform', 'DER', '-in', sigfile, '-noout', '-print'])
                 signing_ts = cms_signing_time(cms)
 
@@ -141,8 +199,6 @@ def handle(args, task):
                         # I hope, it has no messages like "Not Quite Verification successful\n"...
                         raise RuntimeError(' '.join(oargs), signing_ts, stderr)
                 try:
-                        with open(os.path.join(path,"confirm"),"w+") as f:
-                                f.write("")
                         code = confirm(args.apiurl, task, args.token, "ok")
                         logger.info("Confirm ok: %s", code)
                         #if code in (200, 409, 400):
@@ -154,15 +210,13 @@ def handle(args, task):
                 try:
                         code = confirm(args.apiurl, task, args.token, "fail")
                         logger.info("Confirm fail: %s", code)
-                        if code in (200, 409, 400):
-                                cleanup(path)
                 except:
                         logger.error("Oops: %s", sys.exc_info()[1])
 
 if __name__ == "__main__":
 
         parser = argparse.ArgumentParser(description='Verify GOST documents')
-        parser.add_argument('-d', dest="datadir", required=True, help='data directory')
+        parser.add_argument('-d', dest="datadir", default=None, help='directory for downloaded files (default: system temporary)')
         parser.add_argument('-c', dest="capath", required=True, help='GOST CA path')
         parser.add_argument('-u', dest="apiurl", required=True, help='API URL')
         parser.add_argument('-t', dest="token", required=True, help='Token')